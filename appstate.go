@@ -158,9 +158,15 @@ func (cli *Client) dispatchAppState(mutation appstate.Mutation, fullSync bool, e
 	case appstate.IndexClearChat:
 		act := mutation.Action.GetClearChatAction()
 		eventToDispatch = &events.ClearChat{JID: jid, Timestamp: ts, Action: act, FromFullSync: fullSync}
+		if cli.Store.ChatMetadata != nil {
+			storeUpdateError = cli.Store.ChatMetadata.PutChatCleared(jid, ts)
+		}
 	case appstate.IndexDeleteChat:
 		act := mutation.Action.GetDeleteChatAction()
 		eventToDispatch = &events.DeleteChat{JID: jid, Timestamp: ts, Action: act, FromFullSync: fullSync}
+		if cli.Store.ChatMetadata != nil {
+			storeUpdateError = cli.Store.ChatMetadata.PutChatDeleted(jid, ts)
+		}
 	case appstate.IndexStar:
 		if len(mutation.Index) < 5 {
 			return
@@ -177,6 +183,9 @@ func (cli *Client) dispatchAppState(mutation appstate.Mutation, fullSync bool, e
 			evt.SenderJID, _ = types.ParseJID(mutation.Index[4])
 		}
 		eventToDispatch = &evt
+		if cli.Store.ChatMetadata != nil {
+			storeUpdateError = cli.Store.ChatMetadata.PutMessageStarred(jid, evt.SenderJID, evt.MessageID, evt.IsFromMe, evt.Action.GetStarred(), ts)
+		}
 	case appstate.IndexDeleteMessageForMe:
 		if len(mutation.Index) < 5 {
 			return
@@ -193,13 +202,24 @@ func (cli *Client) dispatchAppState(mutation appstate.Mutation, fullSync bool, e
 			evt.SenderJID, _ = types.ParseJID(mutation.Index[4])
 		}
 		eventToDispatch = &evt
+		if cli.Store.Messages != nil {
+			storeUpdateError = cli.Store.Messages.MarkMessageDeletedForMe(jid, evt.MessageID)
+		}
+		if cli.Store.ChatMetadata != nil {
+			err := cli.Store.ChatMetadata.PutMessageDeletedForMe(jid, evt.SenderJID, evt.MessageID, evt.IsFromMe, ts)
+			storeUpdateError = errors.Join(storeUpdateError, err)
+		}
 	case appstate.IndexMarkChatAsRead:
+		act := mutation.Action.GetMarkChatAsReadAction()
 		eventToDispatch = &events.MarkChatAsRead{
 			JID:          jid,
 			Timestamp:    ts,
-			Action:       mutation.Action.GetMarkChatAsReadAction(),
+			Action:       act,
 			FromFullSync: fullSync,
 		}
+		if cli.Store.ChatMetadata != nil {
+			storeUpdateError = cli.Store.ChatMetadata.PutMarkedAsUnread(jid, !act.GetRead())
+		}
 	case appstate.IndexSettingPushName:
 		eventToDispatch = &events.PushNameSetting{
 			Timestamp:    ts,
@@ -232,6 +252,15 @@ func (cli *Client) dispatchAppState(mutation appstate.Mutation, fullSync bool, e
 			Action:       act,
 			FromFullSync: fullSync,
 		}
+		if cli.Store.ChatMetadata != nil {
+			storeUpdateError = cli.Store.ChatMetadata.PutLabel(store.Label{
+				ID:           mutation.Index[1],
+				Name:         act.GetName(),
+				Color:        act.GetColor(),
+				PredefinedID: act.GetPredefinedID(),
+				Deleted:      act.GetDeleted(),
+			})
+		}
 	case appstate.IndexLabelAssociationChat:
 		if len(mutation.Index) < 3 {
 			return
@@ -245,6 +274,9 @@ func (cli *Client) dispatchAppState(mutation appstate.Mutation, fullSync bool, e
 			Action:       act,
 			FromFullSync: fullSync,
 		}
+		if cli.Store.ChatMetadata != nil {
+			storeUpdateError = cli.Store.ChatMetadata.PutChatLabel(jid, mutation.Index[1], act.GetLabeled())
+		}
 	case appstate.IndexLabelAssociationMessage:
 		if len(mutation.Index) < 6 {
 			return
@@ -259,6 +291,14 @@ func (cli *Client) dispatchAppState(mutation appstate.Mutation, fullSync bool, e
 			Action:       act,
 			FromFullSync: fullSync,
 		}
+		if cli.Store.ChatMetadata != nil {
+			storeUpdateError = cli.Store.ChatMetadata.PutMessageLabel(jid, mutation.Index[3], mutation.Index[1], act.GetLabeled())
+		}
+	case appstate.IndexPnForLidChat:
+		pn, _ := types.ParseJID(mutation.Action.GetPnForLidChatAction().GetPnJID())
+		if cli.Store.LIDs != nil && jid.Server == types.HiddenUserServer && pn.Server == types.DefaultUserServer {
+			storeUpdateError = cli.Store.LIDs.PutLIDMapping(jid, pn)
+		}
 	}
 	if storeUpdateError != nil {
 		cli.Log.Errorf("Failed to update device store after app state mutation: %v", storeUpdateError)
@@ -52,6 +52,7 @@ const (
 	IndexLabelEdit               = "label_edit"
 	IndexLabelAssociationChat    = "label_jid"
 	IndexLabelAssociationMessage = "label_message"
+	IndexPnForLidChat            = "pnForLidChat"
 )
 
 type Processor struct {
@@ -0,0 +1,92 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package binary
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+// JSONNode is a lossless JSON representation of a Node.
+//
+// Marshaling a Node directly loses the types of attributes, so JIDs can't be reliably told apart from
+// strings when unmarshaling. JSONNode stores all attributes as strings and lists which ones are JIDs,
+// which is enough to restore nodes decoded from the binary format exactly.
+type JSONNode struct {
+	Tag      string            `json:"tag"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+	JIDAttrs []string          `json:"jid_attrs,omitempty"`
+	Children []JSONNode        `json:"children,omitempty"`
+	Bytes    []byte            `json:"bytes,omitempty"`
+}
+
+// ToJSONNode converts the given node into its JSON representation.
+// Attributes that aren't strings or JIDs are converted to strings, like the binary encoder does.
+func ToJSONNode(n *Node) JSONNode {
+	jn := JSONNode{Tag: n.Tag}
+	if len(n.Attrs) > 0 {
+		jn.Attrs = make(map[string]string, len(n.Attrs))
+		for key, val := range n.Attrs {
+			switch typedVal := val.(type) {
+			case nil:
+				continue
+			case types.JID:
+				jn.JIDAttrs = append(jn.JIDAttrs, key)
+				jn.Attrs[key] = typedVal.String()
+			default:
+				jn.Attrs[key] = fmt.Sprint(typedVal)
+			}
+		}
+		sort.Strings(jn.JIDAttrs)
+	}
+	switch content := n.Content.(type) {
+	case []Node:
+		jn.Children = make([]JSONNode, len(content))
+		for i := range content {
+			jn.Children[i] = ToJSONNode(&content[i])
+		}
+	case []byte:
+		jn.Bytes = content
+	case string:
+		jn.Bytes = []byte(content)
+	}
+	return jn
+}
+
+// ToNode converts the JSON representation back into a Node.
+func (jn *JSONNode) ToNode() (Node, error) {
+	n := Node{Tag: jn.Tag}
+	if len(jn.Attrs) > 0 {
+		n.Attrs = make(Attrs, len(jn.Attrs))
+		for key, val := range jn.Attrs {
+			n.Attrs[key] = val
+		}
+		for _, key := range jn.JIDAttrs {
+			jid, err := types.ParseJID(jn.Attrs[key])
+			if err != nil {
+				return n, fmt.Errorf("failed to parse %s attribute of <%s>: %w", key, jn.Tag, err)
+			}
+			n.Attrs[key] = jid
+		}
+	}
+	if jn.Children != nil {
+		children := make([]Node, len(jn.Children))
+		for i := range jn.Children {
+			var err error
+			children[i], err = jn.Children[i].ToNode()
+			if err != nil {
+				return n, err
+			}
+		}
+		n.Content = children
+	} else if jn.Bytes != nil {
+		n.Content = jn.Bytes
+	}
+	return n, nil
+}
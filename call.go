@@ -13,7 +13,7 @@ import (
 )
 
 func (cli *Client) handleCallEvent(node *waBinary.Node) {
-	go cli.sendAck(node)
+	cli.sendInBackground(func() { cli.sendAck(node) })
 
 	if len(node.GetChildren()) != 1 {
 		cli.dispatchEvent(&events.UnknownCallEvent{Node: node})
@@ -9,6 +9,7 @@ package whatsmeow
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -16,6 +17,7 @@ import (
 	"net/http"
 	"net/url"
 	"runtime/debug"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,18 +40,24 @@ import (
 
 // EventHandler is a function that can handle events from WhatsApp.
 type EventHandler func(evt interface{})
+
+// EventHandlerWithError is an event handler that can report that it failed to handle an event.
+// The error is only used when Client.AckAfterHandle is enabled.
+type EventHandlerWithError func(evt interface{}) error
 type nodeHandler func(node *waBinary.Node)
 
 var nextHandlerID uint32
 
 type wrappedEventHandler struct {
-	fn EventHandler
-	id uint32
+	fn       EventHandlerWithError
+	id       uint32
+	priority int
 }
 
 type deviceCache struct {
-	devices []types.JID
-	dhash   string
+	devices   []types.JID
+	dhash     string
+	updatedAt time.Time
 }
 
 // Client contains everything necessary to connect to and interact with the WhatsApp web API.
@@ -64,6 +72,7 @@ type Client struct {
 	socketWait chan struct{}
 
 	isLoggedIn            atomic.Bool
+	connState             connectionStateMachine
 	expectedDisconnect    atomic.Bool
 	EnableAutoReconnect   bool
 	LastSuccessfulConnect time.Time
@@ -71,11 +80,51 @@ type Client struct {
 	// AutoReconnectHook is called when auto-reconnection fails. If the function returns false,
 	// the client will not attempt to reconnect. The number of retries can be read from AutoReconnectErrors.
 	AutoReconnectHook func(error) bool
+	// ReconnectPolicy decides the delays between automatic reconnection attempts and when to give up.
+	// If nil, DefaultReconnectPolicy is used.
+	ReconnectPolicy ReconnectPolicy
+	reconnectLock   sync.Mutex
+	reconnectCtx    context.Context
+	cancelReconnect context.CancelFunc
 
 	DisableLoginAutoReconnect bool
 
 	sendActiveReceipts atomic.Uint32
 
+	// If AckAfterHandle is true, incoming messages are only acknowledged (and delivery receipts sent) after
+	// event handlers have returned. Messages are also stored in the device's outbox store (store.Device.Outbox)
+	// before being passed to event handlers and removed after all handlers succeed, so that events whose
+	// handlers failed or didn't finish (e.g. because the process crashed) can be replayed with ReplayOutbox.
+	// The outbox is replayed automatically after connecting, before any new messages are handled.
+	// Replayed events have IsReplay set.
+	//
+	// If the outbox isn't available, messages whose handlers returned an error aren't acknowledged at all,
+	// which makes the server send them again after reconnecting. In that case, the message will usually
+	// be received through the retry receipt flow, as the Signal session has already moved forward.
+	//
+	// Only events.Message is covered by this. Handlers can report errors by being registered with
+	// AddEventHandlerWithError. Event handlers should be idempotent, as the same message may be delivered
+	// multiple times.
+	//
+	// Messages are handled one at a time, as the client must wait for the handlers of each message before
+	// acknowledging it. This also applies when concurrent dispatch (EnableConcurrentDispatch) is enabled:
+	// message events are still passed to the worker of their chat, but the next message isn't processed
+	// until the previous one has been handled, so messages in different chats aren't handled in parallel.
+	// Other events are dispatched concurrently as usual.
+	AckAfterHandle bool
+	// OutboxMaxAttempts is the number of times event handlers may fail to handle a message from the outbox
+	// before it's given up on. Such messages are dispatched as events.OutboxDeadLetter instead of being
+	// replayed again. Defaults to DefaultOutboxMaxAttempts if zero. If negative, messages are retried forever.
+	OutboxMaxAttempts int
+	outboxReplayLock  sync.Mutex
+
+	// Metrics receives measurements like message counts and info query latencies (see MetricDefinitions).
+	// The github.com/Romerito007/whatsmeow/metrics/prommetrics module contains an implementation that exports
+	// the metrics to Prometheus. It's a separate Go module, so the Prometheus client is only a dependency if it's used.
+	Metrics Metrics
+	// Tracer is used to create spans for sending messages, info queries, encryption, decryption and media transfers.
+	Tracer Tracer
+
 	// EmitAppStateEventsOnFullSync can be set to true if you want to get app state events emitted
 	// even when re-syncing the whole state.
 	EmitAppStateEventsOnFullSync bool
@@ -100,9 +149,20 @@ type Client struct {
 	responseWaitersLock sync.Mutex
 
 	nodeHandlers      map[string]nodeHandler
-	handlerQueue      chan *waBinary.Node
+	handlerQueue      chan queuedNode
+	handlerLoopLock   sync.Mutex
+	handlerOverflow   atomic.Int32
+	handlersInFlight  inFlightTracker
+	inFlight          inFlightTracker
 	eventHandlers     []wrappedEventHandler
 	eventHandlersLock sync.RWMutex
+	dispatcher        atomic.Pointer[concurrentDispatcher]
+	recorder          atomic.Pointer[NodeRecorder]
+	recordSlots       sync.Map
+	replaying         atomic.Bool
+
+	sendMiddlewares     []wrappedSendMiddleware
+	sendMiddlewaresLock sync.RWMutex
 
 	messageRetries     map[string]int
 	messageRetriesLock sync.Mutex
@@ -121,6 +181,10 @@ type Client struct {
 	groupParticipantsCacheLock sync.Mutex
 	userDevicesCache           map[types.JID]deviceCache
 	userDevicesCacheLock       sync.Mutex
+	// DeviceListCacheTTL is the maximum age of cached device lists of other users. Expired device lists are
+	// fetched from the server again the next time they're needed. If zero, cached device lists never expire,
+	// but they're still kept up to date using device list notifications.
+	DeviceListCacheTTL time.Duration
 
 	recentMessagesMap  map[recentMessageKey]RecentMessage
 	recentMessagesList [recentMessagesSize]recentMessageKey
@@ -169,6 +233,9 @@ type Client struct {
 	// The library is currently embedded in mautrix-meta (https://github.com/mautrix/meta), but may be separated later.
 	MessengerConfig *MessengerConfig
 	RefreshCAT      func() error
+
+	serverConfig *ServerConfig
+	transport    socket.Transport
 }
 
 type MessengerConfig struct {
@@ -176,10 +243,27 @@ type MessengerConfig struct {
 	BaseURL   string
 }
 
+// ServerConfig contains the details of a server that the client connects to instead of WhatsApp.
+// This is only meant for testing against a fake server, like the one in the testserver package.
+type ServerConfig struct {
+	// The websocket URL to connect to.
+	WebsocketURL string
+	// The public key that must have signed the noise certificate chain sent by the server.
+	CertPubKey [32]byte
+	// The TLS config to use for the websocket and media HTTP requests, e.g. to trust a self-signed certificate.
+	TLSConfig *tls.Config
+}
+
 // Size of buffer for the channel that all incoming XML nodes go through.
 // In general it shouldn't go past a few buffered messages, but the channel is big to be safe.
 const handlerQueueSize = 2048
 
+// queuedNode is an incoming node in the handler queue, along with the context of the connection it was received on.
+type queuedNode struct {
+	node *waBinary.Node
+	ctx  context.Context
+}
+
 // NewClient initializes a new WhatsApp web client.
 //
 // The logger can be nil, it will default to a no-op logger.
@@ -214,7 +298,7 @@ func NewClient(deviceStore *store.Device, log waLog.Logger) *Client {
 		responseWaiters: make(map[string]chan<- *waBinary.Node),
 		eventHandlers:   make([]wrappedEventHandler, 0, 1),
 		messageRetries:  make(map[string]int),
-		handlerQueue:    make(chan *waBinary.Node, handlerQueueSize),
+		handlerQueue:    make(chan queuedNode, handlerQueueSize),
 		appStateProc:    appstate.NewProcessor(deviceStore, log.Sub("AppState")),
 		socketWait:      make(chan struct{}),
 
@@ -350,6 +434,30 @@ func (cli *Client) SetSOCKSProxy(px proxy.Dialer, opts ...SetProxyOptions) {
 	}
 }
 
+// SetServerConfig makes the client connect to a different server instead of WhatsApp.
+// Passing nil restores the default servers.
+//
+// Must be called before Connect() to take effect. This is only meant for tests, see the testserver package.
+func (cli *Client) SetServerConfig(cfg *ServerConfig) {
+	cli.serverConfig = cfg
+	transport := cli.http.Transport.(*http.Transport)
+	if cfg != nil {
+		transport.TLSClientConfig = cfg.TLSConfig
+	} else {
+		transport.TLSClientConfig = nil
+	}
+}
+
+// SetTransport sets the transport used to connect to the WhatsApp servers, e.g. a socket.NetTransport
+// to send frames over a raw TCP connection or an in-memory pipe instead of a websocket.
+// Passing nil restores the default websocket transport.
+//
+// Must be called before Connect() to take effect. Proxies set with SetProxy or SetSOCKSProxy
+// and the websocket URL are not used by custom transports.
+func (cli *Client) SetTransport(transport socket.Transport) {
+	cli.transport = transport
+}
+
 // ToggleProxyOnlyForLogin changes whether the proxy set with SetProxy or related methods
 // is only used for the pre-login websocket and not authenticated websockets.
 func (cli *Client) ToggleProxyOnlyForLogin(only bool) {
@@ -409,6 +517,7 @@ func (cli *Client) Connect() error {
 	}
 
 	cli.resetExpectedDisconnect()
+	cli.setState(StateDialing, "connecting")
 	wsDialer := websocket.Dialer{}
 	if !cli.proxyOnlyLogin || cli.Store.ID == nil {
 		if cli.proxy != nil {
@@ -430,13 +539,23 @@ func (cli *Client) Connect() error {
 		fs.HTTPHeaders.Set("Sec-Fetch-Mode", "websocket")
 		fs.HTTPHeaders.Set("Sec-Fetch-Site", "cross-site")
 	}
+	if cli.serverConfig != nil {
+		fs.URL = cli.serverConfig.WebsocketURL
+		fs.Dialer.TLSClientConfig = cli.serverConfig.TLSConfig
+	}
+	fs.Transport = cli.transport
 	if err := fs.Connect(); err != nil {
 		fs.Close(0)
+		cli.setDisconnectedState(fmt.Sprintf("failed to connect: %v", err))
 		return err
-	} else if err = cli.doHandshake(fs, *keys.NewKeyPair()); err != nil {
+	}
+	cli.setState(StateHandshaking, "websocket connected")
+	if err := cli.doHandshake(fs, *keys.NewKeyPair()); err != nil {
 		fs.Close(0)
+		cli.setDisconnectedState(fmt.Sprintf("noise handshake failed: %v", err))
 		return fmt.Errorf("noise handshake failed: %w", err)
 	}
+	cli.setState(StateAuthenticating, "handshake complete")
 	go cli.keepAliveLoop(cli.socket.Context())
 	go cli.handlerQueueLoop(cli.socket.Context())
 	return nil
@@ -456,10 +575,12 @@ func (cli *Client) onDisconnect(ns *socket.NoiseSocket, remote bool) {
 		cli.clearResponseWaiters(xmlStreamEndNode)
 		if !cli.isExpectedDisconnect() && remote {
 			cli.Log.Debugf("Emitting Disconnected event")
+			cli.setDisconnectedState("connection lost")
 			go cli.dispatchEvent(&events.Disconnected{})
 			go cli.autoReconnect()
 		} else if remote {
 			cli.Log.Debugf("OnDisconnect() called, but it was expected, so not emitting event")
+			cli.setDisconnectedState("connection closed by server")
 		} else {
 			cli.Log.Debugf("OnDisconnect() called after manual disconnection")
 		}
@@ -480,31 +601,6 @@ func (cli *Client) isExpectedDisconnect() bool {
 	return cli.expectedDisconnect.Load()
 }
 
-func (cli *Client) autoReconnect() {
-	if !cli.EnableAutoReconnect || cli.Store.ID == nil {
-		return
-	}
-	for {
-		autoReconnectDelay := time.Duration(cli.AutoReconnectErrors) * 2 * time.Second
-		cli.Log.Debugf("Automatically reconnecting after %v", autoReconnectDelay)
-		cli.AutoReconnectErrors++
-		time.Sleep(autoReconnectDelay)
-		err := cli.Connect()
-		if errors.Is(err, ErrAlreadyConnected) {
-			cli.Log.Debugf("Connect() said we're already connected after autoreconnect sleep")
-			return
-		} else if err != nil {
-			cli.Log.Errorf("Error reconnecting after autoreconnect sleep: %v", err)
-			if cli.AutoReconnectHook != nil && !cli.AutoReconnectHook(err) {
-				cli.Log.Debugf("AutoReconnectHook returned false, not reconnecting")
-				return
-			}
-		} else {
-			return
-		}
-	}
-}
-
 // IsConnected checks if the client is connected to the WhatsApp web websocket.
 // Note that this doesn't check if the client is authenticated. See the IsLoggedIn field for that.
 func (cli *Client) IsConnected() bool {
@@ -518,7 +614,20 @@ func (cli *Client) IsConnected() bool {
 //
 // This will not emit any events, the Disconnected event is only used when the
 // connection is closed by the server or a network error.
+//
+// If the client is waiting to reconnect automatically, the reconnection is cancelled.
+//
+// Nodes that were received, but are still waiting in the handler queue, are dropped without calling their
+// handlers. They haven't been acknowledged, so the server sends them again after the next connection.
+// The same happens when the connection is lost and the client reconnects automatically. Use Shutdown to
+// handle queued nodes and let in-progress sends finish before disconnecting.
 func (cli *Client) Disconnect() {
+	cli.disconnectWithReason("disconnect requested")
+}
+
+func (cli *Client) disconnectWithReason(reason string) {
+	cli.stopReconnectLoop()
+	defer cli.setDisconnectedState(reason)
 	if cli.socket == nil {
 		return
 	}
@@ -567,6 +676,7 @@ func (cli *Client) Logout() error {
 		return fmt.Errorf("error sending logout request: %w", err)
 	}
 	cli.Disconnect()
+	cli.setState(StateLoggedOut, "logged out")
 	err = cli.Store.Delete()
 	if err != nil {
 		return fmt.Errorf("error deleting data from store: %w", err)
@@ -606,9 +716,39 @@ func (cli *Client) Logout() error {
 //		// Handle event and access mycli.WAClient
 //	}
 func (cli *Client) AddEventHandler(handler EventHandler) uint32 {
+	return cli.AddEventHandlerWithPriority(handler, 0)
+}
+
+// AddEventHandlerWithPriority registers a new function to receive all events emitted by this client.
+//
+// Handlers with a higher priority are called before handlers with a lower priority. Handlers with the same
+// priority are called in the order they were added. Handlers added with AddEventHandler have priority 0.
+func (cli *Client) AddEventHandlerWithPriority(handler EventHandler, priority int) uint32 {
+	return cli.addEventHandler(func(evt interface{}) error {
+		handler(evt)
+		return nil
+	}, priority)
+}
+
+// AddEventHandlerWithError registers a new function to receive all events emitted by this client.
+// Unlike handlers added with AddEventHandler, the function can return an error to signal that handling
+// the event failed, in which case the event will be retried later if AckAfterHandle is enabled.
+func (cli *Client) AddEventHandlerWithError(handler EventHandlerWithError) uint32 {
+	return cli.addEventHandler(handler, 0)
+}
+
+func (cli *Client) addEventHandler(handler EventHandlerWithError, priority int) uint32 {
 	nextID := atomic.AddUint32(&nextHandlerID, 1)
+	wrapped := wrappedEventHandler{fn: handler, id: nextID, priority: priority}
 	cli.eventHandlersLock.Lock()
-	cli.eventHandlers = append(cli.eventHandlers, wrappedEventHandler{handler, nextID})
+	index := len(cli.eventHandlers)
+	for i, existing := range cli.eventHandlers {
+		if existing.priority < priority {
+			index = i
+			break
+		}
+	}
+	cli.eventHandlers = slices.Insert(cli.eventHandlers, index, wrapped)
 	cli.eventHandlersLock.Unlock()
 	return nextID
 }
@@ -652,7 +792,7 @@ func (cli *Client) RemoveEventHandlers() {
 	cli.eventHandlersLock.Unlock()
 }
 
-func (cli *Client) handleFrame(data []byte) {
+func (cli *Client) handleFrame(ctx context.Context, data []byte) {
 	decompressed, err := waBinary.Unpack(data)
 	if err != nil {
 		cli.Log.Warnf("Failed to decompress frame: %v", err)
@@ -666,6 +806,12 @@ func (cli *Client) handleFrame(data []byte) {
 		return
 	}
 	cli.recvLog.Debugf("%s", node.XMLString())
+	if node.Tag == "message" {
+		// Messages are recorded after decryption in handleEncryptedMessage, but they keep their place in the recording
+		cli.reserveRecordSlot(node)
+	} else {
+		cli.recordNode(RecordIncoming, node)
+	}
 	if node.Tag == "xmlstreamend" {
 		if !cli.isExpectedDisconnect() {
 			cli.Log.Warnf("Received stream end frame")
@@ -673,17 +819,34 @@ func (cli *Client) handleFrame(data []byte) {
 		// TODO should we do something else?
 	} else if cli.receiveResponse(node) {
 		// handled
+		cli.releaseRecordSlot(node)
 	} else if _, ok := cli.nodeHandlers[node.Tag]; ok {
+		if !cli.handlersInFlight.tryAdd() {
+			// The node isn't acked, so the server will send it again after reconnecting
+			cli.Log.Debugf("Not handling %s node %s as the client is shutting down", node.Tag, node.AttrGetter().OptionalString("id"))
+			cli.releaseRecordSlot(node)
+			return
+		}
+		item := queuedNode{node: node, ctx: ctx}
 		select {
-		case cli.handlerQueue <- node:
+		case cli.handlerQueue <- item:
 		default:
 			cli.Log.Warnf("Handler queue is full, message ordering is no longer guaranteed")
+			cli.handlerOverflow.Add(1)
 			go func() {
-				cli.handlerQueue <- node
+				defer cli.handlerOverflow.Add(-1)
+				select {
+				case cli.handlerQueue <- item:
+				case <-ctx.Done():
+					cli.dropQueuedNode(node)
+				}
 			}()
 		}
-	} else if node.Tag != "ack" {
-		cli.Log.Debugf("Didn't handle WhatsApp node %s", node.Tag)
+	} else {
+		cli.releaseRecordSlot(node)
+		if node.Tag != "ack" {
+			cli.Log.Debugf("Didn't handle WhatsApp node %s", node.Tag)
+		}
 	}
 }
 
@@ -697,36 +860,84 @@ func stopAndDrainTimer(timer *time.Timer) {
 }
 
 func (cli *Client) handlerQueueLoop(ctx context.Context) {
+	// The loop of the previous connection may still be handling a node, so wait for it to exit
+	// to make sure nodes are still handled in order.
+	cli.handlerLoopLock.Lock()
+	defer cli.handlerLoopLock.Unlock()
 	timer := time.NewTimer(5 * time.Minute)
 	stopAndDrainTimer(timer)
 	cli.Log.Debugf("Starting handler queue loop")
 	for {
 		select {
-		case node := <-cli.handlerQueue:
-			doneChan := make(chan struct{}, 1)
-			go func() {
-				start := time.Now()
-				cli.nodeHandlers[node.Tag](node)
-				duration := time.Since(start)
-				doneChan <- struct{}{}
-				if duration > 5*time.Second {
-					cli.Log.Warnf("Node handling took %s for %s", duration, node.XMLString())
-				}
-			}()
-			timer.Reset(5 * time.Minute)
-			select {
-			case <-doneChan:
-				stopAndDrainTimer(timer)
-			case <-timer.C:
-				cli.Log.Warnf("Node handling is taking long for %s - continuing in background", node.XMLString())
-			}
+		case item := <-cli.handlerQueue:
+			cli.handleQueuedNode(item, timer)
 		case <-ctx.Done():
 			cli.Log.Debugf("Closing handler queue loop")
+			cli.drainHandlerQueue(timer)
 			return
 		}
 	}
 }
 
+// drainHandlerQueue empties the handler queue after the connection is closed. Nodes received on closed connections
+// are dropped, while nodes of a new connection (if one was already made) are handled before the loop exits.
+func (cli *Client) drainHandlerQueue(timer *time.Timer) {
+	dropped := 0
+	for {
+		select {
+		case item := <-cli.handlerQueue:
+			if !cli.handleQueuedNode(item, timer) {
+				dropped++
+			}
+		default:
+			if cli.handlerOverflow.Load() == 0 {
+				if dropped > 0 {
+					cli.Log.Debugf("Dropped %d unhandled nodes from closed connection", dropped)
+				}
+				return
+			}
+			// Nodes that didn't fit in the queue are still being added, wait for them too
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// handleQueuedNode calls the node handler for a node from the handler queue. If the connection the node was received on
+// has been closed, it's dropped instead and false is returned. Dropped nodes haven't been acked, so the server will send
+// them again after reconnecting.
+func (cli *Client) handleQueuedNode(item queuedNode, timer *time.Timer) bool {
+	node := item.node
+	if item.ctx.Err() != nil {
+		cli.dropQueuedNode(node)
+		return false
+	}
+	doneChan := make(chan struct{}, 1)
+	go func() {
+		start := time.Now()
+		cli.nodeHandlers[node.Tag](node)
+		duration := time.Since(start)
+		doneChan <- struct{}{}
+		cli.handlersInFlight.done()
+		if duration > 5*time.Second {
+			cli.Log.Warnf("Node handling took %s for %s", duration, node.XMLString())
+		}
+	}()
+	timer.Reset(5 * time.Minute)
+	select {
+	case <-doneChan:
+		stopAndDrainTimer(timer)
+	case <-timer.C:
+		cli.Log.Warnf("Node handling is taking long for %s - continuing in background", node.XMLString())
+	}
+	return true
+}
+
+// dropQueuedNode marks a node that was queued for handling as finished without handling it.
+func (cli *Client) dropQueuedNode(node *waBinary.Node) {
+	cli.releaseRecordSlot(node)
+	cli.handlersInFlight.done()
+}
+
 func (cli *Client) sendNodeAndGetData(node waBinary.Node) ([]byte, error) {
 	cli.socketLock.RLock()
 	sock := cli.socket
@@ -741,6 +952,7 @@ func (cli *Client) sendNodeAndGetData(node waBinary.Node) ([]byte, error) {
 	}
 
 	cli.sendLog.Debugf("%s", node.XMLString())
+	cli.recordNode(RecordOutgoing, &node)
 	return payload, sock.SendFrame(payload)
 }
 
@@ -750,17 +962,40 @@ func (cli *Client) sendNode(node waBinary.Node) error {
 }
 
 func (cli *Client) dispatchEvent(evt interface{}) {
+	if disp := cli.dispatcher.Load(); disp != nil && disp.dispatch(evt, nil) {
+		return
+	}
+	_ = cli.callEventHandlers(evt)
+}
+
+// dispatchEventAndWait dispatches the event and waits for all event handlers to finish handling it.
+func (cli *Client) dispatchEventAndWait(evt interface{}) error {
+	if disp := cli.dispatcher.Load(); disp != nil {
+		done := make(chan error, 1)
+		if disp.dispatch(evt, done) {
+			return <-done
+		}
+	}
+	return cli.callEventHandlers(evt)
+}
+
+func (cli *Client) callEventHandlers(evt interface{}) (err error) {
+	var errs []error
 	cli.eventHandlersLock.RLock()
 	defer func() {
 		cli.eventHandlersLock.RUnlock()
-		err := recover()
-		if err != nil {
-			cli.Log.Errorf("Event handler panicked while handling a %T: %v\n%s", evt, err, debug.Stack())
+		p := recover()
+		if p != nil {
+			cli.Log.Errorf("Event handler panicked while handling a %T: %v\n%s", evt, p, debug.Stack())
+			err = errors.Join(append(errs, fmt.Errorf("event handler panicked: %v", p))...)
 		}
 	}()
 	for _, handler := range cli.eventHandlers {
-		handler.fn(evt)
+		if handlerErr := handler.fn(evt); handlerErr != nil {
+			errs = append(errs, handlerErr)
+		}
 	}
+	return errors.Join(errs...)
 }
 
 // ParseWebMessage parses a WebMessageInfo object into *events.Message to match what real-time messages have.
@@ -7,6 +7,8 @@
 package whatsmeow
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	waBinary "github.com/Romerito007/whatsmeow/binary"
@@ -38,6 +40,7 @@ func (cli *Client) handleStreamError(node *waBinary.Node) {
 		}()
 	case code == "401" && conflictType == "device_removed":
 		cli.expectDisconnect()
+		cli.setState(StateLoggedOut, "device removed")
 		cli.Log.Infof("Got device removed stream error, sending LoggedOut event and deleting session")
 		go cli.dispatchEvent(&events.LoggedOut{OnConnect: false, Reason: events.ConnectFailureLoggedOut})
 		err := cli.Store.Delete()
@@ -46,6 +49,7 @@ func (cli *Client) handleStreamError(node *waBinary.Node) {
 		}
 	case conflictType == "replaced":
 		cli.expectDisconnect()
+		cli.setDisconnectedState("stream replaced")
 		cli.Log.Infof("Got replaced stream error, sending StreamReplaced event")
 		go cli.dispatchEvent(&events.StreamReplaced{})
 	case code == "503":
@@ -84,6 +88,7 @@ func (cli *Client) handleIB(node *waBinary.Node) {
 				Receipts:       ag.Int("receipt"),
 			})
 		case "offline":
+			cli.setState(StateOnline, "offline sync completed")
 			cli.dispatchEvent(&events.OfflineSyncCompleted{
 				Count: ag.Int("count"),
 			})
@@ -119,6 +124,7 @@ func (cli *Client) handleConnectFailure(node *waBinary.Node) {
 	}
 	if reason.IsLoggedOut() {
 		cli.Log.Infof("Got %s connect failure, sending LoggedOut event and deleting session", reason)
+		cli.setState(StateLoggedOut, fmt.Sprintf("connect failure: %s", reason))
 		go cli.dispatchEvent(&events.LoggedOut{OnConnect: true, Reason: reason})
 		err := cli.Store.Delete()
 		if err != nil {
@@ -153,9 +159,18 @@ func (cli *Client) handleConnectSuccess(node *waBinary.Node) {
 	cli.Log.Infof("Successfully authenticated")
 	cli.LastSuccessfulConnect = time.Now()
 	cli.AutoReconnectErrors = 0
+	if cli.ReconnectPolicy != nil {
+		cli.ReconnectPolicy.Reset()
+	}
 	cli.isLoggedIn.Store(true)
+	cli.setState(StateSyncing, "authenticated")
+	if cli.AckAfterHandle && cli.Store.Outbox != nil {
+		// This runs in the handler queue, so the replayed messages are handled before anything the server
+		// sends on the new connection. Replaying in the background would break the ordering guarantees.
+		cli.replayOutboxAfterConnect()
+	}
 	go func() {
-		if dbCount, err := cli.Store.PreKeys.UploadedPreKeyCount(); err != nil {
+		if dbCount, err := cli.Store.UploadedPreKeyCountContext(context.TODO()); err != nil {
 			cli.Log.Errorf("Failed to get number of prekeys in database: %v", err)
 		} else if serverCount, err := cli.getServerPreKeyCount(); err != nil {
 			cli.Log.Warnf("Failed to get number of prekeys on server: %v", err)
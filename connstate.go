@@ -0,0 +1,134 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnectionState is a step in the lifecycle of the client's connection to WhatsApp.
+type ConnectionState int
+
+const (
+	// StateDisconnected means there is no connection and no reconnection is scheduled.
+	StateDisconnected ConnectionState = iota
+	// StateDialing means the websocket is being opened.
+	StateDialing
+	// StateHandshaking means the websocket is open and the noise handshake is in progress.
+	StateHandshaking
+	// StateAuthenticating means the handshake is done and the client is waiting for the server to accept
+	// the login (or for pairing, if the client isn't logged in yet).
+	StateAuthenticating
+	// StateSyncing means the client is logged in and is receiving the events that happened while it was offline.
+	StateSyncing
+	// StateOnline means the client is logged in and has received all offline events.
+	StateOnline
+	// StateBackingOff means the connection was lost and the client is waiting before reconnecting automatically.
+	StateBackingOff
+	// StateLoggedOut means the server rejected the session and the client must be paired again.
+	StateLoggedOut
+)
+
+var connectionStateNames = map[ConnectionState]string{
+	StateDisconnected:   "disconnected",
+	StateDialing:        "dialing",
+	StateHandshaking:    "handshaking",
+	StateAuthenticating: "authenticating",
+	StateSyncing:        "syncing",
+	StateOnline:         "online",
+	StateBackingOff:     "backing off",
+	StateLoggedOut:      "logged out",
+}
+
+func (cs ConnectionState) String() string {
+	name, ok := connectionStateNames[cs]
+	if !ok {
+		return fmt.Sprintf("ConnectionState(%d)", int(cs))
+	}
+	return name
+}
+
+// StateTransition is a change in the connection state of a client.
+type StateTransition struct {
+	From   ConnectionState
+	To     ConnectionState
+	Reason string
+	Time   time.Time
+}
+
+// stateWatchBufferSize is the number of transitions that can be buffered for each watcher.
+const stateWatchBufferSize = 32
+
+type connectionStateMachine struct {
+	lock     sync.Mutex
+	state    ConnectionState
+	watchers map[chan StateTransition]struct{}
+}
+
+// State returns the current connection state of the client.
+func (cli *Client) State() ConnectionState {
+	cli.connState.lock.Lock()
+	defer cli.connState.lock.Unlock()
+	return cli.connState.state
+}
+
+// WatchState returns a channel that receives every connection state transition from now on,
+// and a function that stops watching and closes the channel.
+//
+// Transitions are sent without blocking, so if the channel isn't read fast enough and its buffer fills up,
+// further transitions are dropped until there's space again. State can be used to get the current state.
+func (cli *Client) WatchState() (<-chan StateTransition, func()) {
+	ch := make(chan StateTransition, stateWatchBufferSize)
+	cli.connState.lock.Lock()
+	if cli.connState.watchers == nil {
+		cli.connState.watchers = make(map[chan StateTransition]struct{})
+	}
+	cli.connState.watchers[ch] = struct{}{}
+	cli.connState.lock.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			cli.connState.lock.Lock()
+			delete(cli.connState.watchers, ch)
+			close(ch)
+			cli.connState.lock.Unlock()
+		})
+	}
+}
+
+func (cli *Client) setState(state ConnectionState, reason string) {
+	cli.connState.lock.Lock()
+	defer cli.connState.lock.Unlock()
+	cli.unlockedSetState(state, reason)
+}
+
+// setDisconnectedState moves the client to the disconnected state, unless it has been logged out.
+func (cli *Client) setDisconnectedState(reason string) {
+	cli.connState.lock.Lock()
+	defer cli.connState.lock.Unlock()
+	if cli.connState.state != StateLoggedOut {
+		cli.unlockedSetState(StateDisconnected, reason)
+	}
+}
+
+func (cli *Client) unlockedSetState(state ConnectionState, reason string) {
+	if cli.connState.state == state {
+		return
+	}
+	transition := StateTransition{From: cli.connState.state, To: state, Reason: reason, Time: time.Now()}
+	cli.connState.state = state
+	cli.Log.Debugf("Connection state changed from %s to %s (%s)", transition.From, transition.To, reason)
+	for ch := range cli.connState.watchers {
+		select {
+		case ch <- transition:
+		default:
+			cli.Log.Warnf("Dropping connection state transition to %s as watcher channel is full", state)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func (cli *Client) isDeviceCacheExpired(updatedAt time.Time) bool {
+	return cli.DeviceListCacheTTL > 0 && time.Since(updatedAt) > cli.DeviceListCacheTTL
+}
+
+// getCachedUserDevices finds the device list of the given user from the in-memory cache or the device list store.
+//
+// This must be called with the userDevicesCacheLock held.
+func (cli *Client) getCachedUserDevices(jid types.JID) (deviceCache, bool) {
+	cached, ok := cli.getManyCachedUserDevices([]types.JID{jid})[jid]
+	return cached, ok
+}
+
+// getManyCachedUserDevices finds the device lists of the given users from the in-memory cache,
+// and the ones that aren't in memory from the device list store with a single query.
+// Users whose device list isn't cached or has expired are not included in the returned map.
+//
+// This must be called with the userDevicesCacheLock held.
+func (cli *Client) getManyCachedUserDevices(jids []types.JID) map[types.JID]deviceCache {
+	output := make(map[types.JID]deviceCache, len(jids))
+	var missing []types.JID
+	for _, jid := range jids {
+		cached, ok := cli.userDevicesCache[jid]
+		if ok && !cli.isDeviceCacheExpired(cached.updatedAt) {
+			output[jid] = cached
+			continue
+		} else if ok {
+			delete(cli.userDevicesCache, jid)
+		}
+		missing = append(missing, jid)
+	}
+	if len(missing) == 0 || cli.Store.DeviceLists == nil {
+		return output
+	}
+	stored, err := cli.Store.DeviceLists.GetDeviceLists(missing)
+	if err != nil {
+		cli.Log.Warnf("Failed to get device lists of %d users from store: %v", len(missing), err)
+		return output
+	}
+	for _, jid := range missing {
+		list, ok := stored[jid.ToNonAD()]
+		if !ok || cli.isDeviceCacheExpired(list.UpdatedAt) {
+			continue
+		}
+		cached := deviceCache{devices: list.Devices, dhash: list.DHash, updatedAt: list.UpdatedAt}
+		cli.userDevicesCache[jid] = cached
+		output[jid] = cached
+	}
+	return output
+}
+
+// putCachedUserDevices stores the device list of the given user in the in-memory cache and the device list store.
+//
+// This must be called with the userDevicesCacheLock held.
+func (cli *Client) putCachedUserDevices(jid types.JID, cached deviceCache) {
+	cached.updatedAt = time.Now()
+	cli.userDevicesCache[jid] = cached
+	if cli.Store.DeviceLists != nil {
+		err := cli.Store.DeviceLists.PutDeviceList(store.CachedDeviceList{
+			User:      jid,
+			Devices:   cached.devices,
+			DHash:     cached.dhash,
+			UpdatedAt: cached.updatedAt,
+		})
+		if err != nil {
+			cli.Log.Warnf("Failed to store %s's device list: %v", jid, err)
+		}
+	}
+}
+
+// deleteCachedUserDevices removes the device list of the given user from the in-memory cache and the device list store.
+//
+// This must be called with the userDevicesCacheLock held.
+func (cli *Client) deleteCachedUserDevices(jid types.JID) {
+	delete(cli.userDevicesCache, jid)
+	if cli.Store.DeviceLists != nil {
+		err := cli.Store.DeviceLists.DeleteDeviceList(jid)
+		if err != nil {
+			cli.Log.Warnf("Failed to delete %s's device list from store: %v", jid, err)
+		}
+	}
+}
+
+// RefreshUserDevices drops the cached device lists of the given users and fetches them from the server again.
+func (cli *Client) RefreshUserDevices(ctx context.Context, jids ...types.JID) ([]types.JID, error) {
+	cli.userDevicesCacheLock.Lock()
+	for _, jid := range jids {
+		cli.deleteCachedUserDevices(jid)
+	}
+	cli.userDevicesCacheLock.Unlock()
+	return cli.GetUserDevicesContext(ctx, jids)
+}
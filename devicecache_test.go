@@ -0,0 +1,178 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+type countingDeviceListStore struct {
+	store.DeviceListStore
+	singleGets int
+	batchGets  int
+}
+
+func (s *countingDeviceListStore) GetDeviceList(user types.JID) (*store.CachedDeviceList, error) {
+	s.singleGets++
+	return s.DeviceListStore.GetDeviceList(user)
+}
+
+func (s *countingDeviceListStore) GetDeviceLists(users []types.JID) (map[types.JID]*store.CachedDeviceList, error) {
+	s.batchGets++
+	return s.DeviceListStore.GetDeviceLists(users)
+}
+
+func newDeviceCacheTestClient(t *testing.T) (*Client, *countingDeviceListStore) {
+	t.Helper()
+	cli := newTestClient(t)
+	counter := &countingDeviceListStore{DeviceListStore: cli.Store.DeviceLists}
+	cli.Store.DeviceLists = counter
+	return cli, counter
+}
+
+func putTestDeviceList(t *testing.T, cli *Client, user types.JID, updatedAt time.Time, deviceIDs ...uint16) []types.JID {
+	t.Helper()
+	devices := make([]types.JID, len(deviceIDs))
+	for i, id := range deviceIDs {
+		devices[i] = types.JID{User: user.User, Device: id, Server: user.Server}
+	}
+	err := cli.Store.DeviceLists.PutDeviceList(store.CachedDeviceList{
+		User:      user,
+		Devices:   devices,
+		DHash:     participantListHashV2(devices),
+		UpdatedAt: updatedAt,
+	})
+	if err != nil {
+		t.Fatalf("failed to store device list: %v", err)
+	}
+	return devices
+}
+
+func TestGetUserDevices_BatchesStoreLookups(t *testing.T) {
+	cli, counter := newDeviceCacheTestClient(t)
+	users := []types.JID{testPN1, testPN2, testPN3}
+	var expected []types.JID
+	for _, user := range users {
+		expected = append(expected, putTestDeviceList(t, cli, user, time.Now(), 0, 1)...)
+	}
+
+	devices, err := cli.GetUserDevicesContext(context.Background(), users)
+	if err != nil {
+		t.Fatalf("failed to get devices: %v", err)
+	} else if !slices.Equal(devices, expected) {
+		t.Errorf("got devices %v, expected %v", devices, expected)
+	}
+	if counter.batchGets != 1 || counter.singleGets != 0 {
+		t.Errorf("store was queried %d times in batch and %d times individually, expected one batch", counter.batchGets, counter.singleGets)
+	}
+
+	// The second call is served from memory
+	_, err = cli.GetUserDevicesContext(context.Background(), users)
+	if err != nil {
+		t.Fatalf("failed to get devices: %v", err)
+	} else if counter.batchGets != 1 {
+		t.Errorf("store was queried again for device lists cached in memory")
+	}
+}
+
+func TestGetUserDevices_TTL(t *testing.T) {
+	cli, _ := newDeviceCacheTestClient(t)
+	cli.DeviceListCacheTTL = time.Hour
+	putTestDeviceList(t, cli, testPN1, time.Now().Add(-30*time.Minute), 0)
+	putTestDeviceList(t, cli, testPN2, time.Now().Add(-2*time.Hour), 0)
+
+	cli.userDevicesCacheLock.Lock()
+	cached := cli.getManyCachedUserDevices([]types.JID{testPN1, testPN2})
+	cli.userDevicesCacheLock.Unlock()
+	if _, ok := cached[testPN1]; !ok {
+		t.Errorf("fresh device list wasn't returned")
+	}
+	if _, ok := cached[testPN2]; ok {
+		t.Errorf("expired device list from store was returned")
+	}
+
+	// The client isn't connected, so an expired device list has to fail with ErrNotConnected
+	_, err := cli.GetUserDevicesContext(context.Background(), []types.JID{testPN2})
+	if !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected expired device list to be fetched from server, got %v", err)
+	}
+
+	// Entries in memory expire too
+	err = cli.Store.DeviceLists.DeleteDeviceList(testPN1)
+	if err != nil {
+		t.Fatalf("failed to delete device list: %v", err)
+	}
+	cli.userDevicesCacheLock.Lock()
+	entry := cli.userDevicesCache[testPN1]
+	entry.updatedAt = time.Now().Add(-2 * time.Hour)
+	cli.userDevicesCache[testPN1] = entry
+	cli.userDevicesCacheLock.Unlock()
+	_, err = cli.GetUserDevicesContext(context.Background(), []types.JID{testPN1})
+	if !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected expired in-memory device list to be fetched from server, got %v", err)
+	}
+	cli.userDevicesCacheLock.Lock()
+	_, stillCached := cli.userDevicesCache[testPN1]
+	cli.userDevicesCacheLock.Unlock()
+	if stillCached {
+		t.Errorf("expired device list wasn't removed from memory")
+	}
+}
+
+func makeDeviceNotification(from types.JID, action string, device types.JID, hash string) *waBinary.Node {
+	return &waBinary.Node{
+		Tag:   "notification",
+		Attrs: waBinary.Attrs{"from": from, "type": "devices"},
+		Content: []waBinary.Node{{
+			Tag:     action,
+			Attrs:   waBinary.Attrs{"device_hash": hash},
+			Content: []waBinary.Node{{Tag: "device", Attrs: waBinary.Attrs{"jid": device}}},
+		}},
+	}
+}
+
+func TestDeviceNotification_DHash(t *testing.T) {
+	cli, _ := newDeviceCacheTestClient(t)
+	devices := putTestDeviceList(t, cli, testPN1, time.Now(), 0, 1)
+	newDevice := types.JID{User: testPN1.User, Device: 5, Server: testPN1.Server}
+
+	// A matching hash updates the cached list in memory and in the store
+	added := append(slices.Clone(devices), newDevice)
+	cli.handleDeviceNotification(makeDeviceNotification(testPN1, "add", newDevice, participantListHashV2(added)))
+	stored, err := cli.Store.DeviceLists.GetDeviceList(testPN1)
+	if err != nil || stored == nil {
+		t.Fatalf("failed to get device list: %v", err)
+	} else if !slices.Equal(stored.Devices, added) || stored.DHash != participantListHashV2(added) {
+		t.Errorf("stored device list is %v (%s), expected %v", stored.Devices, stored.DHash, added)
+	}
+	cli.userDevicesCacheLock.Lock()
+	cached, ok := cli.getCachedUserDevices(testPN1)
+	cli.userDevicesCacheLock.Unlock()
+	if !ok || !slices.Equal(cached.devices, added) {
+		t.Errorf("cached device list is %v, expected %v", cached.devices, added)
+	}
+
+	// A mismatching hash means the cached list is out of date, so it's dropped everywhere
+	cli.handleDeviceNotification(makeDeviceNotification(testPN1, "remove", newDevice, "wrong hash"))
+	if stored, err = cli.Store.DeviceLists.GetDeviceList(testPN1); err != nil || stored != nil {
+		t.Errorf("device list with mismatching hash wasn't deleted from store: %+v, %v", stored, err)
+	}
+	cli.userDevicesCacheLock.Lock()
+	_, ok = cli.userDevicesCache[testPN1]
+	cli.userDevicesCacheLock.Unlock()
+	if ok {
+		t.Errorf("device list with mismatching hash wasn't deleted from memory")
+	}
+}
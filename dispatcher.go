@@ -0,0 +1,234 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Default values for ConcurrentDispatchConfig.
+const (
+	DefaultDispatchWorkers   = 8
+	DefaultDispatchQueueSize = 256
+)
+
+// ConcurrentDispatchConfig contains the settings for Client.EnableConcurrentDispatch.
+type ConcurrentDispatchConfig struct {
+	// The number of worker goroutines that call event handlers. Defaults to DefaultDispatchWorkers.
+	Workers int
+	// The number of events that can be buffered for each worker. When a worker's queue is full,
+	// dispatching events to it will block, which in turn stops the client from processing further incoming data.
+	// Defaults to DefaultDispatchQueueSize.
+	QueueSize int
+}
+
+// DispatchStats contains metrics about the concurrent event dispatcher.
+type DispatchStats struct {
+	// The number of workers.
+	Workers int
+	// The number of events currently waiting in each worker's queue.
+	QueueDepths []int
+	// The total number of events currently waiting in all queues.
+	TotalQueued int
+	// The highest number of events that have been waiting in a single worker's queue at once.
+	MaxQueueDepth int
+	// The total number of events that have been dispatched to the workers.
+	Dispatched uint64
+	// The total number of events that workers have finished handling.
+	Handled uint64
+}
+
+type dispatchItem struct {
+	evt  any
+	done chan<- error
+}
+
+type concurrentDispatcher struct {
+	cli    *Client
+	queues []chan dispatchItem
+	wg     sync.WaitGroup
+
+	lock   sync.RWMutex
+	closed bool
+
+	dispatched    atomic.Uint64
+	handled       atomic.Uint64
+	maxQueueDepth atomic.Int64
+}
+
+// EnableConcurrentDispatch makes the client call event handlers on a pool of worker goroutines
+// instead of the goroutine that processes incoming data. This allows slow event handlers
+// (e.g. ones that do database writes or HTTP requests) without blocking everything else.
+//
+// Events are assigned to workers based on their chat JID, so events in the same chat are always handled
+// in the order they were dispatched, while events in different chats may be handled in parallel.
+// Events that don't belong to any chat (e.g. events.Connected) are all handled by the same worker.
+//
+// Note that event handlers will run after the client has finished processing the event, e.g. incoming
+// messages will already have been acknowledged by the time handlers are called. The exception is
+// Client.AckAfterHandle, which makes the client wait for each message to be handled before continuing,
+// so messages won't be handled in parallel even if they're in different chats.
+//
+// If concurrent dispatch is already enabled, the previous workers are stopped after their queues are drained.
+//
+// N.B. Like DisableConcurrentDispatch, this must not be called directly from an event handler when concurrent
+// dispatch is already enabled. Stopping the previous workers waits for all of them to finish, including the one
+// running the handler, so it would deadlock. Instead run it in a goroutine:
+//
+//	func (mycli *MyClient) myEventHandler(evt interface{}) {
+//		if shouldSwitchDispatchMode {
+//			go mycli.WAClient.EnableConcurrentDispatch(newConfig)
+//		}
+//	}
+func (cli *Client) EnableConcurrentDispatch(config ConcurrentDispatchConfig) {
+	if config.Workers <= 0 {
+		config.Workers = DefaultDispatchWorkers
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultDispatchQueueSize
+	}
+	disp := &concurrentDispatcher{
+		cli:    cli,
+		queues: make([]chan dispatchItem, config.Workers),
+	}
+	for i := range disp.queues {
+		disp.queues[i] = make(chan dispatchItem, config.QueueSize)
+		disp.wg.Add(1)
+		go disp.worker(disp.queues[i])
+	}
+	if old := cli.dispatcher.Swap(disp); old != nil {
+		old.stop()
+	}
+}
+
+// DisableConcurrentDispatch switches the client back to calling event handlers synchronously.
+// This blocks until all events already queued in the concurrent dispatcher have been handled.
+//
+// N.B. Do not run this directly from an event handler while concurrent dispatch is enabled. That would cause
+// a deadlock, because this waits for the workers to exit, and one of them is busy running the handler.
+// Instead run it in a goroutine.
+func (cli *Client) DisableConcurrentDispatch() {
+	if old := cli.dispatcher.Swap(nil); old != nil {
+		old.stop()
+	}
+}
+
+// GetDispatchStats returns metrics about the concurrent event dispatcher.
+// If concurrent dispatch is not enabled, this returns nil.
+func (cli *Client) GetDispatchStats() *DispatchStats {
+	disp := cli.dispatcher.Load()
+	if disp == nil {
+		return nil
+	}
+	stats := &DispatchStats{
+		Workers:       len(disp.queues),
+		QueueDepths:   make([]int, len(disp.queues)),
+		MaxQueueDepth: int(disp.maxQueueDepth.Load()),
+		Dispatched:    disp.dispatched.Load(),
+		Handled:       disp.handled.Load(),
+	}
+	for i, queue := range disp.queues {
+		stats.QueueDepths[i] = len(queue)
+		stats.TotalQueued += stats.QueueDepths[i]
+	}
+	return stats
+}
+
+func (disp *concurrentDispatcher) worker(queue <-chan dispatchItem) {
+	defer disp.wg.Done()
+	for item := range queue {
+		if item.evt == nil {
+			// Items without an event are only used by flush to find out when the queue has been drained
+			item.done <- nil
+			continue
+		}
+		err := disp.cli.callEventHandlers(item.evt)
+		disp.handled.Add(1)
+		if item.done != nil {
+			item.done <- err
+		}
+	}
+}
+
+// dispatch queues the event for the worker responsible for the event's chat. If done is non-nil,
+// the result of the event handlers will be sent to it after they've been called.
+// It returns false if the dispatcher has been stopped, in which case the caller should handle the event itself.
+func (disp *concurrentDispatcher) dispatch(evt any, done chan<- error) bool {
+	queue := disp.queues[disp.queueIndex(evt)]
+
+	disp.lock.RLock()
+	defer disp.lock.RUnlock()
+	if disp.closed {
+		return false
+	}
+	// If the queue is full, this blocks with the read lock held, which also makes stop wait. That's fine as
+	// the workers keep draining the queues until stop closes them, except if stop is called from an event
+	// handler, which is why Enable/DisableConcurrentDispatch must not be called from handlers.
+	queue <- dispatchItem{evt: evt, done: done}
+	disp.dispatched.Add(1)
+	depth := int64(len(queue))
+	for {
+		prevMax := disp.maxQueueDepth.Load()
+		if depth <= prevMax || disp.maxQueueDepth.CompareAndSwap(prevMax, depth) {
+			break
+		}
+	}
+	return true
+}
+
+// queueIndex returns the index of the worker queue that handles the given event.
+func (disp *concurrentDispatcher) queueIndex(evt any) int {
+	var key string
+	if source, ok := getEventMessageSource(evt); ok {
+		key = source.Chat.ToNonAD().String()
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(disp.queues)))
+}
+
+// flush blocks until all events that were queued before the call have been handled, or until the context is done.
+func (disp *concurrentDispatcher) flush(ctx context.Context) error {
+	done := make(chan error, len(disp.queues))
+	disp.lock.RLock()
+	if disp.closed {
+		disp.lock.RUnlock()
+		return nil
+	}
+	for _, queue := range disp.queues {
+		select {
+		case queue <- dispatchItem{done: done}:
+		case <-ctx.Done():
+			disp.lock.RUnlock()
+			return ctx.Err()
+		}
+	}
+	disp.lock.RUnlock()
+	for range disp.queues {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (disp *concurrentDispatcher) stop() {
+	disp.lock.Lock()
+	if !disp.closed {
+		disp.closed = true
+		for _, queue := range disp.queues {
+			close(queue)
+		}
+	}
+	disp.lock.Unlock()
+	disp.wg.Wait()
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+func makeDispatchTestEvent(chat types.JID, id int) *events.Message {
+	return &events.Message{Info: types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: chat, Sender: chat},
+		ID:            types.MessageID(fmt.Sprint(id)),
+	}}
+}
+
+func flushDispatcher(t *testing.T, cli *Client) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cli.dispatcher.Load().flush(ctx); err != nil {
+		t.Fatalf("failed to flush dispatcher: %v", err)
+	}
+}
+
+// findChatsOnDifferentWorkers returns two chats that the dispatcher assigns to different workers.
+func findChatsOnDifferentWorkers(t *testing.T, cli *Client) (types.JID, types.JID) {
+	t.Helper()
+	disp := cli.dispatcher.Load()
+	first := types.NewJID("1000", types.DefaultUserServer)
+	firstIndex := disp.queueIndex(makeDispatchTestEvent(first, 0))
+	for i := 1001; i < 2000; i++ {
+		second := types.NewJID(fmt.Sprint(i), types.DefaultUserServer)
+		if disp.queueIndex(makeDispatchTestEvent(second, 0)) != firstIndex {
+			return first, second
+		}
+	}
+	t.Fatalf("didn't find chats on different workers")
+	return types.EmptyJID, types.EmptyJID
+}
+
+func TestConcurrentDispatch_PerChatOrdering(t *testing.T) {
+	cli := newTestClient(t)
+	cli.EnableConcurrentDispatch(ConcurrentDispatchConfig{Workers: 4})
+	t.Cleanup(cli.DisableConcurrentDispatch)
+
+	var lock sync.Mutex
+	received := make(map[types.JID][]string)
+	cli.AddEventHandler(func(rawEvt any) {
+		evt := rawEvt.(*events.Message)
+		// Vary the handling time, so that unordered handling would show up
+		if len(evt.Info.ID)%2 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		lock.Lock()
+		received[evt.Info.Chat] = append(received[evt.Info.Chat], evt.Info.ID)
+		lock.Unlock()
+	})
+	chats := make([]types.JID, 6)
+	for i := range chats {
+		chats[i] = types.NewJID(fmt.Sprint(1000+i), types.DefaultUserServer)
+	}
+	const perChat = 30
+	for i := 0; i < perChat; i++ {
+		for _, chat := range chats {
+			cli.dispatchEvent(makeDispatchTestEvent(chat, i))
+		}
+	}
+	flushDispatcher(t, cli)
+
+	lock.Lock()
+	defer lock.Unlock()
+	for _, chat := range chats {
+		ids := received[chat]
+		if len(ids) != perChat {
+			t.Fatalf("got %d events in %s, expected %d", len(ids), chat, perChat)
+		}
+		for i, id := range ids {
+			if id != fmt.Sprint(i) {
+				t.Errorf("events in %s were handled out of order: %v", chat, ids)
+				break
+			}
+		}
+	}
+}
+
+func TestConcurrentDispatch_ParallelChats(t *testing.T) {
+	cli := newTestClient(t)
+	cli.EnableConcurrentDispatch(ConcurrentDispatchConfig{Workers: 4})
+	t.Cleanup(cli.DisableConcurrentDispatch)
+	blockedChat, otherChat := findChatsOnDifferentWorkers(t, cli)
+
+	otherHandled := make(chan struct{})
+	cli.AddEventHandler(func(rawEvt any) {
+		evt := rawEvt.(*events.Message)
+		if evt.Info.Chat == otherChat {
+			close(otherHandled)
+			return
+		}
+		// The handler for the first chat only returns after the other chat's event has been handled,
+		// which would never happen if the events were handled one by one.
+		select {
+		case <-otherHandled:
+		case <-time.After(5 * time.Second):
+			t.Errorf("event in other chat wasn't handled while the first chat's handler was running")
+		}
+	})
+	cli.dispatchEvent(makeDispatchTestEvent(blockedChat, 1))
+	cli.dispatchEvent(makeDispatchTestEvent(otherChat, 1))
+	flushDispatcher(t, cli)
+}
+
+func TestGetDispatchStats(t *testing.T) {
+	cli := newTestClient(t)
+	if stats := cli.GetDispatchStats(); stats != nil {
+		t.Errorf("got stats %+v without concurrent dispatch", stats)
+	}
+	cli.EnableConcurrentDispatch(ConcurrentDispatchConfig{Workers: 3, QueueSize: 10})
+	t.Cleanup(cli.DisableConcurrentDispatch)
+	chat := types.NewJID("1000", types.DefaultUserServer)
+	index := cli.dispatcher.Load().queueIndex(makeDispatchTestEvent(chat, 0))
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	cli.AddEventHandler(func(evt any) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+	})
+	for i := 0; i < 4; i++ {
+		cli.dispatchEvent(makeDispatchTestEvent(chat, i))
+	}
+	<-started
+	// The first event is being handled and the other three are waiting in the chat's queue
+	stats := cli.GetDispatchStats()
+	if stats.Workers != 3 || len(stats.QueueDepths) != 3 {
+		t.Fatalf("stats have %d workers and %d queue depths, expected 3", stats.Workers, len(stats.QueueDepths))
+	} else if stats.QueueDepths[index] != 3 || stats.TotalQueued != 3 {
+		t.Errorf("queue depth is %d and total queued is %d, expected 3", stats.QueueDepths[index], stats.TotalQueued)
+	} else if stats.Dispatched != 4 || stats.Handled != 0 {
+		t.Errorf("dispatched %d and handled %d, expected 4 and 0", stats.Dispatched, stats.Handled)
+	} else if stats.MaxQueueDepth < 3 {
+		t.Errorf("max queue depth is %d, expected at least 3", stats.MaxQueueDepth)
+	}
+
+	close(release)
+	flushDispatcher(t, cli)
+	stats = cli.GetDispatchStats()
+	if stats.TotalQueued != 0 || stats.Dispatched != 4 || stats.Handled != 4 {
+		t.Errorf("after handling, total queued is %d, dispatched %d and handled %d", stats.TotalQueued, stats.Dispatched, stats.Handled)
+	}
+
+	cli.DisableConcurrentDispatch()
+	if stats = cli.GetDispatchStats(); stats != nil {
+		t.Errorf("got stats %+v after disabling concurrent dispatch", stats)
+	}
+}
+
+func TestDisableConcurrentDispatch_DrainsQueue(t *testing.T) {
+	cli := newTestClient(t)
+	cli.EnableConcurrentDispatch(ConcurrentDispatchConfig{Workers: 2})
+	var lock sync.Mutex
+	var handled int
+	cli.AddEventHandler(func(evt any) {
+		time.Sleep(time.Millisecond)
+		lock.Lock()
+		handled++
+		lock.Unlock()
+	})
+	for i := 0; i < 20; i++ {
+		cli.dispatchEvent(makeDispatchTestEvent(types.NewJID(fmt.Sprint(1000+i%3), types.DefaultUserServer), i))
+	}
+	cli.DisableConcurrentDispatch()
+	lock.Lock()
+	defer lock.Unlock()
+	if handled != 20 {
+		t.Errorf("%d events were handled before DisableConcurrentDispatch returned, expected 20", handled)
+	}
+}
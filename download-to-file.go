@@ -7,6 +7,7 @@
 package whatsmeow
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -65,7 +66,12 @@ func (cli *Client) DownloadFBToFile(transport *waMediaTransport.WAMediaTransport
 	return cli.DownloadMediaWithPathToFile(transport.GetDirectPath(), transport.GetFileEncSHA256(), transport.GetFileSHA256(), transport.GetMediaKey(), -1, mediaType, mediaTypeToMMSType[mediaType], file)
 }
 
-func (cli *Client) DownloadMediaWithPathToFile(directPath string, encFileHash, fileHash, mediaKey []byte, fileLength int, mediaType MediaType, mmsType string, file File) error {
+func (cli *Client) DownloadMediaWithPathToFile(directPath string, encFileHash, fileHash, mediaKey []byte, fileLength int, mediaType MediaType, mmsType string, file File) (err error) {
+	_, span := cli.startSpan(context.Background(), "whatsmeow.download",
+		TraceAttribute{Key: "media_type", Value: string(mediaType)}, TraceAttribute{Key: "size", Value: fileLength})
+	defer func() {
+		endSpan(span, err)
+	}()
 	mediaConn, err := cli.refreshMediaConn(false)
 	if err != nil {
 		return fmt.Errorf("failed to refresh media connections: %w", err)
@@ -156,6 +162,7 @@ func (cli *Client) downloadMediaToFile(url string, file io.Writer) (int64, []byt
 	}
 	hasher := sha256.New()
 	n, err := io.Copy(file, io.TeeReader(resp.Body, hasher))
+	cli.addCounter(MetricMediaBytes, float64(n), "download")
 	return n, hasher.Sum(nil), err
 }
 
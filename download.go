@@ -7,6 +7,7 @@
 package whatsmeow
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -230,6 +231,11 @@ func (cli *Client) DownloadFB(transport *waMediaTransport.WAMediaTransport_Integ
 
 // DownloadMediaWithPath downloads an attachment by manually specifying the path and encryption details.
 func (cli *Client) DownloadMediaWithPath(directPath string, encFileHash, fileHash, mediaKey []byte, fileLength int, mediaType MediaType, mmsType string) (data []byte, err error) {
+	_, span := cli.startSpan(context.Background(), "whatsmeow.download",
+		TraceAttribute{Key: "media_type", Value: string(mediaType)}, TraceAttribute{Key: "size", Value: fileLength})
+	defer func() {
+		endSpan(span, err)
+	}()
 	var mediaConn *MediaConn
 	mediaConn, err = cli.refreshMediaConn(false)
 	if err != nil {
@@ -336,6 +342,7 @@ func (cli *Client) downloadMedia(url string) ([]byte, error) {
 	}
 	data, err := io.ReadAll(resp.Body)
 	_ = resp.Body.Close()
+	cli.addCounter(MetricMediaBytes, float64(len(data)), "download")
 	return data, err
 }
 
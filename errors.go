@@ -23,6 +23,8 @@ var (
 	ErrMessageTimedOut = errors.New("timed out waiting for message send response")
 
 	ErrAlreadyConnected = errors.New("websocket is already connected")
+	// ErrClientShuttingDown is returned when trying to send messages while Client.Shutdown is in progress.
+	ErrClientShuttingDown = errors.New("client is shutting down")
 
 	ErrQRAlreadyConnected = errors.New("GetQRChannel must be called before connecting")
 	ErrQRStoreContainsID  = errors.New("GetQRChannel can only be called when there's no user ID in the client's Store")
@@ -10,6 +10,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	waBinary "github.com/Romerito007/whatsmeow/binary"
@@ -92,7 +93,7 @@ func (cli *Client) CreateGroup(req ReqCreateGroup) (*types.GroupInfo, error) {
 	if !ok {
 		return nil, &ElementMissingError{Tag: "group", In: "response to create group query"}
 	}
-	return cli.parseGroupNode(&groupNode)
+	return cli.parseGroupNodeAndLIDs(&groupNode)
 }
 
 // UnlinkGroup removes a child group from a parent community.
@@ -385,7 +386,7 @@ func (cli *Client) GetGroupInfoFromInvite(jid, inviter types.JID, code string, e
 	if !ok {
 		return nil, &ElementMissingError{Tag: "group", In: "response to invite group info query"}
 	}
-	return cli.parseGroupNode(&groupNode)
+	return cli.parseGroupNodeAndLIDs(&groupNode)
 }
 
 // JoinGroupWithInvite joins a group using an invite message.
@@ -422,7 +423,7 @@ func (cli *Client) GetGroupInfoFromLink(code string) (*types.GroupInfo, error) {
 	if !ok {
 		return nil, &ElementMissingError{Tag: "group", In: "response to group link info query"}
 	}
-	return cli.parseGroupNode(&groupNode)
+	return cli.parseGroupNodeAndLIDs(&groupNode)
 }
 
 // JoinGroupWithLink joins the group using the given invite link.
@@ -473,12 +474,18 @@ func (cli *Client) GetJoinedGroups() ([]*types.GroupInfo, error) {
 			cli.Log.Debugf("Unexpected child in group list response: %s", child.XMLString())
 			continue
 		}
-		parsed, parseErr := cli.parseGroupNode(&child)
+		parsed, parseErr := cli.parseGroupNodeAndLIDs(&child)
 		if parseErr != nil {
 			cli.Log.Warnf("Error parsing group %s: %v", parsed.JID, parseErr)
 		}
 		infos = append(infos, parsed)
 	}
+	if cli.Store.Groups != nil {
+		err = cli.Store.Groups.PutGroups(infos)
+		if err != nil {
+			cli.Log.Errorf("Failed to store joined groups in group store: %v", err)
+		}
+	}
 	return infos, nil
 }
 
@@ -523,7 +530,11 @@ func (cli *Client) GetGroupInfo(jid types.JID) (*types.GroupInfo, error) {
 	return cli.getGroupInfo(context.TODO(), jid, true)
 }
 
-func (cli *Client) getGroupInfo(ctx context.Context, jid types.JID, lockParticipantCache bool) (*types.GroupInfo, error) {
+func (cli *Client) getGroupInfo(ctx context.Context, jid types.JID, lockParticipantCache bool) (groupInfo *types.GroupInfo, err error) {
+	ctx, span := cli.startSpan(ctx, "whatsmeow.get_group_info", TraceAttribute{Key: "jid", Value: jid.String()})
+	defer func() {
+		endSpan(span, err)
+	}()
 	res, err := cli.sendGroupIQ(ctx, iqGet, jid, waBinary.Node{
 		Tag:   "query",
 		Attrs: waBinary.Attrs{"request": "interactive"},
@@ -540,34 +551,72 @@ func (cli *Client) getGroupInfo(ctx context.Context, jid types.JID, lockParticip
 	if !ok {
 		return nil, &ElementMissingError{Tag: "groups", In: "response to group info query"}
 	}
-	groupInfo, err := cli.parseGroupNode(&groupNode)
+	groupInfo, err = cli.parseGroupNodeAndLIDs(&groupNode)
 	if err != nil {
 		return groupInfo, err
 	}
+	cli.storeGroupInfo(groupInfo)
 	if lockParticipantCache {
 		cli.groupParticipantsCacheLock.Lock()
 		defer cli.groupParticipantsCacheLock.Unlock()
 	}
-	participants := make([]types.JID, len(groupInfo.Participants))
-	for i, part := range groupInfo.Participants {
+	cli.groupParticipantsCache[jid] = groupParticipantJIDs(groupInfo)
+	return groupInfo, nil
+}
+
+func groupParticipantJIDs(info *types.GroupInfo) []types.JID {
+	participants := make([]types.JID, len(info.Participants))
+	for i, part := range info.Participants {
 		participants[i] = part.JID
 	}
-	cli.groupParticipantsCache[jid] = participants
-	return groupInfo, nil
+	return participants
 }
 
 func (cli *Client) getGroupMembers(ctx context.Context, jid types.JID) ([]types.JID, error) {
 	cli.groupParticipantsCacheLock.Lock()
 	defer cli.groupParticipantsCacheLock.Unlock()
-	if _, ok := cli.groupParticipantsCache[jid]; !ok {
-		_, err := cli.getGroupInfo(ctx, jid, false)
+	if _, ok := cli.groupParticipantsCache[jid]; ok {
+		return cli.groupParticipantsCache[jid], nil
+	}
+	if cli.Store.Groups != nil {
+		storedInfo, err := cli.Store.Groups.GetGroup(jid)
 		if err != nil {
-			return nil, err
+			cli.Log.Warnf("Failed to get %s from group store: %v", jid, err)
+		} else if storedInfo != nil {
+			cli.groupParticipantsCache[jid] = groupParticipantJIDs(storedInfo)
+			return cli.groupParticipantsCache[jid], nil
 		}
 	}
+	_, err := cli.getGroupInfo(ctx, jid, false)
+	if err != nil {
+		return nil, err
+	}
 	return cli.groupParticipantsCache[jid], nil
 }
 
+// invalidateGroupParticipantCache removes the given group from both the in-memory participant cache and the group store.
+func (cli *Client) invalidateGroupParticipantCache(jid types.JID) {
+	cli.groupParticipantsCacheLock.Lock()
+	delete(cli.groupParticipantsCache, jid)
+	cli.groupParticipantsCacheLock.Unlock()
+	if cli.Store.Groups != nil {
+		err := cli.Store.Groups.DeleteGroup(jid)
+		if err != nil {
+			cli.Log.Errorf("Failed to delete %s from group store: %v", jid, err)
+		}
+	}
+}
+
+func (cli *Client) storeGroupInfo(info *types.GroupInfo) {
+	if cli.Store.Groups == nil {
+		return
+	}
+	err := cli.Store.Groups.PutGroup(info)
+	if err != nil {
+		cli.Log.Errorf("Failed to store info of %s in group store: %v", info.JID, err)
+	}
+}
+
 func parseParticipant(childAG *waBinary.AttrUtility, child *waBinary.Node) types.GroupParticipant {
 	pcpType := childAG.OptionalString("type")
 	participant := types.GroupParticipant{
@@ -575,11 +624,14 @@ func parseParticipant(childAG *waBinary.AttrUtility, child *waBinary.Node) types
 		IsSuperAdmin: pcpType == "superadmin",
 		JID:          childAG.JID("jid"),
 		LID:          childAG.OptionalJIDOrEmpty("lid"),
+		PhoneNumber:  childAG.OptionalJIDOrEmpty("phone_number"),
 		DisplayName:  childAG.OptionalString("display_name"),
 	}
 	if participant.JID.Server == types.HiddenUserServer && participant.LID.IsEmpty() {
 		participant.LID = participant.JID
 		//participant.JID = types.EmptyJID
+	} else if participant.JID.Server == types.DefaultUserServer && participant.PhoneNumber.IsEmpty() {
+		participant.PhoneNumber = participant.JID
 	}
 	if errorCode := childAG.OptionalInt("error"); errorCode != 0 {
 		participant.Error = errorCode
@@ -595,6 +647,16 @@ func parseParticipant(childAG *waBinary.AttrUtility, child *waBinary.Node) types
 	return participant
 }
 
+// parseGroupNodeAndLIDs parses a group node from a response to a query, stores the LID mappings of the participants
+// and fills in the participant addresses that are known from the LID store.
+func (cli *Client) parseGroupNodeAndLIDs(groupNode *waBinary.Node) (*types.GroupInfo, error) {
+	info, err := cli.parseGroupNode(groupNode)
+	if info != nil {
+		cli.handleGroupParticipantLIDs(info.Participants)
+	}
+	return info, err
+}
+
 func (cli *Client) parseGroupNode(groupNode *waBinary.Node) (*types.GroupInfo, error) {
 	var group types.GroupInfo
 	ag := groupNode.AttrGetter()
@@ -653,7 +715,6 @@ func (cli *Client) parseGroupNode(groupNode *waBinary.Node) (*types.GroupInfo, e
 			cli.Log.Warnf("Possibly failed to parse %s element in group node: %+v", child.Tag, childAG.Errors)
 		}
 	}
-
 	return &group, ag.Error()
 }
 
@@ -676,6 +737,12 @@ func parseGroupLinkTargetNode(groupNode *waBinary.Node) (types.GroupLinkTarget,
 }
 
 func parseParticipantList(node *waBinary.Node) (participants []types.JID) {
+	return parseParticipantListWithAlts(node, nil)
+}
+
+// parseParticipantListWithAlts parses a participant list and adds the alternative addresses
+// of the participants (if the server included them) to the given map.
+func parseParticipantListWithAlts(node *waBinary.Node, alts map[types.JID]types.JID) (participants []types.JID) {
 	children := node.GetChildren()
 	participants = make([]types.JID, 0, len(children))
 	for _, child := range children {
@@ -684,6 +751,19 @@ func parseParticipantList(node *waBinary.Node) (participants []types.JID) {
 			continue
 		}
 		participants = append(participants, jid)
+		if alts == nil {
+			continue
+		}
+		ag := child.AttrGetter()
+		var alt types.JID
+		if jid.Server == types.HiddenUserServer {
+			alt = ag.OptionalJIDOrEmpty("phone_number")
+		} else {
+			alt = ag.OptionalJIDOrEmpty("lid")
+		}
+		if !alt.IsEmpty() {
+			alts[jid] = alt
+		}
 	}
 	return
 }
@@ -716,6 +796,18 @@ func (cli *Client) parseGroupChange(node *waBinary.Node) (*events.GroupInfo, err
 	if !ag.OK() {
 		return nil, fmt.Errorf("group change doesn't contain required attributes: %w", ag.Error())
 	}
+	evt.AltJIDs = make(map[types.JID]types.JID)
+	if evt.Sender != nil {
+		var senderAlt types.JID
+		if evt.Sender.Server == types.HiddenUserServer {
+			senderAlt = ag.OptionalJIDOrEmpty("participant_pn")
+		} else {
+			senderAlt = ag.OptionalJIDOrEmpty("participant_lid")
+		}
+		if !senderAlt.IsEmpty() {
+			evt.AltJIDs[*evt.Sender] = senderAlt
+		}
+	}
 
 	for _, child := range node.GetChildren() {
 		cag := child.AttrGetter()
@@ -726,13 +818,18 @@ func (cli *Client) parseGroupChange(node *waBinary.Node) (*events.GroupInfo, err
 		switch child.Tag {
 		case "add":
 			evt.JoinReason = cag.OptionalString("reason")
-			evt.Join = parseParticipantList(&child)
+			evt.Join = parseParticipantListWithAlts(&child, evt.AltJIDs)
+			for _, pcpNode := range child.GetChildren() {
+				if _, ok := pcpNode.Attrs["jid"].(types.JID); pcpNode.Tag == "participant" && ok {
+					evt.JoinParticipants = append(evt.JoinParticipants, parseParticipant(pcpNode.AttrGetter(), &pcpNode))
+				}
+			}
 		case "remove":
-			evt.Leave = parseParticipantList(&child)
+			evt.Leave = parseParticipantListWithAlts(&child, evt.AltJIDs)
 		case "promote":
-			evt.Promote = parseParticipantList(&child)
+			evt.Promote = parseParticipantListWithAlts(&child, evt.AltJIDs)
 		case "demote":
-			evt.Demote = parseParticipantList(&child)
+			evt.Demote = parseParticipantListWithAlts(&child, evt.AltJIDs)
 		case "locked":
 			evt.Locked = &types.GroupLocked{IsLocked: true}
 		case "unlocked":
@@ -829,7 +926,106 @@ func (cli *Client) parseGroupChange(node *waBinary.Node) (*events.GroupInfo, err
 	return &evt, nil
 }
 
+// applyGroupInfoChange updates the given group info with the changes in a group change notification.
+func applyGroupInfoChange(info *types.GroupInfo, evt *events.GroupInfo) {
+	if evt.Name != nil {
+		info.GroupName = *evt.Name
+	}
+	if evt.Topic != nil {
+		info.GroupTopic = *evt.Topic
+	}
+	if evt.Locked != nil {
+		info.GroupLocked = *evt.Locked
+	}
+	if evt.Announce != nil {
+		info.GroupAnnounce = *evt.Announce
+	}
+	if evt.Ephemeral != nil {
+		info.GroupEphemeral = *evt.Ephemeral
+	}
+	if evt.MembershipApprovalMode != nil {
+		info.GroupMembershipApprovalMode = *evt.MembershipApprovalMode
+	}
+	if evt.ParticipantVersionID != "" {
+		info.ParticipantVersionID = evt.ParticipantVersionID
+	}
+Outer:
+	for _, jid := range evt.Join {
+		for _, existing := range info.Participants {
+			if existing.JID == jid {
+				continue Outer
+			}
+		}
+		info.Participants = append(info.Participants, getJoinedParticipant(evt, jid))
+	}
+	for _, jid := range evt.Leave {
+		for i, existing := range info.Participants {
+			if existing.JID == jid {
+				info.Participants = append(info.Participants[:i], info.Participants[i+1:]...)
+				break
+			}
+		}
+	}
+	for i, participant := range info.Participants {
+		if slices.Contains(evt.Promote, participant.JID) {
+			info.Participants[i].IsAdmin = true
+		} else if slices.Contains(evt.Demote, participant.JID) {
+			info.Participants[i].IsAdmin = false
+			info.Participants[i].IsSuperAdmin = false
+		}
+	}
+}
+
+// getJoinedParticipant returns the participant info of a user who joined the group in the given change,
+// with the alternative address filled in the same way as in group info fetched from the server.
+func getJoinedParticipant(evt *events.GroupInfo, jid types.JID) types.GroupParticipant {
+	participant := types.GroupParticipant{JID: jid}
+	for _, joined := range evt.JoinParticipants {
+		if joined.JID == jid {
+			participant = joined
+			break
+		}
+	}
+	alt := evt.AltJIDs[jid]
+	switch jid.Server {
+	case types.HiddenUserServer:
+		participant.LID = jid
+		if participant.PhoneNumber.IsEmpty() {
+			participant.PhoneNumber = alt
+		}
+	case types.DefaultUserServer:
+		participant.PhoneNumber = jid
+		if participant.LID.IsEmpty() {
+			participant.LID = alt
+		}
+	}
+	return participant
+}
+
+// updateStoredGroupInfo applies a group change notification to the group store.
+func (cli *Client) updateStoredGroupInfo(evt *events.GroupInfo) {
+	if cli.Store.Groups == nil {
+		return
+	}
+	ownID := cli.getOwnID().ToNonAD()
+	var err error
+	if evt.Delete != nil || slices.Contains(evt.Leave, ownID) {
+		err = cli.Store.Groups.DeleteGroup(evt.JID)
+	} else {
+		var info *types.GroupInfo
+		info, err = cli.Store.Groups.GetGroup(evt.JID)
+		if err == nil && info != nil {
+			applyGroupInfoChange(info, evt)
+			err = cli.Store.Groups.PutGroup(info)
+		}
+	}
+	if err != nil {
+		cli.Log.Errorf("Failed to update %s in group store: %v", evt.JID, err)
+	}
+}
+
 func (cli *Client) updateGroupParticipantCache(evt *events.GroupInfo) {
+	cli.updateStoredGroupInfo(evt)
 	if len(evt.Join) == 0 && len(evt.Leave) == 0 {
 		return
 	}
@@ -863,12 +1059,19 @@ Outer:
 func (cli *Client) parseGroupNotification(node *waBinary.Node) (interface{}, error) {
 	children := node.GetChildren()
 	if len(children) == 1 && children[0].Tag == "create" {
-		return cli.parseGroupCreate(&children[0])
+		joinedGroup, err := cli.parseGroupCreate(&children[0])
+		if err != nil {
+			return nil, err
+		}
+		cli.handleGroupParticipantLIDs(joinedGroup.Participants)
+		cli.storeGroupInfo(&joinedGroup.GroupInfo)
+		return joinedGroup, nil
 	} else {
 		groupChange, err := cli.parseGroupChange(node)
 		if err != nil {
 			return nil, err
 		}
+		cli.handleGroupChangeLIDs(groupChange)
 		cli.updateGroupParticipantCache(groupChange)
 		return groupChange, nil
 	}
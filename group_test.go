@@ -0,0 +1,115 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var testGroupJID = types.NewJID("123456789", types.GroupServer)
+
+func TestGroupChangeJoinKeepsParticipantInfo(t *testing.T) {
+	cli := newTestClient(t)
+	err := cli.Store.Groups.PutGroup(&types.GroupInfo{
+		JID:          testGroupJID,
+		Participants: []types.GroupParticipant{{JID: testLID3, LID: testLID3, PhoneNumber: testPN3, IsSuperAdmin: true, IsAdmin: true}},
+	})
+	if err != nil {
+		t.Fatalf("failed to store group: %v", err)
+	}
+	for _, mapping := range [][2]types.JID{{testLID2, testPN2}, {testLID3, testPN3}} {
+		err = cli.Store.LIDs.PutLIDMapping(mapping[0], mapping[1])
+		if err != nil {
+			t.Fatalf("failed to store mapping: %v", err)
+		}
+	}
+	_, err = cli.parseGroupNotification(&waBinary.Node{
+		Tag:   "notification",
+		Attrs: waBinary.Attrs{"from": testGroupJID, "participant": testLID3, "t": "1700000000"},
+		Content: []waBinary.Node{{
+			Tag:   "add",
+			Attrs: waBinary.Attrs{"prev_v_id": "1", "v_id": "2"},
+			Content: []waBinary.Node{
+				{Tag: "participant", Attrs: waBinary.Attrs{"jid": testLID1, "phone_number": testPN1, "type": "admin", "display_name": "One"}},
+				{Tag: "participant", Attrs: waBinary.Attrs{"jid": testLID2}},
+				{Tag: "participant", Attrs: waBinary.Attrs{"jid": testPN3}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse group notification: %v", err)
+	}
+	info, err := cli.Store.Groups.GetGroup(testGroupJID)
+	if err != nil || info == nil {
+		t.Fatalf("failed to get group: %v", err)
+	}
+	// The participants must look the same as if the group info was fetched from the server
+	expected := []types.GroupParticipant{
+		{JID: testLID3, LID: testLID3, PhoneNumber: testPN3, IsSuperAdmin: true, IsAdmin: true},
+		{JID: testLID1, LID: testLID1, PhoneNumber: testPN1, IsAdmin: true, DisplayName: "One"},
+		{JID: testLID2, LID: testLID2, PhoneNumber: testPN2},
+		{JID: testPN3, LID: testLID3, PhoneNumber: testPN3},
+	}
+	if len(info.Participants) != len(expected) {
+		t.Fatalf("got %d participants, expected %d", len(info.Participants), len(expected))
+	}
+	for i, participant := range info.Participants {
+		if participant.JID != expected[i].JID || participant.LID != expected[i].LID ||
+			participant.PhoneNumber != expected[i].PhoneNumber || participant.IsAdmin != expected[i].IsAdmin ||
+			participant.IsSuperAdmin != expected[i].IsSuperAdmin || participant.DisplayName != expected[i].DisplayName {
+			t.Errorf("participant #%d is %+v, expected %+v", i+1, participant, expected[i])
+		}
+	}
+	if info.ParticipantVersionID != "2" {
+		t.Errorf("participant version is %q, expected 2", info.ParticipantVersionID)
+	}
+}
+
+func TestGetGroupMembers_Fallback(t *testing.T) {
+	cli := newTestClient(t)
+	ctx := context.Background()
+
+	// The client isn't connected, so anything that isn't in the cache or the store fails with ErrNotConnected
+	_, err := cli.getGroupMembers(ctx, testGroupJID)
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("expected fetching unknown group to go to the server, got %v", err)
+	}
+
+	err = cli.Store.Groups.PutGroup(&types.GroupInfo{
+		JID:          testGroupJID,
+		Participants: []types.GroupParticipant{{JID: testPN1}, {JID: testLID2, LID: testLID2}},
+	})
+	if err != nil {
+		t.Fatalf("failed to store group: %v", err)
+	}
+	members, err := cli.getGroupMembers(ctx, testGroupJID)
+	if err != nil {
+		t.Fatalf("failed to get members from store: %v", err)
+	} else if len(members) != 2 || members[0] != testPN1 || members[1] != testLID2 {
+		t.Errorf("unexpected members from store: %v", members)
+	}
+
+	// The members are cached in memory after the first store lookup
+	err = cli.Store.Groups.DeleteGroup(testGroupJID)
+	if err != nil {
+		t.Fatalf("failed to delete group: %v", err)
+	}
+	if members, err = cli.getGroupMembers(ctx, testGroupJID); err != nil || len(members) != 2 {
+		t.Errorf("expected cached members, got %v, %v", members, err)
+	}
+
+	// Invalidating the cache makes the next call go to the server again
+	cli.invalidateGroupParticipantCache(testGroupJID)
+	if _, err = cli.getGroupMembers(ctx, testGroupJID); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected fetching invalidated group to go to the server, got %v", err)
+	}
+}
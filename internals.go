@@ -69,16 +69,16 @@ func (int *DangerousInternalClient) SendRetryReceipt(node *waBinary.Node, info *
 	int.c.sendRetryReceipt(node, info, forceIncludeIdentity)
 }
 
-func (int *DangerousInternalClient) EncryptMessageForDevice(plaintext []byte, to types.JID, bundle *prekey.Bundle, extraAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
-	return int.c.encryptMessageForDevice(plaintext, to, bundle, extraAttrs)
+func (int *DangerousInternalClient) EncryptMessageForDevice(ctx context.Context, plaintext []byte, to types.JID, bundle *prekey.Bundle, extraAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
+	return int.c.encryptMessageForDevice(ctx, plaintext, to, bundle, extraAttrs)
 }
 
 func (int *DangerousInternalClient) GetOwnID() types.JID {
 	return int.c.getOwnID()
 }
 
-func (int *DangerousInternalClient) DecryptDM(child *waBinary.Node, from types.JID, isPreKey bool) ([]byte, error) {
-	return int.c.decryptDM(child, from, isPreKey)
+func (int *DangerousInternalClient) DecryptDM(ctx context.Context, child *waBinary.Node, from types.JID, isPreKey bool) ([]byte, error) {
+	return int.c.decryptDM(ctx, child, from, isPreKey)
 }
 
 func (int *DangerousInternalClient) MakeDeviceIdentityNode() waBinary.Node {
@@ -39,13 +39,14 @@ func (cli *Client) keepAliveLoop(ctx context.Context) {
 				return
 			} else if !isSuccess {
 				errorCount++
+				cli.addCounter(MetricKeepAliveFailures, 1)
 				go cli.dispatchEvent(&events.KeepAliveTimeout{
 					ErrorCount:  errorCount,
 					LastSuccess: lastSuccess,
 				})
 				if cli.EnableAutoReconnect && time.Since(lastSuccess) > KeepAliveMaxFailTime {
 					cli.Log.Debugf("Forcing reconnect due to keepalive failure")
-					cli.Disconnect()
+					cli.disconnectWithReason("keepalive timed out")
 					go cli.autoReconnect()
 				}
 			} else {
@@ -0,0 +1,294 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"errors"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/proto/waHistorySync"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// ErrNoLIDStore is returned by the LID mapping functions if the device store doesn't have a LIDStore.
+var ErrNoLIDStore = errors.New("device store doesn't have a LID store")
+
+// GetPNForLID returns the phone number JID corresponding to the given hidden user (LID) JID.
+//
+// The device ID of the input JID is preserved in the output. If the mapping isn't known, an empty JID is returned.
+func (cli *Client) GetPNForLID(lid types.JID) (types.JID, error) {
+	if cli.Store.LIDs == nil {
+		return types.EmptyJID, ErrNoLIDStore
+	}
+	pn, err := cli.Store.LIDs.GetPNForLID(lid.ToNonAD())
+	if err != nil || pn.IsEmpty() {
+		return types.EmptyJID, err
+	}
+	pn.Device = lid.Device
+	return pn, nil
+}
+
+// GetLIDForPN returns the hidden user (LID) JID corresponding to the given phone number JID.
+//
+// The device ID of the input JID is preserved in the output. If the mapping isn't known, an empty JID is returned.
+func (cli *Client) GetLIDForPN(pn types.JID) (types.JID, error) {
+	if cli.Store.LIDs == nil {
+		return types.EmptyJID, ErrNoLIDStore
+	}
+	lid, err := cli.Store.LIDs.GetLIDForPN(pn.ToNonAD())
+	if err != nil || lid.IsEmpty() {
+		return types.EmptyJID, err
+	}
+	lid.Device = pn.Device
+	return lid, nil
+}
+
+// GetPNsForLIDs returns the phone number JIDs corresponding to the given hidden user (LID) JIDs.
+//
+// The returned map is keyed by the input JIDs and only contains the mappings that are known.
+func (cli *Client) GetPNsForLIDs(lids []types.JID) (map[types.JID]types.JID, error) {
+	if cli.Store.LIDs == nil {
+		return nil, ErrNoLIDStore
+	}
+	return resolveManyLIDMappings(lids, cli.Store.LIDs.GetManyPNsForLIDs)
+}
+
+// GetLIDsForPNs returns the hidden user (LID) JIDs corresponding to the given phone number JIDs.
+//
+// The returned map is keyed by the input JIDs and only contains the mappings that are known.
+func (cli *Client) GetLIDsForPNs(pns []types.JID) (map[types.JID]types.JID, error) {
+	if cli.Store.LIDs == nil {
+		return nil, ErrNoLIDStore
+	}
+	return resolveManyLIDMappings(pns, cli.Store.LIDs.GetManyLIDsForPNs)
+}
+
+func resolveManyLIDMappings(jids []types.JID, getMany func([]types.JID) (map[types.JID]types.JID, error)) (map[types.JID]types.JID, error) {
+	nonAD := make([]types.JID, len(jids))
+	for i, jid := range jids {
+		nonAD[i] = jid.ToNonAD()
+	}
+	mappings, err := getMany(nonAD)
+	if err != nil {
+		return nil, err
+	}
+	output := make(map[types.JID]types.JID, len(mappings))
+	for _, jid := range jids {
+		mapped, ok := mappings[jid.ToNonAD()]
+		if ok {
+			mapped.Device = jid.Device
+			output[jid] = mapped
+		}
+	}
+	return output, nil
+}
+
+func (cli *Client) storeLIDMappings(mappings []store.LIDMapping) {
+	if cli.Store.LIDs == nil || len(mappings) == 0 {
+		return
+	}
+	filtered := make([]store.LIDMapping, 0, len(mappings))
+	for _, mapping := range mappings {
+		if mapping.LID.Server == types.HiddenUserServer && mapping.PN.Server == types.DefaultUserServer {
+			filtered = append(filtered, store.LIDMapping{LID: mapping.LID.ToNonAD(), PN: mapping.PN.ToNonAD()})
+		}
+	}
+	if len(filtered) == 0 {
+		return
+	}
+	err := cli.Store.LIDs.PutManyLIDMappings(filtered)
+	if err != nil {
+		cli.Log.Errorf("Failed to store %d LID mappings: %v", len(filtered), err)
+	}
+}
+
+func (cli *Client) storeLIDMapping(first, second types.JID) {
+	if first.IsEmpty() || second.IsEmpty() {
+		return
+	} else if first.Server == types.HiddenUserServer {
+		cli.storeLIDMappings([]store.LIDMapping{{LID: first, PN: second}})
+	} else {
+		cli.storeLIDMappings([]store.LIDMapping{{LID: second, PN: first}})
+	}
+}
+
+// handleGroupParticipantLIDs stores the LID mappings included in a group participant list and fills in the LID
+// and PhoneNumber fields of participants whose other address wasn't included, but is known from the LID store.
+func (cli *Client) handleGroupParticipantLIDs(participants []types.GroupParticipant) {
+	mappings := make([]store.LIDMapping, 0, len(participants))
+	var missingPNs, missingLIDs []types.JID
+	for _, participant := range participants {
+		if !participant.LID.IsEmpty() && !participant.PhoneNumber.IsEmpty() {
+			mappings = append(mappings, store.LIDMapping{LID: participant.LID, PN: participant.PhoneNumber})
+		} else if !participant.LID.IsEmpty() {
+			missingPNs = append(missingPNs, participant.LID)
+		} else if !participant.PhoneNumber.IsEmpty() {
+			missingLIDs = append(missingLIDs, participant.PhoneNumber)
+		}
+	}
+	cli.storeLIDMappings(mappings)
+	if cli.Store.LIDs == nil || (len(missingPNs) == 0 && len(missingLIDs) == 0) {
+		return
+	}
+	pns, err := cli.GetPNsForLIDs(missingPNs)
+	if err != nil {
+		cli.Log.Warnf("Failed to get phone numbers of group participants: %v", err)
+	}
+	lids, err := cli.GetLIDsForPNs(missingLIDs)
+	if err != nil {
+		cli.Log.Warnf("Failed to get LIDs of group participants: %v", err)
+	}
+	for i, participant := range participants {
+		if participant.PhoneNumber.IsEmpty() && !participant.LID.IsEmpty() {
+			participants[i].PhoneNumber = pns[participant.LID]
+		} else if participant.LID.IsEmpty() && !participant.PhoneNumber.IsEmpty() {
+			participants[i].LID = lids[participant.PhoneNumber]
+		}
+	}
+}
+
+// handleGroupChangeLIDs stores the LID mappings included in a group change notification and adds the alternative
+// addresses of the other users in the notification to AltJIDs if they're known from the LID store.
+func (cli *Client) handleGroupChangeLIDs(evt *events.GroupInfo) {
+	mappings := make([]store.LIDMapping, 0, len(evt.AltJIDs))
+	for jid, alt := range evt.AltJIDs {
+		if jid.Server == types.HiddenUserServer {
+			mappings = append(mappings, store.LIDMapping{LID: jid, PN: alt})
+		} else {
+			mappings = append(mappings, store.LIDMapping{LID: alt, PN: jid})
+		}
+	}
+	cli.storeLIDMappings(mappings)
+	if cli.Store.LIDs == nil {
+		return
+	}
+	var missingPNs, missingLIDs []types.JID
+	addMissing := func(jid types.JID) {
+		if _, ok := evt.AltJIDs[jid]; ok {
+			return
+		} else if jid.Server == types.HiddenUserServer {
+			missingPNs = append(missingPNs, jid)
+		} else if jid.Server == types.DefaultUserServer {
+			missingLIDs = append(missingLIDs, jid)
+		}
+	}
+	if evt.Sender != nil {
+		addMissing(*evt.Sender)
+	}
+	for _, list := range [][]types.JID{evt.Join, evt.Leave, evt.Promote, evt.Demote} {
+		for _, jid := range list {
+			addMissing(jid)
+		}
+	}
+	for _, lookup := range []struct {
+		jids []types.JID
+		get  func([]types.JID) (map[types.JID]types.JID, error)
+	}{{missingPNs, cli.GetPNsForLIDs}, {missingLIDs, cli.GetLIDsForPNs}} {
+		if len(lookup.jids) == 0 {
+			continue
+		}
+		found, err := lookup.get(lookup.jids)
+		if err != nil {
+			cli.Log.Warnf("Failed to get alternative addresses of users in group change of %s: %v", evt.JID, err)
+			continue
+		}
+		if evt.AltJIDs == nil {
+			evt.AltJIDs = make(map[types.JID]types.JID, len(found))
+		}
+		for jid, alt := range found {
+			evt.AltJIDs[jid] = alt
+		}
+	}
+}
+
+func (cli *Client) storeUsyncLIDMapping(jid types.JID, user *waBinary.Node) types.JID {
+	lidNode, ok := user.GetOptionalChildByTag("lid")
+	if !ok {
+		return types.EmptyJID
+	}
+	lid := lidNode.AttrGetter().OptionalJIDOrEmpty("val")
+	if lid.Server == types.HiddenUserServer && jid.Server == types.DefaultUserServer {
+		cli.storeLIDMapping(lid, jid)
+	}
+	return lid
+}
+
+func (cli *Client) storeHistoricalLIDMappings(historySync *waHistorySync.HistorySync) {
+	var mappings []store.LIDMapping
+	for _, mapping := range historySync.GetPhoneNumberToLidMappings() {
+		lid, _ := types.ParseJID(mapping.GetLidJID())
+		pn, _ := types.ParseJID(mapping.GetPnJID())
+		mappings = append(mappings, store.LIDMapping{LID: lid, PN: pn})
+	}
+	for _, conv := range historySync.GetConversations() {
+		chatJID, _ := types.ParseJID(conv.GetId())
+		switch chatJID.Server {
+		case types.HiddenUserServer:
+			pn, _ := types.ParseJID(conv.GetPnJID())
+			mappings = append(mappings, store.LIDMapping{LID: chatJID, PN: pn})
+		case types.DefaultUserServer:
+			lid, _ := types.ParseJID(conv.GetLidJID())
+			mappings = append(mappings, store.LIDMapping{LID: lid, PN: chatJID})
+		}
+	}
+	if len(mappings) > 0 {
+		cli.Log.Debugf("Storing up to %d LID mappings from history sync", len(mappings))
+		cli.storeLIDMappings(mappings)
+	}
+}
+
+// fillSenderAlt finds the alternative address of the message sender, either from the attributes of the
+// message node or from the LID store, and stores any newly learned mappings.
+//
+// This is called for every incoming message, receipt and chat state, so the LID store must be able to answer
+// lookups quickly, including lookups of unknown mappings (the sqlstore caches both hits and misses in memory).
+func (cli *Client) fillSenderAlt(source *types.MessageSource, ag *waBinary.AttrUtility) {
+	switch source.Sender.Server {
+	case types.HiddenUserServer:
+		if source.IsGroup {
+			source.SenderAlt = ag.OptionalJIDOrEmpty("participant_pn")
+		} else {
+			source.SenderAlt = ag.OptionalJIDOrEmpty("sender_pn")
+		}
+	case types.DefaultUserServer:
+		if source.IsGroup {
+			source.SenderAlt = ag.OptionalJIDOrEmpty("participant_lid")
+		} else {
+			source.SenderAlt = ag.OptionalJIDOrEmpty("sender_lid")
+		}
+	default:
+		return
+	}
+	if !source.SenderAlt.IsEmpty() {
+		cli.storeLIDMapping(source.Sender, source.SenderAlt)
+		source.SenderAlt.Device = source.Sender.Device
+	} else {
+		source.SenderAlt = cli.getAltJID(source.Sender)
+	}
+}
+
+// getAltJID returns the alternative address of the given user from the LID store,
+// or an empty JID if the mapping isn't known.
+func (cli *Client) getAltJID(jid types.JID) types.JID {
+	if cli.Store.LIDs == nil {
+		return types.EmptyJID
+	}
+	var alt types.JID
+	var err error
+	switch jid.Server {
+	case types.HiddenUserServer:
+		alt, err = cli.GetPNForLID(jid)
+	case types.DefaultUserServer:
+		alt, err = cli.GetLIDForPN(jid)
+	}
+	if err != nil {
+		cli.Log.Warnf("Failed to get alternative address of %s: %v", jid, err)
+	}
+	return alt
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"testing"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+var (
+	testLID1 = types.NewJID("100", types.HiddenUserServer)
+	testPN1  = types.NewJID("1111", types.DefaultUserServer)
+	testLID2 = types.NewJID("200", types.HiddenUserServer)
+	testPN2  = types.NewJID("2222", types.DefaultUserServer)
+	testLID3 = types.NewJID("300", types.HiddenUserServer)
+	testPN3  = types.NewJID("3333", types.DefaultUserServer)
+)
+
+func TestParseGroupNodeAndLIDs(t *testing.T) {
+	cli := newTestClient(t)
+	// The mapping of the second participant is already known, the first one is included in the node
+	err := cli.Store.LIDs.PutLIDMapping(testLID2, testPN2)
+	if err != nil {
+		t.Fatalf("failed to store mapping: %v", err)
+	}
+	info, err := cli.parseGroupNodeAndLIDs(&waBinary.Node{
+		Tag:   "group",
+		Attrs: waBinary.Attrs{"id": "123456789", "subject": "Test", "s_t": "1700000000", "creation": "1700000000"},
+		Content: []waBinary.Node{
+			{Tag: "participant", Attrs: waBinary.Attrs{"jid": testLID1, "phone_number": testPN1, "type": "admin"}},
+			{Tag: "participant", Attrs: waBinary.Attrs{"jid": testLID2}},
+			{Tag: "participant", Attrs: waBinary.Attrs{"jid": testPN3}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse group node: %v", err)
+	}
+	expected := []types.GroupParticipant{
+		{JID: testLID1, LID: testLID1, PhoneNumber: testPN1, IsAdmin: true},
+		{JID: testLID2, LID: testLID2, PhoneNumber: testPN2},
+		{JID: testPN3, PhoneNumber: testPN3},
+	}
+	if len(info.Participants) != len(expected) {
+		t.Fatalf("got %d participants, expected %d", len(info.Participants), len(expected))
+	}
+	for i, participant := range info.Participants {
+		if participant.JID != expected[i].JID || participant.LID != expected[i].LID ||
+			participant.PhoneNumber != expected[i].PhoneNumber || participant.IsAdmin != expected[i].IsAdmin {
+			t.Errorf("participant #%d is %+v, expected %+v", i+1, participant, expected[i])
+		}
+	}
+	pn, err := cli.GetPNForLID(testLID1)
+	if err != nil || pn != testPN1 {
+		t.Errorf("mapping from group node wasn't stored: got %s, %v", pn, err)
+	}
+}
+
+func TestParseGroupNodeHasNoSideEffects(t *testing.T) {
+	cli := newTestClient(t)
+	_, err := cli.parseGroupNode(&waBinary.Node{
+		Tag:   "group",
+		Attrs: waBinary.Attrs{"id": "123456789", "subject": "Test", "s_t": "1700000000", "creation": "1700000000"},
+		Content: []waBinary.Node{
+			{Tag: "participant", Attrs: waBinary.Attrs{"jid": testLID1, "phone_number": testPN1}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse group node: %v", err)
+	}
+	if pn, _ := cli.GetPNForLID(testLID1); !pn.IsEmpty() {
+		t.Errorf("parsing a group node stored a LID mapping")
+	}
+}
+
+func TestGroupChangeAltJIDs(t *testing.T) {
+	cli := newTestClient(t)
+	err := cli.Store.LIDs.PutLIDMapping(testLID3, testPN3)
+	if err != nil {
+		t.Fatalf("failed to store mapping: %v", err)
+	}
+	evt, err := cli.parseGroupNotification(&waBinary.Node{
+		Tag: "notification",
+		Attrs: waBinary.Attrs{
+			"from":        types.NewJID("123456789", types.GroupServer),
+			"participant": testLID3,
+			"t":           "1700000000",
+		},
+		Content: []waBinary.Node{{
+			Tag:   "add",
+			Attrs: waBinary.Attrs{"prev_v_id": "1", "v_id": "2"},
+			Content: []waBinary.Node{
+				{Tag: "participant", Attrs: waBinary.Attrs{"jid": testLID1, "phone_number": testPN1}},
+				{Tag: "participant", Attrs: waBinary.Attrs{"jid": testLID2}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to parse group notification: %v", err)
+	}
+	groupEvt := evt.(*events.GroupInfo)
+	if groupEvt.AltJIDs[testLID3] != testPN3 || groupEvt.AltJIDs[testLID1] != testPN1 {
+		t.Errorf("unexpected alternative addresses %v", groupEvt.AltJIDs)
+	}
+	if _, ok := groupEvt.AltJIDs[testLID2]; ok {
+		t.Errorf("unknown mapping was included in alternative addresses")
+	}
+	if pn, _ := cli.GetPNForLID(testLID1); pn != testPN1 {
+		t.Errorf("mapping from group change wasn't stored")
+	}
+}
+
+func TestPresenceFromAlt(t *testing.T) {
+	cli := newTestClient(t)
+	err := cli.Store.LIDs.PutLIDMapping(testLID1, testPN1)
+	if err != nil {
+		t.Fatalf("failed to store mapping: %v", err)
+	}
+	evts := make(chan any, 1)
+	cli.AddEventHandler(func(evt any) {
+		evts <- evt
+	})
+	cli.handlePresence(&waBinary.Node{Tag: "presence", Attrs: waBinary.Attrs{"from": testLID1}})
+	evt := (<-evts).(*events.Presence)
+	if evt.From != testLID1 || evt.FromAlt != testPN1 {
+		t.Errorf("unexpected presence source %s / %s", evt.From, evt.FromAlt)
+	}
+}
@@ -9,6 +9,7 @@ package whatsmeow
 import (
 	"bytes"
 	"compress/zlib"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -21,6 +22,7 @@ import (
 	"github.com/Romerito007/whatsmeow/proto/waE2E"
 
 	"go.mau.fi/libsignal/groups"
+	"go.mau.fi/libsignal/keys/prekey"
 	"go.mau.fi/libsignal/protocol"
 	"go.mau.fi/libsignal/session"
 	"go.mau.fi/libsignal/signalerror"
@@ -32,11 +34,17 @@ import (
 	"github.com/Romerito007/whatsmeow/store"
 	"github.com/Romerito007/whatsmeow/types"
 	"github.com/Romerito007/whatsmeow/types/events"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
 )
 
 var pbSerializer = store.SignalProtobufSerializer
 
 func (cli *Client) handleEncryptedMessage(node *waBinary.Node) {
+	var plaintexts map[int][]byte
+	if slot := cli.takeRecordSlot(node); slot != nil {
+		plaintexts = make(map[int][]byte)
+		defer cli.recordDecryptedMessage(slot, node, plaintexts)
+	}
 	info, err := cli.parseMessageInfo(node)
 	if err != nil {
 		cli.Log.Warnf("Failed to parse message: %v", err)
@@ -47,11 +55,23 @@ func (cli *Client) handleEncryptedMessage(node *waBinary.Node) {
 		if len(info.PushName) > 0 && info.PushName != "-" {
 			go cli.updatePushName(info.Sender, info, info.PushName)
 		}
-		go cli.sendAck(node)
+		if !cli.AckAfterHandle {
+			cli.sendInBackground(func() { cli.sendAck(node) })
+		}
+		var delivered bool
+		// Node handlers don't have a context yet, so the decryption transactions start from a new one here
+		ctx := context.TODO()
 		if info.Sender.Server == types.NewsletterServer {
-			cli.handlePlaintextMessage(info, node)
+			delivered = cli.handlePlaintextMessage(info, node)
 		} else {
-			cli.decryptMessages(info, node)
+			delivered = cli.decryptMessages(ctx, info, node, plaintexts)
+		}
+		if cli.AckAfterHandle {
+			if delivered {
+				cli.sendInBackground(func() { cli.sendAck(node) })
+			} else {
+				cli.messageLog(info).Warnf("Not acknowledging message %s from %s as event handlers failed to handle it", info.ID, info.SourceString())
+			}
 		}
 	}
 }
@@ -105,6 +125,7 @@ func (cli *Client) parseMessageSource(node *waBinary.Node, requireParticipant bo
 		source.Chat = from.ToNonAD()
 		source.Sender = from
 	}
+	cli.fillSenderAlt(&source, node.AttrGetter())
 	err = ag.Error()
 	return
 }
@@ -185,23 +206,25 @@ func (cli *Client) parseMessageInfo(node *waBinary.Node) (*types.MessageInfo, er
 	return &info, nil
 }
 
-func (cli *Client) handlePlaintextMessage(info *types.MessageInfo, node *waBinary.Node) {
+// handlePlaintextMessage handles a newsletter message. It returns false if event handlers failed to handle it.
+func (cli *Client) handlePlaintextMessage(info *types.MessageInfo, node *waBinary.Node) bool {
+	log := cli.messageLog(info)
 	// TODO edits have an additional <meta msg_edit_t="1696321271735" original_msg_t="1696321248"/> node
 	plaintext, ok := node.GetOptionalChildByTag("plaintext")
 	if !ok {
 		// 3:
-		return
+		return true
 	}
 	plaintextBody, ok := plaintext.Content.([]byte)
 	if !ok {
-		cli.Log.Warnf("Plaintext message from %s doesn't have byte content", info.SourceString())
-		return
+		log.Warnf("Plaintext message from %s doesn't have byte content", info.SourceString())
+		return true
 	}
 	var msg waE2E.Message
 	err := proto.Unmarshal(plaintextBody, &msg)
 	if err != nil {
-		cli.Log.Warnf("Error unmarshaling plaintext message from %s: %v", info.SourceString(), err)
-		return
+		log.Warnf("Error unmarshaling plaintext message from %s: %v", info.SourceString(), err)
+		return true
 	}
 	cli.storeMessageSecret(info, &msg)
 	evt := &events.Message{
@@ -215,23 +238,34 @@ func (cli *Client) handlePlaintextMessage(info *types.MessageInfo, node *waBinar
 			OriginalTS: meta.AttrGetter().UnixTime("original_msg_t"),
 		}
 	}
-	cli.dispatchEvent(evt.UnwrapRaw())
-	return
+	evt.UnwrapRaw()
+	cli.archiveMessage(evt)
+	return cli.deliverMessage(evt)
 }
 
-func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node) {
+// decryptMessages decrypts and handles all the encrypted parts of a message.
+// It returns false if event handlers failed to handle a decrypted message.
+// If plaintexts is non-nil, the decrypted content of each <enc> element is stored in it for recording.
+func (cli *Client) decryptMessages(ctx context.Context, info *types.MessageInfo, node *waBinary.Node, plaintexts map[int][]byte) (delivered bool) {
+	log := cli.messageLog(info)
+	ctx, span := cli.startSpan(ctx, "whatsmeow.decrypt_message",
+		TraceAttribute{Key: "id", Value: info.ID},
+		TraceAttribute{Key: "chat", Value: info.Chat.String()},
+		TraceAttribute{Key: "sender", Value: info.Sender.String()})
+	defer span.End()
+	delivered = true
 	if len(node.GetChildrenByTag("unavailable")) > 0 && len(node.GetChildrenByTag("enc")) == 0 {
-		cli.Log.Warnf("Unavailable message %s from %s", info.ID, info.SourceString())
+		log.Warnf("Unavailable message %s from %s", info.ID, info.SourceString())
 		go cli.delayedRequestMessageFromPhone(info)
 		cli.dispatchEvent(&events.UndecryptableMessage{Info: *info, IsUnavailable: true})
 		return
 	}
 
 	children := node.GetChildren()
-	cli.Log.Debugf("Decrypting message from %s", info.SourceString())
+	log.Debugf("Decrypting message from %s", info.SourceString())
 	handled := false
 	containsDirectMsg := false
-	for _, child := range children {
+	for i, child := range children {
 		if child.Tag != "enc" {
 			continue
 		}
@@ -242,11 +276,14 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 		}
 		var decrypted []byte
 		var err error
-		if encType == "pkmsg" || encType == "msg" {
-			decrypted, err = cli.decryptDM(&child, info.Sender, encType == "pkmsg")
+		if replayedPlaintext, ok := cli.getReplayedPlaintext(&child); ok {
+			decrypted = replayedPlaintext
+			containsDirectMsg = containsDirectMsg || encType == "pkmsg" || encType == "msg"
+		} else if encType == "pkmsg" || encType == "msg" {
+			decrypted, err = cli.decryptDM(ctx, &child, info.Sender, encType == "pkmsg")
 			containsDirectMsg = true
 		} else if info.IsGroup && encType == "skmsg" {
-			decrypted, err = cli.decryptGroupMsg(&child, info.Sender, info.Chat)
+			decrypted, err = cli.decryptGroupMsg(ctx, &child, info.Sender, info.Chat)
 		} else if encType == "msmsg" && info.Sender.IsBot() {
 			// Meta AI / other bots (biz?):
 
@@ -259,7 +296,7 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 
 			messageSecret, err := cli.Store.MsgSecrets.GetMessageSecret(info.Chat, targetSenderJID, info.MsgMetaInfo.TargetID)
 			if err != nil || messageSecret == nil {
-				cli.Log.Warnf("Error getting message secret for bot msg with id %s", node.AttrGetter().String("id"))
+				log.Warnf("Error getting message secret for bot msg with id %s", node.AttrGetter().String("id"))
 				continue
 			}
 
@@ -269,7 +306,7 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 
 			err = proto.Unmarshal(byteContents, &msMsg)
 			if err != nil {
-				cli.Log.Warnf("Error decoding MessageSecretMesage protobuf %v", err)
+				log.Warnf("Error decoding MessageSecretMesage protobuf %v", err)
 				continue
 			}
 
@@ -284,14 +321,16 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 			// step 4: decrypt and voila
 			decrypted, err = cli.decryptBotMessage(messageSecret, &msMsg, messageID, targetSenderJID, info)
 		} else {
-			cli.Log.Warnf("Unhandled encrypted message (type %s) from %s", encType, info.SourceString())
+			log.Warnf("Unhandled encrypted message (type %s) from %s", encType, info.SourceString())
 			continue
 		}
 
 		if err != nil {
-			cli.Log.Warnf("Error decrypting message from %s: %v", info.SourceString(), err)
+			log.Warnf("Error decrypting message from %s: %v", info.SourceString(), err)
+			span.RecordError(err)
 			isUnavailable := encType == "skmsg" && !containsDirectMsg && errors.Is(err, signalerror.ErrNoSenderKeyForUser)
-			go cli.sendRetryReceipt(node, info, isUnavailable)
+			cli.sendInBackground(func() { cli.sendRetryReceipt(node, info, isUnavailable) })
+			cli.recordDecryptFailure(events.DecryptFailMode(ag.OptionalString("decrypt-fail")))
 			cli.dispatchEvent(&events.UndecryptableMessage{
 				Info:            *info,
 				IsUnavailable:   isUnavailable,
@@ -299,6 +338,9 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 			})
 			return
 		}
+		if plaintexts != nil {
+			plaintexts[i] = decrypted
+		}
 		retryCount := ag.OptionalInt("count")
 		cli.cancelDelayedRequestFromPhone(info.ID)
 
@@ -307,63 +349,114 @@ func (cli *Client) decryptMessages(info *types.MessageInfo, node *waBinary.Node)
 		case 2:
 			err = proto.Unmarshal(decrypted, &msg)
 			if err != nil {
-				cli.Log.Warnf("Error unmarshaling decrypted message from %s: %v", info.SourceString(), err)
+				log.Warnf("Error unmarshaling decrypted message from %s: %v", info.SourceString(), err)
 				continue
 			}
-			cli.handleDecryptedMessage(info, &msg, retryCount)
+			if !cli.handleDecryptedMessage(ctx, info, &msg, retryCount) {
+				delivered = false
+			}
 			handled = true
 		case 3:
-			handled = cli.handleDecryptedArmadillo(info, decrypted, retryCount)
+			handled = cli.handleDecryptedArmadillo(ctx, info, decrypted, retryCount)
 		default:
-			cli.Log.Warnf("Unknown version %d in decrypted message from %s", ag.Int("v"), info.SourceString())
+			log.Warnf("Unknown version %d in decrypted message from %s", ag.Int("v"), info.SourceString())
 		}
 	}
-	if handled {
-		go cli.sendMessageReceipt(info)
+	if handled && delivered {
+		cli.sendInBackground(func() { cli.sendMessageReceipt(info) })
 	}
+	return
+}
+
+func (cli *Client) dispatchImplicitIdentityChange(target types.JID) {
+	cli.dispatchEvent(&events.IdentityChange{JID: target, Timestamp: time.Now(), Implicit: true})
 }
 
-func (cli *Client) clearUntrustedIdentity(target types.JID) {
-	err := cli.Store.Identities.DeleteIdentity(target.SignalAddress().String())
+// encryptForDevice processes the prekey bundle (if any) and encrypts the given plaintext for the given device.
+// The session changes are committed atomically along with any identity that was cleared.
+func (cli *Client) encryptForDevice(ctx context.Context, plaintext []byte, to types.JID, bundle *prekey.Bundle) (protocol.CiphertextMessage, error) {
+	var ciphertext protocol.CiphertextMessage
+	var clearedIdentity bool
+	err := cli.Store.DoTxn(ctx, func(ctx context.Context) error {
+		signalStore := cli.Store.SignalStore(ctx)
+		builder := session.NewBuilderFromSignal(signalStore, to.SignalAddress(), pbSerializer)
+		if bundle != nil {
+			cli.Log.Debugf("Processing prekey bundle for %s", to)
+			err := builder.ProcessBundle(bundle)
+			if cli.AutoTrustIdentity && errors.Is(err, signalerror.ErrUntrustedIdentity) {
+				cli.Log.Warnf("Got %v error while trying to process prekey bundle for %s, clearing stored identity and retrying", err, to)
+				signalStore.DeleteIdentity(to.SignalAddress())
+				clearedIdentity = true
+				err = builder.ProcessBundle(bundle)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to process prekey bundle: %w", err)
+			}
+		} else if !signalStore.ContainsSession(to.SignalAddress()) {
+			if err := signalStore.Err(); err != nil {
+				return err
+			}
+			return ErrNoSession
+		}
+		cipher := session.NewCipher(builder, to.SignalAddress())
+		var err error
+		ciphertext, err = cipher.Encrypt(plaintext)
+		if err != nil {
+			return fmt.Errorf("cipher encryption failed: %w", err)
+		}
+		return signalStore.Err()
+	})
 	if err != nil {
-		cli.Log.Warnf("Failed to delete untrusted identity of %s from store: %v", target, err)
+		return nil, err
 	}
-	err = cli.Store.Sessions.DeleteSession(target.SignalAddress().String())
-	if err != nil {
-		cli.Log.Warnf("Failed to delete session with %s (untrusted identity) from store: %v", target, err)
+	if clearedIdentity {
+		cli.dispatchImplicitIdentityChange(to)
 	}
-	cli.dispatchEvent(&events.IdentityChange{JID: target, Timestamp: time.Now(), Implicit: true})
+	return ciphertext, nil
 }
 
-func (cli *Client) decryptDM(child *waBinary.Node, from types.JID, isPreKey bool) ([]byte, error) {
+func (cli *Client) decryptDM(ctx context.Context, child *waBinary.Node, from types.JID, isPreKey bool) ([]byte, error) {
 	content, _ := child.Content.([]byte)
 
-	builder := session.NewBuilderFromSignal(cli.Store, from.SignalAddress(), pbSerializer)
-	cipher := session.NewCipher(builder, from.SignalAddress())
 	var plaintext []byte
-	if isPreKey {
-		preKeyMsg, err := protocol.NewPreKeySignalMessageFromBytes(content, pbSerializer.PreKeySignalMessage, pbSerializer.SignalMessage)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse prekey message: %w", err)
-		}
-		plaintext, _, err = cipher.DecryptMessageReturnKey(preKeyMsg)
-		if cli.AutoTrustIdentity && errors.Is(err, signalerror.ErrUntrustedIdentity) {
-			cli.Log.Warnf("Got %v error while trying to decrypt prekey message from %s, clearing stored identity and retrying", err, from)
-			cli.clearUntrustedIdentity(from)
+	var clearedIdentity bool
+	// All the Signal state changes (session, prekey removal, identity) are committed atomically
+	err := cli.Store.DoTxn(ctx, func(ctx context.Context) error {
+		signalStore := cli.Store.SignalStore(ctx)
+		builder := session.NewBuilderFromSignal(signalStore, from.SignalAddress(), pbSerializer)
+		cipher := session.NewCipher(builder, from.SignalAddress())
+		if isPreKey {
+			preKeyMsg, err := protocol.NewPreKeySignalMessageFromBytes(content, pbSerializer.PreKeySignalMessage, pbSerializer.SignalMessage)
+			if err != nil {
+				return fmt.Errorf("failed to parse prekey message: %w", err)
+			}
 			plaintext, _, err = cipher.DecryptMessageReturnKey(preKeyMsg)
+			if cli.AutoTrustIdentity && errors.Is(err, signalerror.ErrUntrustedIdentity) {
+				cli.Log.Warnf("Got %v error while trying to decrypt prekey message from %s, clearing stored identity and retrying", err, from)
+				signalStore.DeleteIdentity(from.SignalAddress())
+				clearedIdentity = true
+				plaintext, _, err = cipher.DecryptMessageReturnKey(preKeyMsg)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to decrypt prekey message: %w", err)
+			}
+		} else {
+			msg, err := protocol.NewSignalMessageFromBytes(content, pbSerializer.SignalMessage)
+			if err != nil {
+				return fmt.Errorf("failed to parse normal message: %w", err)
+			}
+			plaintext, err = cipher.Decrypt(msg)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt normal message: %w", err)
+			}
 		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt prekey message: %w", err)
-		}
-	} else {
-		msg, err := protocol.NewSignalMessageFromBytes(content, pbSerializer.SignalMessage)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse normal message: %w", err)
-		}
-		plaintext, err = cipher.Decrypt(msg)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decrypt normal message: %w", err)
-		}
+		return signalStore.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if clearedIdentity {
+		cli.dispatchImplicitIdentityChange(from)
 	}
 	if child.AttrGetter().Int("v") == 3 {
 		return plaintext, nil
@@ -371,19 +464,27 @@ func (cli *Client) decryptDM(child *waBinary.Node, from types.JID, isPreKey bool
 	return unpadMessage(plaintext)
 }
 
-func (cli *Client) decryptGroupMsg(child *waBinary.Node, from types.JID, chat types.JID) ([]byte, error) {
+func (cli *Client) decryptGroupMsg(ctx context.Context, child *waBinary.Node, from types.JID, chat types.JID) ([]byte, error) {
 	content, _ := child.Content.([]byte)
 
 	senderKeyName := protocol.NewSenderKeyName(chat.String(), from.SignalAddress())
-	builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
-	cipher := groups.NewGroupCipher(builder, senderKeyName, cli.Store)
 	msg, err := protocol.NewSenderKeyMessageFromBytes(content, pbSerializer.SenderKeyMessage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse group message: %w", err)
 	}
-	plaintext, err := cipher.Decrypt(msg)
+	var plaintext []byte
+	err = cli.Store.DoTxn(ctx, func(ctx context.Context) error {
+		signalStore := cli.Store.SignalStore(ctx)
+		builder := groups.NewGroupSessionBuilder(signalStore, pbSerializer)
+		cipher := groups.NewGroupCipher(builder, senderKeyName, signalStore)
+		plaintext, err = cipher.Decrypt(msg)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt group message: %w", err)
+		}
+		return signalStore.Err()
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt group message: %w", err)
+		return nil, err
 	}
 	if child.AttrGetter().Int("v") == 3 {
 		return plaintext, nil
@@ -419,15 +520,22 @@ func padMessage(plaintext []byte) []byte {
 	return plaintext
 }
 
-func (cli *Client) handleSenderKeyDistributionMessage(chat, from types.JID, axolotlSKDM []byte) {
-	builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
+func (cli *Client) handleSenderKeyDistributionMessage(ctx context.Context, chat, from types.JID, axolotlSKDM []byte) {
 	senderKeyName := protocol.NewSenderKeyName(chat.String(), from.SignalAddress())
 	sdkMsg, err := protocol.NewSenderKeyDistributionMessageFromBytes(axolotlSKDM, pbSerializer.SenderKeyDistributionMessage)
 	if err != nil {
 		cli.Log.Errorf("Failed to parse sender key distribution message from %s for %s: %v", from, chat, err)
 		return
 	}
-	builder.Process(senderKeyName, sdkMsg)
+	err = cli.Store.DoTxn(ctx, func(ctx context.Context) error {
+		signalStore := cli.Store.SignalStore(ctx)
+		groups.NewGroupSessionBuilder(signalStore, pbSerializer).Process(senderKeyName, sdkMsg)
+		return signalStore.Err()
+	})
+	if err != nil {
+		cli.Log.Errorf("Failed to store sender key distribution message from %s for %s: %v", from, chat, err)
+		return
+	}
 	cli.Log.Debugf("Processed sender key distribution message from %s in %s", senderKeyName.Sender().String(), senderKeyName.GroupID())
 }
 
@@ -465,8 +573,12 @@ func (cli *Client) handleHistorySyncNotification(notif *waE2E.HistorySyncNotific
 		cli.Log.Debugf("Received history sync (type %s, chunk %d)", historySync.GetSyncType(), historySync.GetChunkOrder())
 		if historySync.GetSyncType() == waHistorySync.HistorySync_PUSH_NAME {
 			go cli.handleHistoricalPushNames(historySync.GetPushnames())
-		} else if len(historySync.GetConversations()) > 0 {
-			go cli.storeHistoricalMessageSecrets(historySync.GetConversations())
+		} else {
+			go cli.storeHistoricalLIDMappings(&historySync)
+			if len(historySync.GetConversations()) > 0 {
+				go cli.storeHistoricalMessageSecrets(historySync.GetConversations())
+				go cli.archiveHistoricalMessages(historySync.GetConversations())
+			}
 		}
 		cli.dispatchEvent(&events.HistorySync{
 			Data: &historySync,
@@ -524,6 +636,7 @@ func (cli *Client) handlePlaceholderResendResponse(msg *waE2E.PeerDataOperationR
 			cli.Log.Warnf("Failed to parse web message info in item #%d of response to %s: %v", i+1, reqID, err)
 		} else {
 			msgEvt.UnavailableRequestID = reqID
+			cli.archiveMessage(msgEvt)
 			cli.dispatchEvent(msgEvt)
 		}
 	}
@@ -537,7 +650,7 @@ func (cli *Client) handleProtocolMessage(info *types.MessageInfo, msg *waE2E.Mes
 		if cli.historySyncHandlerStarted.CompareAndSwap(false, true) {
 			go cli.handleHistorySyncNotificationLoop()
 		}
-		go cli.sendProtocolMessageReceipt(info.ID, types.ReceiptTypeHistorySync)
+		cli.sendInBackground(func() { cli.sendProtocolMessageReceipt(info.ID, types.ReceiptTypeHistorySync) })
 	}
 
 	if protoMsg.GetPeerDataOperationRequestResponseMessage().GetPeerDataOperationRequestType() == waE2E.PeerDataOperationRequestType_PLACEHOLDER_MESSAGE_RESEND {
@@ -549,11 +662,11 @@ func (cli *Client) handleProtocolMessage(info *types.MessageInfo, msg *waE2E.Mes
 	}
 
 	if info.Category == "peer" {
-		go cli.sendProtocolMessageReceipt(info.ID, types.ReceiptTypePeerMsg)
+		cli.sendInBackground(func() { cli.sendProtocolMessageReceipt(info.ID, types.ReceiptTypePeerMsg) })
 	}
 }
 
-func (cli *Client) processProtocolParts(info *types.MessageInfo, msg *waE2E.Message) {
+func (cli *Client) processProtocolParts(ctx context.Context, info *types.MessageInfo, msg *waE2E.Message) {
 	// Hopefully sender key distribution messages and protocol messages can't be inside ephemeral messages
 	if msg.GetDeviceSentMessage().GetMessage() != nil {
 		msg = msg.GetDeviceSentMessage().GetMessage()
@@ -562,7 +675,7 @@ func (cli *Client) processProtocolParts(info *types.MessageInfo, msg *waE2E.Mess
 		if !info.IsGroup {
 			cli.Log.Warnf("Got sender key distribution message in non-group chat from %s", info.Sender)
 		} else {
-			cli.handleSenderKeyDistributionMessage(info.Chat, info.Sender, msg.SenderKeyDistributionMessage.AxolotlSenderKeyDistributionMessage)
+			cli.handleSenderKeyDistributionMessage(ctx, info.Chat, info.Sender, msg.SenderKeyDistributionMessage.AxolotlSenderKeyDistributionMessage)
 		}
 	}
 	// N.B. Edits are protocol messages, but they're also wrapped inside EditedMessage,
@@ -652,10 +765,12 @@ func (cli *Client) storeHistoricalMessageSecrets(conversations []*waHistorySync.
 	}
 }
 
-func (cli *Client) handleDecryptedMessage(info *types.MessageInfo, msg *waE2E.Message, retryCount int) {
-	cli.processProtocolParts(info, msg)
+func (cli *Client) handleDecryptedMessage(ctx context.Context, info *types.MessageInfo, msg *waE2E.Message, retryCount int) bool {
+	cli.processProtocolParts(ctx, info, msg)
 	evt := &events.Message{Info: *info, RawMessage: msg, RetryCount: retryCount}
-	cli.dispatchEvent(evt.UnwrapRaw())
+	evt.UnwrapRaw()
+	cli.archiveMessage(evt)
+	return cli.deliverMessage(evt)
 }
 
 func (cli *Client) sendProtocolMessageReceipt(id types.MessageID, msgType types.ReceiptType) {
@@ -676,3 +791,8 @@ func (cli *Client) sendProtocolMessageReceipt(id types.MessageID, msgType types.
 		cli.Log.Warnf("Failed to send acknowledgement for protocol message %s: %v", id, err)
 	}
 }
+
+// messageLog returns a logger with fields identifying the given message.
+func (cli *Client) messageLog(info *types.MessageInfo) waLog.Logger {
+	return waLog.With(cli.Log, "message_id", info.ID, "chat", info.Chat, "sender", info.Sender)
+}
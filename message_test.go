@@ -0,0 +1,107 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.mau.fi/libsignal/ecc"
+	"go.mau.fi/libsignal/keys/identity"
+	"go.mau.fi/libsignal/keys/prekey"
+	"go.mau.fi/libsignal/util/optional"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/proto/waAdv"
+	"github.com/Romerito007/whatsmeow/store/sqlstore"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func newTestSQLClient(t *testing.T, container *sqlstore.Container, phone string) *Client {
+	t.Helper()
+	device := container.NewDevice()
+	device.ID = &types.JID{User: phone, Device: 1, Server: types.DefaultUserServer}
+	device.Account = &waAdv.ADVSignedDeviceIdentity{
+		Details:             []byte{1},
+		AccountSignature:    bytes.Repeat([]byte{2}, 64),
+		AccountSignatureKey: bytes.Repeat([]byte{3}, 32),
+		DeviceSignature:     bytes.Repeat([]byte{4}, 64),
+	}
+	err := device.Save()
+	if err != nil {
+		t.Fatalf("failed to save device: %v", err)
+	}
+	return NewClient(device, nil)
+}
+
+func TestDecryptDM_RollbackWithOuterTransaction(t *testing.T) {
+	container, err := sqlstore.New("sqlite3", "file:"+filepath.Join(t.TempDir(), "whatsmeow.db")+"?_foreign_keys=on", nil)
+	if err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = container.Close()
+	})
+	alice := newTestSQLClient(t, container, "1111")
+	bob := newTestSQLClient(t, container, "2222")
+	ctx := context.Background()
+
+	preKey, err := bob.Store.PreKeys.GenOnePreKey()
+	if err != nil {
+		t.Fatalf("failed to generate prekey: %v", err)
+	}
+	signedPreKey := bob.Store.SignedPreKey
+	bundle := prekey.NewBundle(bob.Store.RegistrationID, uint32(bob.Store.ID.Device),
+		optional.NewOptionalUint32(preKey.KeyID), signedPreKey.KeyID,
+		ecc.NewDjbECPublicKey(*preKey.Pub), ecc.NewDjbECPublicKey(*signedPreKey.Pub), *signedPreKey.Signature,
+		identity.NewKey(ecc.NewDjbECPublicKey(*bob.Store.IdentityKey.Pub)))
+	ciphertext, err := alice.encryptForDevice(ctx, padMessage([]byte("hello")), *bob.Store.ID, bundle)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	encNode := &waBinary.Node{Tag: "enc", Attrs: waBinary.Attrs{"type": "pkmsg"}, Content: ciphertext.Serialize()}
+
+	// A later step in the caller's transaction fails, so everything the decryption did must be rolled back
+	stepErr := errors.New("later step failed")
+	err = bob.Store.DoTxn(ctx, func(ctx context.Context) error {
+		plaintext, err := bob.decryptDM(ctx, encNode, *alice.Store.ID, true)
+		if err != nil {
+			return err
+		} else if string(plaintext) != "hello" {
+			t.Errorf("decrypted %q, expected hello", plaintext)
+		}
+		return stepErr
+	})
+	if !errors.Is(err, stepErr) {
+		t.Fatalf("expected step error, got %v", err)
+	}
+	address := alice.Store.ID.SignalAddress().String()
+	if has, err := bob.Store.Sessions.HasSession(address); err != nil || has {
+		t.Errorf("session wasn't rolled back: %t, %v", has, err)
+	}
+	if key, err := bob.Store.PreKeys.GetPreKey(preKey.KeyID); err != nil || key == nil {
+		t.Errorf("prekey removal wasn't rolled back: %v, %v", key, err)
+	}
+
+	// Since nothing was committed, the same message can be decrypted again
+	plaintext, err := bob.decryptDM(ctx, encNode, *alice.Store.ID, true)
+	if err != nil {
+		t.Fatalf("failed to decrypt message again: %v", err)
+	} else if string(plaintext) != "hello" {
+		t.Errorf("decrypted %q, expected hello", plaintext)
+	}
+	if has, err := bob.Store.Sessions.HasSession(address); err != nil || !has {
+		t.Errorf("session wasn't stored after successful decryption: %t, %v", has, err)
+	}
+	if key, err := bob.Store.PreKeys.GetPreKey(preKey.KeyID); err != nil || key != nil {
+		t.Errorf("prekey wasn't removed after successful decryption: %v, %v", key, err)
+	}
+}
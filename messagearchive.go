@@ -0,0 +1,209 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/Romerito007/whatsmeow/proto/waCommon"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/proto/waHistorySync"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// hasArchivableContent checks if the message contains something other than
+// sender key distribution messages and message context info.
+func hasArchivableContent(msg *waE2E.Message) bool {
+	if msg == nil {
+		return false
+	}
+	hasContent := false
+	msg.ProtoReflect().Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		switch fd.Name() {
+		case "senderKeyDistributionMessage", "fastRatchetKeySenderKeyDistributionMessage", "messageContextInfo":
+			return true
+		default:
+			hasContent = true
+			return false
+		}
+	})
+	return hasContent
+}
+
+// archiveMessage stores the given message event in the device's MessageStore, if one is configured.
+//
+// Edits and revocations are applied to the previously stored message instead of being stored as separate messages.
+func (cli *Client) archiveMessage(evt *events.Message) {
+	if cli.Store.Messages == nil || evt.Info.Category == "peer" {
+		return
+	}
+	var err error
+	if protoMsg := evt.Message.GetProtocolMessage(); protoMsg != nil {
+		targetID := protoMsg.GetKey().GetID()
+		if targetID == "" {
+			return
+		}
+		switch protoMsg.GetType() {
+		case waE2E.ProtocolMessage_REVOKE:
+			targetSender, ok := cli.getRevokeTarget(evt, protoMsg.GetKey())
+			if !ok {
+				return
+			}
+			err = cli.Store.Messages.MarkMessageRevoked(evt.Info.Chat, targetSender, targetID)
+		case waE2E.ProtocolMessage_MESSAGE_EDIT:
+			editTS := evt.Info.Timestamp
+			if protoMsg.GetTimestampMS() != 0 {
+				editTS = time.UnixMilli(protoMsg.GetTimestampMS())
+			}
+			// Messages can only be edited by the original sender
+			err = cli.Store.Messages.UpdateMessageContent(evt.Info.Chat, evt.Info.Sender, targetID, protoMsg.GetEditedMessage(), editTS)
+		}
+		if err != nil {
+			cli.Log.Errorf("Failed to apply %s of %s in %s to message store: %v", protoMsg.GetType(), targetID, evt.Info.Chat, err)
+		}
+		return
+	} else if !hasArchivableContent(evt.Message) {
+		return
+	}
+	err = cli.Store.Messages.PutMessage(store.MessageEntry{
+		Chat:      evt.Info.Chat,
+		Sender:    evt.Info.Sender,
+		ID:        evt.Info.ID,
+		Timestamp: evt.Info.Timestamp,
+		IsFromMe:  evt.Info.IsFromMe,
+		Message:   evt.Message,
+	})
+	if err != nil {
+		cli.Log.Errorf("Failed to store message %s from %s in message store: %v", evt.Info.ID, evt.Info.SourceString(), err)
+	}
+}
+
+// getRevokeTarget finds the sender of the message that the given revoke message targets, and checks that
+// the user who sent the revoke is allowed to revoke it. Users can revoke their own messages,
+// and group admins can revoke messages sent by anyone in the group.
+//
+// The key in a revoke message is relative to the revoker, i.e. FromMe means that the revoker sent the target message.
+func (cli *Client) getRevokeTarget(evt *events.Message, key *waCommon.MessageKey) (types.JID, bool) {
+	revoker := evt.Info.Sender.ToNonAD()
+	if key.GetFromMe() {
+		return revoker, true
+	} else if key.GetParticipant() == "" || !evt.Info.IsGroup {
+		cli.Log.Debugf("Ignoring revoke of %s in %s by %s that doesn't target the revoker's own message", key.GetID(), evt.Info.Chat, revoker)
+		return types.EmptyJID, false
+	}
+	target, err := types.ParseJID(key.GetParticipant())
+	if err != nil {
+		cli.Log.Warnf("Failed to parse participant in revoke of %s in %s: %v", key.GetID(), evt.Info.Chat, err)
+		return types.EmptyJID, false
+	}
+	target = target.ToNonAD()
+	if target == revoker {
+		return target, true
+	}
+	isAdmin, err := cli.isGroupAdmin(evt.Info.Chat, revoker)
+	if err != nil {
+		cli.Log.Warnf("Failed to check if %s is an admin of %s to apply revoke of %s: %v", revoker, evt.Info.Chat, key.GetID(), err)
+		return types.EmptyJID, false
+	} else if !isAdmin {
+		cli.Log.Warnf("Ignoring revoke of %s by %s in %s: not the sender or a group admin", key.GetID(), revoker, evt.Info.Chat)
+		return types.EmptyJID, false
+	}
+	return target, true
+}
+
+// isGroupAdmin checks if the given user is an admin in the given group, using the group store if possible.
+func (cli *Client) isGroupAdmin(group, user types.JID) (bool, error) {
+	var info *types.GroupInfo
+	var err error
+	if cli.Store.Groups != nil {
+		info, err = cli.Store.Groups.GetGroup(group)
+		if err != nil {
+			cli.Log.Warnf("Failed to get %s from group store: %v", group, err)
+		}
+	}
+	if info == nil {
+		info, err = cli.getGroupInfo(context.TODO(), group, true)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, participant := range info.Participants {
+		if participant.JID == user || participant.LID == user {
+			return participant.IsAdmin, nil
+		}
+	}
+	return false, nil
+}
+
+// archiveOutgoingMessage stores a message sent with SendMessage in the device's MessageStore.
+func (cli *Client) archiveOutgoingMessage(to types.JID, id types.MessageID, message *waE2E.Message, resp *SendResponse) {
+	if cli.Store.Messages == nil {
+		return
+	}
+	ts := resp.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	evt := &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:     to,
+				Sender:   cli.getOwnID().ToNonAD(),
+				IsFromMe: true,
+				IsGroup:  to.Server == types.GroupServer || to.Server == types.BroadcastServer,
+			},
+			ID:        id,
+			Timestamp: ts,
+		},
+		RawMessage: message,
+	}
+	cli.archiveMessage(evt.UnwrapRaw())
+}
+
+func (cli *Client) archiveHistoricalMessages(conversations []*waHistorySync.Conversation) {
+	if cli.Store.Messages == nil {
+		return
+	}
+	var entries []store.MessageEntry
+	for _, conv := range conversations {
+		chatJID, _ := types.ParseJID(conv.GetId())
+		if chatJID.IsEmpty() {
+			continue
+		}
+		for _, historyMsg := range conv.GetMessages() {
+			evt, err := cli.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil {
+				cli.Log.Debugf("Failed to parse history sync message in %s for message store: %v", chatJID, err)
+				continue
+			} else if evt.Message.GetProtocolMessage() != nil || !hasArchivableContent(evt.Message) {
+				continue
+			}
+			entries = append(entries, store.MessageEntry{
+				Chat:      evt.Info.Chat,
+				Sender:    evt.Info.Sender,
+				ID:        evt.Info.ID,
+				Timestamp: evt.Info.Timestamp,
+				IsFromMe:  evt.Info.IsFromMe,
+				Message:   evt.Message,
+			})
+		}
+	}
+	if len(entries) > 0 {
+		cli.Log.Debugf("Storing %d messages from history sync in message store", len(entries))
+		err := cli.Store.Messages.PutMessages(entries)
+		if err != nil {
+			cli.Log.Errorf("Failed to store messages from history sync: %v", err)
+		} else {
+			cli.Log.Infof("Stored %d messages from history sync", len(entries))
+		}
+	}
+}
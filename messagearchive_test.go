@@ -0,0 +1,191 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waCommon"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/store/memstore"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// newTestClient creates a client with an in-memory store that isn't connected anywhere.
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	device := memstore.New(nil).NewDevice()
+	device.ID = &types.JID{User: "9999", Device: 1, Server: types.DefaultUserServer}
+	err := device.Save()
+	if err != nil {
+		t.Fatalf("failed to save device: %v", err)
+	}
+	return NewClient(device, nil)
+}
+
+func makeRevokeEvent(chat, revoker types.JID, key *waCommon.MessageKey) *events.Message {
+	return &events.Message{
+		Info: types.MessageInfo{
+			MessageSource: types.MessageSource{
+				Chat:    chat,
+				Sender:  revoker,
+				IsGroup: chat.Server == types.GroupServer,
+			},
+			ID:        "REVOKE" + key.GetID(),
+			Timestamp: time.Now(),
+		},
+		Message: &waE2E.Message{
+			ProtocolMessage: &waE2E.ProtocolMessage{
+				Type: waE2E.ProtocolMessage_REVOKE.Enum(),
+				Key:  key,
+			},
+		},
+	}
+}
+
+func TestArchiveMessage_Revoke(t *testing.T) {
+	group := types.NewJID("123456789", types.GroupServer)
+	alice := types.NewJID("1111", types.DefaultUserServer)
+	bob := types.NewJID("2222", types.DefaultUserServer)
+	admin := types.NewJID("3333", types.DefaultUserServer)
+	adminLID := types.NewJID("4444", types.HiddenUserServer)
+
+	tests := []struct {
+		name    string
+		chat    types.JID
+		sender  types.JID
+		revoker types.JID
+		key     *waCommon.MessageKey
+		revoked bool
+	}{{
+		name:    "sender revokes own message",
+		chat:    group,
+		sender:  alice,
+		revoker: types.JID{User: "1111", Device: 2, Server: types.DefaultUserServer},
+		key:     &waCommon.MessageKey{FromMe: proto.Bool(true)},
+		revoked: true,
+	}, {
+		name:    "participant revokes other participant's message",
+		chat:    group,
+		sender:  alice,
+		revoker: bob,
+		key:     &waCommon.MessageKey{FromMe: proto.Bool(false), Participant: proto.String(alice.String())},
+		revoked: false,
+	}, {
+		name:    "participant claims someone else's message as own",
+		chat:    group,
+		sender:  alice,
+		revoker: bob,
+		key:     &waCommon.MessageKey{FromMe: proto.Bool(true)},
+		revoked: false,
+	}, {
+		name:    "admin revokes participant's message",
+		chat:    group,
+		sender:  alice,
+		revoker: admin,
+		key:     &waCommon.MessageKey{FromMe: proto.Bool(false), Participant: proto.String(alice.String())},
+		revoked: true,
+	}, {
+		name:    "admin revokes with LID",
+		chat:    group,
+		sender:  alice,
+		revoker: adminLID,
+		key:     &waCommon.MessageKey{FromMe: proto.Bool(false), Participant: proto.String(alice.String())},
+		revoked: true,
+	}, {
+		name:    "revoke of other user's message in DM",
+		chat:    alice,
+		sender:  alice,
+		revoker: bob,
+		key:     &waCommon.MessageKey{FromMe: proto.Bool(false)},
+		revoked: false,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli := newTestClient(t)
+			err := cli.Store.Groups.PutGroup(&types.GroupInfo{
+				JID: group,
+				Participants: []types.GroupParticipant{
+					{JID: alice},
+					{JID: bob},
+					{JID: admin, LID: adminLID, IsAdmin: true},
+				},
+			})
+			if err != nil {
+				t.Fatalf("failed to store group: %v", err)
+			}
+			err = cli.Store.Messages.PutMessage(store.MessageEntry{
+				Chat:      test.chat,
+				Sender:    test.sender,
+				ID:        "MSG1",
+				Timestamp: time.Now(),
+				Message:   &waE2E.Message{Conversation: proto.String("hello")},
+			})
+			if err != nil {
+				t.Fatalf("failed to store message: %v", err)
+			}
+			test.key.ID = proto.String("MSG1")
+			cli.archiveMessage(makeRevokeEvent(test.chat, test.revoker, test.key))
+			entry, err := cli.Store.Messages.GetMessage(test.chat, "MSG1")
+			if err != nil {
+				t.Fatalf("failed to get message: %v", err)
+			} else if entry.Revoked != test.revoked {
+				t.Errorf("message revoked = %t, expected %t", entry.Revoked, test.revoked)
+			}
+		})
+	}
+}
+
+func TestArchiveMessage_StoresAndEdits(t *testing.T) {
+	cli := newTestClient(t)
+	alice := types.NewJID("1111", types.DefaultUserServer)
+	bob := types.NewJID("2222", types.DefaultUserServer)
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: alice, Sender: alice},
+		ID:            "MSG1",
+		Timestamp:     time.Unix(1700000000, 0),
+	}
+	cli.archiveMessage(&events.Message{Info: info, Message: &waE2E.Message{Conversation: proto.String("hello")}})
+
+	// Messages without content, like bare sender key distribution messages, aren't stored
+	info.ID = "MSG2"
+	cli.archiveMessage(&events.Message{Info: info, Message: &waE2E.Message{
+		SenderKeyDistributionMessage: &waE2E.SenderKeyDistributionMessage{GroupID: proto.String("abc")},
+	}})
+	if entry, _ := cli.Store.Messages.GetMessage(alice, "MSG2"); entry != nil {
+		t.Errorf("message without content was stored")
+	}
+
+	makeEdit := func(editor types.JID, text string, ts time.Time) *events.Message {
+		return &events.Message{
+			Info: types.MessageInfo{
+				MessageSource: types.MessageSource{Chat: alice, Sender: editor},
+				ID:            "EDIT",
+				Timestamp:     ts,
+			},
+			Message: &waE2E.Message{ProtocolMessage: &waE2E.ProtocolMessage{
+				Type:          waE2E.ProtocolMessage_MESSAGE_EDIT.Enum(),
+				Key:           &waCommon.MessageKey{ID: proto.String("MSG1"), FromMe: proto.Bool(true)},
+				EditedMessage: &waE2E.Message{Conversation: proto.String(text)},
+			}},
+		}
+	}
+	cli.archiveMessage(makeEdit(bob, "edited by bob", info.Timestamp.Add(time.Minute)))
+	cli.archiveMessage(makeEdit(alice, "edited", info.Timestamp.Add(2*time.Minute)))
+	entry, err := cli.Store.Messages.GetMessage(alice, "MSG1")
+	if err != nil || entry == nil {
+		t.Fatalf("failed to get message: %v", err)
+	}
+	if entry.Message.GetConversation() != "edited" {
+		t.Errorf("message content is %q after edits", entry.Message.GetConversation())
+	}
+}
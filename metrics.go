@@ -0,0 +1,127 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// Metrics receives measurements from a client. See Client.Metrics.
+//
+// The metrics that are recorded are listed in MetricDefinitions. Label values are passed in the same order as the
+// label names in the definition. The methods are called synchronously in hot paths, so they must be safe for
+// concurrent use and must not block.
+type Metrics interface {
+	// AddCounter increments the counter with the given name.
+	AddCounter(name MetricName, value float64, labelValues ...string)
+	// ObserveHistogram records a single observation in the histogram with the given name.
+	ObserveHistogram(name MetricName, value float64, labelValues ...string)
+}
+
+// MetricName is the name of a metric recorded by the client.
+type MetricName string
+
+const (
+	// MetricMessagesSent counts messages sent successfully. Labels: type.
+	MetricMessagesSent MetricName = "messages_sent_total"
+	// MetricMessagesReceived counts incoming messages that were dispatched to event handlers. Labels: type.
+	MetricMessagesReceived MetricName = "messages_received_total"
+	// MetricDecryptFailures counts incoming messages that couldn't be decrypted. Labels: mode.
+	MetricDecryptFailures MetricName = "decrypt_failures_total"
+	// MetricRetryReceipts counts retry receipts. Labels: direction ("sent" or "received").
+	MetricRetryReceipts MetricName = "retry_receipts_total"
+	// MetricIQDuration is the time it took to get a response to an info query. Labels: namespace, result.
+	MetricIQDuration MetricName = "iq_duration_seconds"
+	// MetricReconnects counts automatic reconnection attempts. Labels: result.
+	MetricReconnects MetricName = "reconnects_total"
+	// MetricKeepAliveFailures counts keepalive pings that didn't get a response in time.
+	MetricKeepAliveFailures MetricName = "keepalive_failures_total"
+	// MetricMediaBytes counts the bytes of media uploaded and downloaded. Labels: direction ("upload" or "download").
+	MetricMediaBytes MetricName = "media_transfer_bytes_total"
+)
+
+// MetricType is the kind of value a metric records.
+type MetricType int
+
+const (
+	MetricTypeCounter MetricType = iota
+	MetricTypeHistogram
+)
+
+// MetricDefinition describes a metric recorded by the client.
+type MetricDefinition struct {
+	Name       MetricName
+	Type       MetricType
+	Help       string
+	LabelNames []string
+}
+
+// MetricDefinitions contains all the metrics that the client records.
+var MetricDefinitions = []MetricDefinition{
+	{MetricMessagesSent, MetricTypeCounter, "Number of messages sent successfully", []string{"type"}},
+	{MetricMessagesReceived, MetricTypeCounter, "Number of incoming messages dispatched to event handlers", []string{"type"}},
+	{MetricDecryptFailures, MetricTypeCounter, "Number of incoming messages that failed to decrypt", []string{"mode"}},
+	{MetricRetryReceipts, MetricTypeCounter, "Number of retry receipts sent and received", []string{"direction"}},
+	{MetricIQDuration, MetricTypeHistogram, "Time taken to get a response to an info query in seconds", []string{"namespace", "result"}},
+	{MetricReconnects, MetricTypeCounter, "Number of automatic reconnection attempts", []string{"result"}},
+	{MetricKeepAliveFailures, MetricTypeCounter, "Number of keepalive pings that timed out", nil},
+	{MetricMediaBytes, MetricTypeCounter, "Number of media bytes transferred", []string{"direction"}},
+}
+
+func (cli *Client) addCounter(name MetricName, value float64, labelValues ...string) {
+	if cli.Metrics != nil {
+		cli.Metrics.AddCounter(name, value, labelValues...)
+	}
+}
+
+func (cli *Client) observeHistogram(name MetricName, value float64, labelValues ...string) {
+	if cli.Metrics != nil {
+		cli.Metrics.ObserveHistogram(name, value, labelValues...)
+	}
+}
+
+func (cli *Client) recordMessageSent(message *waE2E.Message) {
+	if cli.Metrics != nil && message != nil {
+		cli.Metrics.AddCounter(MetricMessagesSent, 1, getTypeFromMessage(message))
+	}
+}
+
+func (cli *Client) recordMessageReceived(evt *events.Message) {
+	if cli.Metrics == nil {
+		return
+	}
+	msgType := "unknown"
+	if evt.RawMessage != nil {
+		msgType = getTypeFromMessage(evt.RawMessage)
+	}
+	cli.Metrics.AddCounter(MetricMessagesReceived, 1, msgType)
+}
+
+func (cli *Client) recordDecryptFailure(mode events.DecryptFailMode) {
+	if mode == events.DecryptFailShow {
+		cli.addCounter(MetricDecryptFailures, 1, "show")
+	} else {
+		cli.addCounter(MetricDecryptFailures, 1, string(mode))
+	}
+}
+
+func (cli *Client) recordIQDuration(namespace string, start time.Time, err error) {
+	if cli.Metrics == nil {
+		return
+	}
+	result := "success"
+	if errors.Is(err, ErrIQTimedOut) {
+		result = "timeout"
+	} else if err != nil {
+		result = "error"
+	}
+	cli.Metrics.ObserveHistogram(MetricIQDuration, time.Since(start).Seconds(), namespace, result)
+}
@@ -0,0 +1,38 @@
+module github.com/Romerito007/whatsmeow/metrics/prommetrics
+
+go 1.22.0
+
+toolchain go1.23.1
+
+require (
+	github.com/Romerito007/whatsmeow v0.0.0-20261016161737-409a0ad28e41
+	github.com/prometheus/client_golang v1.20.5
+)
+
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/mattn/go-colorable v0.1.13 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	github.com/rs/zerolog v1.33.0 // indirect
+	go.mau.fi/libsignal v0.1.1 // indirect
+	go.mau.fi/util v0.8.1 // indirect
+	golang.org/x/crypto v0.29.0 // indirect
+	golang.org/x/net v0.31.0 // indirect
+	golang.org/x/sys v0.27.0 // indirect
+	google.golang.org/protobuf v1.35.1 // indirect
+)
+
+
+// To build against a local checkout of the main module, use a Go workspace instead of a replace directive:
+//
+//	go work init . ./metrics/prommetrics
+//
+// in the repository root. go.work is ignored by git, so the published module keeps depending on a real version.
@@ -0,0 +1,103 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package prommetrics implements whatsmeow.Metrics using the Prometheus client library.
+//
+// This package is a separate Go module, so that the main whatsmeow module doesn't depend on the Prometheus client.
+//
+//	metrics := prommetrics.New("whatsmeow", nil)
+//	prometheus.MustRegister(metrics)
+//	cli.Metrics = metrics
+package prommetrics
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Romerito007/whatsmeow"
+)
+
+// DefaultIQBuckets are the histogram buckets used for whatsmeow.MetricIQDuration if none are specified.
+var DefaultIQBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 75}
+
+// Metrics is a whatsmeow.Metrics implementation that records everything in Prometheus collectors.
+// It implements prometheus.Collector, so it can be registered directly in a registry.
+//
+// A single instance can be shared by multiple clients. To tell clients apart, pass constant labels to New
+// and create a separate instance for each client.
+type Metrics struct {
+	counters   map[whatsmeow.MetricName]*prometheus.CounterVec
+	histograms map[whatsmeow.MetricName]*prometheus.HistogramVec
+}
+
+var _ whatsmeow.Metrics = (*Metrics)(nil)
+var _ prometheus.Collector = (*Metrics)(nil)
+
+// New creates collectors for all the metrics in whatsmeow.MetricDefinitions.
+// The namespace is prepended to all metric names, and the constant labels are added to all metrics.
+func New(namespace string, constLabels prometheus.Labels) *Metrics {
+	m := &Metrics{
+		counters:   make(map[whatsmeow.MetricName]*prometheus.CounterVec),
+		histograms: make(map[whatsmeow.MetricName]*prometheus.HistogramVec),
+	}
+	for _, def := range whatsmeow.MetricDefinitions {
+		switch def.Type {
+		case whatsmeow.MetricTypeCounter:
+			m.counters[def.Name] = prometheus.NewCounterVec(prometheus.CounterOpts{
+				Namespace:   namespace,
+				Name:        string(def.Name),
+				Help:        def.Help,
+				ConstLabels: constLabels,
+			}, def.LabelNames)
+		case whatsmeow.MetricTypeHistogram:
+			m.histograms[def.Name] = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Namespace:   namespace,
+				Name:        string(def.Name),
+				Help:        def.Help,
+				ConstLabels: constLabels,
+				Buckets:     DefaultIQBuckets,
+			}, def.LabelNames)
+		default:
+			panic(fmt.Errorf("unknown type %d for metric %s", def.Type, def.Name))
+		}
+	}
+	return m
+}
+
+// AddCounter implements whatsmeow.Metrics. Unknown metrics are ignored.
+func (m *Metrics) AddCounter(name whatsmeow.MetricName, value float64, labelValues ...string) {
+	if counter, ok := m.counters[name]; ok {
+		counter.WithLabelValues(labelValues...).Add(value)
+	}
+}
+
+// ObserveHistogram implements whatsmeow.Metrics. Unknown metrics are ignored.
+func (m *Metrics) ObserveHistogram(name whatsmeow.MetricName, value float64, labelValues ...string) {
+	if histogram, ok := m.histograms[name]; ok {
+		histogram.WithLabelValues(labelValues...).Observe(value)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, counter := range m.counters {
+		counter.Describe(ch)
+	}
+	for _, histogram := range m.histograms {
+		histogram.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, counter := range m.counters {
+		counter.Collect(ch)
+	}
+	for _, histogram := range m.histograms {
+		histogram.Collect(ch)
+	}
+}
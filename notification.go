@@ -7,8 +7,10 @@
 package whatsmeow
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/Romerito007/whatsmeow/proto/waE2E"
 
 	"google.golang.org/protobuf/proto"
@@ -36,13 +38,19 @@ func (cli *Client) handleEncryptNotification(node *waBinary.Node) {
 		}
 	} else if _, ok := node.GetOptionalChildByTag("identity"); ok {
 		cli.Log.Debugf("Got identity change for %s: %s, deleting all identities/sessions for that number", from, node.XMLString())
-		err := cli.Store.Identities.DeleteAllIdentities(from.User)
-		if err != nil {
-			cli.Log.Warnf("Failed to delete all identities of %s from store after identity change: %v", from, err)
-		}
-		err = cli.Store.Sessions.DeleteAllSessions(from.User)
+		err := cli.Store.DoTxn(context.TODO(), func(ctx context.Context) error {
+			err := cli.Store.DeleteAllIdentitiesContext(ctx, from.User)
+			if err != nil {
+				return fmt.Errorf("failed to delete identities: %w", err)
+			}
+			err = cli.Store.DeleteAllSessionsContext(ctx, from.User)
+			if err != nil {
+				return fmt.Errorf("failed to delete sessions: %w", err)
+			}
+			return nil
+		})
 		if err != nil {
-			cli.Log.Warnf("Failed to delete all sessions of %s from store after identity change: %v", from, err)
+			cli.Log.Warnf("Failed to delete all identities and sessions of %s from store after identity change: %v", from, err)
 		}
 		ts := node.AttrGetter().UnixTime("t")
 		cli.dispatchEvent(&events.IdentityChange{JID: from, Timestamp: ts})
@@ -99,7 +107,7 @@ func (cli *Client) handleDeviceNotification(node *waBinary.Node) {
 	defer cli.userDevicesCacheLock.Unlock()
 	ag := node.AttrGetter()
 	from := ag.JID("from")
-	cached, ok := cli.userDevicesCache[from]
+	cached, ok := cli.getCachedUserDevices(from)
 	if !ok {
 		cli.Log.Debugf("No device list cached for %s, ignoring device list notification", from)
 		return
@@ -129,10 +137,11 @@ func (cli *Client) handleDeviceNotification(node *waBinary.Node) {
 		newParticipantHash := participantListHashV2(cached.devices)
 		if newParticipantHash == deviceHash {
 			cli.Log.Debugf("%s's device list hash changed from %s to %s (%s). New hash matches", from, cachedParticipantHash, deviceHash, child.Tag)
-			cli.userDevicesCache[from] = cached
+			cached.dhash = newParticipantHash
+			cli.putCachedUserDevices(from, cached)
 		} else {
 			cli.Log.Warnf("%s's device list hash changed from %s to %s (%s). New hash doesn't match (%s)", from, cachedParticipantHash, deviceHash, child.Tag, newParticipantHash)
-			delete(cli.userDevicesCache, from)
+			cli.deleteCachedUserDevices(from)
 		}
 	}
 }
@@ -142,7 +151,7 @@ func (cli *Client) handleFBDeviceNotification(node *waBinary.Node) {
 	defer cli.userDevicesCacheLock.Unlock()
 	jid := node.AttrGetter().JID("from")
 	userDevices := parseFBDeviceList(jid, node.GetChildByTag("devices"))
-	cli.userDevicesCache[jid] = userDevices
+	cli.putCachedUserDevices(jid, userDevices)
 }
 
 func (cli *Client) handleOwnDevicesNotification(node *waBinary.Node) {
@@ -153,7 +162,7 @@ func (cli *Client) handleOwnDevicesNotification(node *waBinary.Node) {
 		cli.Log.Debugf("Ignoring own device change notification, session was deleted")
 		return
 	}
-	cached, ok := cli.userDevicesCache[ownID]
+	cached, ok := cli.getCachedUserDevices(ownID)
 	if !ok {
 		cli.Log.Debugf("Ignoring own device change notification, device list not cached")
 		return
@@ -170,10 +179,10 @@ func (cli *Client) handleOwnDevicesNotification(node *waBinary.Node) {
 	newHash := participantListHashV2(newDeviceList)
 	if newHash != expectedNewHash {
 		cli.Log.Debugf("Received own device list change notification %s -> %s, but expected hash was %s", oldHash, newHash, expectedNewHash)
-		delete(cli.userDevicesCache, ownID)
+		cli.deleteCachedUserDevices(ownID)
 	} else {
 		cli.Log.Debugf("Received own device list change notification %s -> %s", oldHash, newHash)
-		cli.userDevicesCache[ownID] = deviceCache{devices: newDeviceList, dhash: expectedNewHash}
+		cli.putCachedUserDevices(ownID, deviceCache{devices: newDeviceList, dhash: expectedNewHash})
 	}
 }
 
@@ -377,7 +386,7 @@ func (cli *Client) handleNotification(node *waBinary.Node) {
 	if !ag.OK() {
 		return
 	}
-	go cli.sendAck(node)
+	cli.sendInBackground(func() { cli.sendAck(node) })
 	switch notifType {
 	case "encrypt":
 		go cli.handleEncryptNotification(node)
@@ -0,0 +1,176 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// ErrOutboxNotAvailable is returned by ReplayOutbox if the device store doesn't have an outbox.
+var ErrOutboxNotAvailable = errors.New("device store doesn't have an outbox")
+
+// The maximum number of events to replay in one ReplayOutbox call.
+const outboxReplayBatchSize = 1000
+
+// DefaultOutboxMaxAttempts is the default value for Client.OutboxMaxAttempts.
+const DefaultOutboxMaxAttempts = 10
+
+func (cli *Client) outboxMaxAttempts() int {
+	if cli.OutboxMaxAttempts == 0 {
+		return DefaultOutboxMaxAttempts
+	}
+	return cli.OutboxMaxAttempts
+}
+
+func decodeOutboxMessage(data []byte) (*events.Message, error) {
+	decoded, err := events.UnmarshalEvent(data)
+	if err != nil {
+		return nil, err
+	}
+	evt, ok := decoded.(*events.Message)
+	if !ok {
+		return nil, fmt.Errorf("unexpected event type %T in outbox", decoded)
+	}
+	evt.IsReplay = true
+	return evt, nil
+}
+
+// deliverMessage dispatches an incoming message event.
+// If AckAfterHandle is enabled, it returns false if the message must not be acknowledged.
+func (cli *Client) deliverMessage(evt *events.Message) bool {
+	cli.recordMessageReceived(evt)
+	if !cli.AckAfterHandle {
+		cli.dispatchEvent(evt)
+		return true
+	}
+	persisted := false
+	if cli.Store.Outbox != nil {
+		data, err := events.MarshalEvent(evt)
+		if err == nil {
+			err = cli.Store.Outbox.PutOutboxEvent(store.OutboxEvent{
+				Chat:   evt.Info.Chat,
+				Sender: evt.Info.Sender,
+				ID:     evt.Info.ID,
+				Data:   data,
+			})
+		}
+		if err != nil {
+			cli.Log.Errorf("Failed to store message %s from %s in outbox: %v", evt.Info.ID, evt.Info.SourceString(), err)
+		} else {
+			persisted = true
+		}
+	}
+	err := cli.dispatchEventAndWait(evt)
+	if err != nil {
+		if !persisted {
+			return false
+		}
+		cli.Log.Warnf("Event handlers failed to handle message %s from %s, it will be replayed from the outbox later: %v", evt.Info.ID, evt.Info.SourceString(), err)
+		err = cli.Store.Outbox.IncrementOutboxAttempts(evt.Info.Chat, evt.Info.ID)
+		if err != nil {
+			cli.Log.Errorf("Failed to increment outbox attempt counter of message %s: %v", evt.Info.ID, err)
+		}
+	} else if persisted {
+		err = cli.Store.Outbox.DeleteOutboxEvent(evt.Info.Chat, evt.Info.ID)
+		if err != nil {
+			cli.Log.Errorf("Failed to delete message %s from outbox: %v", evt.Info.ID, err)
+		}
+	}
+	return true
+}
+
+// ReplayOutbox passes events stored in the outbox to event handlers again (see AckAfterHandle).
+// Events that are handled successfully are removed from the outbox.
+//
+// This is called automatically after connecting if AckAfterHandle is enabled, before any incoming data from
+// the new connection is handled. Calling it manually while connected may interleave the replayed events with
+// live ones.
+//
+// It returns the number of events that were handled successfully. Events that fail again are kept in the outbox
+// and are retried the next time this is called, until they have failed OutboxMaxAttempts times, after which
+// they're dispatched as events.OutboxDeadLetter instead.
+func (cli *Client) ReplayOutbox() (int, error) {
+	if cli.Store.Outbox == nil {
+		return 0, ErrOutboxNotAvailable
+	}
+	cli.outboxReplayLock.Lock()
+	defer cli.outboxReplayLock.Unlock()
+	stored, err := cli.Store.Outbox.GetOutboxEvents(outboxReplayBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get events from outbox: %w", err)
+	}
+	handled := 0
+	maxAttempts := cli.outboxMaxAttempts()
+	for _, entry := range stored {
+		evt, err := decodeOutboxMessage(entry.Data)
+		if maxAttempts > 0 && entry.Attempts >= maxAttempts {
+			err = cli.handleOutboxDeadLetter(entry, evt)
+			if err != nil {
+				return handled, err
+			}
+			continue
+		} else if err != nil {
+			cli.Log.Errorf("Failed to decode message %s in outbox: %v", entry.ID, err)
+			err = cli.Store.Outbox.IncrementOutboxAttempts(entry.Chat, entry.ID)
+			if err != nil {
+				cli.Log.Errorf("Failed to increment outbox attempt counter of message %s: %v", entry.ID, err)
+			}
+			continue
+		}
+		err = cli.dispatchEventAndWait(evt)
+		if err != nil {
+			cli.Log.Warnf("Event handlers failed to handle replayed message %s from %s (attempt #%d): %v", entry.ID, evt.Info.SourceString(), entry.Attempts+1, err)
+			err = cli.Store.Outbox.IncrementOutboxAttempts(entry.Chat, entry.ID)
+			if err != nil {
+				cli.Log.Errorf("Failed to increment outbox attempt counter of message %s: %v", entry.ID, err)
+			}
+			continue
+		}
+		handled++
+		err = cli.Store.Outbox.DeleteOutboxEvent(entry.Chat, entry.ID)
+		if err != nil {
+			return handled, fmt.Errorf("failed to delete message %s from outbox: %w", entry.ID, err)
+		}
+	}
+	return handled, nil
+}
+
+// handleOutboxDeadLetter dispatches an events.OutboxDeadLetter for an outbox entry that has failed too many times,
+// and removes the entry from the outbox if the event handlers succeed. The message is nil if it couldn't be decoded.
+func (cli *Client) handleOutboxDeadLetter(entry *store.OutboxEvent, msg *events.Message) error {
+	cli.Log.Warnf("Giving up on replaying message %s in %s from outbox after %d failed attempts", entry.ID, entry.Chat, entry.Attempts)
+	err := cli.dispatchEventAndWait(&events.OutboxDeadLetter{
+		Chat:     entry.Chat,
+		Sender:   entry.Sender,
+		ID:       entry.ID,
+		Attempts: entry.Attempts,
+		Message:  msg,
+		Data:     entry.Data,
+	})
+	if err != nil {
+		cli.Log.Warnf("Event handlers failed to handle dead letter of message %s, keeping it in outbox: %v", entry.ID, err)
+		return nil
+	}
+	err = cli.Store.Outbox.DeleteOutboxEvent(entry.Chat, entry.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete message %s from outbox: %w", entry.ID, err)
+	}
+	return nil
+}
+
+func (cli *Client) replayOutboxAfterConnect() {
+	handled, err := cli.ReplayOutbox()
+	if err != nil {
+		cli.Log.Errorf("Failed to replay outbox: %v", err)
+	} else if handled > 0 {
+		cli.Log.Infof("Replayed %d messages from outbox", handled)
+	}
+}
@@ -59,7 +59,7 @@ func (cli *Client) uploadPreKeys() {
 	}
 	var registrationIDBytes [4]byte
 	binary.BigEndian.PutUint32(registrationIDBytes[:], cli.Store.RegistrationID)
-	preKeys, err := cli.Store.PreKeys.GetOrGenPreKeys(WantedPreKeyCount)
+	preKeys, err := cli.Store.GetOrGenPreKeysContext(context.TODO(), WantedPreKeyCount)
 	if err != nil {
 		cli.Log.Errorf("Failed to get prekeys to upload: %v", err)
 		return
@@ -82,7 +82,7 @@ func (cli *Client) uploadPreKeys() {
 		return
 	}
 	cli.Log.Debugf("Got response to uploading prekeys")
-	err = cli.Store.PreKeys.MarkPreKeysAsUploaded(preKeys[len(preKeys)-1].KeyID)
+	err = cli.Store.MarkPreKeysAsUploadedContext(context.TODO(), preKeys[len(preKeys)-1].KeyID)
 	if err != nil {
 		cli.Log.Warnf("Failed to mark prekeys as uploaded: %v", err)
 	}
@@ -94,7 +94,11 @@ type preKeyResp struct {
 	err    error
 }
 
-func (cli *Client) fetchPreKeys(ctx context.Context, users []types.JID) (map[types.JID]preKeyResp, error) {
+func (cli *Client) fetchPreKeys(ctx context.Context, users []types.JID) (respData map[types.JID]preKeyResp, err error) {
+	ctx, span := cli.startSpan(ctx, "whatsmeow.fetch_prekeys", TraceAttribute{Key: "user_count", Value: len(users)})
+	defer func() {
+		endSpan(span, err)
+	}()
 	requests := make([]waBinary.Node, len(users))
 	for i, user := range users {
 		requests[i].Tag = "user"
@@ -119,7 +123,7 @@ func (cli *Client) fetchPreKeys(ctx context.Context, users []types.JID) (map[typ
 		return nil, fmt.Errorf("got empty response to prekey request")
 	}
 	list := resp.GetChildByTag("list")
-	respData := make(map[types.JID]preKeyResp)
+	respData = make(map[types.JID]preKeyResp)
 	for _, child := range list.GetChildren() {
 		if child.Tag != "user" {
 			continue
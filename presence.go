@@ -39,6 +39,7 @@ func (cli *Client) handlePresence(node *waBinary.Node) {
 	var evt events.Presence
 	ag := node.AttrGetter()
 	evt.From = ag.JID("from")
+	evt.FromAlt = cli.getAltJID(evt.From)
 	presenceType := ag.OptionalString("type")
 	if presenceType == "unavailable" {
 		evt.Unavailable = true
@@ -7,6 +7,7 @@
 package whatsmeow
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -21,8 +22,9 @@ func (cli *Client) handleReceipt(node *waBinary.Node) {
 		cli.Log.Warnf("Failed to parse receipt: %v", err)
 	} else if receipt != nil {
 		if receipt.Type == types.ReceiptTypeRetry {
+			cli.addCounter(MetricRetryReceipts, 1, "received")
 			go func() {
-				err := cli.handleRetryReceipt(receipt, node)
+				err := cli.handleRetryReceipt(context.TODO(), receipt, node)
 				if err != nil {
 					cli.Log.Errorf("Failed to handle retry receipt for %s/%s from %s: %v", receipt.Chat, receipt.MessageIDs[0], receipt.Sender, err)
 				}
@@ -30,7 +32,7 @@ func (cli *Client) handleReceipt(node *waBinary.Node) {
 		}
 		go cli.dispatchEvent(receipt)
 	}
-	go cli.sendAck(node)
+	cli.sendInBackground(func() { cli.sendAck(node) })
 }
 
 func (cli *Client) handleGroupedReceipt(partialReceipt events.Receipt, participants *waBinary.Node) {
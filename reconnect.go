@@ -0,0 +1,188 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// ReconnectPolicy decides when the client reconnects automatically after losing the connection
+// (see Client.EnableAutoReconnect and Client.ReconnectPolicy).
+type ReconnectPolicy interface {
+	// NextDelay returns how long to wait before the given reconnection attempt. Attempts are numbered from 1,
+	// and the number is only reset after the client successfully connects and logs in.
+	NextDelay(attempt int) time.Duration
+	// ShouldGiveUp is called after a reconnection attempt fails. If it returns true, the client stops reconnecting.
+	ShouldGiveUp(attempt int, err error) bool
+	// Reset is called after the client successfully connects and logs in.
+	Reset()
+}
+
+// Default values for ExponentialBackoffPolicy.
+const (
+	DefaultReconnectInitialDelay = 1 * time.Second
+	DefaultReconnectMaxDelay     = 2 * time.Minute
+	DefaultReconnectMultiplier   = 2
+	DefaultReconnectJitter       = 0.25
+)
+
+// ExponentialBackoffPolicy is a ReconnectPolicy where the delay grows exponentially up to a limit.
+// The delays are randomized, so that many clients that lose their connections at the same time
+// don't all reconnect at the same time.
+type ExponentialBackoffPolicy struct {
+	// The delay before the first attempt. If zero or negative, DefaultReconnectInitialDelay is used.
+	InitialDelay time.Duration
+	// The maximum delay between attempts. If zero or negative, DefaultReconnectMaxDelay is used.
+	MaxDelay time.Duration
+	// The factor by which the delay grows after each attempt. If less than 1, DefaultReconnectMultiplier is used.
+	Multiplier float64
+	// The fraction of the delay that is randomized, between 0 and 1. For example, with 0.25, a 20 second
+	// delay becomes a random delay between 15 and 20 seconds. Zero disables randomization.
+	Jitter float64
+	// The number of failed attempts after which to give up. Zero means reconnecting forever.
+	MaxAttempts int
+}
+
+var _ ReconnectPolicy = (*ExponentialBackoffPolicy)(nil)
+
+// DefaultReconnectPolicy returns the policy used if Client.ReconnectPolicy is not set.
+func DefaultReconnectPolicy() *ExponentialBackoffPolicy {
+	return &ExponentialBackoffPolicy{
+		InitialDelay: DefaultReconnectInitialDelay,
+		MaxDelay:     DefaultReconnectMaxDelay,
+		Multiplier:   DefaultReconnectMultiplier,
+		Jitter:       DefaultReconnectJitter,
+	}
+}
+
+func (ebp *ExponentialBackoffPolicy) NextDelay(attempt int) time.Duration {
+	initialDelay, maxDelay, multiplier := ebp.InitialDelay, ebp.MaxDelay, ebp.Multiplier
+	if initialDelay <= 0 {
+		initialDelay = DefaultReconnectInitialDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultReconnectMaxDelay
+	}
+	if multiplier < 1 {
+		multiplier = DefaultReconnectMultiplier
+	}
+	// The exponent can overflow to +Inf after enough attempts, which is also caught by the comparison
+	delay := float64(initialDelay) * math.Pow(multiplier, float64(max(attempt-1, 0)))
+	if delay > float64(maxDelay) {
+		delay = float64(maxDelay)
+	}
+	if ebp.Jitter > 0 {
+		delay -= delay * min(ebp.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+func (ebp *ExponentialBackoffPolicy) ShouldGiveUp(attempt int, _ error) bool {
+	return ebp.MaxAttempts > 0 && attempt >= ebp.MaxAttempts
+}
+
+func (ebp *ExponentialBackoffPolicy) Reset() {}
+
+func (cli *Client) getReconnectPolicy() ReconnectPolicy {
+	if cli.ReconnectPolicy == nil {
+		return DefaultReconnectPolicy()
+	}
+	return cli.ReconnectPolicy
+}
+
+// startReconnectLoop returns a context that is canceled when Disconnect is called.
+// If another reconnect loop is already running, it returns false.
+func (cli *Client) startReconnectLoop() (context.Context, bool) {
+	cli.reconnectLock.Lock()
+	defer cli.reconnectLock.Unlock()
+	if cli.reconnectCtx != nil {
+		return nil, false
+	}
+	cli.reconnectCtx, cli.cancelReconnect = context.WithCancel(context.Background())
+	return cli.reconnectCtx, true
+}
+
+// finishReconnectLoop marks the reconnect loop with the given context as finished.
+func (cli *Client) finishReconnectLoop(ctx context.Context) {
+	cli.reconnectLock.Lock()
+	if cli.reconnectCtx == ctx {
+		cli.cancelReconnect()
+		cli.reconnectCtx, cli.cancelReconnect = nil, nil
+	}
+	cli.reconnectLock.Unlock()
+}
+
+// stopReconnectLoop cancels the currently running reconnect loop, if any.
+func (cli *Client) stopReconnectLoop() {
+	cli.reconnectLock.Lock()
+	if cli.cancelReconnect != nil {
+		cli.cancelReconnect()
+		cli.reconnectCtx, cli.cancelReconnect = nil, nil
+	}
+	cli.reconnectLock.Unlock()
+}
+
+func (cli *Client) autoReconnect() {
+	if !cli.EnableAutoReconnect || cli.Store.ID == nil {
+		return
+	} else if cli.inFlight.isClosing() {
+		cli.Log.Debugf("Not starting automatic reconnection as the client is shutting down")
+		return
+	}
+	ctx, ok := cli.startReconnectLoop()
+	if !ok {
+		cli.Log.Debugf("Not starting automatic reconnection as it's already in progress")
+		return
+	}
+	defer cli.finishReconnectLoop(ctx)
+	policy := cli.getReconnectPolicy()
+	var lastErr error
+	for {
+		cli.AutoReconnectErrors++
+		attempt := cli.AutoReconnectErrors
+		delay := policy.NextDelay(attempt)
+		cli.Log.Debugf("Automatically reconnecting after %v (attempt #%d)", delay, attempt)
+		cli.setState(StateBackingOff, fmt.Sprintf("reconnect attempt #%d in %s", attempt, delay))
+		cli.dispatchEvent(&events.ReconnectScheduled{Attempt: attempt, Delay: delay, LastError: lastErr})
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			cli.Log.Debugf("Automatic reconnection was cancelled")
+			return
+		}
+		err := cli.Connect()
+		if errors.Is(err, ErrAlreadyConnected) {
+			cli.Log.Debugf("Connect() said we're already connected after autoreconnect sleep")
+			return
+		} else if err != nil {
+			lastErr = err
+			cli.addCounter(MetricReconnects, 1, "error")
+			cli.Log.Errorf("Error reconnecting after autoreconnect sleep: %v", err)
+			if cli.AutoReconnectHook != nil && !cli.AutoReconnectHook(err) {
+				cli.Log.Debugf("AutoReconnectHook returned false, not reconnecting")
+				cli.setDisconnectedState("AutoReconnectHook stopped reconnecting")
+				return
+			} else if policy.ShouldGiveUp(attempt, err) {
+				cli.Log.Warnf("Giving up on reconnecting after %d attempts", attempt)
+				cli.setDisconnectedState(fmt.Sprintf("gave up reconnecting after %d attempts", attempt))
+				return
+			}
+		} else {
+			cli.addCounter(MetricReconnects, 1, "success")
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoffPolicyNextDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ExponentialBackoffPolicy
+		attempt  int
+		minDelay time.Duration
+		maxDelay time.Duration
+	}{
+		{"default first attempt", *DefaultReconnectPolicy(), 1, 750 * time.Millisecond, time.Second},
+		{"default third attempt", *DefaultReconnectPolicy(), 3, 3 * time.Second, 4 * time.Second},
+		{"default capped", *DefaultReconnectPolicy(), 20, 90 * time.Second, 2 * time.Minute},
+		{"attempt zero", *DefaultReconnectPolicy(), 0, 750 * time.Millisecond, time.Second},
+		{"zero value", ExponentialBackoffPolicy{}, 1, time.Second, time.Second},
+		{"zero value grows", ExponentialBackoffPolicy{}, 4, 8 * time.Second, 8 * time.Second},
+		{"zero value capped", ExponentialBackoffPolicy{}, 50, 2 * time.Minute, 2 * time.Minute},
+		{"no max delay", ExponentialBackoffPolicy{InitialDelay: time.Second, Multiplier: 10}, 10000, 2 * time.Minute, 2 * time.Minute},
+		{"negative fields", ExponentialBackoffPolicy{InitialDelay: -1, MaxDelay: -1, Multiplier: -2, Jitter: -1}, 2, 2 * time.Second, 2 * time.Second},
+		{"multiplier below one", ExponentialBackoffPolicy{InitialDelay: time.Second, Multiplier: 0.5}, 3, 4 * time.Second, 4 * time.Second},
+		{"constant", ExponentialBackoffPolicy{InitialDelay: 5 * time.Second, Multiplier: 1}, 100, 5 * time.Second, 5 * time.Second},
+		{"initial delay above max", ExponentialBackoffPolicy{InitialDelay: time.Hour, MaxDelay: time.Minute}, 1, time.Minute, time.Minute},
+		{"custom", ExponentialBackoffPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 3}, 3, 900 * time.Millisecond, 900 * time.Millisecond},
+		{"full jitter", ExponentialBackoffPolicy{InitialDelay: 10 * time.Second, Jitter: 1}, 1, 0, 10 * time.Second},
+		{"jitter above one", ExponentialBackoffPolicy{InitialDelay: 10 * time.Second, Jitter: 5}, 1, 0, 10 * time.Second},
+		{"jitter on capped delay", ExponentialBackoffPolicy{MaxDelay: 10 * time.Second, Jitter: 0.5}, 100, 5 * time.Second, 10 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The jitter is random, so check the bounds over many samples
+			for i := 0; i < 1000; i++ {
+				delay := test.policy.NextDelay(test.attempt)
+				if delay < test.minDelay || delay > test.maxDelay {
+					t.Fatalf("delay %s is outside [%s, %s]", delay, test.minDelay, test.maxDelay)
+				}
+			}
+		})
+	}
+}
+
+func TestExponentialBackoffPolicyShouldGiveUp(t *testing.T) {
+	forever := ExponentialBackoffPolicy{}
+	if forever.ShouldGiveUp(1000, nil) {
+		t.Errorf("policy without max attempts gave up")
+	}
+	limited := ExponentialBackoffPolicy{MaxAttempts: 3}
+	if limited.ShouldGiveUp(2, nil) {
+		t.Errorf("policy gave up before max attempts")
+	} else if !limited.ShouldGiveUp(3, nil) {
+		t.Errorf("policy didn't give up after max attempts")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"sync"
+	"time"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+)
+
+// RecordDirection specifies whether a recorded node was received or sent.
+type RecordDirection string
+
+const (
+	RecordIncoming RecordDirection = "in"
+	RecordOutgoing RecordDirection = "out"
+)
+
+// recordedPlaintextAttr is added to <enc> elements in recorded message nodes whose content
+// was replaced with the decrypted plaintext.
+const recordedPlaintextAttr = "_plaintext"
+
+// ErrReplayWhileConnected is returned by ReplayRecording if the client is connected to WhatsApp.
+var ErrReplayWhileConnected = errors.New("can't replay recording while connected")
+
+// NodeRecord is a single line in a recording made with NodeRecorder.
+type NodeRecord struct {
+	Time      time.Time
+	Direction RecordDirection
+	Node      *waBinary.Node
+}
+
+type marshalableNodeRecord struct {
+	Time      time.Time         `json:"time"`
+	Direction RecordDirection   `json:"direction"`
+	Node      waBinary.JSONNode `json:"node"`
+}
+
+func (rec NodeRecord) MarshalJSON() ([]byte, error) {
+	mrec := marshalableNodeRecord{Time: rec.Time, Direction: rec.Direction}
+	if rec.Node != nil {
+		mrec.Node = waBinary.ToJSONNode(rec.Node)
+	}
+	return json.Marshal(&mrec)
+}
+
+func (rec *NodeRecord) UnmarshalJSON(data []byte) error {
+	var mrec marshalableNodeRecord
+	err := json.Unmarshal(data, &mrec)
+	if err != nil {
+		return err
+	}
+	node, err := mrec.Node.ToNode()
+	if err != nil {
+		return err
+	}
+	rec.Time = mrec.Time
+	rec.Direction = mrec.Direction
+	rec.Node = &node
+	return nil
+}
+
+// NodeRecorder writes the nodes sent and received by a client to a JSONL file. See Client.SetNodeRecorder.
+//
+// Incoming messages are recorded after they've been decrypted: the content of each <enc> element that was
+// decrypted successfully is replaced with the plaintext, so the recording can be replayed without the Signal
+// sessions. Outgoing messages are recorded as sent, i.e. encrypted. Messages still keep the position in the
+// recording (and the timestamp) of when they were received, so records are always in the order the client
+// saw them.
+//
+// Recordings contain message contents and other sensitive data, so they should be handled with care.
+type NodeRecorder struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+
+	// The position of the next reserved record and the next record to be written.
+	nextPos  uint64
+	writePos uint64
+	// Records that have been reserved, but can't be written yet, either because they haven't been filled
+	// (Node is nil) or because they're waiting for an earlier record to be filled.
+	pending map[uint64]*NodeRecord
+}
+
+// NewNodeRecorder creates a new recorder that writes to the given writer.
+func NewNodeRecorder(w io.Writer) *NodeRecorder {
+	return &NodeRecorder{enc: json.NewEncoder(w), pending: make(map[uint64]*NodeRecord)}
+}
+
+// Record writes a single node to the recording.
+func (rec *NodeRecorder) Record(direction RecordDirection, node *waBinary.Node) error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	pos := rec.unlockedReserve(direction)
+	return rec.unlockedFill(pos, node)
+}
+
+// reserve reserves a position for a record that will be filled later with fill.
+// Records after the reserved one are buffered until it's filled.
+func (rec *NodeRecorder) reserve(direction RecordDirection) uint64 {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return rec.unlockedReserve(direction)
+}
+
+func (rec *NodeRecorder) unlockedReserve(direction RecordDirection) uint64 {
+	pos := rec.nextPos
+	rec.nextPos++
+	rec.pending[pos] = &NodeRecord{Time: time.Now(), Direction: direction}
+	return pos
+}
+
+// fill sets the node of a record reserved with reserve, and writes all records that are no longer waiting
+// for earlier ones.
+func (rec *NodeRecorder) fill(pos uint64, node *waBinary.Node) error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return rec.unlockedFill(pos, node)
+}
+
+func (rec *NodeRecorder) unlockedFill(pos uint64, node *waBinary.Node) error {
+	rec.pending[pos].Node = node
+	var errs []error
+	for {
+		next, ok := rec.pending[rec.writePos]
+		if !ok || next.Node == nil {
+			break
+		}
+		if err := rec.enc.Encode(next); err != nil {
+			errs = append(errs, err)
+		}
+		delete(rec.pending, rec.writePos)
+		rec.writePos++
+	}
+	return errors.Join(errs...)
+}
+
+// NodeRecordReader reads recordings made with NodeRecorder.
+type NodeRecordReader struct {
+	dec *json.Decoder
+}
+
+// NewNodeRecordReader creates a new reader for a recording.
+func NewNodeRecordReader(r io.Reader) *NodeRecordReader {
+	return &NodeRecordReader{dec: json.NewDecoder(r)}
+}
+
+// Next reads the next record. It returns io.EOF when there are no more records.
+func (rr *NodeRecordReader) Next() (*NodeRecord, error) {
+	var rec NodeRecord
+	err := rr.dec.Decode(&rec)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// SetNodeRecorder sets the recorder that all nodes sent and received by this client are written to.
+// The recorder can be removed by passing nil.
+func (cli *Client) SetNodeRecorder(rec *NodeRecorder) {
+	cli.recorder.Store(rec)
+}
+
+func (cli *Client) recordNode(direction RecordDirection, node *waBinary.Node) {
+	if rec := cli.recorder.Load(); rec != nil {
+		err := rec.Record(direction, node)
+		if err != nil {
+			cli.Log.Warnf("Failed to record %s node: %v", node.Tag, err)
+		}
+	}
+}
+
+// recordSlot is the reserved position of an incoming node in a recording.
+type recordSlot struct {
+	rec *NodeRecorder
+	pos uint64
+}
+
+func (slot *recordSlot) fill(cli *Client, node *waBinary.Node) {
+	err := slot.rec.fill(slot.pos, node)
+	if err != nil {
+		cli.Log.Warnf("Failed to record %s node: %v", node.Tag, err)
+	}
+}
+
+// reserveRecordSlot reserves the position of an incoming node in the recording when it's received,
+// so that it can be recorded after being handled (see recordDecryptedMessage) without changing the order.
+func (cli *Client) reserveRecordSlot(node *waBinary.Node) {
+	if rec := cli.recorder.Load(); rec != nil {
+		cli.recordSlots.Store(node, &recordSlot{rec: rec, pos: rec.reserve(RecordIncoming)})
+	}
+}
+
+// takeRecordSlot returns the position reserved for the given node with reserveRecordSlot.
+// If there's no reservation, but a recorder is set, a new position is reserved.
+func (cli *Client) takeRecordSlot(node *waBinary.Node) *recordSlot {
+	if slot, ok := cli.recordSlots.LoadAndDelete(node); ok {
+		return slot.(*recordSlot)
+	} else if rec := cli.recorder.Load(); rec != nil {
+		return &recordSlot{rec: rec, pos: rec.reserve(RecordIncoming)}
+	}
+	return nil
+}
+
+// releaseRecordSlot records the node as-is if a position was reserved for it, but it won't be handled.
+func (cli *Client) releaseRecordSlot(node *waBinary.Node) {
+	if slot, ok := cli.recordSlots.LoadAndDelete(node); ok {
+		slot.(*recordSlot).fill(cli, node)
+	}
+}
+
+// recordDecryptedMessage records an incoming message node with the given <enc> children replaced by their plaintext.
+func (cli *Client) recordDecryptedMessage(slot *recordSlot, node *waBinary.Node, plaintexts map[int][]byte) {
+	if len(plaintexts) == 0 {
+		slot.fill(cli, node)
+		return
+	}
+	children := append([]waBinary.Node(nil), node.GetChildren()...)
+	for index, plaintext := range plaintexts {
+		children[index].Attrs = maps.Clone(children[index].Attrs)
+		children[index].Attrs[recordedPlaintextAttr] = "true"
+		children[index].Content = plaintext
+	}
+	slot.fill(cli, &waBinary.Node{Tag: node.Tag, Attrs: node.Attrs, Content: children})
+}
+
+// getReplayedPlaintext returns the recorded plaintext of an <enc> element if a recording is being replayed.
+func (cli *Client) getReplayedPlaintext(enc *waBinary.Node) ([]byte, bool) {
+	if !cli.replaying.Load() || enc.AttrGetter().OptionalString(recordedPlaintextAttr) != "true" {
+		return nil, false
+	}
+	plaintext, ok := enc.Content.([]byte)
+	return plaintext, ok
+}
+
+// ReplayRecording feeds the incoming nodes in a recording made with NodeRecorder through the node handlers
+// of this client, as if they were received from the server. Outgoing nodes in the recording are ignored.
+//
+// Nodes are handled synchronously one at a time in the order they were recorded, which makes this useful for
+// testing event handlers deterministically. Events are dispatched to the event handlers as usual.
+//
+// The client must not be connected, and the device store must have the same ID as the device that made the
+// recording. Anything that requires a connection (e.g. sending receipts or downloading history syncs)
+// will fail and log errors. Messages whose decryption failed when recording will fail again.
+func (cli *Client) ReplayRecording(r io.Reader) error {
+	if cli.IsConnected() {
+		return ErrReplayWhileConnected
+	} else if cli.Store.ID == nil {
+		return ErrNotLoggedIn
+	}
+	cli.replaying.Store(true)
+	defer cli.replaying.Store(false)
+	reader := NewNodeRecordReader(r)
+	for i := 1; ; i++ {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read record #%d: %w", i, err)
+		}
+		if rec.Direction != RecordIncoming {
+			continue
+		}
+		if handler, ok := cli.nodeHandlers[rec.Node.Tag]; ok {
+			handler(rec.Node)
+		} else {
+			cli.Log.Debugf("No handler for replayed node %s", rec.Node.Tag)
+		}
+	}
+}
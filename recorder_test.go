@@ -0,0 +1,207 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+func readRecordTags(t *testing.T, data []byte) []string {
+	t.Helper()
+	reader := NewNodeRecordReader(bytes.NewReader(data))
+	var tags []string
+	for {
+		rec, err := reader.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("failed to read record: %v", err)
+			}
+			return tags
+		}
+		tags = append(tags, string(rec.Direction)+":"+rec.Node.Tag)
+	}
+}
+
+func TestNodeRecorderOrdering(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewNodeRecorder(&buf)
+	first := rec.reserve(RecordIncoming)
+	if err := rec.Record(RecordOutgoing, &waBinary.Node{Tag: "second"}); err != nil {
+		t.Fatalf("failed to record node: %v", err)
+	}
+	third := rec.reserve(RecordIncoming)
+	if err := rec.fill(third, &waBinary.Node{Tag: "third"}); err != nil {
+		t.Fatalf("failed to fill record: %v", err)
+	}
+	// Everything waits for the first record, which hasn't been filled yet
+	if buf.Len() != 0 {
+		t.Fatalf("records were written before the first reserved record was filled: %s", buf.String())
+	}
+	if err := rec.fill(first, &waBinary.Node{Tag: "first"}); err != nil {
+		t.Fatalf("failed to fill record: %v", err)
+	}
+	if err := rec.Record(RecordIncoming, &waBinary.Node{Tag: "fourth"}); err != nil {
+		t.Fatalf("failed to record node: %v", err)
+	}
+	tags := readRecordTags(t, buf.Bytes())
+	expected := []string{"in:first", "out:second", "in:third", "in:fourth"}
+	if !slices.Equal(tags, expected) {
+		t.Errorf("records were written in order %v, expected %v", tags, expected)
+	}
+	if len(rec.pending) != 0 {
+		t.Errorf("recorder still has %d pending records", len(rec.pending))
+	}
+}
+
+func TestNodeRecordJSONRoundTrip(t *testing.T) {
+	node := &waBinary.Node{
+		Tag: "message",
+		Attrs: waBinary.Attrs{
+			"from":        testGroupJID,
+			"participant": testLID1,
+			"id":          "MSG",
+			"t":           int64(1700000000),
+			// Strings that look like JIDs must stay strings
+			"notify": "1234@s.whatsapp.net",
+		},
+		Content: []waBinary.Node{
+			{Tag: "enc", Attrs: waBinary.Attrs{"v": "2", "type": "skmsg"}, Content: []byte{0, 1, 2, 0xff}},
+			{Tag: "meta", Attrs: waBinary.Attrs{"target_sender_jid": testPN1}},
+		},
+	}
+	original := NodeRecord{Time: time.Unix(1700000000, 0).UTC(), Direction: RecordIncoming, Node: node}
+	data, err := json.Marshal(original)
+	if err != nil {
+		t.Fatalf("failed to marshal record: %v", err)
+	}
+	var decoded NodeRecord
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal record: %v", err)
+	}
+	if !decoded.Time.Equal(original.Time) || decoded.Direction != original.Direction {
+		t.Errorf("record metadata changed: %+v", decoded)
+	}
+	// Non-string attributes are stored as strings, like in the binary format
+	expected := *node
+	expected.Attrs = waBinary.Attrs{
+		"from":        testGroupJID,
+		"participant": testLID1,
+		"id":          "MSG",
+		"t":           "1700000000",
+		"notify":      "1234@s.whatsapp.net",
+	}
+	if !reflect.DeepEqual(*decoded.Node, expected) {
+		t.Errorf("node changed in round trip:\n%s\nexpected\n%s", decoded.Node.XMLString(), expected.XMLString())
+	}
+	// Decoding the binary form of the original node gives the same result
+	encoded, err := waBinary.Marshal(*node)
+	if err != nil {
+		t.Fatalf("failed to encode node: %v", err)
+	}
+	unpacked, err := waBinary.Unpack(encoded)
+	if err != nil {
+		t.Fatalf("failed to unpack node: %v", err)
+	}
+	fromBinary, err := waBinary.Unmarshal(unpacked)
+	if err != nil {
+		t.Fatalf("failed to decode node: %v", err)
+	}
+	if !reflect.DeepEqual(fromBinary, decoded.Node) {
+		t.Errorf("node changed in round trip:\n%s\nexpected the same as from binary\n%s", decoded.Node.XMLString(), fromBinary.XMLString())
+	}
+}
+
+func makeRecordedMessageNode(id types.MessageID, encType string, content []byte) *waBinary.Node {
+	return &waBinary.Node{
+		Tag: "message",
+		Attrs: waBinary.Attrs{
+			"from": testPN1,
+			"id":   id,
+			"t":    "1700000000",
+			"type": "text",
+		},
+		Content: []waBinary.Node{{Tag: "enc", Attrs: waBinary.Attrs{"v": "2", "type": encType}, Content: content}},
+	}
+}
+
+func TestReplayRecording(t *testing.T) {
+	var buf bytes.Buffer
+	recorder := NewNodeRecorder(&buf)
+	recCli := newTestClient(t)
+	recCli.SetNodeRecorder(recorder)
+	// Record a message as if it had been decrypted successfully
+	plaintext, err := proto.Marshal(&waE2E.Message{Conversation: proto.String("Hello")})
+	if err != nil {
+		t.Fatalf("failed to marshal message: %v", err)
+	}
+	decrypted := makeRecordedMessageNode("DECRYPTED", "msg", []byte("ciphertext"))
+	recCli.recordDecryptedMessage(recCli.takeRecordSlot(decrypted), decrypted, map[int][]byte{0: plaintext})
+	recCli.recordNode(RecordOutgoing, &waBinary.Node{Tag: "receipt", Attrs: waBinary.Attrs{"id": "DECRYPTED"}})
+	// A message that couldn't be decrypted when recording is recorded as-is
+	undecryptable := makeRecordedMessageNode("UNDECRYPTABLE", "msg", []byte("ciphertext"))
+	recCli.recordDecryptedMessage(recCli.takeRecordSlot(undecryptable), undecryptable, map[int][]byte{})
+	if strings.Contains(buf.String(), "Hello") {
+		t.Fatalf("recording contains plaintext as a string, expected base64 bytes")
+	}
+
+	cli := newTestClient(t)
+	var received []any
+	cli.AddEventHandler(func(evt any) {
+		switch evt.(type) {
+		case *events.Message, *events.UndecryptableMessage:
+			received = append(received, evt)
+		}
+	})
+	if err = cli.ReplayRecording(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("failed to replay recording: %v", err)
+	}
+	if len(received) != 2 {
+		t.Fatalf("got %d events from replay, expected 2", len(received))
+	}
+	msg, ok := received[0].(*events.Message)
+	if !ok {
+		t.Fatalf("first event is %T, expected message", received[0])
+	} else if msg.Info.ID != "DECRYPTED" || msg.Info.Sender != testPN1 || msg.Message.GetConversation() != "Hello" {
+		t.Errorf("unexpected replayed message %s from %s: %q", msg.Info.ID, msg.Info.Sender, msg.Message.GetConversation())
+	}
+	if undecryptableEvt, ok := received[1].(*events.UndecryptableMessage); !ok {
+		t.Errorf("second event is %T, expected undecryptable message", received[1])
+	} else if undecryptableEvt.Info.ID != "UNDECRYPTABLE" {
+		t.Errorf("unexpected undecryptable message %s", undecryptableEvt.Info.ID)
+	}
+	if cli.replaying.Load() {
+		t.Errorf("client is still in replay mode after replay")
+	}
+
+	// The plaintext marker is ignored outside replays, so recordings can't inject plaintext into live traffic
+	received = nil
+	rec, err := NewNodeRecordReader(bytes.NewReader(buf.Bytes())).Next()
+	if err != nil {
+		t.Fatalf("failed to read record: %v", err)
+	}
+	cli.handleEncryptedMessage(rec.Node)
+	if len(received) != 1 {
+		t.Fatalf("got %d events from handling recorded node outside replay, expected 1", len(received))
+	} else if _, ok = received[0].(*events.UndecryptableMessage); !ok {
+		t.Errorf("handling recorded node outside replay dispatched %T, expected undecryptable message", received[0])
+	}
+}
@@ -14,6 +14,7 @@ import (
 
 	waBinary "github.com/Romerito007/whatsmeow/binary"
 	"github.com/Romerito007/whatsmeow/types"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
 )
 
 func (cli *Client) generateRequestID() string {
@@ -141,6 +142,19 @@ func (cli *Client) sendIQAsync(query infoQuery) (<-chan *waBinary.Node, error) {
 const defaultRequestTimeout = 75 * time.Second
 
 func (cli *Client) sendIQ(query infoQuery) (*waBinary.Node, error) {
+	var span Span
+	query.Context, span = cli.startSpan(query.Context, "whatsmeow.iq",
+		TraceAttribute{Key: "namespace", Value: query.Namespace}, TraceAttribute{Key: "type", Value: string(query.Type)})
+	start := time.Now()
+	cli.inFlight.add()
+	res, err := cli.sendIQAndWait(query)
+	cli.inFlight.done()
+	cli.recordIQDuration(query.Namespace, start, err)
+	endSpan(span, err)
+	return res, err
+}
+
+func (cli *Client) sendIQAndWait(query infoQuery) (*waBinary.Node, error) {
 	resChan, data, err := cli.sendIQAsyncAndGetData(&query)
 	if err != nil {
 		return nil, err
@@ -177,14 +191,15 @@ func (cli *Client) sendIQ(query infoQuery) (*waBinary.Node, error) {
 }
 
 func (cli *Client) retryFrame(reqType, id string, data []byte, origResp *waBinary.Node, ctx context.Context, timeout time.Duration) (*waBinary.Node, error) {
+	log := waLog.With(cli.Log, "request_id", id, "request_type", reqType)
 	if isAuthErrorDisconnect(origResp) {
-		cli.Log.Debugf("%s (%s) was interrupted by websocket disconnection (%s), not retrying as it looks like an auth error", id, reqType, origResp.XMLString())
+		log.Debugf("%s (%s) was interrupted by websocket disconnection (%s), not retrying as it looks like an auth error", id, reqType, origResp.XMLString())
 		return nil, &DisconnectedError{Action: reqType, Node: origResp}
 	}
 
-	cli.Log.Debugf("%s (%s) was interrupted by websocket disconnection (%s), waiting for reconnect to retry...", id, reqType, origResp.XMLString())
+	log.Debugf("%s (%s) was interrupted by websocket disconnection (%s), waiting for reconnect to retry...", id, reqType, origResp.XMLString())
 	if !cli.WaitForConnection(5 * time.Second) {
-		cli.Log.Debugf("Websocket didn't reconnect within 5 seconds of failed %s (%s)", reqType, id)
+		log.Debugf("Websocket didn't reconnect within 5 seconds of failed %s (%s)", reqType, id)
 		return nil, &DisconnectedError{Action: reqType, Node: origResp}
 	}
 
@@ -215,7 +230,7 @@ func (cli *Client) retryFrame(reqType, id string, data []byte, origResp *waBinar
 		return nil, ErrIQTimedOut
 	}
 	if isDisconnectNode(resp) {
-		cli.Log.Debugf("Retrying %s %s was interrupted by websocket disconnection (%v), not retrying anymore", reqType, id, resp.XMLString())
+		log.Debugf("Retrying %s %s was interrupted by websocket disconnection (%v), not retrying anymore", reqType, id, resp.XMLString())
 		return nil, &DisconnectedError{Action: fmt.Sprintf("%s (retry)", reqType), Node: resp}
 	}
 	return resp, nil
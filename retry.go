@@ -28,6 +28,7 @@ import (
 	"github.com/Romerito007/whatsmeow/proto/waMsgTransport"
 	"github.com/Romerito007/whatsmeow/types"
 	"github.com/Romerito007/whatsmeow/types/events"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
 )
 
 // Number of sent messages to cache in memory for handling retry receipts.
@@ -110,7 +111,7 @@ type incomingRetryKey struct {
 }
 
 // handleRetryReceipt handles an incoming retry receipt for an outgoing message.
-func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.Node) error {
+func (cli *Client) handleRetryReceipt(ctx context.Context, receipt *events.Receipt, node *waBinary.Node) error {
 	retryChild, ok := node.GetOptionalChildByTag("retry")
 	if !ok {
 		return &ElementMissingError{Tag: "retry", In: "retry receipt"}
@@ -122,6 +123,7 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 	if !ag.OK() {
 		return ag.Error()
 	}
+	log := waLog.With(cli.Log, "message_id", messageID, "chat", receipt.Chat, "sender", receipt.Sender)
 	msg, err := cli.getMessageForRetry(receipt, messageID)
 	if err != nil {
 		return err
@@ -143,7 +145,7 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 	internalCounter := cli.incomingRetryRequestCounter[retryKey]
 	cli.incomingRetryRequestCounterLock.Unlock()
 	if internalCounter >= 10 {
-		cli.Log.Warnf("Dropping retry request from %s for %s: internal retry counter is %d", messageID, receipt.Sender, internalCounter)
+		log.Warnf("Dropping retry request from %s for %s: internal retry counter is %d", messageID, receipt.Sender, internalCounter)
 		return nil
 	}
 
@@ -155,11 +157,19 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 	var fbSKDM *waMsgTransport.MessageTransport_Protocol_Ancillary_SenderKeyDistributionMessage
 	var fbDSM *waMsgTransport.MessageTransport_Protocol_Integral_DeviceSentMessage
 	if receipt.IsGroup {
-		builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
 		senderKeyName := protocol.NewSenderKeyName(receipt.Chat.String(), ownID.SignalAddress())
-		signalSKDMessage, err := builder.Create(senderKeyName)
+		var signalSKDMessage *protocol.SenderKeyDistributionMessage
+		err := cli.Store.DoTxn(ctx, func(ctx context.Context) (err error) {
+			signalStore := cli.Store.SignalStore(ctx)
+			builder := groups.NewGroupSessionBuilder(signalStore, pbSerializer)
+			signalSKDMessage, err = builder.Create(senderKeyName)
+			if err != nil {
+				return err
+			}
+			return signalStore.Err()
+		})
 		if err != nil {
-			cli.Log.Warnf("Failed to create sender key distribution message to include in retry of %s in %s to %s: %v", messageID, receipt.Chat, receipt.Sender, err)
+			log.Warnf("Failed to create sender key distribution message to include in retry of %s in %s to %s: %v", messageID, receipt.Chat, receipt.Sender, err)
 		}
 		if msg.wa != nil {
 			msg.wa.SenderKeyDistributionMessage = &waE2E.SenderKeyDistributionMessage{
@@ -189,7 +199,7 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 
 	// TODO pre-retry callback for fb
 	if cli.PreRetryCallback != nil && !cli.PreRetryCallback(receipt, messageID, retryCount, msg.wa) {
-		cli.Log.Debugf("Cancelled retry receipt in PreRetryCallback")
+		log.Debugf("Cancelled retry receipt in PreRetryCallback")
 		return nil
 	}
 
@@ -216,9 +226,9 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 			return fmt.Errorf("failed to read prekey bundle in retry receipt: %w", err)
 		}
 	} else if reason, recreate := cli.shouldRecreateSession(retryCount, receipt.Sender); recreate {
-		cli.Log.Debugf("Fetching prekeys for %s for handling retry receipt with no prekey bundle because %s", receipt.Sender, reason)
+		log.Debugf("Fetching prekeys for %s for handling retry receipt with no prekey bundle because %s", receipt.Sender, reason)
 		var keys map[types.JID]preKeyResp
-		keys, err = cli.fetchPreKeys(context.TODO(), []types.JID{receipt.Sender})
+		keys, err = cli.fetchPreKeys(ctx, []types.JID{receipt.Sender})
 		if err != nil {
 			return err
 		}
@@ -245,9 +255,9 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 	var encrypted *waBinary.Node
 	var includeDeviceIdentity bool
 	if msg.wa != nil {
-		encrypted, includeDeviceIdentity, err = cli.encryptMessageForDevice(plaintext, receipt.Sender, bundle, encAttrs)
+		encrypted, includeDeviceIdentity, err = cli.encryptMessageForDevice(ctx, plaintext, receipt.Sender, bundle, encAttrs)
 	} else {
-		encrypted, err = cli.encryptMessageForDeviceV3(&waMsgTransport.MessageTransport_Payload{
+		encrypted, err = cli.encryptMessageForDeviceV3(ctx, &waMsgTransport.MessageTransport_Payload{
 			ApplicationPayload: &waCommon.SubProtocol{
 				Payload: plaintext,
 				Version: proto.Int32(FBMessageApplicationVersion),
@@ -295,7 +305,7 @@ func (cli *Client) handleRetryReceipt(receipt *events.Receipt, node *waBinary.No
 	if err != nil {
 		return fmt.Errorf("failed to send retry message: %w", err)
 	}
-	cli.Log.Debugf("Sent retry #%d for %s/%s to %s", retryCount, receipt.Chat, messageID, receipt.Sender)
+	log.Debugf("Sent retry #%d for %s/%s to %s", retryCount, receipt.Chat, messageID, receipt.Sender)
 	return nil
 }
 
@@ -357,6 +367,7 @@ func (cli *Client) delayedRequestMessageFromPhone(info *types.MessageInfo) {
 // sendRetryReceipt sends a retry receipt for an incoming message.
 func (cli *Client) sendRetryReceipt(node *waBinary.Node, info *types.MessageInfo, forceIncludeIdentity bool) {
 	id, _ := node.Attrs["id"].(string)
+	log := cli.messageLog(info)
 	children := node.GetChildren()
 	var retryCountInMsg int
 	if len(children) == 1 && children[0].Tag == "enc" {
@@ -373,7 +384,7 @@ func (cli *Client) sendRetryReceipt(node *waBinary.Node, info *types.MessageInfo
 	}
 	cli.messageRetriesLock.Unlock()
 	if retryCount >= 5 {
-		cli.Log.Warnf("Not sending any more retry receipts for %s", id)
+		log.Warnf("Not sending any more retry receipts for %s", id)
 		return
 	}
 	if retryCount == 1 {
@@ -407,10 +418,10 @@ func (cli *Client) sendRetryReceipt(node *waBinary.Node, info *types.MessageInfo
 		},
 	}
 	if retryCount > 1 || forceIncludeIdentity {
-		if key, err := cli.Store.PreKeys.GenOnePreKey(); err != nil {
-			cli.Log.Errorf("Failed to get prekey for retry receipt: %v", err)
+		if key, err := cli.Store.GenOnePreKeyContext(context.TODO()); err != nil {
+			log.Errorf("Failed to get prekey for retry receipt: %v", err)
 		} else if deviceIdentity, err := proto.Marshal(cli.Store.Account); err != nil {
-			cli.Log.Errorf("Failed to marshal account info: %v", err)
+			log.Errorf("Failed to marshal account info: %v", err)
 			return
 		} else {
 			payload.Content = append(payload.GetChildren(), waBinary.Node{
@@ -427,6 +438,8 @@ func (cli *Client) sendRetryReceipt(node *waBinary.Node, info *types.MessageInfo
 	}
 	err := cli.sendNode(payload)
 	if err != nil {
-		cli.Log.Errorf("Failed to send retry receipt for %s: %v", id, err)
+		log.Errorf("Failed to send retry receipt for %s: %v", id, err)
+	} else {
+		cli.addCounter(MetricRetryReceipts, 1, "sent")
 	}
 }
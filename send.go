@@ -24,8 +24,6 @@ import (
 	"go.mau.fi/libsignal/groups"
 	"go.mau.fi/libsignal/keys/prekey"
 	"go.mau.fi/libsignal/protocol"
-	"go.mau.fi/libsignal/session"
-	"go.mau.fi/libsignal/signalerror"
 	"go.mau.fi/util/random"
 	"google.golang.org/protobuf/proto"
 
@@ -166,14 +164,33 @@ type SendRequestExtra struct {
 // in binary/proto/def.proto may be useful to find out all the allowed fields. Printing the RawMessage
 // field in incoming message events to figure out what it contains is also a good way to learn how to
 // send the same kind of message.
-func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waE2E.Message, extra ...SendRequestExtra) (resp SendResponse, err error) {
+//
+// Middleware registered with AddSendMiddleware is called before and after sending the message.
+func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waE2E.Message, extra ...SendRequestExtra) (SendResponse, error) {
 	var req SendRequestExtra
 	if len(extra) > 1 {
-		err = errors.New("only one extra parameter may be provided to SendMessage")
-		return
+		return SendResponse{}, errors.New("only one extra parameter may be provided to SendMessage")
 	} else if len(extra) == 1 {
 		req = extra[0]
 	}
+	if !cli.inFlight.tryAdd() {
+		return SendResponse{}, ErrClientShuttingDown
+	}
+	defer cli.inFlight.done()
+	if len(req.ID) == 0 {
+		req.ID = cli.GenerateMessageID()
+	}
+	ctx, span := cli.startSpan(ctx, "whatsmeow.send_message",
+		TraceAttribute{Key: "to", Value: to.String()}, TraceAttribute{Key: "id", Value: req.ID})
+	msg := &OutgoingMessage{To: to, Message: message, Extra: req}
+	resp, err := cli.sendWithMiddleware(ctx, msg, func() (SendResponse, error) {
+		return cli.sendMessage(ctx, msg.To, msg.Message, msg.Extra)
+	})
+	endSpan(span, err)
+	return resp, err
+}
+
+func (cli *Client) sendMessage(ctx context.Context, to types.JID, message *waE2E.Message, req SendRequestExtra) (resp SendResponse, err error) {
 	if to.Device > 0 && !req.Peer {
 		err = ErrRecipientADJID
 		return
@@ -187,9 +204,6 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waE2E
 	if req.Timeout == 0 {
 		req.Timeout = defaultRequestTimeout
 	}
-	if len(req.ID) == 0 {
-		req.ID = cli.GenerateMessageID()
-	}
 	if to.Server == types.NewsletterServer {
 		// TODO somehow deduplicate this with the code in sendNewsletter?
 		if message.EditedMessage != nil {
@@ -293,7 +307,7 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waE2E
 		phash, data, err = cli.sendGroup(ctx, to, ownID, req.ID, message, &resp.DebugTimings, botNode)
 	case types.DefaultUserServer:
 		if req.Peer {
-			data, err = cli.sendPeerMessage(to, req.ID, message, &resp.DebugTimings)
+			data, err = cli.sendPeerMessage(ctx, to, req.ID, message, &resp.DebugTimings)
 		} else {
 			data, err = cli.sendDM(ctx, to, ownID, req.ID, message, &resp.DebugTimings, botNode)
 		}
@@ -344,9 +358,13 @@ func (cli *Client) SendMessage(ctx context.Context, to types.JID, message *waE2E
 	if len(expectedPHash) > 0 && phash != expectedPHash {
 		cli.Log.Warnf("Server returned different participant list hash when sending to %s. Some devices may not have received the message.", to)
 		// TODO also invalidate device list caches
-		cli.groupParticipantsCacheLock.Lock()
-		delete(cli.groupParticipantsCache, to)
-		cli.groupParticipantsCacheLock.Unlock()
+		cli.invalidateGroupParticipantCache(to)
+	}
+	if err == nil && !req.Peer {
+		cli.archiveOutgoingMessage(to, req.ID, message, &resp)
+	}
+	if err == nil {
+		cli.recordMessageSent(message)
 	}
 	return
 }
@@ -626,12 +644,13 @@ func (cli *Client) sendGroup(ctx context.Context, to, ownID types.JID, id types.
 	}
 
 	start = time.Now()
-	builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
 	senderKeyName := protocol.NewSenderKeyName(to.String(), ownID.SignalAddress())
-	signalSKDMessage, err := builder.Create(senderKeyName)
+	signalSKDMessage, encrypted, err := cli.encryptGroupMessage(ctx, senderKeyName, padMessage(plaintext))
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to create sender key distribution message to send %s to %s: %w", id, to, err)
+		return "", nil, fmt.Errorf("failed to encrypt group message to send %s to %s: %w", id, to, err)
 	}
+	ciphertext := encrypted.SignedSerialize()
+	timings.GroupEncrypt = time.Since(start)
 	skdMessage := &waE2E.Message{
 		SenderKeyDistributionMessage: &waE2E.SenderKeyDistributionMessage{
 			GroupID:                             proto.String(to.String()),
@@ -643,14 +662,6 @@ func (cli *Client) sendGroup(ctx context.Context, to, ownID types.JID, id types.
 		return "", nil, fmt.Errorf("failed to marshal sender key distribution message to send %s to %s: %w", id, to, err)
 	}
 
-	cipher := groups.NewGroupCipher(builder, senderKeyName, cli.Store)
-	encrypted, err := cipher.Encrypt(padMessage(plaintext))
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to encrypt group message to send %s to %s: %w", id, to, err)
-	}
-	ciphertext := encrypted.SignedSerialize()
-	timings.GroupEncrypt = time.Since(start)
-
 	node, allDevices, err := cli.prepareMessageNode(ctx, to, ownID, id, message, participants, skdPlaintext, nil, timings, botNode)
 	if err != nil {
 		return "", nil, err
@@ -677,8 +688,33 @@ func (cli *Client) sendGroup(ctx context.Context, to, ownID types.JID, id types.
 	return phash, data, nil
 }
 
-func (cli *Client) sendPeerMessage(to types.JID, id types.MessageID, message *waE2E.Message, timings *MessageDebugTimings) ([]byte, error) {
-	node, err := cli.preparePeerMessageNode(to, id, message, timings)
+// encryptGroupMessage creates a sender key distribution message for the given sender key and encrypts
+// the plaintext with the same key. Both happen in one store transaction, so the sender key state can't
+// be left half-updated.
+func (cli *Client) encryptGroupMessage(
+	ctx context.Context,
+	senderKeyName *protocol.SenderKeyName,
+	plaintext []byte,
+) (skdm *protocol.SenderKeyDistributionMessage, encrypted protocol.GroupCiphertextMessage, err error) {
+	err = cli.Store.DoTxn(ctx, func(ctx context.Context) error {
+		signalStore := cli.Store.SignalStore(ctx)
+		builder := groups.NewGroupSessionBuilder(signalStore, pbSerializer)
+		skdm, err = builder.Create(senderKeyName)
+		if err != nil {
+			return fmt.Errorf("failed to create sender key distribution message: %w", err)
+		}
+		cipher := groups.NewGroupCipher(builder, senderKeyName, signalStore)
+		encrypted, err = cipher.Encrypt(plaintext)
+		if err != nil {
+			return err
+		}
+		return signalStore.Err()
+	})
+	return
+}
+
+func (cli *Client) sendPeerMessage(ctx context.Context, to types.JID, id types.MessageID, message *waE2E.Message, timings *MessageDebugTimings) ([]byte, error) {
+	node, err := cli.preparePeerMessageNode(ctx, to, id, message, timings)
 	if err != nil {
 		return nil, err
 	}
@@ -864,7 +900,7 @@ func getEditAttribute(msg *waE2E.Message) types.EditAttribute {
 	return types.EditAttributeEmpty
 }
 
-func (cli *Client) preparePeerMessageNode(to types.JID, id types.MessageID, message *waE2E.Message, timings *MessageDebugTimings) (*waBinary.Node, error) {
+func (cli *Client) preparePeerMessageNode(ctx context.Context, to types.JID, id types.MessageID, message *waE2E.Message, timings *MessageDebugTimings) (*waBinary.Node, error) {
 	attrs := waBinary.Attrs{
 		"id":       id,
 		"type":     "text",
@@ -882,7 +918,7 @@ func (cli *Client) preparePeerMessageNode(to types.JID, id types.MessageID, mess
 		return nil, err
 	}
 	start = time.Now()
-	encrypted, isPreKey, err := cli.encryptMessageForDevice(plaintext, to, nil, nil)
+	encrypted, isPreKey, err := cli.encryptMessageForDevice(ctx, plaintext, to, nil, nil)
 	timings.PeerEncrypt = time.Since(start)
 	if err != nil {
 		return nil, fmt.Errorf("failed to encrypt peer message for %s: %v", to, err)
@@ -1011,6 +1047,9 @@ func (cli *Client) makeDeviceIdentityNode() waBinary.Node {
 }
 
 func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []types.JID, ownID types.JID, id string, msgPlaintext, dsmPlaintext []byte, encAttrs waBinary.Attrs) ([]waBinary.Node, bool) {
+	ctx, span := cli.startSpan(ctx, "whatsmeow.encrypt_message",
+		TraceAttribute{Key: "id", Value: id}, TraceAttribute{Key: "device_count", Value: len(allDevices)})
+	defer span.End()
 	includeIdentity := false
 	participantNodes := make([]waBinary.Node, 0, len(allDevices))
 	var retryDevices []types.JID
@@ -1022,7 +1061,7 @@ func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []ty
 			}
 			plaintext = dsmPlaintext
 		}
-		encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(plaintext, jid, nil, encAttrs)
+		encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(ctx, plaintext, jid, nil, encAttrs)
 		if errors.Is(err, ErrNoSession) {
 			retryDevices = append(retryDevices, jid)
 			continue
@@ -1051,7 +1090,7 @@ func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []ty
 				if jid.User == ownID.User && dsmPlaintext != nil {
 					plaintext = dsmPlaintext
 				}
-				encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(plaintext, jid, resp.bundle, encAttrs)
+				encrypted, isPreKey, err := cli.encryptMessageForDeviceAndWrap(ctx, plaintext, jid, resp.bundle, encAttrs)
 				if err != nil {
 					cli.Log.Warnf("Failed to encrypt %s for %s (retry): %v", id, jid, err)
 					continue
@@ -1066,8 +1105,8 @@ func (cli *Client) encryptMessageForDevices(ctx context.Context, allDevices []ty
 	return participantNodes, includeIdentity
 }
 
-func (cli *Client) encryptMessageForDeviceAndWrap(plaintext []byte, to types.JID, bundle *prekey.Bundle, encAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
-	node, includeDeviceIdentity, err := cli.encryptMessageForDevice(plaintext, to, bundle, encAttrs)
+func (cli *Client) encryptMessageForDeviceAndWrap(ctx context.Context, plaintext []byte, to types.JID, bundle *prekey.Bundle, encAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
+	node, includeDeviceIdentity, err := cli.encryptMessageForDevice(ctx, plaintext, to, bundle, encAttrs)
 	if err != nil {
 		return nil, false, err
 	}
@@ -1084,26 +1123,10 @@ func copyAttrs(from, to waBinary.Attrs) {
 	}
 }
 
-func (cli *Client) encryptMessageForDevice(plaintext []byte, to types.JID, bundle *prekey.Bundle, extraAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
-	builder := session.NewBuilderFromSignal(cli.Store, to.SignalAddress(), pbSerializer)
-	if bundle != nil {
-		cli.Log.Debugf("Processing prekey bundle for %s", to)
-		err := builder.ProcessBundle(bundle)
-		if cli.AutoTrustIdentity && errors.Is(err, signalerror.ErrUntrustedIdentity) {
-			cli.Log.Warnf("Got %v error while trying to process prekey bundle for %s, clearing stored identity and retrying", err, to)
-			cli.clearUntrustedIdentity(to)
-			err = builder.ProcessBundle(bundle)
-		}
-		if err != nil {
-			return nil, false, fmt.Errorf("failed to process prekey bundle: %w", err)
-		}
-	} else if !cli.Store.ContainsSession(to.SignalAddress()) {
-		return nil, false, ErrNoSession
-	}
-	cipher := session.NewCipher(builder, to.SignalAddress())
-	ciphertext, err := cipher.Encrypt(padMessage(plaintext))
+func (cli *Client) encryptMessageForDevice(ctx context.Context, plaintext []byte, to types.JID, bundle *prekey.Bundle, extraAttrs waBinary.Attrs) (*waBinary.Node, bool, error) {
+	ciphertext, err := cli.encryptForDevice(ctx, padMessage(plaintext), to, bundle)
 	if err != nil {
-		return nil, false, fmt.Errorf("cipher encryption failed: %w", err)
+		return nil, false, err
 	}
 
 	encAttrs := waBinary.Attrs{
@@ -15,11 +15,8 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"go.mau.fi/libsignal/groups"
 	"go.mau.fi/libsignal/keys/prekey"
 	"go.mau.fi/libsignal/protocol"
-	"go.mau.fi/libsignal/session"
-	"go.mau.fi/libsignal/signalerror"
 	"go.mau.fi/util/random"
 	"google.golang.org/protobuf/proto"
 
@@ -40,20 +37,45 @@ const FBConsumerMessageVersion = 1
 const FBArmadilloMessageVersion = 1
 
 // SendFBMessage sends the given v3 message to the given JID.
+//
+// Middleware registered with AddSendMiddleware is called before and after sending the message.
 func (cli *Client) SendFBMessage(
 	ctx context.Context,
 	to types.JID,
 	message armadillo.RealMessageApplicationSub,
 	metadata *waMsgApplication.MessageApplication_Metadata,
 	extra ...SendRequestExtra,
-) (resp SendResponse, err error) {
+) (SendResponse, error) {
 	var req SendRequestExtra
 	if len(extra) > 1 {
-		err = errors.New("only one extra parameter may be provided to SendMessage")
-		return
+		return SendResponse{}, errors.New("only one extra parameter may be provided to SendMessage")
 	} else if len(extra) == 1 {
 		req = extra[0]
 	}
+	if !cli.inFlight.tryAdd() {
+		return SendResponse{}, ErrClientShuttingDown
+	}
+	defer cli.inFlight.done()
+	if len(req.ID) == 0 {
+		req.ID = cli.GenerateMessageID()
+	}
+	ctx, span := cli.startSpan(ctx, "whatsmeow.send_message",
+		TraceAttribute{Key: "to", Value: to.String()}, TraceAttribute{Key: "id", Value: req.ID})
+	msg := &OutgoingMessage{To: to, FBMessage: message, FBMetadata: metadata, Extra: req}
+	resp, err := cli.sendWithMiddleware(ctx, msg, func() (SendResponse, error) {
+		return cli.sendFBMessage(ctx, msg.To, msg.FBMessage, msg.FBMetadata, msg.Extra)
+	})
+	endSpan(span, err)
+	return resp, err
+}
+
+func (cli *Client) sendFBMessage(
+	ctx context.Context,
+	to types.JID,
+	message armadillo.RealMessageApplicationSub,
+	metadata *waMsgApplication.MessageApplication_Metadata,
+	req SendRequestExtra,
+) (resp SendResponse, err error) {
 	var subproto waMsgApplication.MessageApplication_SubProtocolPayload
 	subproto.FutureProof = waCommon.FutureProofBehavior_PLACEHOLDER.Enum()
 	switch typedMsg := message.(type) {
@@ -121,9 +143,6 @@ func (cli *Client) SendFBMessage(
 	if req.Timeout == 0 {
 		req.Timeout = defaultRequestTimeout
 	}
-	if len(req.ID) == 0 {
-		req.ID = cli.GenerateMessageID()
-	}
 	resp.ID = req.ID
 
 	start := time.Now()
@@ -144,7 +163,7 @@ func (cli *Client) SendFBMessage(
 	case types.DefaultUserServer, types.MessengerServer:
 		if req.Peer {
 			err = fmt.Errorf("peer messages to fb are not yet supported")
-			//data, err = cli.sendPeerMessage(to, req.ID, message, &resp.DebugTimings)
+			//data, err = cli.sendPeerMessage(ctx, to, req.ID, message, &resp.DebugTimings)
 		} else {
 			data, phash, err = cli.sendDMV3(ctx, to, ownID, req.ID, messageApp, msgAttrs, frankingTag, &resp.DebugTimings)
 		}
@@ -193,9 +212,10 @@ func (cli *Client) SendFBMessage(
 	if len(expectedPHash) > 0 && phash != expectedPHash {
 		cli.Log.Warnf("Server returned different participant list hash when sending to %s. Some devices may not have received the message.", to)
 		// TODO also invalidate device list caches
-		cli.groupParticipantsCacheLock.Lock()
-		delete(cli.groupParticipantsCache, to)
-		cli.groupParticipantsCacheLock.Unlock()
+		cli.invalidateGroupParticipantCache(to)
+	}
+	if err == nil {
+		cli.addCounter(MetricMessagesSent, 1, "fb")
 	}
 	return
 }
@@ -222,18 +242,6 @@ func (cli *Client) sendGroupV3(
 	timings.GetParticipants = time.Since(start)
 
 	start = time.Now()
-	builder := groups.NewGroupSessionBuilder(cli.Store, pbSerializer)
-	senderKeyName := protocol.NewSenderKeyName(to.String(), ownID.SignalAddress())
-	signalSKDMessage, err := builder.Create(senderKeyName)
-	if err != nil {
-		return "", nil, fmt.Errorf("failed to create sender key distribution message to send %s to %s: %w", id, to, err)
-	}
-	skdm := &waMsgTransport.MessageTransport_Protocol_Ancillary_SenderKeyDistributionMessage{
-		GroupID:                             proto.String(to.String()),
-		AxolotlSenderKeyDistributionMessage: signalSKDMessage.Serialize(),
-	}
-
-	cipher := groups.NewGroupCipher(builder, senderKeyName, cli.Store)
 	plaintext, err := proto.Marshal(&waMsgTransport.MessageTransport{
 		Payload: &waMsgTransport.MessageTransport_Payload{
 			ApplicationPayload: &waCommon.SubProtocol{
@@ -261,12 +269,17 @@ func (cli *Client) sendGroupV3(
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to marshal message transport: %w", err)
 	}
-	encrypted, err := cipher.Encrypt(plaintext)
+	senderKeyName := protocol.NewSenderKeyName(to.String(), ownID.SignalAddress())
+	signalSKDMessage, encrypted, err := cli.encryptGroupMessage(ctx, senderKeyName, plaintext)
 	if err != nil {
 		return "", nil, fmt.Errorf("failed to encrypt group message to send %s to %s: %w", id, to, err)
 	}
 	ciphertext := encrypted.SignedSerialize()
 	timings.GroupEncrypt = time.Since(start)
+	skdm := &waMsgTransport.MessageTransport_Protocol_Ancillary_SenderKeyDistributionMessage{
+		GroupID:                             proto.String(to.String()),
+		AxolotlSenderKeyDistributionMessage: signalSKDMessage.Serialize(),
+	}
 
 	node, allDevices, err := cli.prepareMessageNodeV3(ctx, to, ownID, id, nil, skdm, msgAttrs, frankingTag, participants, timings)
 	if err != nil {
@@ -522,7 +535,7 @@ func (cli *Client) encryptMessageForDevicesV3(
 			}
 			dsmForDevice = dsm
 		}
-		encrypted, err := cli.encryptMessageForDeviceAndWrapV3(payload, skdm, dsmForDevice, jid, nil, encAttrs)
+		encrypted, err := cli.encryptMessageForDeviceAndWrapV3(ctx, payload, skdm, dsmForDevice, jid, nil, encAttrs)
 		if errors.Is(err, ErrNoSession) {
 			retryDevices = append(retryDevices, jid)
 			continue
@@ -547,7 +560,7 @@ func (cli *Client) encryptMessageForDevicesV3(
 				if jid.User == ownID.User {
 					dsmForDevice = dsm
 				}
-				encrypted, err := cli.encryptMessageForDeviceAndWrapV3(payload, skdm, dsmForDevice, jid, resp.bundle, encAttrs)
+				encrypted, err := cli.encryptMessageForDeviceAndWrapV3(ctx, payload, skdm, dsmForDevice, jid, resp.bundle, encAttrs)
 				if err != nil {
 					cli.Log.Warnf("Failed to encrypt %s for %s (retry): %v", id, jid, err)
 					continue
@@ -560,6 +573,7 @@ func (cli *Client) encryptMessageForDevicesV3(
 }
 
 func (cli *Client) encryptMessageForDeviceAndWrapV3(
+	ctx context.Context,
 	payload *waMsgTransport.MessageTransport_Payload,
 	skdm *waMsgTransport.MessageTransport_Protocol_Ancillary_SenderKeyDistributionMessage,
 	dsm *waMsgTransport.MessageTransport_Protocol_Integral_DeviceSentMessage,
@@ -567,7 +581,7 @@ func (cli *Client) encryptMessageForDeviceAndWrapV3(
 	bundle *prekey.Bundle,
 	encAttrs waBinary.Attrs,
 ) (*waBinary.Node, error) {
-	node, err := cli.encryptMessageForDeviceV3(payload, skdm, dsm, to, bundle, encAttrs)
+	node, err := cli.encryptMessageForDeviceV3(ctx, payload, skdm, dsm, to, bundle, encAttrs)
 	if err != nil {
 		return nil, err
 	}
@@ -579,6 +593,7 @@ func (cli *Client) encryptMessageForDeviceAndWrapV3(
 }
 
 func (cli *Client) encryptMessageForDeviceV3(
+	ctx context.Context,
 	payload *waMsgTransport.MessageTransport_Payload,
 	skdm *waMsgTransport.MessageTransport_Protocol_Ancillary_SenderKeyDistributionMessage,
 	dsm *waMsgTransport.MessageTransport_Protocol_Integral_DeviceSentMessage,
@@ -586,22 +601,6 @@ func (cli *Client) encryptMessageForDeviceV3(
 	bundle *prekey.Bundle,
 	extraAttrs waBinary.Attrs,
 ) (*waBinary.Node, error) {
-	builder := session.NewBuilderFromSignal(cli.Store, to.SignalAddress(), pbSerializer)
-	if bundle != nil {
-		cli.Log.Debugf("Processing prekey bundle for %s", to)
-		err := builder.ProcessBundle(bundle)
-		if cli.AutoTrustIdentity && errors.Is(err, signalerror.ErrUntrustedIdentity) {
-			cli.Log.Warnf("Got %v error while trying to process prekey bundle for %s, clearing stored identity and retrying", err, to)
-			cli.clearUntrustedIdentity(to)
-			err = builder.ProcessBundle(bundle)
-		}
-		if err != nil {
-			return nil, fmt.Errorf("failed to process prekey bundle: %w", err)
-		}
-	} else if !cli.Store.ContainsSession(to.SignalAddress()) {
-		return nil, ErrNoSession
-	}
-	cipher := session.NewCipher(builder, to.SignalAddress())
 	plaintext, err := proto.Marshal(&waMsgTransport.MessageTransport{
 		Payload: payload,
 		Protocol: &waMsgTransport.MessageTransport_Protocol{
@@ -620,9 +619,9 @@ func (cli *Client) encryptMessageForDeviceV3(
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal message transport: %w", err)
 	}
-	ciphertext, err := cipher.Encrypt(plaintext)
+	ciphertext, err := cli.encryptForDevice(ctx, plaintext, to, bundle)
 	if err != nil {
-		return nil, fmt.Errorf("cipher encryption failed: %w", err)
+		return nil, err
 	}
 
 	encAttrs := waBinary.Attrs{
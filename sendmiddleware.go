@@ -0,0 +1,152 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+
+	armadillo "github.com/Romerito007/whatsmeow/proto"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/proto/waMsgApplication"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var (
+	// ErrSendVetoed is returned by SendMessage and SendFBMessage if a send middleware rejected the message.
+	// The error returned by the middleware is wrapped in the same error.
+	ErrSendVetoed = errors.New("message send was vetoed by middleware")
+	// ErrSendMiddlewareInvalidMessage is returned by SendMessage and SendFBMessage if a send middleware removed
+	// the message, or replaced it with a message of the other kind (e.g. set FBMessage in a SendMessage call).
+	ErrSendMiddlewareInvalidMessage = errors.New("send middleware left an invalid message")
+)
+
+// OutgoingMessage is a message that is about to be sent with SendMessage (including RevokeMessage) or SendFBMessage.
+type OutgoingMessage struct {
+	// The chat the message is being sent to.
+	To types.JID
+	// The message, if it's being sent with SendMessage.
+	Message *waE2E.Message
+	// The message and metadata, if it's being sent with SendFBMessage.
+	FBMessage  armadillo.RealMessageApplicationSub
+	FBMetadata *waMsgApplication.MessageApplication_Metadata
+	// The optional parameters of the send. The ID is always filled before the middleware is called.
+	Extra SendRequestExtra
+}
+
+// IsFB returns true if the message is being sent with SendFBMessage.
+func (om *OutgoingMessage) IsFB() bool {
+	return om.FBMessage != nil
+}
+
+// SendMiddleware contains hooks that are called around every message sent by the client.
+//
+// Middleware is called in the order it was added before sending, and in reverse order after sending.
+// PostSend is only called for middleware whose PreSend was called, so if a PreSend vetoes the message,
+// PostSend of the same middleware isn't called, but PostSend of earlier middleware is called with the error.
+type SendMiddleware struct {
+	// PreSend is called before the message is encrypted and sent. It can modify the fields of the
+	// OutgoingMessage to change what is sent, but the message can't be removed or changed to the other kind
+	// (see ErrSendMiddlewareInvalidMessage). Returning an error vetoes the send, in which case the
+	// send method returns an error wrapping both ErrSendVetoed and the returned error.
+	PreSend func(ctx context.Context, msg *OutgoingMessage) error
+	// PostSend is called after the send has finished, with the response from the server or the error
+	// that the send method is about to return.
+	PostSend func(ctx context.Context, msg *OutgoingMessage, resp SendResponse, err error)
+}
+
+type wrappedSendMiddleware struct {
+	SendMiddleware
+	id uint32
+}
+
+// AddSendMiddleware registers hooks that are called for every message sent with SendMessage, SendFBMessage or
+// RevokeMessage. This includes the peer messages that the client sends to its own devices internally, e.g. app state
+// key requests, which have Extra.Peer set to true.
+//
+// The returned integer is the middleware ID, which can be passed to RemoveSendMiddleware to remove it.
+//
+// For example, to block sending messages to a specific chat:
+//
+//	cli.AddSendMiddleware(whatsmeow.SendMiddleware{
+//		PreSend: func(ctx context.Context, msg *whatsmeow.OutgoingMessage) error {
+//			if msg.To == blockedChat {
+//				return errors.New("sending to this chat is not allowed")
+//			}
+//			return nil
+//		},
+//	})
+func (cli *Client) AddSendMiddleware(mw SendMiddleware) uint32 {
+	nextID := atomic.AddUint32(&nextHandlerID, 1)
+	cli.sendMiddlewaresLock.Lock()
+	cli.sendMiddlewares = append(cli.sendMiddlewares, wrappedSendMiddleware{SendMiddleware: mw, id: nextID})
+	cli.sendMiddlewaresLock.Unlock()
+	return nextID
+}
+
+// RemoveSendMiddleware removes middleware previously registered with AddSendMiddleware.
+// If the middleware with the given ID is found, this returns true.
+func (cli *Client) RemoveSendMiddleware(id uint32) bool {
+	cli.sendMiddlewaresLock.Lock()
+	defer cli.sendMiddlewaresLock.Unlock()
+	index := slices.IndexFunc(cli.sendMiddlewares, func(mw wrappedSendMiddleware) bool {
+		return mw.id == id
+	})
+	if index < 0 {
+		return false
+	}
+	// Copy the list instead of modifying it in place, as sends in progress may still be iterating over the old one.
+	cli.sendMiddlewares = slices.Delete(slices.Clone(cli.sendMiddlewares), index, index+1)
+	return true
+}
+
+// sendWithMiddleware calls the send function with the pre-send and post-send hooks of all registered middleware.
+func (cli *Client) sendWithMiddleware(ctx context.Context, msg *OutgoingMessage, send func() (SendResponse, error)) (resp SendResponse, err error) {
+	cli.sendMiddlewaresLock.RLock()
+	middlewares := cli.sendMiddlewares
+	cli.sendMiddlewaresLock.RUnlock()
+	if len(middlewares) == 0 {
+		return send()
+	}
+	isFB := msg.IsFB()
+	wasValid := msg.isValid(isFB)
+	called := 0
+	defer func() {
+		for i := called - 1; i >= 0; i-- {
+			if middlewares[i].PostSend != nil {
+				middlewares[i].PostSend(ctx, msg, resp, err)
+			}
+		}
+	}()
+	for _, mw := range middlewares {
+		if mw.PreSend != nil {
+			preErr := mw.PreSend(ctx, msg)
+			if preErr != nil {
+				err = fmt.Errorf("%w: %w", ErrSendVetoed, preErr)
+				return
+			}
+		}
+		called++
+	}
+	if wasValid && !msg.isValid(isFB) {
+		err = ErrSendMiddlewareInvalidMessage
+		return
+	}
+	return send()
+}
+
+// isValid checks that the message still has the content the send method expects after middleware has modified it.
+func (om *OutgoingMessage) isValid(isFB bool) bool {
+	if isFB {
+		// The interface may contain a typed nil pointer, which doesn't have a valid protoreflect message
+		return om.Message == nil && om.FBMessage != nil && om.FBMessage.ProtoReflect().IsValid()
+	}
+	return om.Message != nil && om.FBMessage == nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waConsumerApplication"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/proto/waMsgApplication"
+)
+
+var errTestVeto = errors.New("not allowed")
+
+// addOrderMiddleware adds middleware that appends its name to the order slice when its hooks are called.
+func addOrderMiddleware(cli *Client, name string, order *[]string, veto bool) {
+	cli.AddSendMiddleware(SendMiddleware{
+		PreSend: func(ctx context.Context, msg *OutgoingMessage) error {
+			*order = append(*order, "pre "+name)
+			if veto {
+				return errTestVeto
+			}
+			return nil
+		},
+		PostSend: func(ctx context.Context, msg *OutgoingMessage, resp SendResponse, err error) {
+			*order = append(*order, "post "+name)
+		},
+	})
+}
+
+func TestSendMiddlewareOrder(t *testing.T) {
+	cli := newTestClient(t)
+	var order []string
+	addOrderMiddleware(cli, "first", &order, false)
+	addOrderMiddleware(cli, "second", &order, false)
+	var postErr error
+	cli.AddSendMiddleware(SendMiddleware{
+		PreSend: func(ctx context.Context, msg *OutgoingMessage) error {
+			order = append(order, "pre third")
+			// Sending to a device JID fails before anything is sent, which shows that the change was applied
+			msg.To.Device = 1
+			return nil
+		},
+		PostSend: func(ctx context.Context, msg *OutgoingMessage, resp SendResponse, err error) {
+			order = append(order, "post third")
+			postErr = err
+		},
+	})
+
+	_, err := cli.SendMessage(context.Background(), testPN1, &waE2E.Message{Conversation: proto.String("Hello")})
+	if !errors.Is(err, ErrRecipientADJID) {
+		t.Errorf("send returned %v, expected the error from sending to the changed recipient", err)
+	}
+	if !errors.Is(postErr, ErrRecipientADJID) {
+		t.Errorf("post-send hook got error %v, expected the send error", postErr)
+	}
+	expected := []string{"pre first", "pre second", "pre third", "post third", "post second", "post first"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("hooks were called in order %v, expected %v", order, expected)
+	}
+}
+
+func TestSendMiddlewareVeto(t *testing.T) {
+	cli := newTestClient(t)
+	var order []string
+	var postErr error
+	cli.AddSendMiddleware(SendMiddleware{
+		PostSend: func(ctx context.Context, msg *OutgoingMessage, resp SendResponse, err error) {
+			postErr = err
+		},
+	})
+	addOrderMiddleware(cli, "first", &order, false)
+	addOrderMiddleware(cli, "vetoing", &order, true)
+	addOrderMiddleware(cli, "after veto", &order, false)
+
+	_, err := cli.SendMessage(context.Background(), testPN1, &waE2E.Message{Conversation: proto.String("Hello")})
+	if !errors.Is(err, ErrSendVetoed) || !errors.Is(err, errTestVeto) {
+		t.Errorf("send returned %v, expected veto error", err)
+	}
+	if postErr != err {
+		t.Errorf("post-send hook got error %v, expected %v", postErr, err)
+	}
+	// Middleware after the veto isn't called at all, and the vetoing middleware's PostSend isn't called either
+	expected := []string{"pre first", "pre vetoing", "post first"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("hooks were called in order %v, expected %v", order, expected)
+	}
+}
+
+func TestSendMiddlewareInvalidMessage(t *testing.T) {
+	fbMessage := &waConsumerApplication.ConsumerApplication{}
+	tests := []struct {
+		name    string
+		fb      bool
+		preSend func(msg *OutgoingMessage)
+	}{
+		{"message removed", false, func(msg *OutgoingMessage) { msg.Message = nil }},
+		{"changed to FB message", false, func(msg *OutgoingMessage) { msg.FBMessage = fbMessage }},
+		{"FB message removed", true, func(msg *OutgoingMessage) { msg.FBMessage = nil }},
+		{"FB message set to nil pointer", true, func(msg *OutgoingMessage) { msg.FBMessage = (*waConsumerApplication.ConsumerApplication)(nil) }},
+		{"changed to normal message", true, func(msg *OutgoingMessage) {
+			msg.FBMessage = nil
+			msg.Message = &waE2E.Message{Conversation: proto.String("Hello")}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli := newTestClient(t)
+			var postErr error
+			cli.AddSendMiddleware(SendMiddleware{
+				PreSend: func(ctx context.Context, msg *OutgoingMessage) error {
+					test.preSend(msg)
+					return nil
+				},
+				PostSend: func(ctx context.Context, msg *OutgoingMessage, resp SendResponse, err error) {
+					postErr = err
+				},
+			})
+			var err error
+			if test.fb {
+				_, err = cli.SendFBMessage(context.Background(), testPN1, fbMessage, &waMsgApplication.MessageApplication_Metadata{})
+			} else {
+				_, err = cli.SendMessage(context.Background(), testPN1, &waE2E.Message{Conversation: proto.String("Hello")})
+			}
+			if !errors.Is(err, ErrSendMiddlewareInvalidMessage) {
+				t.Errorf("send returned %v, expected invalid message error", err)
+			}
+			if postErr != err {
+				t.Errorf("post-send hook got error %v, expected %v", postErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// inFlightTracker counts operations that are in progress, so that they can be waited for.
+type inFlightTracker struct {
+	lock    sync.Mutex
+	count   int
+	idle    chan struct{}
+	closing bool
+}
+
+// add marks an operation as started, even if the tracker is closing.
+func (t *inFlightTracker) add() {
+	t.lock.Lock()
+	t.unlockedAdd()
+	t.lock.Unlock()
+}
+
+// tryAdd marks an operation as started, unless the tracker is closing, in which case it returns false.
+func (t *inFlightTracker) tryAdd() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return false
+	}
+	t.unlockedAdd()
+	return true
+}
+
+func (t *inFlightTracker) unlockedAdd() {
+	if t.count == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.count++
+}
+
+// done marks an operation started with add or tryAdd as finished.
+func (t *inFlightTracker) done() {
+	t.lock.Lock()
+	t.count--
+	if t.count == 0 {
+		close(t.idle)
+	}
+	t.lock.Unlock()
+}
+
+func (t *inFlightTracker) setClosing(closing bool) {
+	t.lock.Lock()
+	t.closing = closing
+	t.lock.Unlock()
+}
+
+func (t *inFlightTracker) isClosing() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closing
+}
+
+// wait blocks until there are no operations in progress or the context is done.
+func (t *inFlightTracker) wait(ctx context.Context) error {
+	t.lock.Lock()
+	if t.count == 0 {
+		t.lock.Unlock()
+		return nil
+	}
+	idle := t.idle
+	t.lock.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendInBackground calls the given function (which usually sends an ack or receipt) in a new goroutine.
+// Shutdown waits for functions started this way before closing the connection.
+func (cli *Client) sendInBackground(fn func()) {
+	cli.inFlight.add()
+	go func() {
+		defer cli.inFlight.done()
+		fn()
+	}()
+}
+
+// Shutdown gracefully disconnects from the WhatsApp web websocket.
+//
+// Unlike Disconnect, which closes the connection immediately, Shutdown first lets in-progress work finish:
+//
+//  1. New SendMessage and SendFBMessage calls are rejected with ErrClientShuttingDown, and no new incoming
+//     nodes are queued for handling (the server will send them again after the next connection,
+//     as they won't be acknowledged).
+//  2. Nodes already in the handler queue are handled, which includes calling event handlers for them.
+//     If concurrent dispatch is enabled, events already queued in the dispatcher are handled too.
+//     If the connection is lost while draining, the remaining nodes from it are dropped instead
+//     (the server will send them again after reconnecting, as they weren't acknowledged).
+//  3. In-progress message sends and info queries, as well as acks and receipts that are being sent
+//     in the background, are waited for.
+//  4. The connection is closed like Disconnect does.
+//
+// If the context is done before everything has finished, the connection is closed anyway and the context's
+// error is returned. Like Disconnect, this doesn't emit any events. The client can be connected again
+// with Connect after Shutdown returns.
+//
+// Shutdown must not be called from event handlers, as it would wait for the handler itself to return.
+func (cli *Client) Shutdown(ctx context.Context) error {
+	cli.inFlight.setClosing(true)
+	cli.handlersInFlight.setClosing(true)
+	defer func() {
+		cli.inFlight.setClosing(false)
+		cli.handlersInFlight.setClosing(false)
+	}()
+	// The connection is about to be closed, so make sure nothing tries to reconnect in the meantime
+	cli.expectDisconnect()
+	cli.stopReconnectLoop()
+
+	err := cli.drain(ctx)
+	if err != nil {
+		cli.Log.Warnf("Closing connection before in-progress work finished: %v", err)
+	}
+	cli.disconnectWithReason("shutdown")
+	return err
+}
+
+func (cli *Client) drain(ctx context.Context) error {
+	cli.Log.Debugf("Waiting for handler queue to be drained")
+	if err := cli.handlersInFlight.wait(ctx); err != nil {
+		return fmt.Errorf("failed to drain handler queue: %w", err)
+	}
+	if disp := cli.dispatcher.Load(); disp != nil {
+		cli.Log.Debugf("Waiting for queued events to be handled")
+		if err := disp.flush(ctx); err != nil {
+			return fmt.Errorf("failed to drain event dispatcher: %w", err)
+		}
+	}
+	cli.Log.Debugf("Waiting for in-progress sends, info queries and receipts to finish")
+	if err := cli.inFlight.wait(ctx); err != nil {
+		return fmt.Errorf("failed to wait for in-progress requests: %w", err)
+	}
+	return nil
+}
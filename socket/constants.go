@@ -4,7 +4,7 @@
 // License, v. 2.0. If a copy of the MPL was not distributed with this
 // file, You can obtain one at http://mozilla.org/MPL/2.0/.
 
-// Package socket implements a subset of the Noise protocol framework on top of websockets as used by WhatsApp.
+// Package socket implements a subset of the Noise protocol framework on top of websockets (or other transports) as used by WhatsApp.
 //
 // There shouldn't be any need to manually interact with this package.
 // The Client struct in the top-level whatsmeow package handles everything.
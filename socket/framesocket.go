@@ -10,6 +10,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"sync"
 	"time"
@@ -20,7 +21,7 @@ import (
 )
 
 type FrameSocket struct {
-	conn   *websocket.Conn
+	conn   TransportConn
 	ctx    context.Context
 	cancel func()
 	log    waLog.Logger
@@ -36,6 +37,10 @@ type FrameSocket struct {
 	Header []byte
 	Dialer websocket.Dialer
 
+	// Transport is used to open the connection. If nil, a WebsocketTransport is created
+	// using the URL, HTTPHeaders and Dialer fields.
+	Transport Transport
+
 	incomingLength int
 	receivedLength int
 	incoming       []byte
@@ -57,7 +62,14 @@ func NewFrameSocket(log waLog.Logger, dialer websocket.Dialer) *FrameSocket {
 }
 
 func (fs *FrameSocket) IsConnected() bool {
-	return fs.conn != nil
+	return fs.getConn() != nil
+}
+
+// getConn returns the current connection, or nil if the socket is closed.
+func (fs *FrameSocket) getConn() TransportConn {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.conn
 }
 
 func (fs *FrameSocket) Context() context.Context {
@@ -72,18 +84,10 @@ func (fs *FrameSocket) Close(code int) {
 		return
 	}
 
-	if code > 0 {
-		message := websocket.FormatCloseMessage(code, "")
-		err := fs.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
-		if err != nil {
-			fs.log.Warnf("Error sending close message: %v", err)
-		}
-	}
-
 	fs.cancel()
-	err := fs.conn.Close()
+	err := fs.conn.Close(code)
 	if err != nil {
-		fs.log.Errorf("Error closing websocket: %v", err)
+		fs.log.Errorf("Error closing connection: %v", err)
 	}
 	fs.conn = nil
 	fs.ctx = nil
@@ -102,30 +106,32 @@ func (fs *FrameSocket) Connect() error {
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 
-	fs.log.Debugf("Dialing %s", fs.URL)
-	conn, _, err := fs.Dialer.Dial(fs.URL, fs.HTTPHeaders)
+	transport := fs.Transport
+	if transport == nil {
+		fs.log.Debugf("Dialing %s", fs.URL)
+		transport = &WebsocketTransport{
+			URL:         fs.URL,
+			HTTPHeaders: fs.HTTPHeaders,
+			Dialer:      fs.Dialer,
+		}
+	} else {
+		fs.log.Debugf("Dialing with custom transport %T", transport)
+	}
+	conn, err := transport.Dial(ctx)
 	if err != nil {
 		cancel()
-		return fmt.Errorf("couldn't dial whatsapp web websocket: %w", err)
+		return err
 	}
 
 	fs.ctx, fs.cancel = ctx, cancel
 	fs.conn = conn
-	conn.SetCloseHandler(func(code int, text string) error {
-		fs.log.Debugf("Server closed websocket with status %d/%s", code, text)
-		cancel()
-		// from default CloseHandler
-		message := websocket.FormatCloseMessage(code, "")
-		_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
-		return nil
-	})
 
 	go fs.readPump(conn, ctx)
 	return nil
 }
 
 func (fs *FrameSocket) SendFrame(data []byte) error {
-	conn := fs.conn
+	conn := fs.getConn()
 	if conn == nil {
 		return ErrSocketClosed
 	}
@@ -159,7 +165,7 @@ func (fs *FrameSocket) SendFrame(data []byte) error {
 			fs.log.Warnf("Failed to set write deadline: %v", err)
 		}
 	}
-	return conn.WriteMessage(websocket.BinaryMessage, wholeFrame)
+	return conn.WriteFrames(wholeFrame)
 }
 
 func (fs *FrameSocket) frameComplete() {
@@ -182,7 +188,6 @@ func (fs *FrameSocket) processData(msg []byte) {
 			if len(msg) >= FrameLengthSize {
 				length := (int(msg[0]) << 16) + (int(msg[1]) << 8) + int(msg[2])
 				fs.incomingLength = length
-				fs.receivedLength = len(msg)
 				msg = msg[FrameLengthSize:]
 				if len(msg) >= length {
 					fs.incoming = msg[:length]
@@ -190,16 +195,16 @@ func (fs *FrameSocket) processData(msg []byte) {
 					fs.frameComplete()
 				} else {
 					fs.incoming = make([]byte, length)
-					copy(fs.incoming, msg)
+					fs.receivedLength = copy(fs.incoming, msg)
 					msg = nil
 				}
 			} else {
-				fs.log.Warnf("Received partial header (report if this happens often)")
+				fs.log.Debugf("Received partial frame header, waiting for more data")
 				fs.partialHeader = msg
 				msg = nil
 			}
 		} else {
-			if len(fs.incoming)+len(msg) >= fs.incomingLength {
+			if fs.receivedLength+len(msg) >= fs.incomingLength {
 				copy(fs.incoming[fs.receivedLength:], msg[:fs.incomingLength-fs.receivedLength])
 				msg = msg[fs.incomingLength-fs.receivedLength:]
 				fs.frameComplete()
@@ -212,23 +217,22 @@ func (fs *FrameSocket) processData(msg []byte) {
 	}
 }
 
-func (fs *FrameSocket) readPump(conn *websocket.Conn, ctx context.Context) {
-	fs.log.Debugf("Frame websocket read pump starting %p", fs)
+func (fs *FrameSocket) readPump(conn TransportConn, ctx context.Context) {
+	fs.log.Debugf("Frame socket read pump starting %p", fs)
 	defer func() {
-		fs.log.Debugf("Frame websocket read pump exiting %p", fs)
+		fs.log.Debugf("Frame socket read pump exiting %p", fs)
 		go fs.Close(0)
 	}()
 	for {
-		msgType, data, err := conn.ReadMessage()
+		data, err := conn.ReadFrames()
 		if err != nil {
-			// Ignore the error if the context has been closed
-			if !errors.Is(ctx.Err(), context.Canceled) {
-				fs.log.Errorf("Error reading from websocket: %v", err)
+			if errors.Is(err, io.EOF) {
+				fs.log.Debugf("Connection closed by remote: %v", err)
+			} else if !errors.Is(ctx.Err(), context.Canceled) {
+				// Ignore the error if the context has been closed
+				fs.log.Errorf("Error reading from connection: %v", err)
 			}
 			return
-		} else if msgType != websocket.BinaryMessage {
-			fs.log.Warnf("Got unexpected websocket message type %d", msgType)
-			continue
 		}
 		fs.processData(data)
 	}
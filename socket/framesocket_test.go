@@ -0,0 +1,149 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package socket
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	waLog "github.com/Romerito007/whatsmeow/util/log"
+)
+
+func makeFrame(payload []byte) []byte {
+	length := len(payload)
+	return append([]byte{byte(length >> 16), byte(length >> 8), byte(length)}, payload...)
+}
+
+func makePayload(length int, seed byte) []byte {
+	payload := make([]byte, length)
+	for i := range payload {
+		payload[i] = seed + byte(i)
+	}
+	return payload
+}
+
+// feedChunks passes the chunks to processData like a transport would, each in a newly allocated buffer,
+// and returns the frames that were completed.
+func feedChunks(t *testing.T, chunks [][]byte, expectedFrames int) [][]byte {
+	t.Helper()
+	fs := NewFrameSocket(waLog.Noop, websocket.Dialer{})
+	fs.Frames = make(chan []byte, expectedFrames+1)
+	for _, chunk := range chunks {
+		fs.processData(append([]byte(nil), chunk...))
+	}
+	close(fs.Frames)
+	var frames [][]byte
+	for frame := range fs.Frames {
+		frames = append(frames, frame)
+	}
+	if fs.incoming != nil || fs.partialHeader != nil || fs.incomingLength != 0 || fs.receivedLength != 0 {
+		t.Errorf("frame socket has leftover state after all data was processed")
+	}
+	return frames
+}
+
+func checkFrames(t *testing.T, got, expected [][]byte) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("got %d frames, expected %d", len(got), len(expected))
+	}
+	for i := range expected {
+		if !bytes.Equal(got[i], expected[i]) {
+			t.Fatalf("frame #%d is wrong:\n got: %x\nwant: %x", i+1, got[i], expected[i])
+		}
+	}
+}
+
+var processDataTests = []struct {
+	name     string
+	payloads [][]byte
+}{
+	{"single frame", [][]byte{makePayload(10, 1)}},
+	{"two frames", [][]byte{makePayload(5, 1), makePayload(7, 100)}},
+	{"one byte frames", [][]byte{{1}, {2}, {3}, {4}}},
+	{"empty frames", [][]byte{{}, makePayload(4, 1), {}, {}, makePayload(2, 50)}},
+	{"multi-byte length", [][]byte{makePayload(300, 1), makePayload(3, 7)}},
+	{"three-byte length", [][]byte{makePayload(1<<16+5, 1)}},
+}
+
+func buildStream(payloads [][]byte) []byte {
+	var stream []byte
+	for _, payload := range payloads {
+		stream = append(stream, makeFrame(payload)...)
+	}
+	return stream
+}
+
+func TestProcessDataWhole(t *testing.T) {
+	for _, test := range processDataTests {
+		t.Run(test.name, func(t *testing.T) {
+			checkFrames(t, feedChunks(t, [][]byte{buildStream(test.payloads)}, len(test.payloads)), test.payloads)
+		})
+	}
+}
+
+func TestProcessDataSplitOnce(t *testing.T) {
+	for _, test := range processDataTests {
+		stream := buildStream(test.payloads)
+		if len(stream) > 1024 {
+			// Large frames are split at the interesting offsets in TestProcessDataLargeFrameSplits
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i <= len(stream); i++ {
+				t.Run(fmt.Sprintf("at %d", i), func(t *testing.T) {
+					frames := feedChunks(t, [][]byte{stream[:i], stream[i:]}, len(test.payloads))
+					checkFrames(t, frames, test.payloads)
+				})
+			}
+		})
+	}
+}
+
+func TestProcessDataSplitTwice(t *testing.T) {
+	for _, test := range processDataTests {
+		stream := buildStream(test.payloads)
+		if len(stream) > 64 {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i <= len(stream); i++ {
+				for j := i; j <= len(stream); j++ {
+					frames := feedChunks(t, [][]byte{stream[:i], stream[i:j], stream[j:]}, len(test.payloads))
+					checkFrames(t, frames, test.payloads)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessDataByteByByte(t *testing.T) {
+	for _, test := range processDataTests {
+		t.Run(test.name, func(t *testing.T) {
+			stream := buildStream(test.payloads)
+			chunks := make([][]byte, len(stream))
+			for i := range stream {
+				chunks[i] = stream[i : i+1]
+			}
+			checkFrames(t, feedChunks(t, chunks, len(test.payloads)), test.payloads)
+		})
+	}
+}
+
+func TestProcessDataLargeFrameSplits(t *testing.T) {
+	payload := makePayload(1<<16+5, 1)
+	stream := makeFrame(payload)
+	// Splits inside the header, right after it, in the middle of the payload and right before the end
+	for _, i := range []int{1, 2, 3, 4, 1 << 15, len(stream) - 1} {
+		t.Run(fmt.Sprintf("at %d", i), func(t *testing.T) {
+			checkFrames(t, feedChunks(t, [][]byte{stream[:i], stream[i:]}, 1), [][]byte{payload})
+		})
+	}
+}
@@ -75,12 +75,8 @@ func (nh *NoiseHandshake) Decrypt(ciphertext []byte) (plaintext []byte, err erro
 }
 
 func (nh *NoiseHandshake) Finish(fs *FrameSocket, frameHandler FrameHandler, disconnectHandler DisconnectHandler) (*NoiseSocket, error) {
-	if write, read, err := nh.extractAndExpand(nh.salt, nil); err != nil {
-		return nil, fmt.Errorf("failed to extract final keys: %w", err)
-	} else if writeKey, err := gcmutil.Prepare(write); err != nil {
-		return nil, fmt.Errorf("failed to create final write cipher: %w", err)
-	} else if readKey, err := gcmutil.Prepare(read); err != nil {
-		return nil, fmt.Errorf("failed to create final read cipher: %w", err)
+	if writeKey, readKey, err := nh.FinalKeys(); err != nil {
+		return nil, err
 	} else if ns, err := newNoiseSocket(fs, writeKey, readKey, frameHandler, disconnectHandler); err != nil {
 		return nil, fmt.Errorf("failed to create noise socket: %w", err)
 	} else {
@@ -88,6 +84,20 @@ func (nh *NoiseHandshake) Finish(fs *FrameSocket, frameHandler FrameHandler, dis
 	}
 }
 
+// FinalKeys returns the ciphers for encrypting frames after the handshake is complete.
+// The first cipher is used for frames sent by the client and the second for frames sent by the server.
+func (nh *NoiseHandshake) FinalKeys() (clientKey, serverKey cipher.AEAD, err error) {
+	if write, read, err := nh.extractAndExpand(nh.salt, nil); err != nil {
+		return nil, nil, fmt.Errorf("failed to extract final keys: %w", err)
+	} else if clientKey, err = gcmutil.Prepare(write); err != nil {
+		return nil, nil, fmt.Errorf("failed to create final write cipher: %w", err)
+	} else if serverKey, err = gcmutil.Prepare(read); err != nil {
+		return nil, nil, fmt.Errorf("failed to create final read cipher: %w", err)
+	} else {
+		return clientKey, serverKey, nil
+	}
+}
+
 func (nh *NoiseHandshake) MixSharedSecretIntoKey(priv, pub [32]byte) error {
 	secret, err := curve25519.X25519(priv[:], pub[:])
 	if err != nil {
@@ -0,0 +1,166 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package socket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport opens the connections that FrameSocket sends and receives frames through.
+//
+// The default transport is WebsocketTransport. NetTransport can be used to run the protocol
+// over any stream-oriented net.Conn, like a raw TCP connection, a custom tunnel or an in-memory pipe.
+type Transport interface {
+	// Dial opens a new connection. The context is only used for dialing.
+	Dial(ctx context.Context) (TransportConn, error)
+}
+
+// TransportConn is a single connection opened by a Transport.
+//
+// Data is passed through as-is: written data contains the connection header (before the first frame)
+// and frames prefixed with their 3-byte length, and the same length-prefixed frames are expected back.
+type TransportConn interface {
+	// ReadFrames blocks until data is available and returns it. The returned data may contain any number
+	// of whole or partial length-prefixed frames, and must not be modified by the transport afterwards.
+	// io.EOF should be returned if the other side closed the connection.
+	ReadFrames() ([]byte, error)
+	// WriteFrames writes data containing one or more whole length-prefixed frames.
+	WriteFrames(data []byte) error
+	// SetWriteDeadline sets the deadline for future WriteFrames calls. A zero value disables the deadline.
+	SetWriteDeadline(t time.Time) error
+	// Close closes the connection. If code is positive, the transport may tell the other side
+	// the reason for closing (e.g. using a websocket close message).
+	Close(code int) error
+}
+
+// WebsocketTransport is a Transport that connects to a websocket URL. Each websocket message carries
+// one or more frames, which is how WhatsApp's servers expect to receive them.
+type WebsocketTransport struct {
+	URL         string
+	HTTPHeaders http.Header
+	Dialer      websocket.Dialer
+}
+
+var _ Transport = (*WebsocketTransport)(nil)
+
+func (wt *WebsocketTransport) Dial(ctx context.Context) (TransportConn, error) {
+	conn, _, err := wt.Dialer.DialContext(ctx, wt.URL, wt.HTTPHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't dial whatsapp web websocket: %w", err)
+	}
+	return &websocketConn{conn: conn}, nil
+}
+
+type websocketConn struct {
+	conn *websocket.Conn
+}
+
+func (wc *websocketConn) ReadFrames() ([]byte, error) {
+	for {
+		msgType, data, err := wc.conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			return nil, fmt.Errorf("%w: server closed websocket with status %d/%s", io.EOF, closeErr.Code, closeErr.Text)
+		} else if err != nil {
+			return nil, err
+		} else if msgType != websocket.BinaryMessage {
+			// Other message types aren't used by WhatsApp, so just skip them
+			continue
+		}
+		return data, nil
+	}
+}
+
+func (wc *websocketConn) WriteFrames(data []byte) error {
+	return wc.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (wc *websocketConn) SetWriteDeadline(t time.Time) error {
+	return wc.conn.SetWriteDeadline(t)
+}
+
+func (wc *websocketConn) Close(code int) error {
+	if code > 0 {
+		message := websocket.FormatCloseMessage(code, "")
+		err := wc.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		if err != nil {
+			_ = wc.conn.Close()
+			return fmt.Errorf("failed to send close message: %w", err)
+		}
+	}
+	return wc.conn.Close()
+}
+
+// NetTransport is a Transport that sends frames directly over a stream-oriented net.Conn,
+// using only the 3-byte length prefixes of frames to separate them.
+type NetTransport struct {
+	// DialFunc opens the underlying connection.
+	DialFunc func(ctx context.Context) (net.Conn, error)
+	// ReadBufferSize is the maximum number of bytes returned by a single ReadFrames call. Defaults to 32 KiB.
+	ReadBufferSize int
+}
+
+var _ Transport = (*NetTransport)(nil)
+
+// NewNetTransport creates a NetTransport that dials the given address, e.g. NewNetTransport("tcp", "127.0.0.1:5222").
+func NewNetTransport(network, address string) *NetTransport {
+	var dialer net.Dialer
+	return &NetTransport{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+func (nt *NetTransport) Dial(ctx context.Context) (TransportConn, error) {
+	conn, err := nt.DialFunc(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't dial connection: %w", err)
+	}
+	bufSize := nt.ReadBufferSize
+	if bufSize <= 0 {
+		bufSize = 32 * 1024
+	}
+	return &netConn{conn: conn, bufSize: bufSize}, nil
+}
+
+type netConn struct {
+	conn    net.Conn
+	bufSize int
+}
+
+func (nc *netConn) ReadFrames() ([]byte, error) {
+	// A new buffer is needed for each read, as FrameSocket may keep references to the returned data
+	buf := make([]byte, nc.bufSize)
+	n, err := nc.conn.Read(buf)
+	if n > 0 {
+		// Errors will be returned again by the next read, so they can be ignored when there's data
+		return buf[:n], nil
+	}
+	return nil, err
+}
+
+func (nc *netConn) WriteFrames(data []byte) error {
+	_, err := nc.conn.Write(data)
+	return err
+}
+
+func (nc *netConn) SetWriteDeadline(t time.Time) error {
+	return nc.conn.SetWriteDeadline(t)
+}
+
+func (nc *netConn) Close(_ int) error {
+	return nc.conn.Close()
+}
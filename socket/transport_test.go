@@ -0,0 +1,132 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package socket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	waLog "github.com/Romerito007/whatsmeow/util/log"
+)
+
+func waitFrame(t *testing.T, fs *FrameSocket) []byte {
+	t.Helper()
+	select {
+	case frame := <-fs.Frames:
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for frame")
+		return nil
+	}
+}
+
+// connectPipe connects two frame sockets through a net.Pipe using NetTransport. The server side reads
+// and checks the connection header before the frame socket starts reading, like a real server would.
+func connectPipe(t *testing.T, readBufferSize int) (client, server *FrameSocket) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	client = NewFrameSocket(waLog.Noop, websocket.Dialer{})
+	client.Frames = make(chan []byte, 4)
+	client.Transport = &NetTransport{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			return clientConn, nil
+		},
+		ReadBufferSize: readBufferSize,
+	}
+	server = NewFrameSocket(waLog.Noop, websocket.Dialer{})
+	server.Header = nil
+	server.Frames = make(chan []byte, 4)
+	server.Transport = &NetTransport{
+		DialFunc: func(ctx context.Context) (net.Conn, error) {
+			header := make([]byte, len(WAConnHeader))
+			if _, err := io.ReadFull(serverConn, header); err != nil {
+				return nil, err
+			} else if !bytes.Equal(header, WAConnHeader) {
+				return nil, fmt.Errorf("unexpected connection header %x", header)
+			}
+			return serverConn, nil
+		},
+		ReadBufferSize: readBufferSize,
+	}
+	t.Cleanup(func() {
+		client.Close(0)
+		server.Close(0)
+	})
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect client: %v", err)
+	}
+	// net.Pipe is synchronous, so the server has to be reading before the client can send the header.
+	// The server finishes connecting when the client sends its first frame.
+	go func() {
+		if err := server.Connect(); err != nil {
+			t.Errorf("failed to connect server: %v", err)
+		}
+	}()
+	return client, server
+}
+
+func TestNetTransportFrames(t *testing.T) {
+	// A small buffer makes frames arrive split across reads, including in the middle of length prefixes
+	for _, bufSize := range []int{0, 2, 7} {
+		t.Run(fmt.Sprintf("buffer %d", bufSize), func(t *testing.T) {
+			client, server := connectPipe(t, bufSize)
+
+			payloads := [][]byte{[]byte("hello"), {}, makePayload(70000, 3)}
+			for _, payload := range payloads {
+				go func() {
+					if err := client.SendFrame(payload); err != nil {
+						t.Errorf("failed to send frame from client: %v", err)
+					}
+				}()
+				if frame := waitFrame(t, server); !bytes.Equal(frame, payload) {
+					t.Fatalf("server received %d bytes, expected %d", len(frame), len(payload))
+				}
+			}
+			go func() {
+				if err := server.SendFrame([]byte("response")); err != nil {
+					t.Errorf("failed to send frame from server: %v", err)
+				}
+			}()
+			if frame := waitFrame(t, client); string(frame) != "response" {
+				t.Fatalf("client received %q, expected response", frame)
+			}
+		})
+	}
+}
+
+func TestNetTransportRemoteClose(t *testing.T) {
+	client, server := connectPipe(t, 0)
+	disconnected := make(chan bool, 1)
+	client.OnDisconnect = func(remote bool) {
+		disconnected <- remote
+	}
+	go func() {
+		_ = client.SendFrame([]byte("hello"))
+	}()
+	waitFrame(t, server)
+
+	server.Close(0)
+	select {
+	case remote := <-disconnected:
+		if !remote {
+			t.Errorf("disconnection wasn't reported as remote")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client didn't notice the connection being closed")
+	}
+	if client.IsConnected() {
+		t.Errorf("client still reports being connected")
+	}
+}
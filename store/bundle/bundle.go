@@ -0,0 +1,275 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package bundle implements exporting a paired device into a passphrase-encrypted archive and importing it
+// into another store container, e.g. for migrating from SQLite to Postgres or into the in-memory store
+// without having to pair again.
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/random"
+	"golang.org/x/crypto/argon2"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waAdv"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/util/gcmutil"
+	"github.com/Romerito007/whatsmeow/util/keys"
+)
+
+// Version is the current version of the bundle format written by Export.
+const Version = 1
+
+const (
+	magic       = "WMBUNDLE"
+	saltLength  = 16
+	nonceLength = 12
+	headerLen   = len(magic) + 1 + saltLength + nonceLength
+
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	kdfKeyLen  = 32
+)
+
+// Errors returned by Export and Import
+var (
+	ErrNotBundle          = errors.New("data is not a whatsmeow device bundle")
+	ErrUnsupportedVersion = errors.New("unsupported bundle version")
+	ErrWrongPassphrase    = errors.New("wrong passphrase or corrupted bundle")
+	ErrDeviceNotPaired    = errors.New("can't export a device that isn't paired")
+	ErrDeviceAlreadyUsed  = errors.New("import target must be a new device")
+	ErrDeviceExists       = errors.New("the target container already contains the device being imported")
+	ErrNoDeviceDataStore  = errors.New("device store doesn't support exporting or importing data")
+)
+
+type deviceInfo struct {
+	ID              types.JID `json:"id"`
+	RegistrationID  uint32    `json:"registration_id"`
+	NoiseKey        []byte    `json:"noise_key"`
+	IdentityKey     []byte    `json:"identity_key"`
+	SignedPreKey    []byte    `json:"signed_pre_key"`
+	SignedPreKeyID  uint32    `json:"signed_pre_key_id"`
+	SignedPreKeySig []byte    `json:"signed_pre_key_sig"`
+	AdvSecretKey    []byte    `json:"adv_key"`
+	Account         []byte    `json:"account"`
+	Platform        string    `json:"platform"`
+	BusinessName    string    `json:"business_name"`
+	PushName        string    `json:"push_name"`
+	FacebookUUID    uuid.UUID `json:"facebook_uuid"`
+}
+
+type payload struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Device    deviceInfo        `json:"device"`
+	Data      *store.DeviceData `json:"data"`
+}
+
+func deriveKey(passphrase string, salt []byte) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, kdfTime, kdfMemory, kdfThreads, kdfKeyLen)
+}
+
+// Export writes the given device and all of its Signal and app state data into w as an encrypted bundle.
+//
+// The bundle is encrypted with AES-GCM using a key derived from the passphrase with Argon2id.
+// It contains the private keys of the device, so the passphrase should be strong.
+func Export(w io.Writer, device *store.Device, passphrase string) error {
+	if device.ID == nil || device.Account == nil {
+		return ErrDeviceNotPaired
+	} else if device.DeviceData == nil {
+		return ErrNoDeviceDataStore
+	}
+	account, err := proto.Marshal(device.Account)
+	if err != nil {
+		return fmt.Errorf("failed to marshal account: %w", err)
+	}
+	data, err := device.DeviceData.ExportDeviceData()
+	if err != nil {
+		return fmt.Errorf("failed to export device data: %w", err)
+	}
+	plaintext, err := json.Marshal(&payload{
+		CreatedAt: time.Now(),
+		Device: deviceInfo{
+			ID:              *device.ID,
+			RegistrationID:  device.RegistrationID,
+			NoiseKey:        device.NoiseKey.Priv[:],
+			IdentityKey:     device.IdentityKey.Priv[:],
+			SignedPreKey:    device.SignedPreKey.Priv[:],
+			SignedPreKeyID:  device.SignedPreKey.KeyID,
+			SignedPreKeySig: device.SignedPreKey.Signature[:],
+			AdvSecretKey:    device.AdvSecretKey,
+			Account:         account,
+			Platform:        device.Platform,
+			BusinessName:    device.BusinessName,
+			PushName:        device.PushName,
+			FacebookUUID:    device.FacebookUUID,
+		},
+		Data: data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal bundle: %w", err)
+	}
+
+	header := make([]byte, 0, headerLen)
+	header = append(header, magic...)
+	header = append(header, Version)
+	header = append(header, random.Bytes(saltLength)...)
+	header = append(header, random.Bytes(nonceLength)...)
+	salt := header[len(magic)+1 : len(magic)+1+saltLength]
+	nonce := header[len(magic)+1+saltLength:]
+	ciphertext, err := gcmutil.Encrypt(deriveKey(passphrase, salt), nonce, plaintext, header)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt bundle: %w", err)
+	}
+	_, err = w.Write(header)
+	if err == nil {
+		_, err = w.Write(ciphertext)
+	}
+	return err
+}
+
+// ImportOptions contains optional parameters for Import.
+type ImportOptions struct {
+	// If Overwrite is true and the target container already contains the device being imported,
+	// the existing device and all of its data are deleted and replaced with the contents of the bundle.
+	// Otherwise, Import returns ErrDeviceExists in that case.
+	Overwrite bool
+}
+
+// deviceGetter is implemented by the store containers that can look up devices by JID.
+type deviceGetter interface {
+	GetDevice(jid types.JID) (*store.Device, error)
+}
+
+func getDevice(ctx context.Context, container store.DeviceContainer, jid types.JID) (*store.Device, error) {
+	if ctxContainer, ok := container.(store.ContextDeviceContainer); ok {
+		return ctxContainer.GetDeviceContext(ctx, jid)
+	} else if getter, ok := container.(deviceGetter); ok {
+		return getter.GetDevice(jid)
+	}
+	return nil, nil
+}
+
+func deleteDevice(ctx context.Context, container store.DeviceContainer, device *store.Device) error {
+	if ctxContainer, ok := container.(store.ContextDeviceContainer); ok {
+		return ctxContainer.DeleteDeviceContext(ctx, device)
+	}
+	return container.DeleteDevice(device)
+}
+
+func importDeviceData(ctx context.Context, dataStore store.DeviceDataStore, data *store.DeviceData) error {
+	if ctxStore, ok := dataStore.(store.ContextDeviceDataStore); ok {
+		return ctxStore.ImportDeviceDataContext(ctx, data)
+	}
+	return dataStore.ImportDeviceData(data)
+}
+
+// Import reads a bundle written by Export and stores its contents using the given device.
+//
+// The target device must be a new unpaired device from the container the data should be imported into, i.e.
+// the return value of NewDevice. If the container already contains the device being imported, ErrDeviceExists
+// is returned, unless overwriting is enabled in the options.
+// After a successful import, the device can be passed to whatsmeow.NewClient and connected like normal.
+//
+// If the container supports transactions (like sqlstore), the device and all of its data are stored in a single
+// transaction, so a failed import doesn't leave a partially imported device behind.
+func Import(r io.Reader, passphrase string, target *store.Device, opts ...ImportOptions) error {
+	var opt ImportOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if target.ID != nil {
+		return ErrDeviceAlreadyUsed
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read bundle: %w", err)
+	} else if len(raw) < headerLen || !bytes.HasPrefix(raw, []byte(magic)) {
+		return ErrNotBundle
+	} else if raw[len(magic)] != Version {
+		return fmt.Errorf("%w %d", ErrUnsupportedVersion, raw[len(magic)])
+	}
+	header := raw[:headerLen]
+	salt := header[len(magic)+1 : len(magic)+1+saltLength]
+	nonce := header[len(magic)+1+saltLength:]
+	plaintext, err := gcmutil.Decrypt(deriveKey(passphrase, salt), nonce, raw[headerLen:], header)
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	var bundle payload
+	err = json.Unmarshal(plaintext, &bundle)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal bundle: %w", err)
+	}
+	info := &bundle.Device
+	if len(info.NoiseKey) != 32 || len(info.IdentityKey) != 32 || len(info.SignedPreKey) != 32 || len(info.SignedPreKeySig) != 64 {
+		return fmt.Errorf("bundle contains keys with invalid lengths")
+	}
+	var account waAdv.ADVSignedDeviceIdentity
+	err = proto.Unmarshal(info.Account, &account)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal account: %w", err)
+	}
+
+	original := *target
+	target.ID = &info.ID
+	target.RegistrationID = info.RegistrationID
+	target.NoiseKey = keys.NewKeyPairFromPrivateKey(*(*[32]byte)(info.NoiseKey))
+	target.IdentityKey = keys.NewKeyPairFromPrivateKey(*(*[32]byte)(info.IdentityKey))
+	target.SignedPreKey = &keys.PreKey{
+		KeyPair:   *keys.NewKeyPairFromPrivateKey(*(*[32]byte)(info.SignedPreKey)),
+		KeyID:     info.SignedPreKeyID,
+		Signature: (*[64]byte)(info.SignedPreKeySig),
+	}
+	target.AdvSecretKey = info.AdvSecretKey
+	target.Account = &account
+	target.Platform = info.Platform
+	target.BusinessName = info.BusinessName
+	target.PushName = info.PushName
+	target.FacebookUUID = info.FacebookUUID
+	err = target.DoTxn(context.Background(), func(ctx context.Context) error {
+		existing, err := getDevice(ctx, target.Container, info.ID)
+		if err != nil {
+			return fmt.Errorf("failed to check for existing device: %w", err)
+		} else if existing != nil {
+			if !opt.Overwrite {
+				return ErrDeviceExists
+			}
+			err = deleteDevice(ctx, target.Container, existing)
+			if err != nil {
+				return fmt.Errorf("failed to delete existing device: %w", err)
+			}
+		}
+		err = target.SaveContext(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to save device: %w", err)
+		} else if target.DeviceData == nil {
+			return ErrNoDeviceDataStore
+		}
+		if bundle.Data != nil {
+			err = importDeviceData(ctx, target.DeviceData, bundle.Data)
+			if err != nil {
+				return fmt.Errorf("failed to import device data: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Restore the target device so that the caller can't accidentally use a half-imported device
+		*target = original
+	}
+	return err
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package bundle_test
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/Romerito007/whatsmeow/proto/waAdv"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/store/bundle"
+	"github.com/Romerito007/whatsmeow/store/memstore"
+	"github.com/Romerito007/whatsmeow/store/sqlstore"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+func newTestSQLContainer(t *testing.T) *sqlstore.Container {
+	container, _ := newTestSQLContainerWithDB(t)
+	return container
+}
+
+// newTestSQLContainerWithDB creates a container backed by a new SQLite database and also returns the raw database
+// connection, so that tests can check what's actually stored.
+func newTestSQLContainerWithDB(t *testing.T) (*sqlstore.Container, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "whatsmeow.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	container := sqlstore.NewWithDB(db, "sqlite3", nil)
+	t.Cleanup(func() {
+		_ = container.Close()
+	})
+	err = container.Upgrade()
+	if err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	return container, db
+}
+
+func makeTestDeviceData() *store.DeviceData {
+	return &store.DeviceData{
+		Identities: map[string][]byte{"1111.0:1": bytes.Repeat([]byte{1}, 32)},
+		Sessions:   map[string][]byte{"1111.0:1": []byte("session")},
+		PreKeys:    []store.ExportedPreKey{{KeyID: 5, Key: bytes.Repeat([]byte{2}, 32), Uploaded: true}},
+		SenderKeys: []store.ExportedSenderKey{{Group: "123456789@g.us", User: "1111.0:1", Key: []byte("sender key")}},
+		AppStateSyncKeys: []store.ExportedAppStateSyncKey{{
+			ID:              []byte("sync key"),
+			AppStateSyncKey: store.AppStateSyncKey{Data: []byte("data"), Fingerprint: []byte("fingerprint"), Timestamp: 1700000000},
+		}},
+		AppStateVersions: []store.ExportedAppStateVersion{{
+			Name:    "regular",
+			Version: 3,
+			Hash:    bytes.Repeat([]byte{3}, 128),
+			MutationMACs: []store.ExportedAppStateMutationMAC{{
+				Version:             2,
+				AppStateMutationMAC: store.AppStateMutationMAC{IndexMAC: bytes.Repeat([]byte{4}, 32), ValueMAC: bytes.Repeat([]byte{5}, 32)},
+			}},
+		}},
+		Contacts: []store.ExportedContact{{JID: types.NewJID("1111", types.DefaultUserServer), FirstName: "Alice", FullName: "Alice A"}},
+		PrivacyTokens: []store.PrivacyToken{{
+			User:      types.NewJID("1111", types.DefaultUserServer),
+			Token:     []byte("token"),
+			Timestamp: time.Unix(1700000000, 0),
+		}},
+	}
+}
+
+// newSourceDevice creates a paired device with one row of every kind of device data.
+func newSourceDevice(t *testing.T, phone string) *store.Device {
+	t.Helper()
+	device := newTestSQLContainer(t).NewDevice()
+	device.ID = &types.JID{User: phone, Device: 1, Server: types.DefaultUserServer}
+	device.PushName = "Source"
+	device.Account = &waAdv.ADVSignedDeviceIdentity{
+		Details:             []byte{1},
+		AccountSignature:    bytes.Repeat([]byte{2}, 64),
+		AccountSignatureKey: bytes.Repeat([]byte{3}, 32),
+		DeviceSignature:     bytes.Repeat([]byte{4}, 64),
+	}
+	err := device.Save()
+	if err != nil {
+		t.Fatalf("failed to save device: %v", err)
+	}
+	err = device.DeviceData.ImportDeviceData(makeTestDeviceData())
+	if err != nil {
+		t.Fatalf("failed to fill device data: %v", err)
+	}
+	return device
+}
+
+func exportDevice(t *testing.T, device *store.Device, passphrase string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	err := bundle.Export(&buf, device, passphrase)
+	if err != nil {
+		t.Fatalf("failed to export device: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func exportData(t *testing.T, device *store.Device) string {
+	t.Helper()
+	data, err := device.DeviceData.ExportDeviceData()
+	if err != nil {
+		t.Fatalf("failed to export device data: %v", err)
+	}
+	return fmt.Sprintf("%+v", *data)
+}
+
+func checkSameDevice(t *testing.T, imported, source *store.Device) {
+	t.Helper()
+	if *imported.ID != *source.ID || imported.RegistrationID != source.RegistrationID ||
+		*imported.NoiseKey.Priv != *source.NoiseKey.Priv || *imported.IdentityKey.Priv != *source.IdentityKey.Priv ||
+		imported.SignedPreKey.KeyID != source.SignedPreKey.KeyID || *imported.SignedPreKey.Signature != *source.SignedPreKey.Signature ||
+		!bytes.Equal(imported.AdvSecretKey, source.AdvSecretKey) || imported.PushName != source.PushName ||
+		!bytes.Equal(imported.Account.GetAccountSignature(), source.Account.GetAccountSignature()) {
+		t.Errorf("imported device doesn't match the source device")
+	}
+	if importedData, sourceData := exportData(t, imported), exportData(t, source); importedData != sourceData {
+		t.Errorf("imported device data doesn't match:\n%s\nexpected:\n%s", importedData, sourceData)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	source := newSourceDevice(t, "1234")
+	data := exportDevice(t, source, testPassphrase)
+
+	targets := []struct {
+		name      string
+		container interface {
+			NewDevice() *store.Device
+			GetDevice(types.JID) (*store.Device, error)
+		}
+	}{
+		{"sqlstore", newTestSQLContainer(t)},
+		{"memstore", memstore.New(nil)},
+	}
+	for _, target := range targets {
+		t.Run(target.name, func(t *testing.T) {
+			device := target.container.NewDevice()
+			err := bundle.Import(bytes.NewReader(data), testPassphrase, device)
+			if err != nil {
+				t.Fatalf("failed to import bundle: %v", err)
+			}
+			checkSameDevice(t, device, source)
+			loaded, err := target.container.GetDevice(*source.ID)
+			if err != nil || loaded == nil {
+				t.Fatalf("failed to load imported device: %v", err)
+			}
+			checkSameDevice(t, loaded, source)
+		})
+	}
+}
+
+func TestImport_ExistingDevice(t *testing.T) {
+	source := newSourceDevice(t, "1234")
+	data := exportDevice(t, source, testPassphrase)
+	container := newTestSQLContainer(t)
+	err := bundle.Import(bytes.NewReader(data), testPassphrase, container.NewDevice())
+	if err != nil {
+		t.Fatalf("failed to import bundle: %v", err)
+	}
+	existing, _ := container.GetDevice(*source.ID)
+	err = existing.Sessions.PutSession("2222.0:1", []byte("only in target"))
+	if err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+
+	target := container.NewDevice()
+	err = bundle.Import(bytes.NewReader(data), testPassphrase, target)
+	if !errors.Is(err, bundle.ErrDeviceExists) {
+		t.Fatalf("expected ErrDeviceExists, got %v", err)
+	} else if target.ID != nil {
+		t.Errorf("target device wasn't restored after failed import")
+	}
+	if has, _ := existing.Sessions.HasSession("2222.0:1"); !has {
+		t.Errorf("existing device was modified by refused import")
+	}
+
+	// Overwriting deletes the existing device with all of its data first
+	err = bundle.Import(bytes.NewReader(data), testPassphrase, target, bundle.ImportOptions{Overwrite: true})
+	if err != nil {
+		t.Fatalf("failed to overwrite device: %v", err)
+	}
+	checkSameDevice(t, target, source)
+	if has, _ := target.Sessions.HasSession("2222.0:1"); has {
+		t.Errorf("data of the overwritten device was kept")
+	}
+}
+
+// brokenDataStore returns device data that the sqlstore rejects halfway through the import.
+type brokenDataStore struct {
+	store.DeviceDataStore
+}
+
+func (bds brokenDataStore) ExportDeviceData() (*store.DeviceData, error) {
+	data, err := bds.DeviceDataStore.ExportDeviceData()
+	if err != nil {
+		return nil, err
+	}
+	// Mutation MACs are imported after the sessions and keys, and the schema requires them to be 32 bytes
+	data.AppStateVersions[0].MutationMACs[0].IndexMAC = []byte{1}
+	return data, nil
+}
+
+func TestImport_FailureRollsBack(t *testing.T) {
+	source := newSourceDevice(t, "1234")
+	source.DeviceData = brokenDataStore{source.DeviceData}
+	data := exportDevice(t, source, testPassphrase)
+
+	container, db := newTestSQLContainerWithDB(t)
+	target := container.NewDevice()
+	err := bundle.Import(bytes.NewReader(data), testPassphrase, target)
+	if err == nil {
+		t.Fatalf("importing broken data succeeded")
+	} else if target.ID != nil {
+		t.Errorf("target device wasn't restored after failed import")
+	}
+	if device, err := container.GetDevice(*source.ID); err != nil || device != nil {
+		t.Fatalf("device was left behind by failed import: %v, %v", device, err)
+	}
+	// The data of the failed import must not be left behind either
+	for _, table := range []string{"whatsmeow_identity_keys", "whatsmeow_sessions", "whatsmeow_pre_keys", "whatsmeow_app_state_version"} {
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		if err != nil {
+			t.Fatalf("failed to count rows in %s: %v", table, err)
+		} else if count != 0 {
+			t.Errorf("failed import left %d rows in %s", count, table)
+		}
+	}
+}
+
+func TestImport_BadBundles(t *testing.T) {
+	data := exportDevice(t, newSourceDevice(t, "1234"), testPassphrase)
+	tamper := func(index int) []byte {
+		tampered := bytes.Clone(data)
+		tampered[index] ^= 1
+		return tampered
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		passphrase string
+		expected   error
+	}{
+		{"wrong passphrase", data, "wrong", bundle.ErrWrongPassphrase},
+		{"tampered salt", tamper(len("WMBUNDLE") + 1), testPassphrase, bundle.ErrWrongPassphrase},
+		{"tampered nonce", tamper(len("WMBUNDLE") + 1 + 16), testPassphrase, bundle.ErrWrongPassphrase},
+		{"tampered ciphertext", tamper(len(data) - 1), testPassphrase, bundle.ErrWrongPassphrase},
+		{"tampered version", tamper(len("WMBUNDLE")), testPassphrase, bundle.ErrUnsupportedVersion},
+		{"tampered magic", tamper(0), testPassphrase, bundle.ErrNotBundle},
+		{"truncated header", data[:20], testPassphrase, bundle.ErrNotBundle},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container := newTestSQLContainer(t)
+			target := container.NewDevice()
+			err := bundle.Import(bytes.NewReader(test.data), test.passphrase, target)
+			if !errors.Is(err, test.expected) {
+				t.Errorf("got error %v, expected %v", err, test.expected)
+			} else if target.ID != nil {
+				t.Errorf("target device was modified by failed import")
+			}
+			if devices, _ := container.GetAllDevices(); len(devices) != 0 {
+				t.Errorf("failed import stored %d devices", len(devices))
+			}
+		})
+	}
+}
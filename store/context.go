@@ -0,0 +1,224 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package store
+
+import (
+	"context"
+
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/util/keys"
+)
+
+// ContextIdentityStore is a variant of IdentityStore where all methods accept a context.
+//
+// Implementations must run queries inside the transaction stored in the context by
+// TransactionalContainer.DoTxn, if there is one.
+type ContextIdentityStore interface {
+	PutIdentityContext(ctx context.Context, address string, key [32]byte) error
+	DeleteAllIdentitiesContext(ctx context.Context, phone string) error
+	DeleteIdentityContext(ctx context.Context, address string) error
+	IsTrustedIdentityContext(ctx context.Context, address string, key [32]byte) (bool, error)
+}
+
+// ContextSessionStore is a variant of SessionStore where all methods accept a context.
+type ContextSessionStore interface {
+	GetSessionContext(ctx context.Context, address string) ([]byte, error)
+	HasSessionContext(ctx context.Context, address string) (bool, error)
+	PutSessionContext(ctx context.Context, address string, session []byte) error
+	DeleteAllSessionsContext(ctx context.Context, phone string) error
+	DeleteSessionContext(ctx context.Context, address string) error
+}
+
+// ContextPreKeyStore is a variant of PreKeyStore where all methods accept a context.
+type ContextPreKeyStore interface {
+	GetOrGenPreKeysContext(ctx context.Context, count uint32) ([]*keys.PreKey, error)
+	GenOnePreKeyContext(ctx context.Context) (*keys.PreKey, error)
+	GetPreKeyContext(ctx context.Context, id uint32) (*keys.PreKey, error)
+	RemovePreKeyContext(ctx context.Context, id uint32) error
+	MarkPreKeysAsUploadedContext(ctx context.Context, upToID uint32) error
+	UploadedPreKeyCountContext(ctx context.Context) (int, error)
+}
+
+// ContextSenderKeyStore is a variant of SenderKeyStore where all methods accept a context.
+type ContextSenderKeyStore interface {
+	PutSenderKeyContext(ctx context.Context, group, user string, session []byte) error
+	GetSenderKeyContext(ctx context.Context, group, user string) ([]byte, error)
+}
+
+// ContextDeviceContainer is a variant of DeviceContainer where all methods accept a context.
+type ContextDeviceContainer interface {
+	// GetDeviceContext returns the device with the given JID, or nil if it doesn't exist.
+	GetDeviceContext(ctx context.Context, jid types.JID) (*Device, error)
+	PutDeviceContext(ctx context.Context, store *Device) error
+	DeleteDeviceContext(ctx context.Context, store *Device) error
+}
+
+// ContextDeviceDataStore is a variant of DeviceDataStore where all methods accept a context.
+type ContextDeviceDataStore interface {
+	ExportDeviceDataContext(ctx context.Context) (*DeviceData, error)
+	ImportDeviceDataContext(ctx context.Context, data *DeviceData) error
+}
+
+// TransactionalContainer is implemented by containers that can run multiple store operations atomically.
+type TransactionalContainer interface {
+	// DoTxn runs the given function inside a transaction. Store methods that accept a context will use the
+	// transaction when called with the context passed to the function. The transaction is committed if the
+	// function returns nil and rolled back otherwise. If the context already contains a transaction,
+	// the function is called directly.
+	DoTxn(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+// DoTxn runs the given function in a transaction if the container supports it (see TransactionalContainer).
+// Otherwise, the function is just called directly.
+//
+// Only the context-accepting store methods (e.g. those in SignalStore) take part in the transaction.
+// Calling other store methods inside the function may block until the transaction is finished.
+func (device *Device) DoTxn(ctx context.Context, fn func(ctx context.Context) error) error {
+	if txnContainer, ok := device.Container.(TransactionalContainer); ok {
+		return txnContainer.DoTxn(ctx, fn)
+	}
+	return fn(ctx)
+}
+
+// SaveContext is a variant of Save that uses the transaction in the context if the container supports it.
+func (device *Device) SaveContext(ctx context.Context) error {
+	if ctxContainer, ok := device.Container.(ContextDeviceContainer); ok {
+		return ctxContainer.PutDeviceContext(ctx, device)
+	}
+	return device.Save()
+}
+
+func (device *Device) putIdentity(ctx context.Context, address string, key [32]byte) error {
+	if ctxStore, ok := device.Identities.(ContextIdentityStore); ok {
+		return ctxStore.PutIdentityContext(ctx, address, key)
+	}
+	return device.Identities.PutIdentity(address, key)
+}
+
+func (device *Device) deleteIdentity(ctx context.Context, address string) error {
+	if ctxStore, ok := device.Identities.(ContextIdentityStore); ok {
+		return ctxStore.DeleteIdentityContext(ctx, address)
+	}
+	return device.Identities.DeleteIdentity(address)
+}
+
+func (device *Device) isTrustedIdentity(ctx context.Context, address string, key [32]byte) (bool, error) {
+	if ctxStore, ok := device.Identities.(ContextIdentityStore); ok {
+		return ctxStore.IsTrustedIdentityContext(ctx, address, key)
+	}
+	return device.Identities.IsTrustedIdentity(address, key)
+}
+
+func (device *Device) getSession(ctx context.Context, address string) ([]byte, error) {
+	if ctxStore, ok := device.Sessions.(ContextSessionStore); ok {
+		return ctxStore.GetSessionContext(ctx, address)
+	}
+	return device.Sessions.GetSession(address)
+}
+
+func (device *Device) hasSession(ctx context.Context, address string) (bool, error) {
+	if ctxStore, ok := device.Sessions.(ContextSessionStore); ok {
+		return ctxStore.HasSessionContext(ctx, address)
+	}
+	return device.Sessions.HasSession(address)
+}
+
+func (device *Device) putSession(ctx context.Context, address string, session []byte) error {
+	if ctxStore, ok := device.Sessions.(ContextSessionStore); ok {
+		return ctxStore.PutSessionContext(ctx, address, session)
+	}
+	return device.Sessions.PutSession(address, session)
+}
+
+func (device *Device) deleteSession(ctx context.Context, address string) error {
+	if ctxStore, ok := device.Sessions.(ContextSessionStore); ok {
+		return ctxStore.DeleteSessionContext(ctx, address)
+	}
+	return device.Sessions.DeleteSession(address)
+}
+
+func (device *Device) getPreKey(ctx context.Context, id uint32) (*keys.PreKey, error) {
+	if ctxStore, ok := device.PreKeys.(ContextPreKeyStore); ok {
+		return ctxStore.GetPreKeyContext(ctx, id)
+	}
+	return device.PreKeys.GetPreKey(id)
+}
+
+func (device *Device) removePreKey(ctx context.Context, id uint32) error {
+	if ctxStore, ok := device.PreKeys.(ContextPreKeyStore); ok {
+		return ctxStore.RemovePreKeyContext(ctx, id)
+	}
+	return device.PreKeys.RemovePreKey(id)
+}
+
+func (device *Device) putSenderKey(ctx context.Context, group, user string, session []byte) error {
+	if ctxStore, ok := device.SenderKeys.(ContextSenderKeyStore); ok {
+		return ctxStore.PutSenderKeyContext(ctx, group, user, session)
+	}
+	return device.SenderKeys.PutSenderKey(group, user, session)
+}
+
+func (device *Device) getSenderKey(ctx context.Context, group, user string) ([]byte, error) {
+	if ctxStore, ok := device.SenderKeys.(ContextSenderKeyStore); ok {
+		return ctxStore.GetSenderKeyContext(ctx, group, user)
+	}
+	return device.SenderKeys.GetSenderKey(group, user)
+}
+
+// DeleteAllIdentitiesContext deletes the identity keys of all devices of the given phone number.
+// The context-accepting store method is used if the store implements ContextIdentityStore.
+func (device *Device) DeleteAllIdentitiesContext(ctx context.Context, phone string) error {
+	if ctxStore, ok := device.Identities.(ContextIdentityStore); ok {
+		return ctxStore.DeleteAllIdentitiesContext(ctx, phone)
+	}
+	return device.Identities.DeleteAllIdentities(phone)
+}
+
+// DeleteAllSessionsContext deletes the sessions with all devices of the given phone number.
+// The context-accepting store method is used if the store implements ContextSessionStore.
+func (device *Device) DeleteAllSessionsContext(ctx context.Context, phone string) error {
+	if ctxStore, ok := device.Sessions.(ContextSessionStore); ok {
+		return ctxStore.DeleteAllSessionsContext(ctx, phone)
+	}
+	return device.Sessions.DeleteAllSessions(phone)
+}
+
+// GetOrGenPreKeysContext returns prekeys that haven't been uploaded yet, generating new ones if necessary.
+// The context-accepting store method is used if the store implements ContextPreKeyStore.
+func (device *Device) GetOrGenPreKeysContext(ctx context.Context, count uint32) ([]*keys.PreKey, error) {
+	if ctxStore, ok := device.PreKeys.(ContextPreKeyStore); ok {
+		return ctxStore.GetOrGenPreKeysContext(ctx, count)
+	}
+	return device.PreKeys.GetOrGenPreKeys(count)
+}
+
+// GenOnePreKeyContext generates a single prekey that is marked as uploaded.
+// The context-accepting store method is used if the store implements ContextPreKeyStore.
+func (device *Device) GenOnePreKeyContext(ctx context.Context) (*keys.PreKey, error) {
+	if ctxStore, ok := device.PreKeys.(ContextPreKeyStore); ok {
+		return ctxStore.GenOnePreKeyContext(ctx)
+	}
+	return device.PreKeys.GenOnePreKey()
+}
+
+// MarkPreKeysAsUploadedContext marks all prekeys up to the given ID as uploaded.
+// The context-accepting store method is used if the store implements ContextPreKeyStore.
+func (device *Device) MarkPreKeysAsUploadedContext(ctx context.Context, upToID uint32) error {
+	if ctxStore, ok := device.PreKeys.(ContextPreKeyStore); ok {
+		return ctxStore.MarkPreKeysAsUploadedContext(ctx, upToID)
+	}
+	return device.PreKeys.MarkPreKeysAsUploaded(upToID)
+}
+
+// UploadedPreKeyCountContext returns the number of prekeys that have been uploaded to the server.
+// The context-accepting store method is used if the store implements ContextPreKeyStore.
+func (device *Device) UploadedPreKeyCountContext(ctx context.Context) (int, error) {
+	if ctxStore, ok := device.PreKeys.(ContextPreKeyStore); ok {
+		return ctxStore.UploadedPreKeyCountContext(ctx)
+	}
+	return device.PreKeys.UploadedPreKeyCount()
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.ChatMetadataStore = (*MemStore)(nil)
+
+// updateChatMetadata must be called with the lock held.
+func (s *MemStore) updateChatMetadata(chat types.JID, update func(meta *store.ChatMetadata)) {
+	meta := s.data.ChatMetadata[chat]
+	update(&meta)
+	meta.Found = true
+	s.data.ChatMetadata[chat] = meta
+}
+
+func (s *MemStore) PutMarkedAsUnread(chat types.JID, unread bool) error {
+	s.lock.Lock()
+	s.updateChatMetadata(chat, func(meta *store.ChatMetadata) {
+		meta.MarkedAsUnread = unread
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutChatCleared(chat types.JID, ts time.Time) error {
+	s.lock.Lock()
+	s.updateChatMetadata(chat, func(meta *store.ChatMetadata) {
+		meta.ClearedAt = ts
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutChatDeleted(chat types.JID, ts time.Time) error {
+	s.lock.Lock()
+	s.updateChatMetadata(chat, func(meta *store.ChatMetadata) {
+		meta.DeletedAt = ts
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetChatMetadata(chat types.JID) (store.ChatMetadata, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.data.ChatMetadata[chat], nil
+}
+
+func (s *MemStore) GetArchivedChats() ([]types.JID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var output []types.JID
+	for chat, settings := range s.data.ChatSettings {
+		if settings.Archived {
+			output = append(output, chat)
+		}
+	}
+	return output, nil
+}
+
+// updateMessageMetadata must be called with the lock held.
+func (s *MemStore) updateMessageMetadata(chat, sender types.JID, id types.MessageID, fromMe bool, ts time.Time, update func(meta *store.MessageMetadata)) {
+	key := messageKey{Chat: chat, Sender: sender, ID: id}
+	meta, ok := s.data.MessageMetadata[key]
+	if !ok {
+		meta = &store.MessageMetadata{Chat: chat, Sender: sender, ID: id, IsFromMe: fromMe}
+		s.data.MessageMetadata[key] = meta
+	}
+	update(meta)
+	meta.UpdatedAt = ts
+}
+
+func (s *MemStore) PutMessageStarred(chat, sender types.JID, id types.MessageID, fromMe, starred bool, ts time.Time) error {
+	s.lock.Lock()
+	s.updateMessageMetadata(chat, sender, id, fromMe, ts, func(meta *store.MessageMetadata) {
+		meta.Starred = starred
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutMessageDeletedForMe(chat, sender types.JID, id types.MessageID, fromMe bool, ts time.Time) error {
+	s.lock.Lock()
+	s.updateMessageMetadata(chat, sender, id, fromMe, ts, func(meta *store.MessageMetadata) {
+		meta.DeletedForMe = true
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetMessageMetadata(chat, sender types.JID, id types.MessageID) (*store.MessageMetadata, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	meta, ok := s.data.MessageMetadata[messageKey{Chat: chat, Sender: sender, ID: id}]
+	if !ok {
+		return nil, nil
+	}
+	metaCopy := *meta
+	return &metaCopy, nil
+}
+
+func (s *MemStore) GetStarredMessages(chat types.JID) ([]*store.MessageMetadata, error) {
+	s.lock.RLock()
+	var output []*store.MessageMetadata
+	for key, meta := range s.data.MessageMetadata {
+		if meta.Starred && (chat.IsEmpty() || key.Chat == chat) {
+			metaCopy := *meta
+			output = append(output, &metaCopy)
+		}
+	}
+	s.lock.RUnlock()
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].UpdatedAt.After(output[j].UpdatedAt)
+	})
+	return output, nil
+}
+
+func (s *MemStore) PutLabel(label store.Label) error {
+	s.lock.Lock()
+	s.data.Labels[label.ID] = label
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetLabels() ([]store.Label, error) {
+	s.lock.RLock()
+	var output []store.Label
+	for _, label := range s.data.Labels {
+		if !label.Deleted {
+			output = append(output, label)
+		}
+	}
+	s.lock.RUnlock()
+	sort.Slice(output, func(i, j int) bool {
+		return output[i].ID < output[j].ID
+	})
+	return output, nil
+}
+
+func (s *MemStore) PutChatLabel(chat types.JID, labelID string, labeled bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	chats, ok := s.data.ChatLabels[labelID]
+	if !labeled {
+		delete(chats, chat)
+		return nil
+	} else if !ok {
+		chats = make(map[types.JID]bool)
+		s.data.ChatLabels[labelID] = chats
+	}
+	chats[chat] = true
+	return nil
+}
+
+func (s *MemStore) PutMessageLabel(chat types.JID, id types.MessageID, labelID string, labeled bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	chats, ok := s.data.MessageLabels[labelID]
+	if !labeled {
+		delete(chats[chat], id)
+		return nil
+	} else if !ok {
+		chats = make(map[types.JID]map[types.MessageID]bool)
+		s.data.MessageLabels[labelID] = chats
+	}
+	messages, ok := chats[chat]
+	if !ok {
+		messages = make(map[types.MessageID]bool)
+		chats[chat] = messages
+	}
+	messages[id] = true
+	return nil
+}
+
+func (s *MemStore) GetChatsByLabel(labelID string) ([]types.JID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var output []types.JID
+	for chat := range s.data.ChatLabels[labelID] {
+		output = append(output, chat)
+	}
+	return output, nil
+}
+
+func (s *MemStore) GetLabelsForChat(chat types.JID) ([]string, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var output []string
+	for labelID, chats := range s.data.ChatLabels {
+		if chats[chat] {
+			output = append(output, labelID)
+		}
+	}
+	return output, nil
+}
+
+func (s *MemStore) GetMessagesByLabel(labelID string) ([]store.LabeledMessage, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var output []store.LabeledMessage
+	for chat, messages := range s.data.MessageLabels[labelID] {
+		for id := range messages {
+			output = append(output, store.LabeledMessage{Chat: chat, ID: id})
+		}
+	}
+	return output, nil
+}
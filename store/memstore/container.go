@@ -0,0 +1,268 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"errors"
+	mathRand "math/rand"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+	"go.mau.fi/util/random"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waAdv"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/util/keys"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
+)
+
+// ErrDeviceIDMustBeSet is the error returned by PutDevice if you try to save a device before knowing its JID.
+var ErrDeviceIDMustBeSet = errors.New("device JID must be known before accessing the store")
+
+// deviceRecord contains the device-level data that would be stored in the whatsmeow_device table in sqlstore.
+type deviceRecord struct {
+	ID              types.JID `json:"id"`
+	RegistrationID  uint32    `json:"registration_id"`
+	NoiseKey        []byte    `json:"noise_key"`
+	IdentityKey     []byte    `json:"identity_key"`
+	SignedPreKey    []byte    `json:"signed_pre_key"`
+	SignedPreKeyID  uint32    `json:"signed_pre_key_id"`
+	SignedPreKeySig []byte    `json:"signed_pre_key_sig"`
+	AdvSecretKey    []byte    `json:"adv_key"`
+	Account         []byte    `json:"account"`
+	Platform        string    `json:"platform"`
+	BusinessName    string    `json:"business_name"`
+	PushName        string    `json:"push_name"`
+	FacebookUUID    uuid.UUID `json:"facebook_uuid"`
+}
+
+// Container is an in-memory store that can contain multiple whatsmeow sessions.
+//
+// All data is lost when the process exits, unless it's explicitly saved with
+// WriteSnapshot or SaveSnapshotFile and restored with ReadSnapshot or NewFromSnapshotFile.
+type Container struct {
+	lock sync.RWMutex
+	log  waLog.Logger
+
+	devices map[types.JID]*deviceRecord
+	data    map[types.JID]*deviceData
+	lidToPN map[types.JID]types.JID
+	pnToLID map[types.JID]types.JID
+}
+
+var _ store.DeviceContainer = (*Container)(nil)
+
+// New creates a new empty in-memory Container.
+//
+// The logger can be nil and will default to a no-op logger.
+func New(log waLog.Logger) *Container {
+	if log == nil {
+		log = waLog.Noop
+	}
+	return &Container{
+		log:     log,
+		devices: make(map[types.JID]*deviceRecord),
+		data:    make(map[types.JID]*deviceData),
+		lidToPN: make(map[types.JID]types.JID),
+		pnToLID: make(map[types.JID]types.JID),
+	}
+}
+
+func (c *Container) newDevice(record *deviceRecord) (*store.Device, error) {
+	if len(record.NoiseKey) != 32 || len(record.IdentityKey) != 32 || len(record.SignedPreKey) != 32 || len(record.SignedPreKeySig) != 64 {
+		return nil, ErrInvalidLength
+	}
+	var account waAdv.ADVSignedDeviceIdentity
+	err := proto.Unmarshal(record.Account, &account)
+	if err != nil {
+		return nil, err
+	}
+	id := record.ID
+	device := &store.Device{
+		Log:            c.log,
+		NoiseKey:       keys.NewKeyPairFromPrivateKey(*(*[32]byte)(record.NoiseKey)),
+		IdentityKey:    keys.NewKeyPairFromPrivateKey(*(*[32]byte)(record.IdentityKey)),
+		RegistrationID: record.RegistrationID,
+		AdvSecretKey:   cloneBytes(record.AdvSecretKey),
+		ID:             &id,
+		Account:        &account,
+		Platform:       record.Platform,
+		BusinessName:   record.BusinessName,
+		PushName:       record.PushName,
+		FacebookUUID:   record.FacebookUUID,
+		Container:      c,
+	}
+	device.SignedPreKey = &keys.PreKey{
+		KeyPair:   *keys.NewKeyPairFromPrivateKey(*(*[32]byte)(record.SignedPreKey)),
+		KeyID:     record.SignedPreKeyID,
+		Signature: (*[64]byte)(cloneBytes(record.SignedPreKeySig)),
+	}
+	c.initDevice(device)
+	return device, nil
+}
+
+// initDevice must be called with the lock held.
+func (c *Container) initDevice(device *store.Device) {
+	data, ok := c.data[*device.ID]
+	if !ok {
+		data = newDeviceData()
+		c.data[*device.ID] = data
+	}
+	innerStore := &MemStore{Container: c, JID: *device.ID, data: data}
+	device.Identities = innerStore
+	device.Sessions = innerStore
+	device.PreKeys = innerStore
+	device.SenderKeys = innerStore
+	device.AppStateKeys = innerStore
+	device.AppState = innerStore
+	device.Contacts = innerStore
+	device.ChatSettings = innerStore
+	device.ChatMetadata = innerStore
+	device.MsgSecrets = innerStore
+	device.PrivacyTokens = innerStore
+	device.Messages = innerStore
+	device.Outbox = innerStore
+	device.LIDs = innerStore
+	device.Groups = innerStore
+	device.DeviceLists = innerStore
+	device.DeviceData = innerStore
+	device.Initialized = true
+}
+
+// GetAllDevices finds all the devices in the store, sorted by JID.
+func (c *Container) GetAllDevices() ([]*store.Device, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	records := make([]*deviceRecord, 0, len(c.devices))
+	for _, record := range c.devices {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ID.String() < records[j].ID.String()
+	})
+	devices := make([]*store.Device, 0, len(records))
+	for _, record := range records {
+		device, err := c.newDevice(record)
+		if err != nil {
+			return devices, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// GetFirstDevice is a convenience method for getting the first device in the store. If there are
+// no devices, then a new device will be created. You should only use this if you don't want to
+// have multiple sessions simultaneously.
+func (c *Container) GetFirstDevice() (*store.Device, error) {
+	devices, err := c.GetAllDevices()
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) == 0 {
+		return c.NewDevice(), nil
+	} else {
+		return devices[0], nil
+	}
+}
+
+// GetDevice finds the device with the specified JID in the store.
+//
+// If the device is not found, nil is returned instead.
+//
+// Note that the parameter usually must be an AD-JID.
+func (c *Container) GetDevice(jid types.JID) (*store.Device, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	record, ok := c.devices[jid]
+	if !ok {
+		return nil, nil
+	}
+	return c.newDevice(record)
+}
+
+// NewDevice creates a new device in this store.
+//
+// No data is actually stored before Save is called. However, the pairing process will automatically
+// call Save after a successful pairing, so you most likely don't need to call it yourself.
+func (c *Container) NewDevice() *store.Device {
+	device := &store.Device{
+		Log:       c.log,
+		Container: c,
+
+		NoiseKey:       keys.NewKeyPair(),
+		IdentityKey:    keys.NewKeyPair(),
+		RegistrationID: mathRand.Uint32(),
+		AdvSecretKey:   random.Bytes(32),
+	}
+	device.SignedPreKey = device.IdentityKey.CreateSignedPreKey(1)
+	return device
+}
+
+// PutDevice stores the given device in this store. This should be called through Device.Save()
+// (which usually doesn't need to be called manually, as the library does that automatically when relevant).
+//
+// Like in sqlstore, only the platform, business name and push name are updated if the device already exists.
+func (c *Container) PutDevice(device *store.Device) error {
+	if device.ID == nil {
+		return ErrDeviceIDMustBeSet
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if existing, ok := c.devices[*device.ID]; ok {
+		existing.Platform = device.Platform
+		existing.BusinessName = device.BusinessName
+		existing.PushName = device.PushName
+	} else {
+		account, err := proto.Marshal(device.Account)
+		if err != nil {
+			return err
+		}
+		c.devices[*device.ID] = &deviceRecord{
+			ID:              *device.ID,
+			RegistrationID:  device.RegistrationID,
+			NoiseKey:        cloneBytes(device.NoiseKey.Priv[:]),
+			IdentityKey:     cloneBytes(device.IdentityKey.Priv[:]),
+			SignedPreKey:    cloneBytes(device.SignedPreKey.Priv[:]),
+			SignedPreKeyID:  device.SignedPreKey.KeyID,
+			SignedPreKeySig: cloneBytes(device.SignedPreKey.Signature[:]),
+			AdvSecretKey:    cloneBytes(device.AdvSecretKey),
+			Account:         account,
+			Platform:        device.Platform,
+			BusinessName:    device.BusinessName,
+			PushName:        device.PushName,
+			FacebookUUID:    device.FacebookUUID,
+		}
+	}
+	if !device.Initialized {
+		c.initDevice(device)
+	}
+	return nil
+}
+
+// DeleteDevice deletes the given device and all data associated with it from this store.
+// This should be called through Device.Delete()
+func (c *Container) DeleteDevice(device *store.Device) error {
+	if device.ID == nil {
+		return ErrDeviceIDMustBeSet
+	}
+	c.lock.Lock()
+	delete(c.devices, *device.ID)
+	delete(c.data, *device.ID)
+	c.lock.Unlock()
+	return nil
+}
+
+func cloneBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(data)), data...)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"slices"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func (s *MemStore) PutDeviceList(list store.CachedDeviceList) error {
+	list.User = list.User.ToNonAD()
+	list.Devices = slices.Clone(list.Devices)
+	if list.UpdatedAt.IsZero() {
+		list.UpdatedAt = time.Now()
+	}
+	s.lock.Lock()
+	s.data.DeviceLists[list.User] = list
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetDeviceList(user types.JID) (*store.CachedDeviceList, error) {
+	s.lock.RLock()
+	list, ok := s.data.DeviceLists[user.ToNonAD()]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	list.Devices = slices.Clone(list.Devices)
+	return &list, nil
+}
+
+func (s *MemStore) GetDeviceLists(users []types.JID) (map[types.JID]*store.CachedDeviceList, error) {
+	output := make(map[types.JID]*store.CachedDeviceList, len(users))
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, user := range users {
+		list, ok := s.data.DeviceLists[user.ToNonAD()]
+		if !ok {
+			continue
+		}
+		list.Devices = slices.Clone(list.Devices)
+		output[list.User] = &list
+	}
+	return output, nil
+}
+
+func (s *MemStore) DeleteDeviceList(user types.JID) error {
+	s.lock.Lock()
+	delete(s.data.DeviceLists, user.ToNonAD())
+	s.lock.Unlock()
+	return nil
+}
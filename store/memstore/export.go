@@ -0,0 +1,162 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.DeviceDataStore = (*MemStore)(nil)
+
+func cloneByteMap(data map[string][]byte) map[string][]byte {
+	output := make(map[string][]byte, len(data))
+	for key, val := range data {
+		output[key] = cloneBytes(val)
+	}
+	return output
+}
+
+func (s *MemStore) ExportDeviceData() (*store.DeviceData, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	data := &store.DeviceData{
+		Identities:       cloneByteMap(s.data.Identities),
+		Sessions:         cloneByteMap(s.data.Sessions),
+		PreKeys:          make([]store.ExportedPreKey, 0, len(s.data.PreKeys)),
+		AppStateSyncKeys: make([]store.ExportedAppStateSyncKey, 0, len(s.data.AppStateSyncKeys)),
+		AppStateVersions: make([]store.ExportedAppStateVersion, 0, len(s.data.AppStateVersions)),
+		Contacts:         make([]store.ExportedContact, 0, len(s.data.Contacts)),
+		PrivacyTokens:    make([]store.PrivacyToken, 0, len(s.data.PrivacyTokens)),
+	}
+	for id, preKey := range s.data.PreKeys {
+		data.PreKeys = append(data.PreKeys, store.ExportedPreKey{KeyID: id, Key: cloneBytes(preKey.Key), Uploaded: preKey.Uploaded})
+	}
+	sort.Slice(data.PreKeys, func(i, j int) bool {
+		return data.PreKeys[i].KeyID < data.PreKeys[j].KeyID
+	})
+	for group, groupKeys := range s.data.SenderKeys {
+		for user, key := range groupKeys {
+			data.SenderKeys = append(data.SenderKeys, store.ExportedSenderKey{Group: group, User: user, Key: cloneBytes(key)})
+		}
+	}
+	for hexID, key := range s.data.AppStateSyncKeys {
+		id, err := hex.DecodeString(hexID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid app state sync key ID %q: %w", hexID, err)
+		}
+		data.AppStateSyncKeys = append(data.AppStateSyncKeys, store.ExportedAppStateSyncKey{
+			ID: id,
+			AppStateSyncKey: store.AppStateSyncKey{
+				Data:        cloneBytes(key.Data),
+				Fingerprint: cloneBytes(key.Fingerprint),
+				Timestamp:   key.Timestamp,
+			},
+		})
+	}
+	for name, version := range s.data.AppStateVersions {
+		exported := store.ExportedAppStateVersion{Name: name, Version: version.Version, Hash: cloneBytes(version.Hash)}
+		for hexIndexMAC, mac := range s.data.AppStateMutationMACs[name] {
+			indexMAC, err := hex.DecodeString(hexIndexMAC)
+			if err != nil {
+				return nil, fmt.Errorf("invalid index MAC %q: %w", hexIndexMAC, err)
+			}
+			exported.MutationMACs = append(exported.MutationMACs, store.ExportedAppStateMutationMAC{
+				Version: mac.Version,
+				AppStateMutationMAC: store.AppStateMutationMAC{
+					IndexMAC: indexMAC,
+					ValueMAC: cloneBytes(mac.ValueMAC),
+				},
+			})
+		}
+		data.AppStateVersions = append(data.AppStateVersions, exported)
+	}
+	for jid, contact := range s.data.Contacts {
+		data.Contacts = append(data.Contacts, store.ExportedContact{
+			JID:          jid,
+			FirstName:    contact.FirstName,
+			FullName:     contact.FullName,
+			PushName:     contact.PushName,
+			BusinessName: contact.BusinessName,
+		})
+	}
+	for _, token := range s.data.PrivacyTokens {
+		token.Token = cloneBytes(token.Token)
+		data.PrivacyTokens = append(data.PrivacyTokens, token)
+	}
+	return data, nil
+}
+
+func (s *MemStore) ImportDeviceData(data *store.DeviceData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for address, identity := range data.Identities {
+		s.data.Identities[address] = cloneBytes(identity)
+	}
+	for address, session := range data.Sessions {
+		s.data.Sessions[address] = cloneBytes(session)
+	}
+	for _, preKey := range data.PreKeys {
+		s.data.PreKeys[preKey.KeyID] = &preKeyEntry{Key: cloneBytes(preKey.Key), Uploaded: preKey.Uploaded}
+	}
+	for _, senderKey := range data.SenderKeys {
+		groupKeys, ok := s.data.SenderKeys[senderKey.Group]
+		if !ok {
+			groupKeys = make(map[string][]byte)
+			s.data.SenderKeys[senderKey.Group] = groupKeys
+		}
+		groupKeys[senderKey.User] = cloneBytes(senderKey.Key)
+	}
+	for _, key := range data.AppStateSyncKeys {
+		hexID := hex.EncodeToString(key.ID)
+		existing, ok := s.data.AppStateSyncKeys[hexID]
+		if !ok || key.Timestamp > existing.Timestamp {
+			s.data.AppStateSyncKeys[hexID] = store.AppStateSyncKey{
+				Data:        cloneBytes(key.Data),
+				Fingerprint: cloneBytes(key.Fingerprint),
+				Timestamp:   key.Timestamp,
+			}
+		}
+	}
+	for _, version := range data.AppStateVersions {
+		s.data.AppStateVersions[version.Name] = appStateVersion{Version: version.Version, Hash: cloneBytes(version.Hash)}
+		macs, ok := s.data.AppStateMutationMACs[version.Name]
+		if !ok {
+			macs = make(map[string]mutationMAC)
+			s.data.AppStateMutationMACs[version.Name] = macs
+		}
+		for _, mac := range version.MutationMACs {
+			hexIndexMAC := hex.EncodeToString(mac.IndexMAC)
+			if existing, ok := macs[hexIndexMAC]; !ok || mac.Version >= existing.Version {
+				macs[hexIndexMAC] = mutationMAC{Version: mac.Version, ValueMAC: cloneBytes(mac.ValueMAC)}
+			}
+		}
+	}
+	for _, contact := range data.Contacts {
+		s.data.Contacts[contact.JID] = types.ContactInfo{
+			Found:        true,
+			FirstName:    contact.FirstName,
+			FullName:     contact.FullName,
+			PushName:     contact.PushName,
+			BusinessName: contact.BusinessName,
+		}
+	}
+	for _, token := range data.PrivacyTokens {
+		user := token.User.ToNonAD()
+		s.data.PrivacyTokens[user] = store.PrivacyToken{
+			User:      user,
+			Token:     cloneBytes(token.Token),
+			Timestamp: time.Unix(token.Timestamp.Unix(), 0),
+		}
+	}
+	return nil
+}
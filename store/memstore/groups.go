@@ -0,0 +1,58 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func (s *MemStore) PutGroup(info *types.GroupInfo) error {
+	return s.PutGroups([]*types.GroupInfo{info})
+}
+
+func (s *MemStore) PutGroups(infos []*types.GroupInfo) error {
+	encoded := make(map[types.JID]json.RawMessage, len(infos))
+	for _, info := range infos {
+		// Group infos are stored as JSON to make sure callers can't mutate the stored data through shared pointers
+		data, err := json.Marshal(info)
+		if err != nil {
+			return fmt.Errorf("failed to marshal group info of %s: %w", info.JID, err)
+		}
+		encoded[info.JID] = data
+	}
+	s.lock.Lock()
+	for jid, data := range encoded {
+		s.data.Groups[jid] = data
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetGroup(jid types.JID) (*types.GroupInfo, error) {
+	s.lock.RLock()
+	data, ok := s.data.Groups[jid]
+	s.lock.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	var info types.GroupInfo
+	err := json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal group info of %s: %w", jid, err)
+	}
+	return &info, nil
+}
+
+func (s *MemStore) DeleteGroup(jid types.JID) error {
+	s.lock.Lock()
+	delete(s.data.Groups, jid)
+	s.lock.Unlock()
+	return nil
+}
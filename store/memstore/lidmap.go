@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"fmt"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+// putLIDMapping must be called with the lock held.
+func (c *Container) putLIDMapping(lid, pn types.JID) {
+	if oldPN, ok := c.lidToPN[lid]; ok && oldPN != pn {
+		delete(c.pnToLID, oldPN)
+	}
+	if oldLID, ok := c.pnToLID[pn]; ok && oldLID != lid {
+		delete(c.lidToPN, oldLID)
+	}
+	c.lidToPN[lid] = pn
+	c.pnToLID[pn] = lid
+}
+
+func (s *MemStore) PutLIDMapping(lid, pn types.JID) error {
+	return s.PutManyLIDMappings([]store.LIDMapping{{LID: lid, PN: pn}})
+}
+
+func (s *MemStore) PutManyLIDMappings(mappings []store.LIDMapping) error {
+	for _, mapping := range mappings {
+		if mapping.LID.Server != types.HiddenUserServer {
+			return fmt.Errorf("invalid LID %s", mapping.LID)
+		} else if mapping.PN.Server != types.DefaultUserServer {
+			return fmt.Errorf("invalid phone number JID %s", mapping.PN)
+		}
+	}
+	s.lock.Lock()
+	for _, mapping := range mappings {
+		s.putLIDMapping(mapping.LID.ToNonAD(), mapping.PN.ToNonAD())
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetPNForLID(lid types.JID) (types.JID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lidToPN[lid.ToNonAD()], nil
+}
+
+func (s *MemStore) GetLIDForPN(pn types.JID) (types.JID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.pnToLID[pn.ToNonAD()], nil
+}
+
+func getManyLIDMappings(source map[types.JID]types.JID, keys []types.JID) map[types.JID]types.JID {
+	output := make(map[types.JID]types.JID, len(keys))
+	for _, key := range keys {
+		key = key.ToNonAD()
+		if val, ok := source[key]; ok {
+			output[key] = val
+		}
+	}
+	return output
+}
+
+func (s *MemStore) GetManyPNsForLIDs(lids []types.JID) (map[types.JID]types.JID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return getManyLIDMappings(s.lidToPN, lids), nil
+}
+
+func (s *MemStore) GetManyLIDsForPNs(pns []types.JID) (map[types.JID]types.JID, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return getManyLIDMappings(s.pnToLID, pns), nil
+}
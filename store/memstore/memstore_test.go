@@ -0,0 +1,493 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waAdv"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/store/memstore"
+	"github.com/Romerito007/whatsmeow/store/sqlstore"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var (
+	testDeviceJID = types.JID{User: "1234", Device: 1, Server: types.DefaultUserServer}
+	testIndexMAC  = bytes.Repeat([]byte{7}, 32)
+	testValueMAC  = bytes.Repeat([]byte{8}, 32)
+)
+
+type testStore struct {
+	name   string
+	device *store.Device
+}
+
+// newTestStores returns an empty device in both a memstore and an SQLite-backed sqlstore,
+// so that tests can check that both behave the same way.
+func newTestStores(t *testing.T) []testStore {
+	t.Helper()
+	memDevice := memstore.New(nil).NewDevice()
+	memDevice.ID = &testDeviceJID
+	err := memDevice.Save()
+	if err != nil {
+		t.Fatalf("failed to save memstore device: %v", err)
+	}
+
+	container, err := sqlstore.New("sqlite3", "file:"+filepath.Join(t.TempDir(), "whatsmeow.db")+"?_foreign_keys=on", nil)
+	if err != nil {
+		t.Fatalf("failed to create sqlstore: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = container.Close()
+	})
+	sqlDevice := container.NewDevice()
+	sqlDevice.ID = &testDeviceJID
+	sqlDevice.Account = &waAdv.ADVSignedDeviceIdentity{
+		Details:             []byte{1},
+		AccountSignature:    bytes.Repeat([]byte{2}, 64),
+		AccountSignatureKey: bytes.Repeat([]byte{3}, 32),
+		DeviceSignature:     bytes.Repeat([]byte{4}, 64),
+	}
+	err = sqlDevice.Save()
+	if err != nil {
+		t.Fatalf("failed to save sqlstore device: %v", err)
+	}
+	return []testStore{{"memstore", memDevice}, {"sqlstore", sqlDevice}}
+}
+
+func forEachStore(t *testing.T, fn func(t *testing.T, device *store.Device)) {
+	for _, ts := range newTestStores(t) {
+		t.Run(ts.name, func(t *testing.T) {
+			fn(t, ts.device)
+		})
+	}
+}
+
+func TestDeleteAllSessions(t *testing.T) {
+	addresses := []string{"1234:0", "1234:5", "12345:0", "123:0", "1234_1:0", "5678:0"}
+	tests := []struct {
+		phone     string
+		remaining []string
+	}{
+		{"1234", []string{"12345:0", "123:0", "1234_1:0", "5678:0"}},
+		{"123", []string{"1234:0", "1234:5", "12345:0", "1234_1:0", "5678:0"}},
+		{"1234_1", []string{"1234:0", "1234:5", "12345:0", "123:0", "5678:0"}},
+		{"9999", addresses},
+	}
+	for _, test := range tests {
+		t.Run(test.phone, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, device *store.Device) {
+				for _, addr := range addresses {
+					if err := device.Sessions.PutSession(addr, []byte(addr)); err != nil {
+						t.Fatalf("failed to put session: %v", err)
+					}
+				}
+				if err := device.Sessions.DeleteAllSessions(test.phone); err != nil {
+					t.Fatalf("failed to delete sessions: %v", err)
+				}
+				var remaining []string
+				for _, addr := range addresses {
+					if has, err := device.Sessions.HasSession(addr); err != nil {
+						t.Fatalf("failed to check session: %v", err)
+					} else if has {
+						remaining = append(remaining, addr)
+					}
+				}
+				if !slices.Equal(remaining, test.remaining) {
+					t.Errorf("remaining sessions are %v, expected %v", remaining, test.remaining)
+				}
+			})
+		})
+	}
+}
+
+func TestPreKeys(t *testing.T) {
+	type step struct {
+		getOrGen     uint32
+		markUploaded uint32
+		expectedIDs  []uint32
+		uploaded     int
+	}
+	steps := []step{
+		{getOrGen: 3, expectedIDs: []uint32{1, 2, 3}},
+		// Existing keys that haven't been uploaded are returned again before new ones are generated
+		{getOrGen: 5, expectedIDs: []uint32{1, 2, 3, 4, 5}},
+		{getOrGen: 2, expectedIDs: []uint32{1, 2}},
+		{markUploaded: 2, uploaded: 2},
+		{getOrGen: 4, expectedIDs: []uint32{3, 4, 5, 6}, uploaded: 2},
+		{markUploaded: 6, uploaded: 6},
+		{getOrGen: 1, expectedIDs: []uint32{7}, uploaded: 6},
+	}
+	forEachStore(t, func(t *testing.T, device *store.Device) {
+		generated := make(map[uint32][32]byte)
+		for i, s := range steps {
+			if s.markUploaded != 0 {
+				if err := device.PreKeys.MarkPreKeysAsUploaded(s.markUploaded); err != nil {
+					t.Fatalf("step %d: failed to mark prekeys as uploaded: %v", i, err)
+				}
+			} else {
+				preKeys, err := device.PreKeys.GetOrGenPreKeys(s.getOrGen)
+				if err != nil {
+					t.Fatalf("step %d: failed to get prekeys: %v", i, err)
+				}
+				ids := make([]uint32, len(preKeys))
+				for j, key := range preKeys {
+					ids[j] = key.KeyID
+					if existing, ok := generated[key.KeyID]; ok && existing != *key.Priv {
+						t.Errorf("step %d: prekey %d changed", i, key.KeyID)
+					}
+					generated[key.KeyID] = *key.Priv
+				}
+				if !slices.Equal(ids, s.expectedIDs) {
+					t.Errorf("step %d: got prekeys %v, expected %v", i, ids, s.expectedIDs)
+				}
+			}
+			if count, err := device.PreKeys.UploadedPreKeyCount(); err != nil {
+				t.Fatalf("step %d: failed to count uploaded prekeys: %v", i, err)
+			} else if count != s.uploaded {
+				t.Errorf("step %d: %d prekeys are uploaded, expected %d", i, count, s.uploaded)
+			}
+		}
+		for id, priv := range generated {
+			key, err := device.PreKeys.GetPreKey(id)
+			if err != nil || key == nil || *key.Priv != priv {
+				t.Errorf("prekey %d wasn't stored correctly: %v", id, err)
+			}
+		}
+		if err := device.PreKeys.RemovePreKey(1); err != nil {
+			t.Fatalf("failed to remove prekey: %v", err)
+		} else if key, err := device.PreKeys.GetPreKey(1); err != nil || key != nil {
+			t.Errorf("removed prekey is still there: %v", err)
+		}
+	})
+}
+
+func TestAppStateSyncKeyTimestamps(t *testing.T) {
+	type put struct {
+		id   string
+		ts   int64
+		data string
+	}
+	tests := []struct {
+		name     string
+		puts     []put
+		expected map[string]string
+		latest   string
+	}{{
+		name:     "newer key replaces older",
+		puts:     []put{{"a", 100, "first"}, {"a", 200, "second"}},
+		expected: map[string]string{"a": "second"},
+		latest:   "a",
+	}, {
+		name:     "older key doesn't replace newer",
+		puts:     []put{{"a", 200, "first"}, {"a", 100, "second"}},
+		expected: map[string]string{"a": "first"},
+		latest:   "a",
+	}, {
+		name:     "same timestamp doesn't replace",
+		puts:     []put{{"a", 100, "first"}, {"a", 100, "second"}},
+		expected: map[string]string{"a": "first"},
+		latest:   "a",
+	}, {
+		name:     "latest is the key with the highest timestamp",
+		puts:     []put{{"a", 100, "a"}, {"b", 300, "b"}, {"c", 200, "c"}},
+		expected: map[string]string{"a": "a", "b": "b", "c": "c"},
+		latest:   "b",
+	}, {
+		name:     "updating a key's timestamp makes it the latest",
+		puts:     []put{{"a", 100, "a"}, {"b", 200, "b"}, {"a", 300, "a2"}},
+		expected: map[string]string{"a": "a2", "b": "b"},
+		latest:   "a",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, device *store.Device) {
+				if latest, err := device.AppStateKeys.GetLatestAppStateSyncKeyID(); err != nil || latest != nil {
+					t.Errorf("expected no latest key in empty store, got %q, %v", latest, err)
+				}
+				for _, p := range test.puts {
+					err := device.AppStateKeys.PutAppStateSyncKey([]byte(p.id), store.AppStateSyncKey{
+						Data:        []byte(p.data),
+						Fingerprint: []byte("fp-" + p.data),
+						Timestamp:   p.ts,
+					})
+					if err != nil {
+						t.Fatalf("failed to put key: %v", err)
+					}
+				}
+				for id, data := range test.expected {
+					key, err := device.AppStateKeys.GetAppStateSyncKey([]byte(id))
+					if err != nil || key == nil {
+						t.Fatalf("failed to get key %s: %v", id, err)
+					} else if string(key.Data) != data || string(key.Fingerprint) != "fp-"+data {
+						t.Errorf("key %s has data %q, expected %q", id, key.Data, data)
+					}
+				}
+				latest, err := device.AppStateKeys.GetLatestAppStateSyncKeyID()
+				if err != nil {
+					t.Fatalf("failed to get latest key: %v", err)
+				} else if string(latest) != test.latest {
+					t.Errorf("latest key is %q, expected %q", latest, test.latest)
+				}
+			})
+		})
+	}
+}
+
+// fillTestData puts some data in every store that's included in snapshots.
+func fillTestData(t *testing.T, device *store.Device) {
+	t.Helper()
+	check := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("failed to fill test data: %v", err)
+		}
+	}
+	alice := types.NewJID("1111", types.DefaultUserServer)
+	group := types.NewJID("123456789", types.GroupServer)
+	check(device.Identities.PutIdentity("1111:0", [32]byte{1}))
+	check(device.Sessions.PutSession("1111:0", []byte("session")))
+	_, err := device.PreKeys.GetOrGenPreKeys(3)
+	check(err)
+	check(device.PreKeys.MarkPreKeysAsUploaded(2))
+	check(device.SenderKeys.PutSenderKey(group.String(), "1111:0", []byte("sender key")))
+	check(device.AppStateKeys.PutAppStateSyncKey([]byte("key"), store.AppStateSyncKey{Data: []byte("data"), Fingerprint: []byte("fp"), Timestamp: 100}))
+	check(device.AppState.PutAppStateVersion("regular", 5, [128]byte{5}))
+	check(device.AppState.PutAppStateMutationMACs("regular", 5, []store.AppStateMutationMAC{{IndexMAC: testIndexMAC, ValueMAC: testValueMAC}}))
+	_, _, err = device.Contacts.PutPushName(alice, "Alice")
+	check(err)
+	check(device.ChatSettings.PutPinned(alice, true))
+	check(device.MsgSecrets.PutMessageSecret(group, alice, "MSG1", []byte("secret")))
+	check(device.PrivacyTokens.PutPrivacyTokens(store.PrivacyToken{User: alice, Token: []byte("token"), Timestamp: time.Unix(1700000000, 0)}))
+	check(device.Messages.PutMessage(store.MessageEntry{
+		Chat: group, Sender: alice, ID: "MSG1", Timestamp: time.Unix(1700000000, 0),
+		Message: &waE2E.Message{Conversation: proto.String("hello")},
+	}))
+	check(device.LIDs.PutLIDMapping(types.NewJID("100", types.HiddenUserServer), alice))
+	check(device.Groups.PutGroup(&types.GroupInfo{JID: group, GroupName: types.GroupName{Name: "Group"}}))
+}
+
+// dumpTestData reads back everything that fillTestData stored in a comparable form.
+func dumpTestData(t *testing.T, device *store.Device) map[string]any {
+	t.Helper()
+	alice := types.NewJID("1111", types.DefaultUserServer)
+	group := types.NewJID("123456789", types.GroupServer)
+	dump := make(map[string]any)
+	add := func(name string, val any, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		dump[name] = val
+	}
+	trusted, err := device.Identities.IsTrustedIdentity("1111:0", [32]byte{1})
+	add("identity", trusted, err)
+	session, err := device.Sessions.GetSession("1111:0")
+	add("session", string(session), err)
+	var preKeys []string
+	for id := uint32(1); id <= 3; id++ {
+		key, err := device.PreKeys.GetPreKey(id)
+		if err != nil || key == nil {
+			t.Fatalf("failed to get prekey %d: %v", id, err)
+		}
+		preKeys = append(preKeys, fmt.Sprintf("%d:%x", key.KeyID, key.Priv[:]))
+	}
+	uploaded, err := device.PreKeys.UploadedPreKeyCount()
+	add("prekeys", fmt.Sprint(preKeys, uploaded), err)
+	senderKey, err := device.SenderKeys.GetSenderKey(group.String(), "1111:0")
+	add("sender key", string(senderKey), err)
+	appStateKey, err := device.AppStateKeys.GetAppStateSyncKey([]byte("key"))
+	add("app state key", *appStateKey, err)
+	version, hash, err := device.AppState.GetAppStateVersion("regular")
+	add("app state version", fmt.Sprint(version, hash[0]), err)
+	valueMAC, err := device.AppState.GetAppStateMutationMAC("regular", testIndexMAC)
+	add("app state mac", bytes.Equal(valueMAC, testValueMAC), err)
+	contact, err := device.Contacts.GetContact(alice)
+	add("contact", contact, err)
+	settings, err := device.ChatSettings.GetChatSettings(alice)
+	add("chat settings", settings, err)
+	secret, err := device.MsgSecrets.GetMessageSecret(group, alice, "MSG1")
+	add("message secret", string(secret), err)
+	token, err := device.PrivacyTokens.GetPrivacyToken(alice)
+	add("privacy token", fmt.Sprint(token.User, string(token.Token), token.Timestamp.Unix()), err)
+	msg, err := device.Messages.GetMessage(group, "MSG1")
+	add("message", fmt.Sprint(msg.Sender, msg.Timestamp.Unix(), msg.Message.GetConversation()), err)
+	pn, err := device.LIDs.GetPNForLID(types.NewJID("100", types.HiddenUserServer))
+	add("lid", pn, err)
+	groupInfo, err := device.Groups.GetGroup(group)
+	add("group", groupInfo.Name, err)
+	return dump
+}
+
+func TestMemstoreMatchesSQLStore(t *testing.T) {
+	stores := newTestStores(t)
+	var dumps []map[string]any
+	for _, ts := range stores {
+		fillTestData(t, ts.device)
+		dumps = append(dumps, dumpTestData(t, ts.device))
+	}
+	// Prekeys are random, so only compare the other data
+	delete(dumps[0], "prekeys")
+	delete(dumps[1], "prekeys")
+	if !reflect.DeepEqual(dumps[0], dumps[1]) {
+		t.Errorf("stores returned different data:\nmemstore: %v\nsqlstore: %v", dumps[0], dumps[1])
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	container := memstore.New(nil)
+	device := container.NewDevice()
+	device.ID = &testDeviceJID
+	device.PushName = "Test"
+	device.Account = &waAdv.ADVSignedDeviceIdentity{Details: []byte("details")}
+	err := device.Save()
+	if err != nil {
+		t.Fatalf("failed to save device: %v", err)
+	}
+	fillTestData(t, device)
+	expected := dumpTestData(t, device)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	err = container.SaveSnapshotFile(path)
+	if err != nil {
+		t.Fatalf("failed to save snapshot: %v", err)
+	}
+	restored, err := memstore.NewFromSnapshotFile(path, nil)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	restoredDevice, err := restored.GetDevice(testDeviceJID)
+	if err != nil || restoredDevice == nil {
+		t.Fatalf("failed to get device from restored container: %v", err)
+	}
+	if restoredDevice.PushName != "Test" || *restoredDevice.NoiseKey.Priv != *device.NoiseKey.Priv ||
+		*restoredDevice.IdentityKey.Priv != *device.IdentityKey.Priv || restoredDevice.RegistrationID != device.RegistrationID ||
+		!bytes.Equal(restoredDevice.Account.GetDetails(), []byte("details")) {
+		t.Errorf("device keys or metadata weren't restored")
+	}
+	if actual := dumpTestData(t, restoredDevice); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("restored data doesn't match:\n got: %v\nwant: %v", actual, expected)
+	}
+
+	// Writing the restored container again must produce the same data
+	var second bytes.Buffer
+	if err = restored.WriteSnapshot(&second); err != nil {
+		t.Fatalf("failed to write restored snapshot: %v", err)
+	}
+	again := memstore.New(nil)
+	if err = again.ReadSnapshot(&second); err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+	againDevice, _ := again.GetDevice(testDeviceJID)
+	if againDevice == nil || !reflect.DeepEqual(dumpTestData(t, againDevice), expected) {
+		t.Errorf("second round trip changed the data")
+	}
+
+	missing, err := memstore.NewFromSnapshotFile(filepath.Join(t.TempDir(), "missing.json"), nil)
+	if err != nil {
+		t.Fatalf("failed to create container from missing snapshot: %v", err)
+	} else if devices, _ := missing.GetAllDevices(); len(devices) != 0 {
+		t.Errorf("container from missing snapshot isn't empty")
+	}
+	if err = memstore.New(nil).ReadSnapshot(bytes.NewReader([]byte(`{"version": 99}`))); err == nil {
+		t.Errorf("reading a snapshot with unknown version didn't fail")
+	}
+}
+
+func TestMessageMetadataKeyedBySender(t *testing.T) {
+	forEachStore(t, func(t *testing.T, device *store.Device) {
+		alice := types.NewJID("1111", types.DefaultUserServer)
+		bob := types.NewJID("2222", types.DefaultUserServer)
+		group := types.NewJID("123456789", types.GroupServer)
+		ts := time.Unix(1700000000, 0)
+
+		// The same message ID from different senders refers to different messages
+		if err := device.ChatMetadata.PutMessageStarred(group, alice, "MSG1", false, true, ts); err != nil {
+			t.Fatalf("failed to star message: %v", err)
+		} else if err = device.ChatMetadata.PutMessageDeletedForMe(group, bob, "MSG1", false, ts.Add(time.Second)); err != nil {
+			t.Fatalf("failed to delete message: %v", err)
+		}
+		aliceMeta, err := device.ChatMetadata.GetMessageMetadata(group, alice, "MSG1")
+		if err != nil || aliceMeta == nil {
+			t.Fatalf("failed to get metadata: %v", err)
+		} else if !aliceMeta.Starred || aliceMeta.DeletedForMe || aliceMeta.Sender != alice {
+			t.Errorf("alice's message metadata is %+v", aliceMeta)
+		}
+		bobMeta, err := device.ChatMetadata.GetMessageMetadata(group, bob, "MSG1")
+		if err != nil || bobMeta == nil {
+			t.Fatalf("failed to get metadata: %v", err)
+		} else if bobMeta.Starred || !bobMeta.DeletedForMe || bobMeta.Sender != bob {
+			t.Errorf("bob's message metadata is %+v", bobMeta)
+		}
+		if starred, err := device.ChatMetadata.GetStarredMessages(group); err != nil || len(starred) != 1 || starred[0].Sender != alice {
+			t.Errorf("starred messages are %+v, %v", starred, err)
+		}
+
+		// Messages in private chats don't have a sender
+		if err = device.ChatMetadata.PutMessageStarred(alice, types.EmptyJID, "MSG2", true, true, ts); err != nil {
+			t.Fatalf("failed to star message in private chat: %v", err)
+		} else if meta, err := device.ChatMetadata.GetMessageMetadata(alice, types.EmptyJID, "MSG2"); err != nil || meta == nil || !meta.Starred || !meta.Sender.IsEmpty() {
+			t.Errorf("private chat message metadata is %+v, %v", meta, err)
+		}
+		if meta, err := device.ChatMetadata.GetMessageMetadata(alice, bob, "MSG2"); err != nil || meta != nil {
+			t.Errorf("got metadata %+v, %v for the wrong sender", meta, err)
+		}
+	})
+}
+
+func TestSnapshotLegacyMessageMetadata(t *testing.T) {
+	container := memstore.New(nil)
+	device := container.NewDevice()
+	device.ID = &testDeviceJID
+	if err := device.Save(); err != nil {
+		t.Fatalf("failed to save device: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := container.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	// Old snapshots stored the message metadata keyed by chat and message ID only
+	var snap map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &snap); err != nil {
+		t.Fatalf("failed to decode snapshot: %v", err)
+	}
+	data := snap["devices"].([]any)[0].(map[string]any)["data"].(map[string]any)
+	delete(data, "message_metadata_v2")
+	data["message_metadata"] = map[string]any{
+		"123456789@g.us": map[string]any{
+			"MSG1": map[string]any{"Chat": "123456789@g.us", "Sender": "1111@s.whatsapp.net", "ID": "MSG1", "Starred": true},
+		},
+	}
+	legacy, _ := json.Marshal(snap)
+
+	restored := memstore.New(nil)
+	if err := restored.ReadSnapshot(bytes.NewReader(legacy)); err != nil {
+		t.Fatalf("failed to read legacy snapshot: %v", err)
+	}
+	restoredDevice, _ := restored.GetDevice(testDeviceJID)
+	if restoredDevice == nil {
+		t.Fatalf("device wasn't restored")
+	}
+	meta, err := restoredDevice.ChatMetadata.GetMessageMetadata(
+		types.NewJID("123456789", types.GroupServer), types.NewJID("1111", types.DefaultUserServer), "MSG1",
+	)
+	if err != nil || meta == nil || !meta.Starred {
+		t.Errorf("legacy message metadata wasn't converted: %+v, %v", meta, err)
+	}
+}
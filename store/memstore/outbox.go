@@ -0,0 +1,78 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.OutboxStore = (*MemStore)(nil)
+
+func (s *MemStore) PutOutboxEvent(evt store.OutboxEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	chat := evt.Chat.ToNonAD()
+	chatEvents, ok := s.data.Outbox[chat]
+	if !ok {
+		chatEvents = make(map[types.MessageID]*store.OutboxEvent)
+		s.data.Outbox[chat] = chatEvents
+	}
+	if existing, ok := chatEvents[evt.ID]; ok {
+		existing.Data = cloneBytes(evt.Data)
+		return nil
+	}
+	if evt.CreatedAt.IsZero() {
+		evt.CreatedAt = time.Now()
+	}
+	evt.Chat = chat
+	evt.Data = cloneBytes(evt.Data)
+	chatEvents[evt.ID] = &evt
+	return nil
+}
+
+func (s *MemStore) GetOutboxEvents(limit int) ([]*store.OutboxEvent, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var output []*store.OutboxEvent
+	for _, chatEvents := range s.data.Outbox {
+		for _, evt := range chatEvents {
+			evtCopy := *evt
+			evtCopy.Data = cloneBytes(evt.Data)
+			output = append(output, &evtCopy)
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		if output[i].CreatedAt.Equal(output[j].CreatedAt) {
+			return output[i].ID < output[j].ID
+		}
+		return output[i].CreatedAt.Before(output[j].CreatedAt)
+	})
+	if limit >= 0 && len(output) > limit {
+		output = output[:limit]
+	}
+	return output, nil
+}
+
+func (s *MemStore) IncrementOutboxAttempts(chat types.JID, id types.MessageID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if evt, ok := s.data.Outbox[chat.ToNonAD()][id]; ok {
+		evt.Attempts++
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteOutboxEvent(chat types.JID, id types.MessageID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.data.Outbox[chat.ToNonAD()], id)
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package memstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
+)
+
+// SnapshotVersion is the current version of the snapshot format written by WriteSnapshot.
+const SnapshotVersion = 1
+
+type deviceSnapshot struct {
+	Device *deviceRecord `json:"device"`
+	Data   *deviceData   `json:"data"`
+}
+
+type snapshot struct {
+	Version     int                `json:"version"`
+	Devices     []deviceSnapshot   `json:"devices"`
+	LIDMappings []store.LIDMapping `json:"lid_mappings"`
+}
+
+// WriteSnapshot writes the entire contents of the container into the given writer as JSON.
+//
+// The snapshot contains private keys and should therefore be treated as sensitive.
+func (c *Container) WriteSnapshot(w io.Writer) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	snap := snapshot{
+		Version:     SnapshotVersion,
+		Devices:     make([]deviceSnapshot, 0, len(c.devices)),
+		LIDMappings: make([]store.LIDMapping, 0, len(c.lidToPN)),
+	}
+	for jid, record := range c.devices {
+		snap.Devices = append(snap.Devices, deviceSnapshot{Device: record, Data: c.data[jid]})
+	}
+	for lid, pn := range c.lidToPN {
+		snap.LIDMappings = append(snap.LIDMappings, store.LIDMapping{LID: lid, PN: pn})
+	}
+	return json.NewEncoder(w).Encode(&snap)
+}
+
+// ReadSnapshot replaces the contents of the container with a snapshot previously written with WriteSnapshot.
+//
+// Devices that were fetched from the container before calling this will not see the restored data.
+func (c *Container) ReadSnapshot(r io.Reader) error {
+	var snap snapshot
+	err := json.NewDecoder(r).Decode(&snap)
+	if err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	} else if snap.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	devices := make(map[types.JID]*deviceRecord, len(snap.Devices))
+	data := make(map[types.JID]*deviceData, len(snap.Devices))
+	for _, dev := range snap.Devices {
+		if dev.Device == nil {
+			return fmt.Errorf("snapshot contains data without device")
+		}
+		if dev.Data == nil {
+			dev.Data = newDeviceData()
+		} else {
+			dev.Data.init()
+		}
+		devices[dev.Device.ID] = dev.Device
+		data[dev.Device.ID] = dev.Data
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.devices = devices
+	c.data = data
+	c.lidToPN = make(map[types.JID]types.JID, len(snap.LIDMappings))
+	c.pnToLID = make(map[types.JID]types.JID, len(snap.LIDMappings))
+	for _, mapping := range snap.LIDMappings {
+		c.putLIDMapping(mapping.LID, mapping.PN)
+	}
+	return nil
+}
+
+// SaveSnapshotFile writes a snapshot of the container into the given file.
+//
+// The file is written atomically by first writing into a temporary file in the same directory and then renaming it.
+func (c *Container) SaveSnapshotFile(path string) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tempPath := file.Name()
+	err = c.WriteSnapshot(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, 0600)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// NewFromSnapshotFile creates a new Container with the contents of the given snapshot file.
+//
+// If the file doesn't exist, an empty container is returned.
+//
+// The logger can be nil and will default to a no-op logger.
+func NewFromSnapshotFile(path string, log waLog.Logger) (*Container, error) {
+	container := New(log)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return container, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+	err = container.ReadSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+	return container, nil
+}
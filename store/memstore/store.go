@@ -0,0 +1,838 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package memstore contains an in-memory implementation of the interfaces in the store package.
+//
+// It's mostly meant for tests and short-lived bots that don't need to keep their session across restarts.
+package memstore
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/util/keys"
+)
+
+// ErrInvalidLength is returned by some functions if the stored data has an invalid length.
+var ErrInvalidLength = errors.New("stored data has invalid length")
+
+type preKeyEntry struct {
+	Key      []byte `json:"key"`
+	Uploaded bool   `json:"uploaded"`
+}
+
+type appStateVersion struct {
+	Version uint64 `json:"version"`
+	Hash    []byte `json:"hash"`
+}
+
+type mutationMAC struct {
+	Version  uint64 `json:"version"`
+	ValueMAC []byte `json:"value_mac"`
+}
+
+// messageKey identifies a message in the message secret and metadata maps. It's a text marshaler,
+// so that it can be used as a JSON object key in snapshots.
+type messageKey struct {
+	Chat   types.JID
+	Sender types.JID
+	ID     types.MessageID
+}
+
+func (key messageKey) MarshalText() ([]byte, error) {
+	return []byte(key.Chat.String() + "|" + key.Sender.String() + "|" + key.ID), nil
+}
+
+func (key *messageKey) UnmarshalText(val []byte) (err error) {
+	parts := strings.SplitN(string(val), "|", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid message key %q", val)
+	}
+	key.Chat, err = types.ParseJID(parts[0])
+	if err != nil {
+		return
+	}
+	key.Sender, err = types.ParseJID(parts[1])
+	key.ID = parts[2]
+	return
+}
+
+type messageRecord struct {
+	Sender        types.JID `json:"sender"`
+	Timestamp     int64     `json:"timestamp"`
+	IsFromMe      bool      `json:"from_me"`
+	Message       []byte    `json:"message"`
+	EditTimestamp int64     `json:"edit_timestamp"`
+	Revoked       bool      `json:"revoked"`
+	DeletedForMe  bool      `json:"deleted_for_me"`
+}
+
+// deviceData contains all the data of a single device. All fields are exported for JSON snapshots,
+// but the struct itself is private and only accessed with the container lock held.
+type deviceData struct {
+	Identities           map[string][]byte                                `json:"identities"`
+	Sessions             map[string][]byte                                `json:"sessions"`
+	PreKeys              map[uint32]*preKeyEntry                          `json:"pre_keys"`
+	SenderKeys           map[string]map[string][]byte                     `json:"sender_keys"`
+	AppStateSyncKeys     map[string]store.AppStateSyncKey                 `json:"app_state_sync_keys"`
+	AppStateVersions     map[string]appStateVersion                       `json:"app_state_versions"`
+	AppStateMutationMACs map[string]map[string]mutationMAC                `json:"app_state_mutation_macs"`
+	Contacts             map[types.JID]types.ContactInfo                  `json:"contacts"`
+	ChatSettings         map[types.JID]types.LocalChatSettings            `json:"chat_settings"`
+	MessageSecrets       map[messageKey][]byte                            `json:"message_secrets"`
+	PrivacyTokens        map[types.JID]store.PrivacyToken                 `json:"privacy_tokens"`
+	Messages             map[types.JID]map[types.MessageID]*messageRecord `json:"messages"`
+	Groups               map[types.JID]json.RawMessage                    `json:"groups"`
+	DeviceLists          map[types.JID]store.CachedDeviceList             `json:"device_lists"`
+
+	ChatMetadata    map[types.JID]store.ChatMetadata                  `json:"chat_metadata"`
+	MessageMetadata map[messageKey]*store.MessageMetadata             `json:"message_metadata_v2"`
+	Labels          map[string]store.Label                            `json:"labels"`
+	ChatLabels      map[string]map[types.JID]bool                     `json:"chat_labels"`
+	MessageLabels   map[string]map[types.JID]map[types.MessageID]bool `json:"message_labels"`
+	// Message metadata from old snapshots, where it was keyed without the sender. Converted by init.
+	LegacyMessageMetadata map[types.JID]map[types.MessageID]*store.MessageMetadata `json:"message_metadata,omitempty"`
+
+	Outbox map[types.JID]map[types.MessageID]*store.OutboxEvent `json:"outbox"`
+}
+
+func newDeviceData() *deviceData {
+	data := &deviceData{}
+	data.init()
+	return data
+}
+
+// init makes sure all the maps are non-nil (e.g. after loading a snapshot).
+func (data *deviceData) init() {
+	if data.Identities == nil {
+		data.Identities = make(map[string][]byte)
+	}
+	if data.Sessions == nil {
+		data.Sessions = make(map[string][]byte)
+	}
+	if data.PreKeys == nil {
+		data.PreKeys = make(map[uint32]*preKeyEntry)
+	}
+	if data.SenderKeys == nil {
+		data.SenderKeys = make(map[string]map[string][]byte)
+	}
+	if data.AppStateSyncKeys == nil {
+		data.AppStateSyncKeys = make(map[string]store.AppStateSyncKey)
+	}
+	if data.AppStateVersions == nil {
+		data.AppStateVersions = make(map[string]appStateVersion)
+	}
+	if data.AppStateMutationMACs == nil {
+		data.AppStateMutationMACs = make(map[string]map[string]mutationMAC)
+	}
+	if data.Contacts == nil {
+		data.Contacts = make(map[types.JID]types.ContactInfo)
+	}
+	if data.ChatSettings == nil {
+		data.ChatSettings = make(map[types.JID]types.LocalChatSettings)
+	}
+	if data.MessageSecrets == nil {
+		data.MessageSecrets = make(map[messageKey][]byte)
+	}
+	if data.PrivacyTokens == nil {
+		data.PrivacyTokens = make(map[types.JID]store.PrivacyToken)
+	}
+	if data.Messages == nil {
+		data.Messages = make(map[types.JID]map[types.MessageID]*messageRecord)
+	}
+	if data.Groups == nil {
+		data.Groups = make(map[types.JID]json.RawMessage)
+	}
+	if data.DeviceLists == nil {
+		data.DeviceLists = make(map[types.JID]store.CachedDeviceList)
+	}
+	if data.ChatMetadata == nil {
+		data.ChatMetadata = make(map[types.JID]store.ChatMetadata)
+	}
+	if data.MessageMetadata == nil {
+		data.MessageMetadata = make(map[messageKey]*store.MessageMetadata)
+	}
+	for _, chatMessages := range data.LegacyMessageMetadata {
+		for _, meta := range chatMessages {
+			data.MessageMetadata[messageKey{Chat: meta.Chat, Sender: meta.Sender, ID: meta.ID}] = meta
+		}
+	}
+	data.LegacyMessageMetadata = nil
+	if data.Labels == nil {
+		data.Labels = make(map[string]store.Label)
+	}
+	if data.ChatLabels == nil {
+		data.ChatLabels = make(map[string]map[types.JID]bool)
+	}
+	if data.MessageLabels == nil {
+		data.MessageLabels = make(map[string]map[types.JID]map[types.MessageID]bool)
+	}
+	if data.Outbox == nil {
+		data.Outbox = make(map[types.JID]map[types.MessageID]*store.OutboxEvent)
+	}
+}
+
+// MemStore is an in-memory store for a single device.
+// It implements all the store interfaces in the store package.
+type MemStore struct {
+	*Container
+	JID types.JID
+
+	data *deviceData
+}
+
+var _ store.IdentityStore = (*MemStore)(nil)
+var _ store.SessionStore = (*MemStore)(nil)
+var _ store.PreKeyStore = (*MemStore)(nil)
+var _ store.SenderKeyStore = (*MemStore)(nil)
+var _ store.AppStateSyncKeyStore = (*MemStore)(nil)
+var _ store.AppStateStore = (*MemStore)(nil)
+var _ store.ContactStore = (*MemStore)(nil)
+var _ store.ChatSettingsStore = (*MemStore)(nil)
+var _ store.MsgSecretStore = (*MemStore)(nil)
+var _ store.PrivacyTokenStore = (*MemStore)(nil)
+var _ store.MessageStore = (*MemStore)(nil)
+var _ store.LIDStore = (*MemStore)(nil)
+var _ store.GroupStore = (*MemStore)(nil)
+var _ store.DeviceListStore = (*MemStore)(nil)
+
+func (s *MemStore) PutIdentity(address string, key [32]byte) error {
+	s.lock.Lock()
+	s.data.Identities[address] = cloneBytes(key[:])
+	s.lock.Unlock()
+	return nil
+}
+
+// deleteWithPrefix deletes all entries in the map whose key starts with the given prefix.
+func deleteWithPrefix(data map[string][]byte, prefix string) {
+	for key := range data {
+		if strings.HasPrefix(key, prefix) {
+			delete(data, key)
+		}
+	}
+}
+
+func (s *MemStore) DeleteAllIdentities(phone string) error {
+	s.lock.Lock()
+	deleteWithPrefix(s.data.Identities, phone+":")
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) DeleteIdentity(address string) error {
+	s.lock.Lock()
+	delete(s.data.Identities, address)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) IsTrustedIdentity(address string, key [32]byte) (bool, error) {
+	s.lock.RLock()
+	existingIdentity, ok := s.data.Identities[address]
+	s.lock.RUnlock()
+	if !ok {
+		// Trust if not known, it'll be saved automatically later
+		return true, nil
+	} else if len(existingIdentity) != 32 {
+		return false, ErrInvalidLength
+	}
+	return *(*[32]byte)(existingIdentity) == key, nil
+}
+
+func (s *MemStore) GetSession(address string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return cloneBytes(s.data.Sessions[address]), nil
+}
+
+func (s *MemStore) HasSession(address string) (bool, error) {
+	s.lock.RLock()
+	_, ok := s.data.Sessions[address]
+	s.lock.RUnlock()
+	return ok, nil
+}
+
+func (s *MemStore) PutSession(address string, session []byte) error {
+	s.lock.Lock()
+	s.data.Sessions[address] = cloneBytes(session)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) DeleteAllSessions(phone string) error {
+	s.lock.Lock()
+	deleteWithPrefix(s.data.Sessions, phone+":")
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) DeleteSession(address string) error {
+	s.lock.Lock()
+	delete(s.data.Sessions, address)
+	s.lock.Unlock()
+	return nil
+}
+
+// genOnePreKey must be called with the lock held.
+func (s *MemStore) genOnePreKey(id uint32, markUploaded bool) *keys.PreKey {
+	key := keys.NewPreKey(id)
+	s.data.PreKeys[id] = &preKeyEntry{Key: cloneBytes(key.Priv[:]), Uploaded: markUploaded}
+	return key
+}
+
+// getNextPreKeyID must be called with the lock held.
+func (s *MemStore) getNextPreKeyID() uint32 {
+	var lastKeyID uint32
+	for id := range s.data.PreKeys {
+		if id > lastKeyID {
+			lastKeyID = id
+		}
+	}
+	return lastKeyID + 1
+}
+
+func (s *MemStore) GenOnePreKey() (*keys.PreKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.genOnePreKey(s.getNextPreKeyID(), true), nil
+}
+
+func (s *MemStore) GetOrGenPreKeys(count uint32) ([]*keys.PreKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	existingIDs := make([]uint32, 0, count)
+	for id, entry := range s.data.PreKeys {
+		if !entry.Uploaded {
+			existingIDs = append(existingIDs, id)
+		}
+	}
+	sort.Slice(existingIDs, func(i, j int) bool {
+		return existingIDs[i] < existingIDs[j]
+	})
+	if uint32(len(existingIDs)) > count {
+		existingIDs = existingIDs[:count]
+	}
+	newKeys := make([]*keys.PreKey, count)
+	for i, id := range existingIDs {
+		key, err := s.getPreKey(id)
+		if err != nil {
+			return nil, err
+		}
+		newKeys[i] = key
+	}
+	nextKeyID := s.getNextPreKeyID()
+	for i := uint32(len(existingIDs)); i < count; i++ {
+		newKeys[i] = s.genOnePreKey(nextKeyID, false)
+		nextKeyID++
+	}
+	return newKeys, nil
+}
+
+// getPreKey must be called with the lock held.
+func (s *MemStore) getPreKey(id uint32) (*keys.PreKey, error) {
+	entry, ok := s.data.PreKeys[id]
+	if !ok {
+		return nil, nil
+	} else if len(entry.Key) != 32 {
+		return nil, ErrInvalidLength
+	}
+	return &keys.PreKey{
+		KeyPair: *keys.NewKeyPairFromPrivateKey(*(*[32]byte)(entry.Key)),
+		KeyID:   id,
+	}, nil
+}
+
+func (s *MemStore) GetPreKey(id uint32) (*keys.PreKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.getPreKey(id)
+}
+
+func (s *MemStore) RemovePreKey(id uint32) error {
+	s.lock.Lock()
+	delete(s.data.PreKeys, id)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) MarkPreKeysAsUploaded(upToID uint32) error {
+	s.lock.Lock()
+	for id, entry := range s.data.PreKeys {
+		if id <= upToID {
+			entry.Uploaded = true
+		}
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) UploadedPreKeyCount() (count int, err error) {
+	s.lock.RLock()
+	for _, entry := range s.data.PreKeys {
+		if entry.Uploaded {
+			count++
+		}
+	}
+	s.lock.RUnlock()
+	return
+}
+
+func (s *MemStore) PutSenderKey(group, user string, session []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	groupKeys, ok := s.data.SenderKeys[group]
+	if !ok {
+		groupKeys = make(map[string][]byte)
+		s.data.SenderKeys[group] = groupKeys
+	}
+	groupKeys[user] = cloneBytes(session)
+	return nil
+}
+
+func (s *MemStore) GetSenderKey(group, user string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return cloneBytes(s.data.SenderKeys[group][user]), nil
+}
+
+func (s *MemStore) PutAppStateSyncKey(id []byte, key store.AppStateSyncKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	hexID := hex.EncodeToString(id)
+	existing, ok := s.data.AppStateSyncKeys[hexID]
+	if !ok || key.Timestamp > existing.Timestamp {
+		s.data.AppStateSyncKeys[hexID] = store.AppStateSyncKey{
+			Data:        cloneBytes(key.Data),
+			Fingerprint: cloneBytes(key.Fingerprint),
+			Timestamp:   key.Timestamp,
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) GetAppStateSyncKey(id []byte) (*store.AppStateSyncKey, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	key, ok := s.data.AppStateSyncKeys[hex.EncodeToString(id)]
+	if !ok {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+func (s *MemStore) GetLatestAppStateSyncKeyID() ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var latestID string
+	var latestTS int64
+	found := false
+	for id, key := range s.data.AppStateSyncKeys {
+		if !found || key.Timestamp > latestTS {
+			latestID, latestTS, found = id, key.Timestamp, true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return hex.DecodeString(latestID)
+}
+
+func (s *MemStore) PutAppStateVersion(name string, version uint64, hash [128]byte) error {
+	s.lock.Lock()
+	s.data.AppStateVersions[name] = appStateVersion{Version: version, Hash: cloneBytes(hash[:])}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetAppStateVersion(name string) (version uint64, hash [128]byte, err error) {
+	s.lock.RLock()
+	existing, ok := s.data.AppStateVersions[name]
+	s.lock.RUnlock()
+	if !ok {
+		// version will be 0 and hash will be an empty array, which is the correct initial state
+	} else if len(existing.Hash) != 128 {
+		err = ErrInvalidLength
+	} else {
+		version = existing.Version
+		hash = *(*[128]byte)(existing.Hash)
+	}
+	return
+}
+
+func (s *MemStore) DeleteAppStateVersion(name string) error {
+	s.lock.Lock()
+	delete(s.data.AppStateVersions, name)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutAppStateMutationMACs(name string, version uint64, mutations []store.AppStateMutationMAC) error {
+	if len(mutations) == 0 {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	macs, ok := s.data.AppStateMutationMACs[name]
+	if !ok {
+		macs = make(map[string]mutationMAC)
+		s.data.AppStateMutationMACs[name] = macs
+	}
+	for _, mutation := range mutations {
+		hexIndexMAC := hex.EncodeToString(mutation.IndexMAC)
+		// Only the value MAC with the highest version is ever read, so older versions don't need to be kept
+		if existing, ok := macs[hexIndexMAC]; !ok || version >= existing.Version {
+			macs[hexIndexMAC] = mutationMAC{Version: version, ValueMAC: cloneBytes(mutation.ValueMAC)}
+		}
+	}
+	return nil
+}
+
+func (s *MemStore) DeleteAppStateMutationMACs(name string, indexMACs [][]byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	macs := s.data.AppStateMutationMACs[name]
+	for _, indexMAC := range indexMACs {
+		delete(macs, hex.EncodeToString(indexMAC))
+	}
+	return nil
+}
+
+func (s *MemStore) GetAppStateMutationMAC(name string, indexMAC []byte) (valueMAC []byte, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	mac, ok := s.data.AppStateMutationMACs[name][hex.EncodeToString(indexMAC)]
+	if ok {
+		valueMAC = cloneBytes(mac.ValueMAC)
+	}
+	return
+}
+
+func (s *MemStore) PutPushName(user types.JID, pushName string) (bool, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contact := s.data.Contacts[user]
+	if contact.PushName == pushName {
+		return false, "", nil
+	}
+	previousName := contact.PushName
+	contact.PushName = pushName
+	contact.Found = true
+	s.data.Contacts[user] = contact
+	return true, previousName, nil
+}
+
+func (s *MemStore) PutBusinessName(user types.JID, businessName string) (bool, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	contact := s.data.Contacts[user]
+	if contact.BusinessName == businessName {
+		return false, "", nil
+	}
+	previousName := contact.BusinessName
+	contact.BusinessName = businessName
+	contact.Found = true
+	s.data.Contacts[user] = contact
+	return true, previousName, nil
+}
+
+// putContactName must be called with the lock held.
+func (s *MemStore) putContactName(user types.JID, firstName, fullName string) {
+	contact := s.data.Contacts[user]
+	contact.FirstName = firstName
+	contact.FullName = fullName
+	contact.Found = true
+	s.data.Contacts[user] = contact
+}
+
+func (s *MemStore) PutContactName(user types.JID, firstName, fullName string) error {
+	s.lock.Lock()
+	s.putContactName(user, firstName, fullName)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutAllContactNames(contacts []store.ContactEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, contact := range contacts {
+		if contact.JID.IsEmpty() {
+			s.log.Warnf("Empty contact info in mass insert: %+v", contact)
+			continue
+		}
+		s.putContactName(contact.JID, contact.FirstName, contact.FullName)
+	}
+	return nil
+}
+
+func (s *MemStore) GetContact(user types.JID) (types.ContactInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.data.Contacts[user], nil
+}
+
+func (s *MemStore) GetAllContacts() (map[types.JID]types.ContactInfo, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	output := make(map[types.JID]types.ContactInfo, len(s.data.Contacts))
+	for jid, contact := range s.data.Contacts {
+		output[jid] = contact
+	}
+	return output, nil
+}
+
+// updateChatSettings must be called with the lock held.
+func (s *MemStore) updateChatSettings(chat types.JID, update func(settings *types.LocalChatSettings)) {
+	settings := s.data.ChatSettings[chat]
+	update(&settings)
+	settings.Found = true
+	s.data.ChatSettings[chat] = settings
+}
+
+func (s *MemStore) PutMutedUntil(chat types.JID, mutedUntil time.Time) error {
+	s.lock.Lock()
+	s.updateChatSettings(chat, func(settings *types.LocalChatSettings) {
+		settings.MutedUntil = mutedUntil
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutPinned(chat types.JID, pinned bool) error {
+	s.lock.Lock()
+	s.updateChatSettings(chat, func(settings *types.LocalChatSettings) {
+		settings.Pinned = pinned
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutArchived(chat types.JID, archived bool) error {
+	s.lock.Lock()
+	s.updateChatSettings(chat, func(settings *types.LocalChatSettings) {
+		settings.Archived = archived
+	})
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetChatSettings(chat types.JID) (types.LocalChatSettings, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.data.ChatSettings[chat], nil
+}
+
+// putMessageSecret must be called with the lock held.
+func (s *MemStore) putMessageSecret(chat, sender types.JID, id types.MessageID, secret []byte) {
+	key := messageKey{Chat: chat.ToNonAD(), Sender: sender.ToNonAD(), ID: id}
+	if _, exists := s.data.MessageSecrets[key]; !exists {
+		s.data.MessageSecrets[key] = cloneBytes(secret)
+	}
+}
+
+func (s *MemStore) PutMessageSecrets(inserts []store.MessageSecretInsert) error {
+	s.lock.Lock()
+	for _, insert := range inserts {
+		s.putMessageSecret(insert.Chat, insert.Sender, insert.ID, insert.Secret)
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) PutMessageSecret(chat, sender types.JID, id types.MessageID, secret []byte) error {
+	s.lock.Lock()
+	s.putMessageSecret(chat, sender, id, secret)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetMessageSecret(chat, sender types.JID, id types.MessageID) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return cloneBytes(s.data.MessageSecrets[messageKey{Chat: chat.ToNonAD(), Sender: sender.ToNonAD(), ID: id}]), nil
+}
+
+func (s *MemStore) PutPrivacyTokens(tokens ...store.PrivacyToken) error {
+	s.lock.Lock()
+	for _, token := range tokens {
+		user := token.User.ToNonAD()
+		s.data.PrivacyTokens[user] = store.PrivacyToken{
+			User:      user,
+			Token:     cloneBytes(token.Token),
+			Timestamp: time.Unix(token.Timestamp.Unix(), 0),
+		}
+	}
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *MemStore) GetPrivacyToken(user types.JID) (*store.PrivacyToken, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	token, ok := s.data.PrivacyTokens[user.ToNonAD()]
+	if !ok {
+		return nil, nil
+	}
+	return &token, nil
+}
+
+// putMessage must be called with the lock held.
+func (s *MemStore) putMessage(entry *store.MessageEntry) error {
+	chat := entry.Chat.ToNonAD()
+	chatMessages, ok := s.data.Messages[chat]
+	if !ok {
+		chatMessages = make(map[types.MessageID]*messageRecord)
+		s.data.Messages[chat] = chatMessages
+	} else if _, exists := chatMessages[entry.ID]; exists {
+		return nil
+	}
+	var content []byte
+	if entry.Message != nil {
+		var err error
+		content, err = proto.Marshal(entry.Message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message %s: %w", entry.ID, err)
+		}
+	}
+	chatMessages[entry.ID] = &messageRecord{
+		Sender:    entry.Sender.ToNonAD(),
+		Timestamp: entry.Timestamp.Unix(),
+		IsFromMe:  entry.IsFromMe,
+		Message:   content,
+	}
+	return nil
+}
+
+func (s *MemStore) PutMessage(entry store.MessageEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.putMessage(&entry)
+}
+
+func (s *MemStore) PutMessages(entries []store.MessageEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i := range entries {
+		err := s.putMessage(&entries[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (record *messageRecord) toEntry(chat types.JID, id types.MessageID) (*store.MessageEntry, error) {
+	entry := &store.MessageEntry{
+		Chat:         chat,
+		Sender:       record.Sender,
+		ID:           id,
+		Timestamp:    time.Unix(record.Timestamp, 0),
+		IsFromMe:     record.IsFromMe,
+		Revoked:      record.Revoked,
+		DeletedForMe: record.DeletedForMe,
+	}
+	if record.EditTimestamp != 0 {
+		entry.EditTimestamp = time.Unix(record.EditTimestamp, 0)
+	}
+	if record.Message != nil {
+		entry.Message = &waE2E.Message{}
+		err := proto.Unmarshal(record.Message, entry.Message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message %s: %w", id, err)
+		}
+	}
+	return entry, nil
+}
+
+func (s *MemStore) GetMessage(chat types.JID, id types.MessageID) (*store.MessageEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	chat = chat.ToNonAD()
+	record, ok := s.data.Messages[chat][id]
+	if !ok {
+		return nil, nil
+	}
+	return record.toEntry(chat, id)
+}
+
+func (s *MemStore) GetChatMessages(chat types.JID, before *store.MessageCursor, limit int) ([]*store.MessageEntry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	chat = chat.ToNonAD()
+	chatMessages := s.data.Messages[chat]
+	ids := make([]types.MessageID, 0, len(chatMessages))
+	for id, record := range chatMessages {
+		if before != nil {
+			beforeTS := before.Timestamp.Unix()
+			if record.Timestamp > beforeTS || (record.Timestamp == beforeTS && id >= before.ID) {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		tsI, tsJ := chatMessages[ids[i]].Timestamp, chatMessages[ids[j]].Timestamp
+		if tsI != tsJ {
+			return tsI > tsJ
+		}
+		return ids[i] > ids[j]
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	entries := make([]*store.MessageEntry, 0, len(ids))
+	for _, id := range ids {
+		entry, err := chatMessages[id].toEntry(chat, id)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *MemStore) UpdateMessageContent(chat, sender types.JID, id types.MessageID, message *waE2E.Message, editTimestamp time.Time) error {
+	content, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message %s: %w", id, err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, ok := s.data.Messages[chat.ToNonAD()][id]
+	if ok && record.Sender == sender.ToNonAD() && record.EditTimestamp <= editTimestamp.Unix() {
+		record.Message = content
+		record.EditTimestamp = editTimestamp.Unix()
+	}
+	return nil
+}
+
+func (s *MemStore) MarkMessageRevoked(chat, sender types.JID, id types.MessageID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if record, ok := s.data.Messages[chat.ToNonAD()][id]; ok && record.Sender == sender.ToNonAD() {
+		record.Revoked = true
+	}
+	return nil
+}
+
+func (s *MemStore) MarkMessageDeletedForMe(chat types.JID, id types.MessageID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if record, ok := s.data.Messages[chat.ToNonAD()][id]; ok {
+		record.DeletedForMe = true
+	}
+	return nil
+}
@@ -7,6 +7,9 @@
 package store
 
 import (
+	"context"
+	"fmt"
+
 	"go.mau.fi/libsignal/ecc"
 	groupRecord "go.mau.fi/libsignal/groups/state/record"
 	"go.mau.fi/libsignal/keys/identity"
@@ -21,6 +24,42 @@ import (
 var SignalProtobufSerializer = serialize.NewProtoBufSerializer()
 
 var _ store.SignalProtocol = (*Device)(nil)
+var _ store.SignalProtocol = (*SignalStore)(nil)
+
+// SignalStore is an implementation of the libsignal store interfaces bound to a context.
+//
+// It's meant for running Signal operations inside a transaction (see Device.DoTxn): unlike the methods on
+// Device itself, database errors are not retried or passed to the DatabaseErrorHandler, but saved and returned
+// from Err, so that the caller can roll back the transaction instead of committing partial state.
+type SignalStore struct {
+	*Device
+	ctx   context.Context
+	retry bool
+	err   error
+}
+
+// SignalStore returns a libsignal store that uses the given context for all database operations.
+func (device *Device) SignalStore(ctx context.Context) *SignalStore {
+	return &SignalStore{Device: device, ctx: ctx}
+}
+
+func (device *Device) defaultSignalStore() *SignalStore {
+	return &SignalStore{Device: device, ctx: context.Background(), retry: true}
+}
+
+// Err returns the first database error that happened in this store.
+func (ss *SignalStore) Err() error {
+	return ss.err
+}
+
+func (ss *SignalStore) handleDatabaseError(attemptIndex int, err error, action string, args ...interface{}) bool {
+	if ss.retry {
+		return ss.Device.handleDatabaseError(attemptIndex, err, action, args...)
+	} else if ss.err == nil {
+		ss.err = fmt.Errorf("failed to %s: %w", fmt.Sprintf(action, args...), err)
+	}
+	return false
+}
 
 func (device *Device) GetIdentityKeyPair() *identity.KeyPair {
 	return identity.NewKeyPair(
@@ -34,48 +73,19 @@ func (device *Device) GetLocalRegistrationId() uint32 {
 }
 
 func (device *Device) SaveIdentity(address *protocol.SignalAddress, identityKey *identity.Key) {
-	for i := 0; ; i++ {
-		err := device.Identities.PutIdentity(address.String(), identityKey.PublicKey().PublicKey())
-		if err == nil || !device.handleDatabaseError(i, err, "save identity of %s", address.String()) {
-			break
-		}
-	}
+	device.defaultSignalStore().SaveIdentity(address, identityKey)
 }
 
 func (device *Device) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
-	for i := 0; ; i++ {
-		isTrusted, err := device.Identities.IsTrustedIdentity(address.String(), identityKey.PublicKey().PublicKey())
-		if err == nil || !device.handleDatabaseError(i, err, "check if %s's identity is trusted", address.String()) {
-			return isTrusted
-		}
-	}
+	return device.defaultSignalStore().IsTrustedIdentity(address, identityKey)
 }
 
 func (device *Device) LoadPreKey(id uint32) *record.PreKey {
-	var preKey *keys.PreKey
-	for i := 0; ; i++ {
-		var err error
-		preKey, err = device.PreKeys.GetPreKey(id)
-		if err == nil || !device.handleDatabaseError(i, err, "load prekey %d", id) {
-			break
-		}
-	}
-	if preKey == nil {
-		return nil
-	}
-	return record.NewPreKey(preKey.KeyID, ecc.NewECKeyPair(
-		ecc.NewDjbECPublicKey(*preKey.Pub),
-		ecc.NewDjbECPrivateKey(*preKey.Priv),
-	), nil)
+	return device.defaultSignalStore().LoadPreKey(id)
 }
 
 func (device *Device) RemovePreKey(id uint32) {
-	for i := 0; ; i++ {
-		err := device.PreKeys.RemovePreKey(id)
-		if err == nil || !device.handleDatabaseError(i, err, "remove prekey %d", id) {
-			break
-		}
-	}
+	device.defaultSignalStore().RemovePreKey(id)
 }
 
 func (device *Device) StorePreKey(preKeyID uint32, preKeyRecord *record.PreKey) {
@@ -87,23 +97,7 @@ func (device *Device) ContainsPreKey(preKeyID uint32) bool {
 }
 
 func (device *Device) LoadSession(address *protocol.SignalAddress) *record.Session {
-	var rawSess []byte
-	for i := 0; ; i++ {
-		var err error
-		rawSess, err = device.Sessions.GetSession(address.String())
-		if err == nil || !device.handleDatabaseError(i, err, "load session with %s", address.String()) {
-			break
-		}
-	}
-	if rawSess == nil {
-		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
-	}
-	sess, err := record.NewSessionFromBytes(rawSess, SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
-	if err != nil {
-		device.Log.Errorf("Failed to deserialize session with %s: %v", address.String(), err)
-		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
-	}
-	return sess
+	return device.defaultSignalStore().LoadSession(address)
 }
 
 func (device *Device) GetSubDeviceSessions(name string) []uint32 {
@@ -111,21 +105,11 @@ func (device *Device) GetSubDeviceSessions(name string) []uint32 {
 }
 
 func (device *Device) StoreSession(address *protocol.SignalAddress, record *record.Session) {
-	for i := 0; ; i++ {
-		err := device.Sessions.PutSession(address.String(), record.Serialize())
-		if err == nil || !device.handleDatabaseError(i, err, "store session with %s", address.String()) {
-			return
-		}
-	}
+	device.defaultSignalStore().StoreSession(address, record)
 }
 
 func (device *Device) ContainsSession(remoteAddress *protocol.SignalAddress) bool {
-	for i := 0; ; i++ {
-		hasSession, err := device.Sessions.HasSession(remoteAddress.String())
-		if err == nil || !device.handleDatabaseError(i, err, "store has session for %s", remoteAddress.String()) {
-			return hasSession
-		}
-	}
+	return device.defaultSignalStore().ContainsSession(remoteAddress)
 }
 
 func (device *Device) DeleteSession(remoteAddress *protocol.SignalAddress) {
@@ -163,20 +147,132 @@ func (device *Device) RemoveSignedPreKey(signedPreKeyID uint32) {
 }
 
 func (device *Device) StoreSenderKey(senderKeyName *protocol.SenderKeyName, keyRecord *groupRecord.SenderKey) {
+	device.defaultSignalStore().StoreSenderKey(senderKeyName, keyRecord)
+}
+
+func (device *Device) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *groupRecord.SenderKey {
+	return device.defaultSignalStore().LoadSenderKey(senderKeyName)
+}
+
+func (ss *SignalStore) SaveIdentity(address *protocol.SignalAddress, identityKey *identity.Key) {
 	for i := 0; ; i++ {
-		err := device.SenderKeys.PutSenderKey(senderKeyName.GroupID(), senderKeyName.Sender().String(), keyRecord.Serialize())
-		if err == nil || !device.handleDatabaseError(i, err, "store sender key from %s", senderKeyName.Sender().String()) {
+		err := ss.putIdentity(ss.ctx, address.String(), identityKey.PublicKey().PublicKey())
+		if err == nil || !ss.handleDatabaseError(i, err, "save identity of %s", address.String()) {
+			break
+		}
+	}
+}
+
+func (ss *SignalStore) IsTrustedIdentity(address *protocol.SignalAddress, identityKey *identity.Key) bool {
+	for i := 0; ; i++ {
+		isTrusted, err := ss.isTrustedIdentity(ss.ctx, address.String(), identityKey.PublicKey().PublicKey())
+		if err == nil || !ss.handleDatabaseError(i, err, "check if %s's identity is trusted", address.String()) {
+			return isTrusted
+		}
+	}
+}
+
+func (ss *SignalStore) LoadPreKey(id uint32) *record.PreKey {
+	var preKey *keys.PreKey
+	for i := 0; ; i++ {
+		var err error
+		preKey, err = ss.getPreKey(ss.ctx, id)
+		if err == nil || !ss.handleDatabaseError(i, err, "load prekey %d", id) {
+			break
+		}
+	}
+	if preKey == nil {
+		return nil
+	}
+	return record.NewPreKey(preKey.KeyID, ecc.NewECKeyPair(
+		ecc.NewDjbECPublicKey(*preKey.Pub),
+		ecc.NewDjbECPrivateKey(*preKey.Priv),
+	), nil)
+}
+
+func (ss *SignalStore) RemovePreKey(id uint32) {
+	for i := 0; ; i++ {
+		err := ss.removePreKey(ss.ctx, id)
+		if err == nil || !ss.handleDatabaseError(i, err, "remove prekey %d", id) {
+			break
+		}
+	}
+}
+
+func (ss *SignalStore) LoadSession(address *protocol.SignalAddress) *record.Session {
+	var rawSess []byte
+	for i := 0; ; i++ {
+		var err error
+		rawSess, err = ss.getSession(ss.ctx, address.String())
+		if err == nil || !ss.handleDatabaseError(i, err, "load session with %s", address.String()) {
+			break
+		}
+	}
+	if rawSess == nil {
+		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+	}
+	sess, err := record.NewSessionFromBytes(rawSess, SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+	if err != nil {
+		ss.Log.Errorf("Failed to deserialize session with %s: %v", address.String(), err)
+		return record.NewSession(SignalProtobufSerializer.Session, SignalProtobufSerializer.State)
+	}
+	return sess
+}
+
+func (ss *SignalStore) StoreSession(address *protocol.SignalAddress, record *record.Session) {
+	for i := 0; ; i++ {
+		err := ss.putSession(ss.ctx, address.String(), record.Serialize())
+		if err == nil || !ss.handleDatabaseError(i, err, "store session with %s", address.String()) {
 			return
 		}
 	}
 }
 
-func (device *Device) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *groupRecord.SenderKey {
+func (ss *SignalStore) ContainsSession(remoteAddress *protocol.SignalAddress) bool {
+	for i := 0; ; i++ {
+		hasSession, err := ss.hasSession(ss.ctx, remoteAddress.String())
+		if err == nil || !ss.handleDatabaseError(i, err, "store has session for %s", remoteAddress.String()) {
+			return hasSession
+		}
+	}
+}
+
+func (ss *SignalStore) DeleteSession(remoteAddress *protocol.SignalAddress) {
+	for i := 0; ; i++ {
+		err := ss.deleteSession(ss.ctx, remoteAddress.String())
+		if err == nil || !ss.handleDatabaseError(i, err, "delete session with %s", remoteAddress.String()) {
+			return
+		}
+	}
+}
+
+// DeleteIdentity deletes the stored identity key and session of the given address.
+// This is used to trust a new identity key when it changes.
+func (ss *SignalStore) DeleteIdentity(address *protocol.SignalAddress) {
+	for i := 0; ; i++ {
+		err := ss.deleteIdentity(ss.ctx, address.String())
+		if err == nil || !ss.handleDatabaseError(i, err, "delete identity of %s", address.String()) {
+			break
+		}
+	}
+	ss.DeleteSession(address)
+}
+
+func (ss *SignalStore) StoreSenderKey(senderKeyName *protocol.SenderKeyName, keyRecord *groupRecord.SenderKey) {
+	for i := 0; ; i++ {
+		err := ss.putSenderKey(ss.ctx, senderKeyName.GroupID(), senderKeyName.Sender().String(), keyRecord.Serialize())
+		if err == nil || !ss.handleDatabaseError(i, err, "store sender key from %s", senderKeyName.Sender().String()) {
+			return
+		}
+	}
+}
+
+func (ss *SignalStore) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *groupRecord.SenderKey {
 	var rawKey []byte
 	for i := 0; ; i++ {
 		var err error
-		rawKey, err = device.SenderKeys.GetSenderKey(senderKeyName.GroupID(), senderKeyName.Sender().String())
-		if err == nil || !device.handleDatabaseError(i, err, "load sender key from %s for %s", senderKeyName.Sender().String(), senderKeyName.GroupID()) {
+		rawKey, err = ss.getSenderKey(ss.ctx, senderKeyName.GroupID(), senderKeyName.Sender().String())
+		if err == nil || !ss.handleDatabaseError(i, err, "load sender key from %s for %s", senderKeyName.Sender().String(), senderKeyName.GroupID()) {
 			break
 		}
 	}
@@ -185,7 +281,7 @@ func (device *Device) LoadSenderKey(senderKeyName *protocol.SenderKeyName) *grou
 	}
 	key, err := groupRecord.NewSenderKeyFromBytes(rawKey, SignalProtobufSerializer.SenderKeyRecord, SignalProtobufSerializer.SenderKeyState)
 	if err != nil {
-		device.Log.Errorf("Failed to deserialize sender key from %s for %s: %v", senderKeyName.Sender().String(), senderKeyName.GroupID(), err)
+		ss.Log.Errorf("Failed to deserialize sender key from %s for %s: %v", senderKeyName.Sender().String(), senderKeyName.GroupID(), err)
 		return groupRecord.NewSenderKey(SignalProtobufSerializer.SenderKeyRecord, SignalProtobufSerializer.SenderKeyState)
 	}
 	return key
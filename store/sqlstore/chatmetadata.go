@@ -0,0 +1,255 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.ChatMetadataStore = (*SQLStore)(nil)
+
+const (
+	putChatMetadataQuery = `
+		INSERT INTO whatsmeow_chat_metadata (our_jid, chat_jid, %[1]s) VALUES ($1, $2, $3)
+		ON CONFLICT (our_jid, chat_jid) DO UPDATE SET %[1]s=excluded.%[1]s
+	`
+	getChatMetadataQuery = `
+		SELECT marked_as_unread, cleared_at, deleted_at FROM whatsmeow_chat_metadata WHERE our_jid=$1 AND chat_jid=$2
+	`
+	getArchivedChatsQuery = `SELECT chat_jid FROM whatsmeow_chat_settings WHERE our_jid=$1 AND archived=true`
+
+	putMessageMetadataQuery = `
+		INSERT INTO whatsmeow_message_metadata (our_jid, chat_jid, message_id, sender_jid, from_me, updated_at, %[1]s)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (our_jid, chat_jid, sender_jid, message_id) DO UPDATE SET %[1]s=excluded.%[1]s, updated_at=excluded.updated_at
+	`
+	getMessageMetadataQueryBase = `
+		SELECT chat_jid, message_id, sender_jid, from_me, starred, deleted_for_me, updated_at
+		FROM whatsmeow_message_metadata
+	`
+	getMessageMetadataQuery       = getMessageMetadataQueryBase + `WHERE our_jid=$1 AND chat_jid=$2 AND sender_jid=$3 AND message_id=$4`
+	getAllStarredMessagesQuery    = getMessageMetadataQueryBase + `WHERE our_jid=$1 AND starred=true ORDER BY updated_at DESC`
+	getStarredMessagesInChatQuery = getMessageMetadataQueryBase + `WHERE our_jid=$1 AND chat_jid=$2 AND starred=true ORDER BY updated_at DESC`
+
+	putLabelQuery = `
+		INSERT INTO whatsmeow_labels (our_jid, label_id, name, color, predefined_id, deleted) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (our_jid, label_id) DO UPDATE
+			SET name=excluded.name, color=excluded.color, predefined_id=excluded.predefined_id, deleted=excluded.deleted
+	`
+	getLabelsQuery = `
+		SELECT label_id, name, color, predefined_id, deleted FROM whatsmeow_labels WHERE our_jid=$1 AND deleted=false ORDER BY label_id
+	`
+	putChatLabelQuery = `
+		INSERT INTO whatsmeow_label_chats (our_jid, label_id, chat_jid) VALUES ($1, $2, $3)
+		ON CONFLICT (our_jid, label_id, chat_jid) DO NOTHING
+	`
+	deleteChatLabelQuery = `DELETE FROM whatsmeow_label_chats WHERE our_jid=$1 AND label_id=$2 AND chat_jid=$3`
+	putMessageLabelQuery = `
+		INSERT INTO whatsmeow_label_messages (our_jid, label_id, chat_jid, message_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (our_jid, label_id, chat_jid, message_id) DO NOTHING
+	`
+	deleteMessageLabelQuery = `DELETE FROM whatsmeow_label_messages WHERE our_jid=$1 AND label_id=$2 AND chat_jid=$3 AND message_id=$4`
+	getChatsByLabelQuery    = `SELECT chat_jid FROM whatsmeow_label_chats WHERE our_jid=$1 AND label_id=$2`
+	getLabelsForChatQuery   = `SELECT label_id FROM whatsmeow_label_chats WHERE our_jid=$1 AND chat_jid=$2`
+	getMessagesByLabelQuery = `SELECT chat_jid, message_id FROM whatsmeow_label_messages WHERE our_jid=$1 AND label_id=$2`
+)
+
+func (s *SQLStore) PutMarkedAsUnread(chat types.JID, unread bool) error {
+	_, err := s.db.Exec(fmt.Sprintf(putChatMetadataQuery, "marked_as_unread"), s.JID, chat, unread)
+	return err
+}
+
+func (s *SQLStore) PutChatCleared(chat types.JID, ts time.Time) error {
+	_, err := s.db.Exec(fmt.Sprintf(putChatMetadataQuery, "cleared_at"), s.JID, chat, ts.Unix())
+	return err
+}
+
+func (s *SQLStore) PutChatDeleted(chat types.JID, ts time.Time) error {
+	_, err := s.db.Exec(fmt.Sprintf(putChatMetadataQuery, "deleted_at"), s.JID, chat, ts.Unix())
+	return err
+}
+
+func (s *SQLStore) GetChatMetadata(chat types.JID) (meta store.ChatMetadata, err error) {
+	var clearedAt, deletedAt int64
+	err = s.db.QueryRow(getChatMetadataQuery, s.JID, chat).Scan(&meta.MarkedAsUnread, &clearedAt, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	} else if err != nil {
+		return
+	} else {
+		meta.Found = true
+	}
+	if clearedAt != 0 {
+		meta.ClearedAt = time.Unix(clearedAt, 0)
+	}
+	if deletedAt != 0 {
+		meta.DeletedAt = time.Unix(deletedAt, 0)
+	}
+	return
+}
+
+func scanJIDs(rows *sql.Rows, err error) ([]types.JID, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var output []types.JID
+	for rows.Next() {
+		var jid types.JID
+		err = rows.Scan(&jid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		output = append(output, jid)
+	}
+	return output, rows.Err()
+}
+
+func (s *SQLStore) GetArchivedChats() ([]types.JID, error) {
+	return scanJIDs(s.db.Query(getArchivedChatsQuery, s.JID))
+}
+
+func (s *SQLStore) PutMessageStarred(chat, sender types.JID, id types.MessageID, fromMe, starred bool, ts time.Time) error {
+	// The sender is empty in private chats, which types.JID.Value would turn into NULL,
+	// so it's passed as a string to keep it usable in the primary key.
+	_, err := s.db.Exec(fmt.Sprintf(putMessageMetadataQuery, "starred"), s.JID, chat, id, sender.String(), fromMe, ts.Unix(), starred)
+	return err
+}
+
+func (s *SQLStore) PutMessageDeletedForMe(chat, sender types.JID, id types.MessageID, fromMe bool, ts time.Time) error {
+	_, err := s.db.Exec(fmt.Sprintf(putMessageMetadataQuery, "deleted_for_me"), s.JID, chat, id, sender.String(), fromMe, ts.Unix(), true)
+	return err
+}
+
+func scanMessageMetadata(row scannable) (*store.MessageMetadata, error) {
+	var meta store.MessageMetadata
+	var updatedAt int64
+	err := row.Scan(&meta.Chat, &meta.ID, &meta.Sender, &meta.IsFromMe, &meta.Starred, &meta.DeletedForMe, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	meta.UpdatedAt = time.Unix(updatedAt, 0)
+	return &meta, nil
+}
+
+func (s *SQLStore) GetMessageMetadata(chat, sender types.JID, id types.MessageID) (*store.MessageMetadata, error) {
+	meta, err := scanMessageMetadata(s.db.QueryRow(getMessageMetadataQuery, s.JID, chat, sender.String(), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return meta, err
+}
+
+func (s *SQLStore) GetStarredMessages(chat types.JID) ([]*store.MessageMetadata, error) {
+	var rows *sql.Rows
+	var err error
+	if chat.IsEmpty() {
+		rows, err = s.db.Query(getAllStarredMessagesQuery, s.JID)
+	} else {
+		rows, err = s.db.Query(getStarredMessagesInChatQuery, s.JID, chat)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var output []*store.MessageMetadata
+	for rows.Next() {
+		meta, err := scanMessageMetadata(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		output = append(output, meta)
+	}
+	return output, rows.Err()
+}
+
+func (s *SQLStore) PutLabel(label store.Label) error {
+	_, err := s.db.Exec(putLabelQuery, s.JID, label.ID, label.Name, label.Color, label.PredefinedID, label.Deleted)
+	return err
+}
+
+func (s *SQLStore) GetLabels() ([]store.Label, error) {
+	rows, err := s.db.Query(getLabelsQuery, s.JID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var output []store.Label
+	for rows.Next() {
+		var label store.Label
+		err = rows.Scan(&label.ID, &label.Name, &label.Color, &label.PredefinedID, &label.Deleted)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		output = append(output, label)
+	}
+	return output, rows.Err()
+}
+
+func (s *SQLStore) PutChatLabel(chat types.JID, labelID string, labeled bool) error {
+	query := putChatLabelQuery
+	if !labeled {
+		query = deleteChatLabelQuery
+	}
+	_, err := s.db.Exec(query, s.JID, labelID, chat)
+	return err
+}
+
+func (s *SQLStore) PutMessageLabel(chat types.JID, id types.MessageID, labelID string, labeled bool) error {
+	query := putMessageLabelQuery
+	if !labeled {
+		query = deleteMessageLabelQuery
+	}
+	_, err := s.db.Exec(query, s.JID, labelID, chat, id)
+	return err
+}
+
+func (s *SQLStore) GetChatsByLabel(labelID string) ([]types.JID, error) {
+	return scanJIDs(s.db.Query(getChatsByLabelQuery, s.JID, labelID))
+}
+
+func (s *SQLStore) GetLabelsForChat(chat types.JID) ([]string, error) {
+	rows, err := s.db.Query(getLabelsForChatQuery, s.JID, chat)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var output []string
+	for rows.Next() {
+		var labelID string
+		err = rows.Scan(&labelID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		output = append(output, labelID)
+	}
+	return output, rows.Err()
+}
+
+func (s *SQLStore) GetMessagesByLabel(labelID string) ([]store.LabeledMessage, error) {
+	rows, err := s.db.Query(getMessagesByLabelQuery, s.JID, labelID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var output []store.LabeledMessage
+	for rows.Next() {
+		var msg store.LabeledMessage
+		err = rows.Scan(&msg.Chat, &msg.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		output = append(output, msg)
+	}
+	return output, rows.Err()
+}
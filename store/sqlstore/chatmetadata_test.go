@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func TestUpgradeV14_KeepsMessageMetadata(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "whatsmeow.db")+"?_foreign_keys=on")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	container := NewWithDB(db, "sqlite3", nil)
+	t.Cleanup(func() {
+		_ = container.Close()
+	})
+	// Create the database as it was before the sender was added to the key
+	if _, err = container.getVersion(); err != nil {
+		t.Fatalf("failed to create version table: %v", err)
+	}
+	for version := 0; version < 13; version++ {
+		tx, err := container.db.Begin()
+		if err != nil {
+			t.Fatalf("failed to begin transaction: %v", err)
+		} else if err = Upgrades[version](tx, container); err != nil {
+			t.Fatalf("failed to upgrade to v%d: %v", version+1, err)
+		} else if err = container.setVersion(tx, version+1); err != nil {
+			t.Fatalf("failed to set version: %v", err)
+		} else if err = tx.Commit(); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+	}
+	device := newTestDevice(t, container, "1234")
+	group := types.NewJID("123456789", types.GroupServer)
+	sender := types.NewJID("1111", types.DefaultUserServer)
+	_, err = container.db.Exec(`
+		INSERT INTO whatsmeow_message_metadata (our_jid, chat_jid, message_id, sender_jid, from_me, starred, updated_at)
+		VALUES ($1, $2, $3, $4, false, true, 1700000000)
+	`, device.ID, group, "MSG1", sender)
+	if err != nil {
+		t.Fatalf("failed to insert old message metadata: %v", err)
+	}
+
+	if err = container.Upgrade(); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	checkSchemaVersion(t, container)
+	s := device.ChatMetadata.(*SQLStore)
+	meta, err := s.GetMessageMetadata(group, sender, "MSG1")
+	if err != nil || meta == nil || !meta.Starred || meta.Sender != sender {
+		t.Fatalf("message metadata wasn't kept: %+v, %v", meta, err)
+	}
+	// After the upgrade, a message with the same ID from another sender is stored separately
+	other := types.NewJID("2222", types.DefaultUserServer)
+	if err = s.PutMessageDeletedForMe(group, other, "MSG1", false, meta.UpdatedAt); err != nil {
+		t.Fatalf("failed to put message metadata: %v", err)
+	}
+	if meta, err = s.GetMessageMetadata(group, sender, "MSG1"); err != nil || meta == nil || meta.DeletedForMe {
+		t.Errorf("other sender's message overwrote metadata: %+v, %v", meta, err)
+	}
+}
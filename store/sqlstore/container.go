@@ -7,11 +7,14 @@
 package sqlstore
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/Romerito007/whatsmeow/proto/waAdv"
 	mathRand "math/rand"
+	"sync"
+	"sync/atomic"
 
 	"github.com/google/uuid"
 	"go.mau.fi/util/random"
@@ -24,24 +27,43 @@ import (
 
 // Container is a wrapper for a SQL database that can contain multiple whatsmeow sessions.
 type Container struct {
-	db      *sql.DB
+	db      *sqlDB
 	dialect string
 	log     waLog.Logger
 
+	sqliteTxnLock  sync.Mutex
+	sqliteTxnOwner atomic.Uint64
+
+	lidCacheLock sync.RWMutex
+	lidToPN      map[string]string
+	pnToLID      map[string]string
+	lidMissing   map[string]struct{}
+
 	DatabaseErrorHandler func(device *store.Device, action string, attemptIndex int, err error) (retry bool)
+
+	// EncryptionKeys enables encryption of Signal state (identity keys, sessions, prekeys, sender keys
+	// and app state sync keys) when set. Existing unencrypted data can still be read, and it can be
+	// encrypted with ReEncrypt, which should also be called after rotating keys.
+	EncryptionKeys EncryptionKeyProvider
 }
 
 var _ store.DeviceContainer = (*Container)(nil)
+var _ store.ContextDeviceContainer = (*Container)(nil)
 
 // New connects to the given SQL database and wraps it in a Container.
 //
-// Only SQLite and Postgres are currently fully supported.
+// SQLite ("sqlite3"), Postgres ("postgres" or "pgx") and MySQL/MariaDB ("mysql") are currently supported.
 //
 // The logger can be nil and will default to a no-op logger.
 //
 // When using SQLite, it's strongly recommended to enable foreign keys by adding `?_foreign_keys=true`:
 //
 //	container, err := sqlstore.New("sqlite3", "file:yoursqlitefile.db?_foreign_keys=on", nil)
+//
+// MySQL requires InnoDB tables and MySQL 5.7+ or MariaDB 10.2+. The queries are written for Postgres
+// and are rewritten automatically, so the DSN doesn't need any special parameters:
+//
+//	container, err := sqlstore.New("mysql", "user:password@tcp(localhost:3306)/whatsmeow", nil)
 func New(dialect, address string, log waLog.Logger) (*Container, error) {
 	db, err := sql.Open(dialect, address)
 	if err != nil {
@@ -57,7 +79,7 @@ func New(dialect, address string, log waLog.Logger) (*Container, error) {
 
 // NewWithDB wraps an existing SQL connection in a Container.
 //
-// Only SQLite and Postgres are currently fully supported.
+// The supported dialects are the same as in New.
 //
 // The logger can be nil and will default to a no-op logger.
 //
@@ -78,9 +100,13 @@ func NewWithDB(db *sql.DB, dialect string, log waLog.Logger) *Container {
 		log = waLog.Noop
 	}
 	return &Container{
-		db:      db,
+		db:      &sqlDB{DB: db, dialect: dialect},
 		dialect: dialect,
 		log:     log,
+
+		lidToPN:    make(map[string]string),
+		pnToLID:    make(map[string]string),
+		lidMissing: make(map[string]struct{}),
 	}
 }
 
@@ -134,8 +160,15 @@ func (c *Container) scanDevice(row scannable) (*store.Device, error) {
 	device.AppState = innerStore
 	device.Contacts = innerStore
 	device.ChatSettings = innerStore
+	device.ChatMetadata = innerStore
 	device.MsgSecrets = innerStore
 	device.PrivacyTokens = innerStore
+	device.Messages = innerStore
+	device.Outbox = innerStore
+	device.LIDs = innerStore
+	device.Groups = innerStore
+	device.DeviceLists = innerStore
+	device.DeviceData = innerStore
 	device.Container = c
 	device.Initialized = true
 
@@ -180,7 +213,12 @@ func (c *Container) GetFirstDevice() (*store.Device, error) {
 //
 // Note that the parameter usually must be an AD-JID.
 func (c *Container) GetDevice(jid types.JID) (*store.Device, error) {
-	sess, err := c.scanDevice(c.db.QueryRow(getDeviceQuery, jid))
+	return c.GetDeviceContext(context.Background(), jid)
+}
+
+// GetDeviceContext is a variant of GetDevice that uses the transaction in the context if there is one.
+func (c *Container) GetDeviceContext(ctx context.Context, jid types.JID) (*store.Device, error) {
+	sess, err := c.scanDevice(c.conn(ctx).QueryRowContext(ctx, getDeviceQuery, jid))
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	}
@@ -234,10 +272,15 @@ func (c *Container) Close() error {
 // PutDevice stores the given device in this database. This should be called through Device.Save()
 // (which usually doesn't need to be called manually, as the library does that automatically when relevant).
 func (c *Container) PutDevice(device *store.Device) error {
+	return c.PutDeviceContext(context.Background(), device)
+}
+
+// PutDeviceContext is a variant of PutDevice that uses the transaction in the context if there is one.
+func (c *Container) PutDeviceContext(ctx context.Context, device *store.Device) error {
 	if device.ID == nil {
 		return ErrDeviceIDMustBeSet
 	}
-	_, err := c.db.Exec(insertDeviceQuery,
+	_, err := c.conn(ctx).ExecContext(ctx, insertDeviceQuery,
 		device.ID.String(), device.RegistrationID, device.NoiseKey.Priv[:], device.IdentityKey.Priv[:],
 		device.SignedPreKey.Priv[:], device.SignedPreKey.KeyID, device.SignedPreKey.Signature[:],
 		device.AdvSecretKey, device.Account.Details, device.Account.AccountSignature, device.Account.AccountSignatureKey, device.Account.DeviceSignature,
@@ -253,8 +296,15 @@ func (c *Container) PutDevice(device *store.Device) error {
 		device.AppState = innerStore
 		device.Contacts = innerStore
 		device.ChatSettings = innerStore
+		device.ChatMetadata = innerStore
 		device.MsgSecrets = innerStore
 		device.PrivacyTokens = innerStore
+		device.Messages = innerStore
+		device.Outbox = innerStore
+		device.LIDs = innerStore
+		device.Groups = innerStore
+		device.DeviceLists = innerStore
+		device.DeviceData = innerStore
 		device.Initialized = true
 	}
 	return err
@@ -262,9 +312,14 @@ func (c *Container) PutDevice(device *store.Device) error {
 
 // DeleteDevice deletes the given device from this database. This should be called through Device.Delete()
 func (c *Container) DeleteDevice(store *store.Device) error {
+	return c.DeleteDeviceContext(context.Background(), store)
+}
+
+// DeleteDeviceContext is a variant of DeleteDevice that uses the transaction in the context if there is one.
+func (c *Container) DeleteDeviceContext(ctx context.Context, store *store.Device) error {
 	if store.ID == nil {
 		return ErrDeviceIDMustBeSet
 	}
-	_, err := c.db.Exec(deleteDeviceQuery, store.ID.String())
+	_, err := c.conn(ctx).ExecContext(ctx, deleteDeviceQuery, store.ID.String())
 	return err
 }
@@ -0,0 +1,50 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/Romerito007/whatsmeow/proto/waAdv"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+// newTestContainer creates a container backed by a new SQLite database in the test's temp directory.
+func newTestContainer(t *testing.T) *Container {
+	t.Helper()
+	container, err := New("sqlite3", "file:"+filepath.Join(t.TempDir(), "whatsmeow.db")+"?_foreign_keys=on", nil)
+	if err != nil {
+		t.Fatalf("failed to create container: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = container.Close()
+	})
+	return container
+}
+
+// newTestDevice creates and saves a new device with the given phone number in the container.
+func newTestDevice(t *testing.T, container *Container, phone string) *store.Device {
+	t.Helper()
+	device := container.NewDevice()
+	device.ID = &types.JID{User: phone, Device: 1, Server: types.DefaultUserServer}
+	device.Account = &waAdv.ADVSignedDeviceIdentity{
+		Details:             []byte{1},
+		AccountSignature:    bytes.Repeat([]byte{2}, 64),
+		AccountSignatureKey: bytes.Repeat([]byte{3}, 32),
+		DeviceSignature:     bytes.Repeat([]byte{4}, 64),
+	}
+	err := device.Save()
+	if err != nil {
+		t.Fatalf("failed to save device: %v", err)
+	}
+	return device
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.DeviceListStore = (*SQLStore)(nil)
+
+const (
+	putDeviceListQuery = `
+		INSERT INTO whatsmeow_device_lists (our_jid, user_jid, devices, dhash, updated_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (our_jid, user_jid) DO UPDATE SET devices=excluded.devices, dhash=excluded.dhash, updated_at=excluded.updated_at
+	`
+	getDeviceListQuery      = `SELECT devices, dhash, updated_at FROM whatsmeow_device_lists WHERE our_jid=$1 AND user_jid=$2`
+	getManyDeviceListsQuery = `SELECT user_jid, devices, dhash, updated_at FROM whatsmeow_device_lists WHERE our_jid=$1 AND user_jid IN (%s)`
+	deleteDeviceListQuery   = `DELETE FROM whatsmeow_device_lists WHERE our_jid=$1 AND user_jid=$2`
+)
+
+const deviceListBatchSize = 500
+
+func (s *SQLStore) PutDeviceList(list store.CachedDeviceList) error {
+	devices := make([]string, len(list.Devices))
+	for i, device := range list.Devices {
+		devices[i] = device.String()
+	}
+	updatedAt := list.UpdatedAt
+	if updatedAt.IsZero() {
+		updatedAt = time.Now()
+	}
+	_, err := s.db.Exec(putDeviceListQuery, s.JID, list.User.ToNonAD(), strings.Join(devices, ","), list.DHash, updatedAt.Unix())
+	return err
+}
+
+func (s *SQLStore) GetDeviceList(user types.JID) (*store.CachedDeviceList, error) {
+	list := store.CachedDeviceList{User: user.ToNonAD()}
+	var devices string
+	var updatedAt int64
+	err := s.db.QueryRow(getDeviceListQuery, s.JID, list.User).Scan(&devices, &list.DHash, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = fillDeviceList(&list, devices, updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (s *SQLStore) GetDeviceLists(users []types.JID) (map[types.JID]*store.CachedDeviceList, error) {
+	output := make(map[types.JID]*store.CachedDeviceList, len(users))
+	for i := 0; i < len(users); i += deviceListBatchSize {
+		batch := users[i:min(i+deviceListBatchSize, len(users))]
+		placeholders := make([]string, len(batch))
+		args := make([]any, len(batch)+1)
+		args[0] = s.JID
+		for j, user := range batch {
+			placeholders[j] = fmt.Sprintf("$%d", j+2)
+			args[j+1] = user.ToNonAD()
+		}
+		err := s.scanDeviceLists(fmt.Sprintf(getManyDeviceListsQuery, strings.Join(placeholders, ",")), args, output)
+		if err != nil {
+			return output, err
+		}
+	}
+	return output, nil
+}
+
+func (s *SQLStore) scanDeviceLists(query string, args []any, output map[types.JID]*store.CachedDeviceList) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var list store.CachedDeviceList
+		var devices string
+		var updatedAt int64
+		err = rows.Scan(&list.User, &devices, &list.DHash, &updatedAt)
+		if err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		err = fillDeviceList(&list, devices, updatedAt)
+		if err != nil {
+			return err
+		}
+		output[list.User] = &list
+	}
+	return rows.Err()
+}
+
+func fillDeviceList(list *store.CachedDeviceList, devices string, updatedAt int64) (err error) {
+	list.UpdatedAt = time.Unix(updatedAt, 0)
+	if len(devices) > 0 {
+		parts := strings.Split(devices, ",")
+		list.Devices = make([]types.JID, len(parts))
+		for i, part := range parts {
+			list.Devices[i], err = types.ParseJID(part)
+			if err != nil {
+				return fmt.Errorf("failed to parse device %q in %s's device list: %w", part, list.User, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteDeviceList(user types.JID) error {
+	_, err := s.db.Exec(deleteDeviceListQuery, s.JID, user.ToNonAD())
+	return err
+}
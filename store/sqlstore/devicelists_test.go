@@ -0,0 +1,71 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func TestDeviceListStore_GetDeviceLists(t *testing.T) {
+	container := newTestContainer(t)
+	deviceLists := newTestDevice(t, container, "1234").DeviceLists
+	otherDeviceLists := newTestDevice(t, container, "5678").DeviceLists
+	var users []types.JID
+	for i := 0; i < deviceListBatchSize+5; i++ {
+		users = append(users, types.NewJID(fmt.Sprint(100000+i), types.DefaultUserServer))
+	}
+	// Only every other user has a stored device list
+	for i := 0; i < len(users); i += 2 {
+		err := deviceLists.PutDeviceList(store.CachedDeviceList{
+			User:      users[i],
+			Devices:   []types.JID{users[i], {User: users[i].User, Device: 3, Server: types.DefaultUserServer}},
+			DHash:     fmt.Sprint("hash", i),
+			UpdatedAt: testBaseTS,
+		})
+		if err != nil {
+			t.Fatalf("failed to put device list: %v", err)
+		}
+	}
+	err := otherDeviceLists.PutDeviceList(store.CachedDeviceList{User: users[1], Devices: []types.JID{users[1]}})
+	if err != nil {
+		t.Fatalf("failed to put device list: %v", err)
+	}
+
+	lists, err := deviceLists.GetDeviceLists(users)
+	if err != nil {
+		t.Fatalf("failed to get device lists: %v", err)
+	} else if len(lists) != (len(users)+1)/2 {
+		t.Errorf("got %d device lists, expected %d", len(lists), (len(users)+1)/2)
+	}
+	for i, user := range users {
+		list, ok := lists[user]
+		if i%2 == 1 {
+			if ok {
+				t.Errorf("got device list for %s, which wasn't stored for this device", user)
+			}
+			continue
+		} else if !ok {
+			t.Errorf("device list of %s is missing", user)
+			continue
+		}
+		single, err := deviceLists.GetDeviceList(user)
+		if err != nil {
+			t.Fatalf("failed to get device list: %v", err)
+		}
+		if list.User != user || list.DHash != single.DHash || !list.UpdatedAt.Equal(testBaseTS) ||
+			fmt.Sprint(list.Devices) != fmt.Sprint(single.Devices) || len(list.Devices) != 2 {
+			t.Errorf("batch result %+v doesn't match single result %+v", list, single)
+		}
+	}
+	if lists, err = deviceLists.GetDeviceLists(nil); err != nil || len(lists) != 0 {
+		t.Errorf("expected empty result for no users, got %v, %v", lists, err)
+	}
+}
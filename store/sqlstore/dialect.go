@@ -0,0 +1,160 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// The queries in this package are written for Postgres and SQLite, which both accept $N placeholders and
+// the ON CONFLICT upsert syntax. sqlDB and sqlTx wrap the database connection and transactions to rewrite
+// the queries on the fly for dialects that don't support those (currently only MySQL/MariaDB).
+
+// sqlDB is a wrapper for *sql.DB that rewrites queries to match the dialect of the database.
+type sqlDB struct {
+	*sql.DB
+	dialect string
+}
+
+// sqlTx is a wrapper for *sql.Tx that rewrites queries to match the dialect of the database.
+type sqlTx struct {
+	*sql.Tx
+	dialect string
+}
+
+var (
+	placeholderRegex         = regexp.MustCompile(`\$(\d+)`)
+	onConflictDoNothingRegex = regexp.MustCompile(`ON CONFLICT\s*\(\s*([^,)\s]+)[^)]*\)\s*DO NOTHING`)
+	onConflictDoUpdateRegex  = regexp.MustCompile(`ON CONFLICT\s*\([^)]*\)\s*DO UPDATE\s+SET`)
+	excludedColumnRegex      = regexp.MustCompile(`(?i)\bexcluded\.(\w+)`)
+	keyColumnRegex           = regexp.MustCompile(`\bkey\b`)
+)
+
+// rewriteQueryMySQL converts a Postgres-style query into one that MySQL and MariaDB understand:
+//
+//   - $N placeholders are replaced with ?, and the arguments are reordered (and duplicated) to match.
+//   - ON CONFLICT (...) DO UPDATE SET col=excluded.col becomes ON DUPLICATE KEY UPDATE col=VALUES(col).
+//   - ON CONFLICT (...) DO NOTHING becomes a no-op ON DUPLICATE KEY UPDATE.
+//   - The key column (which is a reserved word in MySQL) is quoted.
+//
+// Conditional upserts (DO UPDATE ... WHERE) can't be rewritten and need a separate MySQL query.
+func rewriteQueryMySQL(query string, args []any) (string, []any, error) {
+	query = onConflictDoNothingRegex.ReplaceAllString(query, "ON DUPLICATE KEY UPDATE $1=$1")
+	if onConflictDoUpdateRegex.MatchString(query) {
+		query = onConflictDoUpdateRegex.ReplaceAllLiteralString(query, "ON DUPLICATE KEY UPDATE")
+		query = excludedColumnRegex.ReplaceAllString(query, "VALUES($1)")
+	}
+	// The key column is quoted last, as the regexes above don't expect quoted column names (e.g. in excluded.key)
+	query = keyColumnRegex.ReplaceAllLiteralString(query, "`key`")
+	matches := placeholderRegex.FindAllStringSubmatchIndex(query, -1)
+	if len(matches) == 0 {
+		return query, args, nil
+	}
+	newArgs := make([]any, len(matches))
+	for i, match := range matches {
+		index, _ := strconv.Atoi(query[match[2]:match[3]])
+		if index < 1 || index > len(args) {
+			return "", nil, fmt.Errorf("placeholder $%d is out of range (got %d arguments)", index, len(args))
+		}
+		newArgs[i] = args[index-1]
+	}
+	return placeholderRegex.ReplaceAllLiteralString(query, "?"), newArgs, nil
+}
+
+func rewriteQuery(dialect, query string, args []any) (string, []any, error) {
+	if dialect == "mysql" {
+		return rewriteQueryMySQL(query, args)
+	}
+	return query, args, nil
+}
+
+func (db *sqlDB) Exec(query string, args ...any) (sql.Result, error) {
+	return db.ExecContext(context.Background(), query, args...)
+}
+
+func (db *sqlDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	query, args, err := rewriteQuery(db.dialect, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return db.DB.ExecContext(ctx, query, args...)
+}
+
+func (db *sqlDB) Query(query string, args ...any) (*sql.Rows, error) {
+	return db.QueryContext(context.Background(), query, args...)
+}
+
+func (db *sqlDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	query, args, err := rewriteQuery(db.dialect, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+func (db *sqlDB) QueryRow(query string, args ...any) *sql.Row {
+	return db.QueryRowContext(context.Background(), query, args...)
+}
+
+func (db *sqlDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	// sql.Row can't be constructed with an error, so if rewriting fails, let the database return the error instead
+	if rewritten, rewrittenArgs, err := rewriteQuery(db.dialect, query, args); err == nil {
+		query, args = rewritten, rewrittenArgs
+	}
+	return db.DB.QueryRowContext(ctx, query, args...)
+}
+
+func (db *sqlDB) Begin() (*sqlTx, error) {
+	return db.BeginTx(context.Background(), nil)
+}
+
+func (db *sqlDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sqlTx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlTx{Tx: tx, dialect: db.dialect}, nil
+}
+
+func (tx *sqlTx) Exec(query string, args ...any) (sql.Result, error) {
+	return tx.ExecContext(context.Background(), query, args...)
+}
+
+func (tx *sqlTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	query, args, err := rewriteQuery(tx.dialect, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Tx.ExecContext(ctx, query, args...)
+}
+
+func (tx *sqlTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.QueryContext(context.Background(), query, args...)
+}
+
+func (tx *sqlTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	query, args, err := rewriteQuery(tx.dialect, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Tx.QueryContext(ctx, query, args...)
+}
+
+func (tx *sqlTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.QueryRowContext(context.Background(), query, args...)
+}
+
+func (tx *sqlTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	if rewritten, rewrittenArgs, err := rewriteQuery(tx.dialect, query, args); err == nil {
+		query, args = rewritten, rewrittenArgs
+	}
+	return tx.Tx.QueryRowContext(ctx, query, args...)
+}
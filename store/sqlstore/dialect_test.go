@@ -0,0 +1,128 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var whitespaceRegex = regexp.MustCompile(`\s+`)
+
+func normalizeQuery(query string) string {
+	return strings.TrimSpace(whitespaceRegex.ReplaceAllLiteralString(query, " "))
+}
+
+func TestRewriteQueryMySQL(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		args      []any
+		wantQuery string
+		wantArgs  []any
+	}{{
+		name:      "no placeholders",
+		query:     "SELECT COUNT(*) FROM whatsmeow_device",
+		wantQuery: "SELECT COUNT(*) FROM whatsmeow_device",
+	}, {
+		name:      "placeholders in order",
+		query:     "SELECT identity FROM whatsmeow_identity_keys WHERE our_jid=$1 AND their_id=$2",
+		args:      []any{"a", "b"},
+		wantQuery: "SELECT identity FROM whatsmeow_identity_keys WHERE our_jid=? AND their_id=?",
+		wantArgs:  []any{"a", "b"},
+	}, {
+		name:      "placeholders reordered and repeated",
+		query:     "UPDATE whatsmeow_contacts SET push_name=$3 WHERE our_jid=$1 AND (their_jid=$2 OR their_jid=$2)",
+		args:      []any{"a", "b", "c"},
+		wantQuery: "UPDATE whatsmeow_contacts SET push_name=? WHERE our_jid=? AND (their_jid=? OR their_jid=?)",
+		wantArgs:  []any{"c", "a", "b", "b"},
+	}, {
+		name:      "on conflict do nothing",
+		query:     "INSERT INTO whatsmeow_lid_map (lid, pn) VALUES ($1, $2) ON CONFLICT (lid) DO NOTHING",
+		args:      []any{"a", "b"},
+		wantQuery: "INSERT INTO whatsmeow_lid_map (lid, pn) VALUES (?, ?) ON DUPLICATE KEY UPDATE lid=lid",
+		wantArgs:  []any{"a", "b"},
+	}, {
+		name:      "on conflict do update",
+		query:     putIdentityQuery,
+		args:      []any{"a", "b", []byte{1}},
+		wantQuery: "INSERT INTO whatsmeow_identity_keys (our_jid, their_id, identity) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE identity=VALUES(identity)",
+		wantArgs:  []any{"a", "b", []byte{1}},
+	}, {
+		name:      "uppercase excluded",
+		query:     "INSERT INTO t (a, b) VALUES ($1, $2) ON CONFLICT (a) DO UPDATE SET b=EXCLUDED.b",
+		args:      []any{1, 2},
+		wantQuery: "INSERT INTO t (a, b) VALUES (?, ?) ON DUPLICATE KEY UPDATE b=VALUES(b)",
+		wantArgs:  []any{1, 2},
+	}, {
+		name:      "multiline do update",
+		query:     importContactQuery,
+		args:      []any{1, 2, 3, 4, 5, 6},
+		wantQuery: "INSERT INTO whatsmeow_contacts (our_jid, their_jid, first_name, full_name, push_name, business_name) VALUES (?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE first_name=VALUES(first_name), full_name=VALUES(full_name), push_name=VALUES(push_name), business_name=VALUES(business_name)",
+		wantArgs:  []any{1, 2, 3, 4, 5, 6},
+	}, {
+		name:      "key column quoted",
+		query:     "SELECT key_id, key FROM whatsmeow_pre_keys WHERE jid=$1 AND key_id=$2",
+		args:      []any{"a", 1},
+		wantQuery: "SELECT key_id, `key` FROM whatsmeow_pre_keys WHERE jid=? AND key_id=?",
+		wantArgs:  []any{"a", 1},
+	}, {
+		name:      "key column in excluded",
+		query:     importPreKeyQuery,
+		args:      []any{"a", 1, []byte{1}, true},
+		wantQuery: "INSERT INTO whatsmeow_pre_keys (jid, key_id, `key`, uploaded) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE `key`=VALUES(`key`), uploaded=VALUES(uploaded)",
+		wantArgs:  []any{"a", 1, []byte{1}, true},
+	}, {
+		name:      "key column as conflict target",
+		query:     "INSERT INTO t (key, value) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING",
+		args:      []any{"a", "b"},
+		wantQuery: "INSERT INTO t (`key`, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE `key`=`key`",
+		wantArgs:  []any{"a", "b"},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, args, err := rewriteQueryMySQL(test.query, test.args)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if normalizeQuery(query) != test.wantQuery {
+				t.Errorf("wrong query:\n got: %s\nwant: %s", normalizeQuery(query), test.wantQuery)
+			}
+			if !reflect.DeepEqual(args, test.wantArgs) {
+				t.Errorf("wrong args: got %v, want %v", args, test.wantArgs)
+			}
+		})
+	}
+}
+
+func TestRewriteQueryMySQLPlaceholderOutOfRange(t *testing.T) {
+	for _, query := range []string{
+		"SELECT * FROM t WHERE a=$1 AND b=$3",
+		"SELECT * FROM t WHERE a=$0",
+	} {
+		_, _, err := rewriteQueryMySQL(query, []any{1, 2})
+		if err == nil {
+			t.Errorf("expected error for %q", query)
+		}
+	}
+}
+
+func TestRewriteQueryOtherDialects(t *testing.T) {
+	query := importPreKeyQuery
+	args := []any{"a", 1, []byte{1}, true}
+	for _, dialect := range []string{"sqlite3", "postgres", "pgx"} {
+		gotQuery, gotArgs, err := rewriteQuery(dialect, query, args)
+		if err != nil {
+			t.Fatalf("unexpected error for %s: %v", dialect, err)
+		}
+		if gotQuery != query || !reflect.DeepEqual(gotArgs, args) {
+			t.Errorf("query was modified for %s: %s", dialect, gotQuery)
+		}
+	}
+}
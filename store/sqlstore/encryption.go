@@ -0,0 +1,274 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mau.fi/util/random"
+
+	"github.com/Romerito007/whatsmeow/util/gcmutil"
+)
+
+// EncryptionKeyProvider provides the keys used to encrypt sensitive Signal state (identity keys, sessions,
+// prekeys, sender keys and app state sync keys) before it's written to the database.
+//
+// Keys must be valid AES keys, i.e. 16, 24 or 32 bytes long.
+type EncryptionKeyProvider interface {
+	// CurrentKey returns the key that should be used to encrypt new data, as well as an identifier for it.
+	// The identifier is stored alongside the encrypted data and must be at most 255 bytes long.
+	CurrentKey() (keyID string, key []byte, err error)
+	// GetKey returns the key with the given identifier. This is used for decrypting existing data,
+	// so old keys must remain available until all data has been re-encrypted with Container.ReEncrypt.
+	//
+	// If the key is not known, nil should be returned.
+	GetKey(keyID string) ([]byte, error)
+}
+
+// StaticKeyProvider is a simple EncryptionKeyProvider that has a fixed set of keys.
+type StaticKeyProvider struct {
+	// CurrentKeyID is the ID of the key in Keys that will be used for encrypting new data.
+	CurrentKeyID string
+	Keys         map[string][]byte
+}
+
+var _ EncryptionKeyProvider = (*StaticKeyProvider)(nil)
+
+func (skp *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, ok := skp.Keys[skp.CurrentKeyID]
+	if !ok {
+		return "", nil, fmt.Errorf("%w %q", ErrUnknownEncryptionKey, skp.CurrentKeyID)
+	}
+	return skp.CurrentKeyID, key, nil
+}
+
+func (skp *StaticKeyProvider) GetKey(keyID string) ([]byte, error) {
+	return skp.Keys[keyID], nil
+}
+
+var (
+	// ErrNoEncryptionKeyProvider is returned when trying to read encrypted data from a container that doesn't have a key provider.
+	ErrNoEncryptionKeyProvider = errors.New("found encrypted data, but no encryption key provider is set")
+	// ErrUnknownEncryptionKey is returned when the key provider doesn't have the key that some data was encrypted with.
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+)
+
+// encryptedValuePrefix is prepended to all encrypted values. Legacy plaintext values never start with it:
+// sessions and sender keys are protobufs, which can't start with a null byte, and raw keys are too short.
+const encryptedValuePrefix = "\x00wm\x01"
+
+const (
+	encryptionNonceLength = 12
+	encryptionTagLength   = 16
+	minEncryptedLength    = len(encryptedValuePrefix) + 1 + encryptionNonceLength + encryptionTagLength
+)
+
+// encryptionAD builds the additional data for encrypting a value, which ties the ciphertext to the row it's stored in.
+func encryptionAD(table string, parts ...string) []byte {
+	ad := binary.AppendUvarint(nil, uint64(len(table)))
+	ad = append(ad, table...)
+	for _, part := range parts {
+		ad = binary.AppendUvarint(ad, uint64(len(part)))
+		ad = append(ad, part...)
+	}
+	return ad
+}
+
+func parseEncryptedValue(data []byte) (keyID string, nonce, ciphertext []byte, ok bool) {
+	if len(data) < minEncryptedLength || !bytes.HasPrefix(data, []byte(encryptedValuePrefix)) {
+		return
+	}
+	data = data[len(encryptedValuePrefix):]
+	keyIDLength := int(data[0])
+	data = data[1:]
+	if len(data) < keyIDLength+encryptionNonceLength+encryptionTagLength {
+		return
+	}
+	keyID = string(data[:keyIDLength])
+	nonce = data[keyIDLength : keyIDLength+encryptionNonceLength]
+	ciphertext = data[keyIDLength+encryptionNonceLength:]
+	ok = true
+	return
+}
+
+// encryptValue encrypts the given value with the current key if the container has a key provider.
+// If there's no key provider, the plaintext is returned as-is.
+func (c *Container) encryptValue(plaintext, ad []byte) ([]byte, error) {
+	if c.EncryptionKeys == nil || plaintext == nil {
+		return plaintext, nil
+	}
+	keyID, key, err := c.EncryptionKeys.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current encryption key: %w", err)
+	} else if len(keyID) > 255 {
+		return nil, fmt.Errorf("encryption key ID is too long (%d bytes)", len(keyID))
+	}
+	nonce := random.Bytes(encryptionNonceLength)
+	ciphertext, err := gcmutil.Encrypt(key, nonce, plaintext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt value: %w", err)
+	}
+	output := make([]byte, 0, len(encryptedValuePrefix)+1+len(keyID)+len(nonce)+len(ciphertext))
+	output = append(output, encryptedValuePrefix...)
+	output = append(output, byte(len(keyID)))
+	output = append(output, keyID...)
+	output = append(output, nonce...)
+	output = append(output, ciphertext...)
+	return output, nil
+}
+
+// decryptValue decrypts the given value if it's encrypted. Unencrypted legacy values are returned as-is.
+func (c *Container) decryptValue(data, ad []byte) ([]byte, error) {
+	keyID, nonce, ciphertext, ok := parseEncryptedValue(data)
+	if !ok {
+		return data, nil
+	} else if c.EncryptionKeys == nil {
+		return nil, ErrNoEncryptionKeyProvider
+	}
+	key, err := c.EncryptionKeys.GetKey(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key %q: %w", keyID, err)
+	} else if key == nil {
+		return nil, fmt.Errorf("%w %q", ErrUnknownEncryptionKey, keyID)
+	}
+	plaintext, err := gcmutil.Decrypt(key, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value with key %q: %w", keyID, err)
+	}
+	return plaintext, nil
+}
+
+type encryptedColumn struct {
+	table      string
+	keyColumns []string
+	column     string
+}
+
+var encryptedColumns = []encryptedColumn{
+	{table: "whatsmeow_identity_keys", keyColumns: []string{"our_jid", "their_id"}, column: "identity"},
+	{table: "whatsmeow_sessions", keyColumns: []string{"our_jid", "their_id"}, column: "session"},
+	{table: "whatsmeow_pre_keys", keyColumns: []string{"jid", "key_id"}, column: "key"},
+	{table: "whatsmeow_sender_keys", keyColumns: []string{"our_jid", "chat_id", "sender_id"}, column: "sender_key"},
+	{table: "whatsmeow_app_state_sync_keys", keyColumns: []string{"jid", "key_id"}, column: "key_data"},
+}
+
+type encryptedRow struct {
+	keys  []any
+	value []byte
+}
+
+func adPart(val any) string {
+	switch typedVal := val.(type) {
+	case string:
+		return typedVal
+	case []byte:
+		return string(typedVal)
+	case int64:
+		return strconv.FormatInt(typedVal, 10)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func (ec *encryptedColumn) reEncrypt(c *Container, tx *sqlTx, currentKeyID string) (int, error) {
+	rows, err := tx.Query(fmt.Sprintf("SELECT %s, %s FROM %s", strings.Join(ec.keyColumns, ", "), ec.column, ec.table))
+	if err != nil {
+		return 0, fmt.Errorf("failed to query %s: %w", ec.table, err)
+	}
+	// Collect all rows before updating anything, as not all drivers support running queries while iterating over rows.
+	var toUpdate []encryptedRow
+	for rows.Next() {
+		row := encryptedRow{keys: make([]any, len(ec.keyColumns))}
+		scanTargets := make([]any, len(ec.keyColumns)+1)
+		for i := range row.keys {
+			scanTargets[i] = &row.keys[i]
+		}
+		scanTargets[len(row.keys)] = &row.value
+		err = rows.Scan(scanTargets...)
+		if err != nil {
+			_ = rows.Close()
+			return 0, fmt.Errorf("failed to scan %s row: %w", ec.table, err)
+		} else if row.value == nil {
+			continue
+		} else if keyID, _, _, ok := parseEncryptedValue(row.value); ok && keyID == currentKeyID {
+			continue
+		}
+		toUpdate = append(toUpdate, row)
+	}
+	_ = rows.Close()
+	if rows.Err() != nil {
+		return 0, fmt.Errorf("failed to iterate %s rows: %w", ec.table, rows.Err())
+	}
+
+	whereParts := make([]string, len(ec.keyColumns))
+	for i, col := range ec.keyColumns {
+		whereParts[i] = fmt.Sprintf("%s=$%d", col, i+2)
+	}
+	updateQuery := fmt.Sprintf("UPDATE %s SET %s=$1 WHERE %s", ec.table, ec.column, strings.Join(whereParts, " AND "))
+	for _, row := range toUpdate {
+		adParts := make([]string, len(row.keys))
+		for i, key := range row.keys {
+			adParts[i] = adPart(key)
+		}
+		ad := encryptionAD(ec.table, adParts...)
+		var plaintext, encrypted []byte
+		plaintext, err = c.decryptValue(row.value, ad)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt %s row: %w", ec.table, err)
+		}
+		encrypted, err = c.encryptValue(plaintext, ad)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(updateQuery, append([]any{encrypted}, row.keys...)...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to update %s row: %w", ec.table, err)
+		}
+	}
+	return len(toUpdate), nil
+}
+
+// ReEncrypt re-encrypts all encrypted columns in the database with the current key of the EncryptionKeys provider.
+// Unencrypted legacy rows are encrypted, and rows encrypted with older keys are decrypted and encrypted again.
+//
+// This should be called after setting the key provider for the first time on an existing database, and after
+// rotating keys. Once this returns successfully, old keys are no longer needed. Everything is done in a single
+// transaction, so the database is never left in a partially re-encrypted state.
+func (c *Container) ReEncrypt() error {
+	if c.EncryptionKeys == nil {
+		return ErrNoEncryptionKeyProvider
+	}
+	currentKeyID, _, err := c.EncryptionKeys.CurrentKey()
+	if err != nil {
+		return fmt.Errorf("failed to get current encryption key: %w", err)
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	total := 0
+	for _, ec := range encryptedColumns {
+		var count int
+		count, err = ec.reEncrypt(c, tx, currentKeyID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		total += count
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	c.log.Infof("Re-encrypted %d rows with key %q", total, currentKeyID)
+	return nil
+}
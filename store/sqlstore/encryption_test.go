@@ -0,0 +1,284 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Romerito007/whatsmeow/store"
+)
+
+const (
+	testSessionAddress = "1111.0:1"
+	testSenderKeyGroup = "123456789@g.us"
+)
+
+var (
+	testIdentityKey = [32]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32}
+	testSessionData = []byte("session data")
+	testSenderKey   = []byte("sender key data")
+	testSyncKeyID   = []byte("sync key id")
+	testSyncKey     = store.AppStateSyncKey{Data: []byte("sync key data"), Fingerprint: []byte("fingerprint"), Timestamp: 1700000000}
+)
+
+func newTestKeyProvider(currentKeyID string, keyIDs ...string) *StaticKeyProvider {
+	skp := &StaticKeyProvider{CurrentKeyID: currentKeyID, Keys: make(map[string][]byte)}
+	for i, keyID := range keyIDs {
+		skp.Keys[keyID] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	return skp
+}
+
+// putEncryptionTestData stores one row in every encrypted table and returns the prekey that was generated.
+func putEncryptionTestData(t *testing.T, s *SQLStore) uint32 {
+	t.Helper()
+	if err := s.PutIdentity(testSessionAddress, testIdentityKey); err != nil {
+		t.Fatalf("failed to put identity: %v", err)
+	} else if err = s.PutSession(testSessionAddress, testSessionData); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	} else if err = s.PutSenderKey(testSenderKeyGroup, testSessionAddress, testSenderKey); err != nil {
+		t.Fatalf("failed to put sender key: %v", err)
+	} else if err = s.PutAppStateSyncKey(testSyncKeyID, testSyncKey); err != nil {
+		t.Fatalf("failed to put app state sync key: %v", err)
+	}
+	preKey, err := s.GenOnePreKey()
+	if err != nil {
+		t.Fatalf("failed to generate prekey: %v", err)
+	}
+	return preKey.KeyID
+}
+
+// checkEncryptionTestData reads all rows stored by putEncryptionTestData and returns the first error.
+func checkEncryptionTestData(t *testing.T, s *SQLStore, preKeyID uint32) error {
+	t.Helper()
+	if trusted, err := s.IsTrustedIdentity(testSessionAddress, testIdentityKey); err != nil {
+		return err
+	} else if !trusted {
+		t.Errorf("identity key changed")
+	}
+	if session, err := s.GetSession(testSessionAddress); err != nil {
+		return err
+	} else if !bytes.Equal(session, testSessionData) {
+		t.Errorf("session is %q, expected %q", session, testSessionData)
+	}
+	if senderKey, err := s.GetSenderKey(testSenderKeyGroup, testSessionAddress); err != nil {
+		return err
+	} else if !bytes.Equal(senderKey, testSenderKey) {
+		t.Errorf("sender key is %q, expected %q", senderKey, testSenderKey)
+	}
+	if syncKey, err := s.GetAppStateSyncKey(testSyncKeyID); err != nil {
+		return err
+	} else if syncKey == nil || !bytes.Equal(syncKey.Data, testSyncKey.Data) {
+		t.Errorf("app state sync key is %+v, expected %+v", syncKey, testSyncKey)
+	}
+	if preKey, err := s.GetPreKey(preKeyID); err != nil {
+		return err
+	} else if preKey == nil || preKey.KeyID != preKeyID {
+		t.Errorf("prekey %d not found", preKeyID)
+	}
+	return nil
+}
+
+// getRawEncryptedValues returns the raw database values of all rows in the encrypted columns, grouped by table.
+func getRawEncryptedValues(t *testing.T, c *Container) map[string][][]byte {
+	t.Helper()
+	values := make(map[string][][]byte)
+	for _, ec := range encryptedColumns {
+		rows, err := c.db.Query("SELECT " + ec.column + " FROM " + ec.table + " ORDER BY " + strings.Join(ec.keyColumns, ", "))
+		if err != nil {
+			t.Fatalf("failed to query %s: %v", ec.table, err)
+		}
+		for rows.Next() {
+			var value []byte
+			if err = rows.Scan(&value); err != nil {
+				t.Fatalf("failed to scan %s: %v", ec.table, err)
+			}
+			values[ec.table] = append(values[ec.table], value)
+		}
+		_ = rows.Close()
+	}
+	return values
+}
+
+func checkEncryptedWithKey(t *testing.T, c *Container, expectedKeyID string) {
+	t.Helper()
+	for table, values := range getRawEncryptedValues(t, c) {
+		for i, value := range values {
+			if keyID, _, _, ok := parseEncryptedValue(value); !ok || keyID != expectedKeyID {
+				t.Errorf("row #%d in %s isn't encrypted with %s", i+1, table, expectedKeyID)
+			}
+		}
+	}
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	container := newTestContainer(t)
+	container.EncryptionKeys = newTestKeyProvider("key1", "key1")
+	s := newTestDevice(t, container, "1234").Sessions.(*SQLStore)
+	preKeyID := putEncryptionTestData(t, s)
+	if err := checkEncryptionTestData(t, s, preKeyID); err != nil {
+		t.Fatalf("failed to read encrypted data: %v", err)
+	}
+	checkEncryptedWithKey(t, container, "key1")
+	if raw := getRawEncryptedValues(t, container); bytes.Contains(raw["whatsmeow_sessions"][0], testSessionData) {
+		t.Errorf("encrypted session contains the plaintext")
+	}
+}
+
+func TestEncryption_LegacyPlaintext(t *testing.T) {
+	container := newTestContainer(t)
+	s := newTestDevice(t, container, "1234").Sessions.(*SQLStore)
+	preKeyID := putEncryptionTestData(t, s)
+
+	// Plaintext rows written before encryption was enabled are still readable
+	container.EncryptionKeys = newTestKeyProvider("key1", "key1")
+	if err := checkEncryptionTestData(t, s, preKeyID); err != nil {
+		t.Fatalf("failed to read legacy plaintext data: %v", err)
+	}
+	if raw := getRawEncryptedValues(t, container); !bytes.Equal(raw["whatsmeow_sessions"][0], testSessionData) {
+		t.Fatalf("reading legacy data modified it")
+	}
+
+	// ReEncrypt encrypts them, and they stay readable
+	if err := container.ReEncrypt(); err != nil {
+		t.Fatalf("failed to re-encrypt: %v", err)
+	}
+	checkEncryptedWithKey(t, container, "key1")
+	if err := checkEncryptionTestData(t, s, preKeyID); err != nil {
+		t.Fatalf("failed to read re-encrypted data: %v", err)
+	}
+}
+
+func TestEncryption_WrongKey(t *testing.T) {
+	container := newTestContainer(t)
+	container.EncryptionKeys = newTestKeyProvider("key1", "key1")
+	s := newTestDevice(t, container, "1234").Sessions.(*SQLStore)
+	preKeyID := putEncryptionTestData(t, s)
+
+	tests := []struct {
+		name      string
+		keys      EncryptionKeyProvider
+		expectErr error
+	}{
+		{"no key provider", nil, ErrNoEncryptionKeyProvider},
+		{"unknown key ID", newTestKeyProvider("key2", "key2"), ErrUnknownEncryptionKey},
+		// The key at index 1 is different from the one the data was encrypted with
+		{"wrong key with same ID", newTestKeyProvider("key1", "key0", "key1"), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			container.EncryptionKeys = test.keys
+			err := checkEncryptionTestData(t, s, preKeyID)
+			if err == nil {
+				t.Fatalf("reading data with wrong key succeeded")
+			} else if test.expectErr != nil && !errors.Is(err, test.expectErr) {
+				t.Errorf("got error %v, expected %v", err, test.expectErr)
+			}
+		})
+	}
+}
+
+func TestEncryption_AdditionalDataBinding(t *testing.T) {
+	container := newTestContainer(t)
+	container.EncryptionKeys = newTestKeyProvider("key1", "key1")
+	s := newTestDevice(t, container, "1234").Sessions.(*SQLStore)
+	other := newTestDevice(t, container, "5678").Sessions.(*SQLStore)
+	putEncryptionTestData(t, s)
+	const otherAddress = "2222.0:1"
+	if err := s.PutSession(otherAddress, []byte("other session")); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	} else if err = other.PutSession(testSessionAddress, []byte("other device's session")); err != nil {
+		t.Fatalf("failed to put session: %v", err)
+	}
+	var encryptedSession []byte
+	err := container.db.QueryRow(
+		"SELECT session FROM whatsmeow_sessions WHERE our_jid=$1 AND their_id=$2", s.JID, testSessionAddress,
+	).Scan(&encryptedSession)
+	if err != nil {
+		t.Fatalf("failed to get raw session: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		args  []any
+		read  func() error
+	}{{
+		name:  "other address",
+		query: "UPDATE whatsmeow_sessions SET session=$1 WHERE our_jid=$2 AND their_id=$3",
+		args:  []any{encryptedSession, s.JID, otherAddress},
+		read: func() error {
+			_, err := s.GetSession(otherAddress)
+			return err
+		},
+	}, {
+		name:  "other device",
+		query: "UPDATE whatsmeow_sessions SET session=$1 WHERE our_jid=$2 AND their_id=$3",
+		args:  []any{encryptedSession, other.JID, testSessionAddress},
+		read: func() error {
+			_, err := other.GetSession(testSessionAddress)
+			return err
+		},
+	}, {
+		name:  "other table",
+		query: "UPDATE whatsmeow_sender_keys SET sender_key=$1 WHERE our_jid=$2",
+		args:  []any{encryptedSession, s.JID},
+		read: func() error {
+			_, err := s.GetSenderKey(testSenderKeyGroup, testSessionAddress)
+			return err
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := container.db.Exec(test.query, test.args...)
+			if err != nil {
+				t.Fatalf("failed to copy ciphertext: %v", err)
+			}
+			if err = test.read(); err == nil {
+				t.Errorf("reading ciphertext copied from another row succeeded")
+			}
+		})
+	}
+	// The original row is still fine
+	if session, err := s.GetSession(testSessionAddress); err != nil || !bytes.Equal(session, testSessionData) {
+		t.Errorf("original session is %q, %v", session, err)
+	}
+}
+
+func TestEncryption_ReEncryptIsAtomic(t *testing.T) {
+	container := newTestContainer(t)
+	container.EncryptionKeys = newTestKeyProvider("old", "old")
+	s := newTestDevice(t, container, "1234").Sessions.(*SQLStore)
+	preKeyID := putEncryptionTestData(t, s)
+
+	// A sender key encrypted with a key that has since been lost makes ReEncrypt fail after it has already
+	// re-encrypted the identity key and session tables, which come first.
+	container.EncryptionKeys = newTestKeyProvider("lost", "lost")
+	if err := s.PutSenderKey(testSenderKeyGroup, "3333.0:1", []byte("unrecoverable")); err != nil {
+		t.Fatalf("failed to put sender key: %v", err)
+	}
+	container.EncryptionKeys = newTestKeyProvider("new", "old", "new")
+	before := getRawEncryptedValues(t, container)
+	err := container.ReEncrypt()
+	if !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Fatalf("expected re-encryption to fail with unknown key, got %v", err)
+	}
+	after := getRawEncryptedValues(t, container)
+	for table, values := range before {
+		for i, value := range values {
+			if !bytes.Equal(value, after[table][i]) {
+				t.Errorf("row #%d in %s was modified by failed re-encryption", i+1, table)
+			}
+		}
+	}
+	if err = checkEncryptionTestData(t, s, preKeyID); err != nil {
+		t.Fatalf("failed to read data after failed re-encryption: %v", err)
+	}
+}
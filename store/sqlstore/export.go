@@ -0,0 +1,312 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.DeviceDataStore = (*SQLStore)(nil)
+var _ store.ContextDeviceDataStore = (*SQLStore)(nil)
+
+const (
+	exportIdentitiesQuery       = `SELECT their_id, identity FROM whatsmeow_identity_keys WHERE our_jid=$1`
+	exportSessionsQuery         = `SELECT their_id, session FROM whatsmeow_sessions WHERE our_jid=$1`
+	exportPreKeysQuery          = `SELECT key_id, key, uploaded FROM whatsmeow_pre_keys WHERE jid=$1 ORDER BY key_id`
+	exportSenderKeysQuery       = `SELECT chat_id, sender_id, sender_key FROM whatsmeow_sender_keys WHERE our_jid=$1`
+	exportAppStateSyncKeysQuery = `SELECT key_id, key_data, timestamp, fingerprint FROM whatsmeow_app_state_sync_keys WHERE jid=$1`
+	exportAppStateVersionsQuery = `SELECT name, version, hash FROM whatsmeow_app_state_version WHERE jid=$1`
+	exportMutationMACsQuery     = `SELECT name, version, index_mac, value_mac FROM whatsmeow_app_state_mutation_macs WHERE jid=$1`
+	exportPrivacyTokensQuery    = `SELECT their_jid, token, timestamp FROM whatsmeow_privacy_tokens WHERE our_jid=$1`
+
+	importPreKeyQuery = `
+		INSERT INTO whatsmeow_pre_keys (jid, key_id, key, uploaded) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (jid, key_id) DO UPDATE SET key=excluded.key, uploaded=excluded.uploaded
+	`
+	importMutationMACQuery = `
+		INSERT INTO whatsmeow_app_state_mutation_macs (jid, name, version, index_mac, value_mac) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (jid, name, version, index_mac) DO UPDATE SET value_mac=excluded.value_mac
+	`
+	importContactQuery = `
+		INSERT INTO whatsmeow_contacts (our_jid, their_jid, first_name, full_name, push_name, business_name)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (our_jid, their_jid) DO UPDATE
+			SET first_name=excluded.first_name, full_name=excluded.full_name,
+			    push_name=excluded.push_name, business_name=excluded.business_name
+	`
+	importPrivacyTokenQuery = `
+		INSERT INTO whatsmeow_privacy_tokens (our_jid, their_jid, token, timestamp) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (our_jid, their_jid) DO UPDATE SET token=excluded.token, timestamp=excluded.timestamp
+	`
+)
+
+func (s *SQLStore) scanAll(ctx context.Context, query string, fn func(row scannable) error) error {
+	rows, err := s.conn(ctx).QueryContext(ctx, query, s.JID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = fn(rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) ExportDeviceData() (*store.DeviceData, error) {
+	return s.ExportDeviceDataContext(context.Background())
+}
+
+// ExportDeviceDataContext is a variant of ExportDeviceData that uses the transaction in the context if there is one.
+// Otherwise, all the data is read inside a new transaction, so that the export is a consistent snapshot.
+func (s *SQLStore) ExportDeviceDataContext(ctx context.Context) (data *store.DeviceData, err error) {
+	err = s.doTxn(ctx, s.snapshotTxnOptions(), func(ctx context.Context) error {
+		data, err = s.exportDeviceData(ctx)
+		return err
+	})
+	return
+}
+
+func (s *SQLStore) exportDeviceData(ctx context.Context) (*store.DeviceData, error) {
+	data := &store.DeviceData{
+		Identities: make(map[string][]byte),
+		Sessions:   make(map[string][]byte),
+	}
+	err := s.scanAll(ctx, exportIdentitiesQuery, func(row scannable) error {
+		var address string
+		var identity []byte
+		err := row.Scan(&address, &identity)
+		if err != nil {
+			return err
+		}
+		data.Identities[address], err = s.decryptValue(identity, s.identityAD(address))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export identities: %w", err)
+	}
+	err = s.scanAll(ctx, exportSessionsQuery, func(row scannable) error {
+		var address string
+		var session []byte
+		err := row.Scan(&address, &session)
+		if err != nil || session == nil {
+			return err
+		}
+		data.Sessions[address], err = s.decryptValue(session, s.sessionAD(address))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export sessions: %w", err)
+	}
+	err = s.scanAll(ctx, exportPreKeysQuery, func(row scannable) error {
+		var preKey store.ExportedPreKey
+		err := row.Scan(&preKey.KeyID, &preKey.Key, &preKey.Uploaded)
+		if err != nil {
+			return err
+		}
+		preKey.Key, err = s.decryptValue(preKey.Key, s.preKeyAD(preKey.KeyID))
+		data.PreKeys = append(data.PreKeys, preKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export prekeys: %w", err)
+	}
+	err = s.scanAll(ctx, exportSenderKeysQuery, func(row scannable) error {
+		var senderKey store.ExportedSenderKey
+		err := row.Scan(&senderKey.Group, &senderKey.User, &senderKey.Key)
+		if err != nil {
+			return err
+		}
+		senderKey.Key, err = s.decryptValue(senderKey.Key, s.senderKeyAD(senderKey.Group, senderKey.User))
+		data.SenderKeys = append(data.SenderKeys, senderKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export sender keys: %w", err)
+	}
+	err = s.scanAll(ctx, exportAppStateSyncKeysQuery, func(row scannable) error {
+		var key store.ExportedAppStateSyncKey
+		err := row.Scan(&key.ID, &key.Data, &key.Timestamp, &key.Fingerprint)
+		if err != nil {
+			return err
+		}
+		key.Data, err = s.decryptValue(key.Data, s.appStateSyncKeyAD(key.ID))
+		data.AppStateSyncKeys = append(data.AppStateSyncKeys, key)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export app state sync keys: %w", err)
+	}
+	versionIndexes := make(map[string]int)
+	err = s.scanAll(ctx, exportAppStateVersionsQuery, func(row scannable) error {
+		var version store.ExportedAppStateVersion
+		err := row.Scan(&version.Name, &version.Version, &version.Hash)
+		if err != nil {
+			return err
+		}
+		versionIndexes[version.Name] = len(data.AppStateVersions)
+		data.AppStateVersions = append(data.AppStateVersions, version)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export app state versions: %w", err)
+	}
+	err = s.scanAll(ctx, exportMutationMACsQuery, func(row scannable) error {
+		var name string
+		var mac store.ExportedAppStateMutationMAC
+		err := row.Scan(&name, &mac.Version, &mac.IndexMAC, &mac.ValueMAC)
+		if err != nil {
+			return err
+		}
+		// Mutation MACs have a foreign key to the version table, so the index should always exist
+		if index, ok := versionIndexes[name]; ok {
+			data.AppStateVersions[index].MutationMACs = append(data.AppStateVersions[index].MutationMACs, mac)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export app state mutation MACs: %w", err)
+	}
+	err = s.scanAll(ctx, getAllContactsQuery, func(row scannable) error {
+		var contact store.ExportedContact
+		var first, full, push, business sql.NullString
+		err := row.Scan(&contact.JID, &first, &full, &push, &business)
+		if err != nil {
+			return err
+		}
+		contact.FirstName = first.String
+		contact.FullName = full.String
+		contact.PushName = push.String
+		contact.BusinessName = business.String
+		data.Contacts = append(data.Contacts, contact)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export contacts: %w", err)
+	}
+	err = s.scanAll(ctx, exportPrivacyTokensQuery, func(row scannable) error {
+		var token store.PrivacyToken
+		var ts int64
+		err := row.Scan(&token.User, &token.Token, &ts)
+		if err != nil {
+			return err
+		}
+		token.Timestamp = time.Unix(ts, 0)
+		data.PrivacyTokens = append(data.PrivacyTokens, token)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export privacy tokens: %w", err)
+	}
+	return data, nil
+}
+
+func (s *SQLStore) importDeviceData(ctx context.Context, data *store.DeviceData) error {
+	tx := s.conn(ctx)
+	for address, identity := range data.Identities {
+		encrypted, err := s.encryptValue(identity, s.identityAD(address))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, putIdentityQuery, s.JID, address, encrypted)
+		if err != nil {
+			return fmt.Errorf("failed to import identity of %s: %w", address, err)
+		}
+	}
+	for address, session := range data.Sessions {
+		encrypted, err := s.encryptValue(session, s.sessionAD(address))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, putSessionQuery, s.JID, address, encrypted)
+		if err != nil {
+			return fmt.Errorf("failed to import session with %s: %w", address, err)
+		}
+	}
+	for _, preKey := range data.PreKeys {
+		encrypted, err := s.encryptValue(preKey.Key, s.preKeyAD(preKey.KeyID))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, importPreKeyQuery, s.JID, preKey.KeyID, encrypted, preKey.Uploaded)
+		if err != nil {
+			return fmt.Errorf("failed to import prekey %d: %w", preKey.KeyID, err)
+		}
+	}
+	for _, senderKey := range data.SenderKeys {
+		encrypted, err := s.encryptValue(senderKey.Key, s.senderKeyAD(senderKey.Group, senderKey.User))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, putSenderKeyQuery, s.JID, senderKey.Group, senderKey.User, encrypted)
+		if err != nil {
+			return fmt.Errorf("failed to import sender key of %s in %s: %w", senderKey.User, senderKey.Group, err)
+		}
+	}
+	for _, key := range data.AppStateSyncKeys {
+		encrypted, err := s.encryptValue(key.Data, s.appStateSyncKeyAD(key.ID))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.putAppStateSyncKeyQuery(), s.JID, key.ID, encrypted, key.Timestamp, key.Fingerprint)
+		if err != nil {
+			return fmt.Errorf("failed to import app state sync key %X: %w", key.ID, err)
+		}
+	}
+	for _, version := range data.AppStateVersions {
+		_, err := tx.ExecContext(ctx, putAppStateVersionQuery, s.JID, version.Name, version.Version, version.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to import app state version of %s: %w", version.Name, err)
+		}
+		for _, mac := range version.MutationMACs {
+			_, err = tx.ExecContext(ctx, importMutationMACQuery, s.JID, version.Name, mac.Version, mac.IndexMAC, mac.ValueMAC)
+			if err != nil {
+				return fmt.Errorf("failed to import app state mutation MAC in %s: %w", version.Name, err)
+			}
+		}
+	}
+	for _, contact := range data.Contacts {
+		_, err := tx.ExecContext(ctx, importContactQuery, s.JID, contact.JID, contact.FirstName, contact.FullName, contact.PushName, contact.BusinessName)
+		if err != nil {
+			return fmt.Errorf("failed to import contact %s: %w", contact.JID, err)
+		}
+	}
+	for _, token := range data.PrivacyTokens {
+		_, err := tx.ExecContext(ctx, importPrivacyTokenQuery, s.JID, token.User.ToNonAD(), token.Token, token.Timestamp.Unix())
+		if err != nil {
+			return fmt.Errorf("failed to import privacy token of %s: %w", token.User, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) ImportDeviceData(data *store.DeviceData) error {
+	return s.ImportDeviceDataContext(context.Background(), data)
+}
+
+// ImportDeviceDataContext is a variant of ImportDeviceData that uses the transaction in the context if there is one.
+// Otherwise, all the data is inserted inside a new transaction.
+func (s *SQLStore) ImportDeviceDataContext(ctx context.Context, data *store.DeviceData) error {
+	err := s.DoTxn(ctx, func(ctx context.Context) error {
+		return s.importDeviceData(ctx, data)
+	})
+	if err != nil {
+		return err
+	}
+	s.contactCacheLock.Lock()
+	s.contactCache = make(map[types.JID]*types.ContactInfo)
+	s.contactCacheLock.Unlock()
+	return nil
+}
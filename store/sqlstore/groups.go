@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.GroupStore = (*SQLStore)(nil)
+
+const (
+	putGroupQuery = `
+		INSERT INTO whatsmeow_groups (our_jid, group_jid, participant_version_id, info, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (our_jid, group_jid) DO UPDATE
+			SET participant_version_id=excluded.participant_version_id, info=excluded.info, updated_at=excluded.updated_at
+	`
+	getGroupQuery    = `SELECT info FROM whatsmeow_groups WHERE our_jid=$1 AND group_jid=$2`
+	deleteGroupQuery = `DELETE FROM whatsmeow_groups WHERE our_jid=$1 AND group_jid=$2`
+)
+
+func (s *SQLStore) putGroup(tx execable, info *types.GroupInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal group info of %s: %w", info.JID, err)
+	}
+	_, err = tx.Exec(putGroupQuery, s.JID, info.JID, info.ParticipantVersionID, data, time.Now().Unix())
+	return err
+}
+
+func (s *SQLStore) PutGroup(info *types.GroupInfo) error {
+	return s.putGroup(s.db, info)
+}
+
+func (s *SQLStore) PutGroups(infos []*types.GroupInfo) error {
+	if len(infos) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	for _, info := range infos {
+		err = s.putGroup(tx, info)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLStore) GetGroup(jid types.JID) (*types.GroupInfo, error) {
+	var data []byte
+	err := s.db.QueryRow(getGroupQuery, s.JID, jid).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var info types.GroupInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal group info of %s: %w", jid, err)
+	}
+	return &info, nil
+}
+
+func (s *SQLStore) DeleteGroup(jid types.JID) error {
+	_, err := s.db.Exec(deleteGroupQuery, s.JID, jid)
+	return err
+}
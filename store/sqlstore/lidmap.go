@@ -0,0 +1,248 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.LIDStore = (*SQLStore)(nil)
+
+const (
+	deleteConflictingLIDMappingQuery = `DELETE FROM whatsmeow_lid_map WHERE (lid=$1 AND pn<>$2) OR (pn=$2 AND lid<>$1)`
+	putLIDMappingQuery               = `INSERT INTO whatsmeow_lid_map (lid, pn) VALUES ($1, $2) ON CONFLICT (lid) DO NOTHING`
+	getPNForLIDQuery                 = `SELECT pn FROM whatsmeow_lid_map WHERE lid=$1`
+	getLIDForPNQuery                 = `SELECT lid FROM whatsmeow_lid_map WHERE pn=$1`
+	getManyPNsForLIDsQuery           = `SELECT lid, pn FROM whatsmeow_lid_map WHERE lid IN (%s)`
+	getManyLIDsForPNsQuery           = `SELECT lid, pn FROM whatsmeow_lid_map WHERE pn IN (%s)`
+)
+
+const lidMappingBatchSize = 500
+
+// lidMissCacheSize is the maximum number of JIDs whose mappings are remembered as unknown.
+// The whole negative cache is cleared when it's full.
+const lidMissCacheSize = 10000
+
+// cacheLIDMapping must be called with the lidCacheLock held.
+func (c *Container) cacheLIDMapping(lid, pn string) {
+	delete(c.lidMissing, lid)
+	delete(c.lidMissing, pn)
+	if oldPN, ok := c.lidToPN[lid]; ok && oldPN != pn {
+		delete(c.pnToLID, oldPN)
+	}
+	if oldLID, ok := c.pnToLID[pn]; ok && oldLID != lid {
+		delete(c.lidToPN, oldLID)
+	}
+	c.lidToPN[lid] = pn
+	c.pnToLID[pn] = lid
+}
+
+// cacheLIDMiss remembers that there's no mapping for the given LID or phone number, so that lookups for users
+// whose mapping isn't known (which happen for every incoming message and receipt) don't all hit the database.
+//
+// This must be called with the lidCacheLock held.
+func (c *Container) cacheLIDMiss(key string) {
+	if len(c.lidMissing) >= lidMissCacheSize {
+		clear(c.lidMissing)
+	}
+	c.lidMissing[key] = struct{}{}
+}
+
+func (c *Container) isLIDMappingCached(lid, pn string) bool {
+	c.lidCacheLock.RLock()
+	defer c.lidCacheLock.RUnlock()
+	return c.lidToPN[lid] == pn
+}
+
+func validateLIDMapping(lid, pn types.JID) error {
+	if lid.Server != types.HiddenUserServer {
+		return fmt.Errorf("invalid LID %s", lid)
+	} else if pn.Server != types.DefaultUserServer {
+		return fmt.Errorf("invalid phone number JID %s", pn)
+	}
+	return nil
+}
+
+func (s *SQLStore) putLIDMapping(tx execable, lid, pn string) error {
+	_, err := tx.Exec(deleteConflictingLIDMappingQuery, lid, pn)
+	if err != nil {
+		return fmt.Errorf("failed to delete conflicting mappings: %w", err)
+	}
+	_, err = tx.Exec(putLIDMappingQuery, lid, pn)
+	return err
+}
+
+func (s *SQLStore) PutLIDMapping(lid, pn types.JID) error {
+	return s.PutManyLIDMappings([]store.LIDMapping{{LID: lid, PN: pn}})
+}
+
+func (s *SQLStore) PutManyLIDMappings(mappings []store.LIDMapping) error {
+	changed := make([]store.LIDMapping, 0, len(mappings))
+	for _, mapping := range mappings {
+		lid, pn := mapping.LID.ToNonAD(), mapping.PN.ToNonAD()
+		if err := validateLIDMapping(lid, pn); err != nil {
+			return err
+		} else if !s.isLIDMappingCached(lid.String(), pn.String()) {
+			changed = append(changed, store.LIDMapping{LID: lid, PN: pn})
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	s.lidCacheLock.Lock()
+	defer s.lidCacheLock.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	for _, mapping := range changed {
+		err = s.putLIDMapping(tx, mapping.LID.String(), mapping.PN.String())
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to store mapping %s -> %s: %w", mapping.LID, mapping.PN, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	for _, mapping := range changed {
+		s.cacheLIDMapping(mapping.LID.String(), mapping.PN.String())
+	}
+	return nil
+}
+
+func (s *SQLStore) getLIDMapping(query string, key types.JID, byLID bool) (types.JID, error) {
+	keyStr := key.ToNonAD().String()
+	s.lidCacheLock.RLock()
+	cache := s.pnToLID
+	if byLID {
+		cache = s.lidToPN
+	}
+	cached, ok := cache[keyStr]
+	_, missing := s.lidMissing[keyStr]
+	s.lidCacheLock.RUnlock()
+	if ok {
+		return types.ParseJID(cached)
+	} else if missing {
+		return types.EmptyJID, nil
+	}
+	var val string
+	err := s.db.QueryRow(query, keyStr).Scan(&val)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.lidCacheLock.Lock()
+		// The mapping may have been stored while the query was running
+		if _, found := cache[keyStr]; !found {
+			s.cacheLIDMiss(keyStr)
+		}
+		s.lidCacheLock.Unlock()
+		return types.EmptyJID, nil
+	} else if err != nil {
+		return types.EmptyJID, err
+	}
+	s.lidCacheLock.Lock()
+	if byLID {
+		s.cacheLIDMapping(keyStr, val)
+	} else {
+		s.cacheLIDMapping(val, keyStr)
+	}
+	s.lidCacheLock.Unlock()
+	return types.ParseJID(val)
+}
+
+func (s *SQLStore) GetPNForLID(lid types.JID) (types.JID, error) {
+	return s.getLIDMapping(getPNForLIDQuery, lid, true)
+}
+
+func (s *SQLStore) GetLIDForPN(pn types.JID) (types.JID, error) {
+	return s.getLIDMapping(getLIDForPNQuery, pn, false)
+}
+
+func (s *SQLStore) getManyLIDMappings(query string, keys []types.JID, byLID bool) (map[types.JID]types.JID, error) {
+	output := make(map[types.JID]types.JID, len(keys))
+	var missing []string
+	s.lidCacheLock.RLock()
+	cache := s.pnToLID
+	if byLID {
+		cache = s.lidToPN
+	}
+	for _, key := range keys {
+		key = key.ToNonAD()
+		if cached, ok := cache[key.String()]; ok {
+			val, err := types.ParseJID(cached)
+			if err == nil {
+				output[key] = val
+				continue
+			}
+		} else if _, ok = s.lidMissing[key.String()]; ok {
+			continue
+		}
+		missing = append(missing, key.String())
+	}
+	s.lidCacheLock.RUnlock()
+	for i := 0; i < len(missing); i += lidMappingBatchSize {
+		batch := missing[i:min(i+lidMappingBatchSize, len(missing))]
+		placeholders := make([]string, len(batch))
+		args := make([]any, len(batch))
+		for j, key := range batch {
+			placeholders[j] = fmt.Sprintf("$%d", j+1)
+			args[j] = key
+		}
+		err := s.scanManyLIDMappings(fmt.Sprintf(query, strings.Join(placeholders, ",")), args, byLID, output)
+		if err != nil {
+			return output, err
+		}
+	}
+	if len(missing) > 0 {
+		s.lidCacheLock.Lock()
+		for _, key := range missing {
+			if _, found := cache[key]; !found {
+				s.cacheLIDMiss(key)
+			}
+		}
+		s.lidCacheLock.Unlock()
+	}
+	return output, nil
+}
+
+func (s *SQLStore) scanManyLIDMappings(query string, args []any, byLID bool, output map[types.JID]types.JID) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lid, pn types.JID
+		err = rows.Scan(&lid, &pn)
+		if err != nil {
+			return fmt.Errorf("error scanning row: %w", err)
+		}
+		if byLID {
+			output[lid] = pn
+		} else {
+			output[pn] = lid
+		}
+		s.lidCacheLock.Lock()
+		s.cacheLIDMapping(lid.String(), pn.String())
+		s.lidCacheLock.Unlock()
+	}
+	return rows.Err()
+}
+
+func (s *SQLStore) GetManyPNsForLIDs(lids []types.JID) (map[types.JID]types.JID, error) {
+	return s.getManyLIDMappings(getManyPNsForLIDsQuery, lids, true)
+}
+
+func (s *SQLStore) GetManyLIDsForPNs(pns []types.JID) (map[types.JID]types.JID, error) {
+	return s.getManyLIDMappings(getManyLIDsForPNsQuery, pns, false)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func TestLIDStore_CachesMisses(t *testing.T) {
+	container := newTestContainer(t)
+	lids := newTestDevice(t, container, "1234").LIDs
+	lid := types.NewJID("100", types.HiddenUserServer)
+	pn := types.NewJID("200", types.DefaultUserServer)
+
+	found, err := lids.GetPNForLID(lid)
+	if err != nil || !found.IsEmpty() {
+		t.Fatalf("expected no mapping, got %s, %v", found, err)
+	}
+	manyFound, err := lids.GetManyLIDsForPNs([]types.JID{pn})
+	if err != nil || len(manyFound) != 0 {
+		t.Fatalf("expected no mappings, got %v, %v", manyFound, err)
+	}
+
+	// Insert the mapping behind the store's back: the misses are cached, so the lookups must not see it
+	_, err = container.db.Exec(putLIDMappingQuery, lid.String(), pn.String())
+	if err != nil {
+		t.Fatalf("failed to insert mapping: %v", err)
+	}
+	if found, _ = lids.GetPNForLID(lid); !found.IsEmpty() {
+		t.Errorf("lookup after miss went to the database")
+	}
+	if manyFound, _ = lids.GetManyLIDsForPNs([]types.JID{pn}); len(manyFound) != 0 {
+		t.Errorf("batch lookup after miss went to the database")
+	}
+
+	// Storing the mapping through the store invalidates the cached misses
+	err = lids.PutLIDMapping(lid, pn)
+	if err != nil {
+		t.Fatalf("failed to store mapping: %v", err)
+	}
+	if found, err = lids.GetPNForLID(lid); err != nil || found != pn {
+		t.Errorf("got %s, %v after storing mapping, expected %s", found, err, pn)
+	}
+	if manyFound, err = lids.GetManyLIDsForPNs([]types.JID{pn}); err != nil || manyFound[pn] != lid {
+		t.Errorf("got %v, %v after storing mapping, expected %s", manyFound, err, lid)
+	}
+}
+
+func TestLIDStore_MissCacheIsBounded(t *testing.T) {
+	container := newTestContainer(t)
+	lids := newTestDevice(t, container, "1234").LIDs
+	batch := make([]types.JID, lidMissCacheSize+10)
+	for i := range batch {
+		batch[i] = types.NewJID(strconv.Itoa(100000+i), types.HiddenUserServer)
+	}
+	_, err := lids.GetManyPNsForLIDs(batch)
+	if err != nil {
+		t.Fatalf("failed to look up mappings: %v", err)
+	}
+	container.lidCacheLock.RLock()
+	size := len(container.lidMissing)
+	container.lidCacheLock.RUnlock()
+	if size > lidMissCacheSize {
+		t.Errorf("negative cache has %d entries, expected at most %d", size, lidMissCacheSize)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.MessageStore = (*SQLStore)(nil)
+
+const (
+	putMessageQuery = `
+		INSERT INTO whatsmeow_messages (our_jid, chat_jid, message_id, sender_jid, timestamp, from_me, message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (our_jid, chat_jid, message_id) DO NOTHING
+	`
+	getMessageQueryBase = `
+		SELECT chat_jid, message_id, sender_jid, timestamp, from_me, message, edit_timestamp, revoked, deleted_for_me
+		FROM whatsmeow_messages
+	`
+	getMessageQuery      = getMessageQueryBase + `WHERE our_jid=$1 AND chat_jid=$2 AND message_id=$3`
+	getChatMessagesQuery = getMessageQueryBase + `
+		WHERE our_jid=$1 AND chat_jid=$2
+		ORDER BY timestamp DESC, message_id DESC
+		LIMIT $3
+	`
+	getChatMessagesBeforeQuery = getMessageQueryBase + `
+		WHERE our_jid=$1 AND chat_jid=$2 AND (timestamp < $3 OR (timestamp = $3 AND message_id < $4))
+		ORDER BY timestamp DESC, message_id DESC
+		LIMIT $5
+	`
+	updateMessageContentQuery = `
+		UPDATE whatsmeow_messages SET message=$1, edit_timestamp=$2
+		WHERE our_jid=$3 AND chat_jid=$4 AND message_id=$5 AND sender_jid=$6 AND edit_timestamp<=$2
+	`
+	markMessageRevokedQuery = `
+		UPDATE whatsmeow_messages SET revoked=true WHERE our_jid=$1 AND chat_jid=$2 AND message_id=$3 AND sender_jid=$4
+	`
+	markMessageDeletedForMeQuery = `UPDATE whatsmeow_messages SET deleted_for_me=true WHERE our_jid=$1 AND chat_jid=$2 AND message_id=$3`
+)
+
+func (s *SQLStore) putMessage(tx execable, entry *store.MessageEntry) error {
+	var content []byte
+	if entry.Message != nil {
+		var err error
+		content, err = proto.Marshal(entry.Message)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message %s: %w", entry.ID, err)
+		}
+	}
+	_, err := tx.Exec(putMessageQuery,
+		s.JID, entry.Chat.ToNonAD(), entry.ID, entry.Sender.ToNonAD(), entry.Timestamp.Unix(), entry.IsFromMe, content)
+	return err
+}
+
+func (s *SQLStore) PutMessage(entry store.MessageEntry) error {
+	return s.putMessage(s.db, &entry)
+}
+
+func (s *SQLStore) PutMessages(entries []store.MessageEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	for i := range entries {
+		err = s.putMessage(tx, &entries[i])
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func scanMessage(row scannable) (*store.MessageEntry, error) {
+	var entry store.MessageEntry
+	var ts, editTS int64
+	var content []byte
+	err := row.Scan(&entry.Chat, &entry.ID, &entry.Sender, &ts, &entry.IsFromMe, &content, &editTS, &entry.Revoked, &entry.DeletedForMe)
+	if err != nil {
+		return nil, err
+	}
+	entry.Timestamp = time.Unix(ts, 0)
+	if editTS != 0 {
+		entry.EditTimestamp = time.Unix(editTS, 0)
+	}
+	if content != nil {
+		entry.Message = &waE2E.Message{}
+		err = proto.Unmarshal(content, entry.Message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message %s: %w", entry.ID, err)
+		}
+	}
+	return &entry, nil
+}
+
+func (s *SQLStore) GetMessage(chat types.JID, id types.MessageID) (*store.MessageEntry, error) {
+	entry, err := scanMessage(s.db.QueryRow(getMessageQuery, s.JID, chat.ToNonAD(), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return entry, err
+}
+
+func (s *SQLStore) GetChatMessages(chat types.JID, before *store.MessageCursor, limit int) ([]*store.MessageEntry, error) {
+	var rows *sql.Rows
+	var err error
+	if before != nil {
+		rows, err = s.db.Query(getChatMessagesBeforeQuery, s.JID, chat.ToNonAD(), before.Timestamp.Unix(), before.ID, limit)
+	} else {
+		rows, err = s.db.Query(getChatMessagesQuery, s.JID, chat.ToNonAD(), limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*store.MessageEntry, 0, limit)
+	for rows.Next() {
+		entry, err := scanMessage(rows)
+		if err != nil {
+			return entries, fmt.Errorf("error scanning row: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLStore) UpdateMessageContent(chat, sender types.JID, id types.MessageID, message *waE2E.Message, editTimestamp time.Time) error {
+	content, err := proto.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message %s: %w", id, err)
+	}
+	_, err = s.db.Exec(updateMessageContentQuery, content, editTimestamp.Unix(), s.JID, chat.ToNonAD(), id, sender.ToNonAD())
+	return err
+}
+
+func (s *SQLStore) MarkMessageRevoked(chat, sender types.JID, id types.MessageID) error {
+	_, err := s.db.Exec(markMessageRevokedQuery, s.JID, chat.ToNonAD(), id, sender.ToNonAD())
+	return err
+}
+
+func (s *SQLStore) MarkMessageDeletedForMe(chat types.JID, id types.MessageID) error {
+	_, err := s.db.Exec(markMessageDeletedForMeQuery, s.JID, chat.ToNonAD(), id)
+	return err
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var (
+	testGroup  = types.NewJID("123456789", types.GroupServer)
+	testAlice  = types.NewJID("1111", types.DefaultUserServer)
+	testBob    = types.NewJID("2222", types.DefaultUserServer)
+	testCarol  = types.NewJID("3333", types.DefaultUserServer)
+	testBaseTS = time.Unix(1700000000, 0)
+)
+
+func textMessage(text string) *waE2E.Message {
+	return &waE2E.Message{Conversation: proto.String(text)}
+}
+
+func getTestMessage(t *testing.T, messages store.MessageStore, chat types.JID, id types.MessageID) *store.MessageEntry {
+	t.Helper()
+	entry, err := messages.GetMessage(chat, id)
+	if err != nil {
+		t.Fatalf("failed to get message %s: %v", id, err)
+	} else if entry == nil {
+		t.Fatalf("message %s not found", id)
+	}
+	return entry
+}
+
+func TestMessageStore_PutAndGet(t *testing.T) {
+	messages := newTestDevice(t, newTestContainer(t), "1234").Messages
+	err := messages.PutMessage(store.MessageEntry{
+		Chat:      testGroup,
+		Sender:    types.JID{User: "1111", Device: 5, Server: types.DefaultUserServer},
+		ID:        "MSG1",
+		Timestamp: testBaseTS,
+		Message:   textMessage("hello"),
+	})
+	if err != nil {
+		t.Fatalf("failed to put message: %v", err)
+	}
+	// Storing the same message again is a no-op
+	err = messages.PutMessage(store.MessageEntry{Chat: testGroup, Sender: testAlice, ID: "MSG1", Timestamp: testBaseTS, Message: textMessage("changed")})
+	if err != nil {
+		t.Fatalf("failed to put duplicate message: %v", err)
+	}
+
+	entry := getTestMessage(t, messages, testGroup, "MSG1")
+	if entry.Sender != testAlice {
+		t.Errorf("sender is %s, expected device part to be removed", entry.Sender)
+	}
+	if !entry.Timestamp.Equal(testBaseTS) || entry.IsFromMe || entry.Revoked || entry.DeletedForMe || !entry.EditTimestamp.IsZero() {
+		t.Errorf("unexpected message metadata: %+v", entry)
+	}
+	if entry.Message.GetConversation() != "hello" {
+		t.Errorf("unexpected message content %q", entry.Message.GetConversation())
+	}
+
+	entry, err = messages.GetMessage(testGroup, "MSG2")
+	if err != nil || entry != nil {
+		t.Errorf("expected nil for missing message, got %+v, %v", entry, err)
+	}
+}
+
+func TestMessageStore_GetChatMessages(t *testing.T) {
+	messages := newTestDevice(t, newTestContainer(t), "1234").Messages
+	var entries []store.MessageEntry
+	for i := 0; i < 5; i++ {
+		entries = append(entries, store.MessageEntry{
+			Chat:      testGroup,
+			Sender:    testAlice,
+			ID:        types.MessageID(fmt.Sprintf("MSG%d", i)),
+			Timestamp: testBaseTS.Add(time.Duration(i/2) * time.Second),
+			Message:   textMessage(fmt.Sprint(i)),
+		})
+	}
+	entries = append(entries, store.MessageEntry{Chat: testAlice, Sender: testAlice, ID: "OTHERCHAT", Timestamp: testBaseTS.Add(time.Hour)})
+	err := messages.PutMessages(entries)
+	if err != nil {
+		t.Fatalf("failed to put messages: %v", err)
+	}
+
+	var ids []types.MessageID
+	var cursor *store.MessageCursor
+	for {
+		page, err := messages.GetChatMessages(testGroup, cursor, 2)
+		if err != nil {
+			t.Fatalf("failed to get chat messages: %v", err)
+		} else if len(page) == 0 {
+			break
+		}
+		for _, entry := range page {
+			ids = append(ids, entry.ID)
+		}
+		cursor = page[len(page)-1].Cursor()
+	}
+	// Newest first, with the message ID as a tiebreaker for messages with the same timestamp
+	expected := []types.MessageID{"MSG4", "MSG3", "MSG2", "MSG1", "MSG0"}
+	if fmt.Sprint(ids) != fmt.Sprint(expected) {
+		t.Errorf("got messages %v, expected %v", ids, expected)
+	}
+}
+
+func TestMessageStore_UpdateMessageContent(t *testing.T) {
+	messages := newTestDevice(t, newTestContainer(t), "1234").Messages
+	err := messages.PutMessage(store.MessageEntry{Chat: testGroup, Sender: testAlice, ID: "MSG1", Timestamp: testBaseTS, Message: textMessage("original")})
+	if err != nil {
+		t.Fatalf("failed to put message: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		sender   types.JID
+		text     string
+		ts       time.Time
+		expected string
+	}{
+		{"edit from other user is ignored", testBob, "bob", testBaseTS.Add(time.Minute), "original"},
+		{"edit from sender is applied", testAlice, "edit 2", testBaseTS.Add(2 * time.Minute), "edit 2"},
+		{"older edit is ignored", testAlice, "edit 1", testBaseTS.Add(time.Minute), "edit 2"},
+		{"edit with same timestamp is applied", testAlice, "edit 2b", testBaseTS.Add(2 * time.Minute), "edit 2b"},
+		{"edit from sender's other device is applied", types.JID{User: "1111", Device: 2, Server: types.DefaultUserServer}, "edit 3", testBaseTS.Add(3 * time.Minute), "edit 3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := messages.UpdateMessageContent(testGroup, test.sender, "MSG1", textMessage(test.text), test.ts)
+			if err != nil {
+				t.Fatalf("failed to update message: %v", err)
+			}
+			entry := getTestMessage(t, messages, testGroup, "MSG1")
+			if entry.Message.GetConversation() != test.expected {
+				t.Errorf("message content is %q, expected %q", entry.Message.GetConversation(), test.expected)
+			}
+		})
+	}
+	entry := getTestMessage(t, messages, testGroup, "MSG1")
+	if !entry.EditTimestamp.Equal(testBaseTS.Add(3 * time.Minute)) {
+		t.Errorf("edit timestamp is %s", entry.EditTimestamp)
+	}
+}
+
+func TestMessageStore_MarkMessageRevoked(t *testing.T) {
+	messages := newTestDevice(t, newTestContainer(t), "1234").Messages
+	err := messages.PutMessages([]store.MessageEntry{
+		{Chat: testGroup, Sender: testAlice, ID: "MSG1", Timestamp: testBaseTS, Message: textMessage("alice")},
+		{Chat: testGroup, Sender: testBob, ID: "MSG2", Timestamp: testBaseTS, Message: textMessage("bob")},
+	})
+	if err != nil {
+		t.Fatalf("failed to put messages: %v", err)
+	}
+
+	// A revoke naming the wrong sender must not touch the message
+	err = messages.MarkMessageRevoked(testGroup, testCarol, "MSG1")
+	if err != nil {
+		t.Fatalf("failed to mark message as revoked: %v", err)
+	}
+	if getTestMessage(t, messages, testGroup, "MSG1").Revoked {
+		t.Errorf("message was revoked with wrong sender")
+	}
+
+	err = messages.MarkMessageRevoked(testGroup, testAlice, "MSG1")
+	if err != nil {
+		t.Fatalf("failed to mark message as revoked: %v", err)
+	}
+	entry := getTestMessage(t, messages, testGroup, "MSG1")
+	if !entry.Revoked {
+		t.Errorf("message wasn't revoked")
+	} else if entry.Message.GetConversation() != "alice" {
+		t.Errorf("original content of revoked message wasn't kept")
+	}
+	if getTestMessage(t, messages, testGroup, "MSG2").Revoked {
+		t.Errorf("revoke affected other message")
+	}
+
+	err = messages.MarkMessageDeletedForMe(testGroup, "MSG2")
+	if err != nil {
+		t.Fatalf("failed to mark message as deleted for me: %v", err)
+	}
+	if entry = getTestMessage(t, messages, testGroup, "MSG2"); !entry.DeletedForMe || entry.Revoked {
+		t.Errorf("unexpected flags after delete for me: %+v", entry)
+	}
+}
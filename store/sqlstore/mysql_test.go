@@ -0,0 +1,111 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build mysqltest
+
+// The MySQL tests run against an embedded go-mysql-server instance. They're behind a build tag so that the
+// main module doesn't depend on go-mysql-server. To run them, add the dependencies and enable the tag:
+//
+//	go get github.com/dolthub/go-mysql-server github.com/go-sql-driver/mysql
+//	go test -tags mysqltest ./store/sqlstore
+
+package sqlstore
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"testing"
+
+	sqle "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	gmssql "github.com/dolthub/go-mysql-server/sql"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// newTestMySQLContainer starts an embedded MySQL-compatible server with an empty database and returns a
+// container connected to it without upgrading it. The test is skipped if the server can't be started.
+func newTestMySQLContainer(t *testing.T) *Container {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen for embedded MySQL server: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	provider := memory.NewDBProvider(memory.NewDatabase("whatsmeow"))
+	engine := sqle.NewDefault(provider)
+	srv, err := server.NewServer(server.Config{Protocol: "tcp", Address: addr}, engine, gmssql.NewContext, memory.NewSessionBuilder(provider), nil)
+	if err != nil {
+		t.Skipf("embedded MySQL server unavailable: %v", err)
+	}
+	go func() {
+		_ = srv.Start()
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	db, err := sql.Open("mysql", fmt.Sprintf("root@tcp(%s)/whatsmeow", addr))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	} else if err = db.Ping(); err != nil {
+		t.Skipf("embedded MySQL server unavailable: %v", err)
+	}
+	container := NewWithDB(db, "mysql", nil)
+	t.Cleanup(func() {
+		_ = container.Close()
+	})
+	return container
+}
+
+func TestStoreRoundTrip_MySQL(t *testing.T) {
+	container := newTestMySQLContainer(t)
+	if err := container.Upgrade(); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	checkSchemaVersion(t, container)
+	testStoreRoundTrip(t, container)
+}
+
+func TestUpgrade_MySQL(t *testing.T) {
+	container := newTestMySQLContainer(t)
+
+	// The base schema is created at v11 and then the later upgrades run normally
+	if err := container.upgradeMySQLBase(); err != nil {
+		t.Fatalf("failed to create base schema: %v", err)
+	}
+	// Creating the base schema again is harmless, since a partially failed attempt must be retryable
+	if err := container.upgradeMySQLBase(); err != nil {
+		t.Fatalf("failed to create base schema again: %v", err)
+	}
+	if version, err := container.getVersion(); err != nil || version != mysqlBaseVersion {
+		t.Fatalf("base schema version is v%d, %v", version, err)
+	}
+	if err := container.Upgrade(); err != nil {
+		t.Fatalf("failed to upgrade base schema: %v", err)
+	}
+	checkSchemaVersion(t, container)
+	for _, table := range []string{"whatsmeow_chat_metadata", "whatsmeow_message_metadata", "whatsmeow_labels", "whatsmeow_event_outbox"} {
+		var count int
+		if err := container.db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+			t.Errorf("table %s wasn't created: %v", table, err)
+		}
+	}
+	// Upgrading an up-to-date database does nothing
+	if err := container.Upgrade(); err != nil {
+		t.Fatalf("failed to upgrade up-to-date database: %v", err)
+	}
+
+	// Databases from before the MySQL base schema can't be upgraded
+	if _, err := container.db.Exec("UPDATE whatsmeow_version SET version=5"); err != nil {
+		t.Fatalf("failed to set version: %v", err)
+	} else if err = container.Upgrade(); err == nil {
+		t.Errorf("upgrading MySQL database from v5 succeeded")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var _ store.OutboxStore = (*SQLStore)(nil)
+
+const (
+	putOutboxEventQuery = `
+		INSERT INTO whatsmeow_event_outbox (our_jid, chat_jid, message_id, sender_jid, data, attempts, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (our_jid, chat_jid, message_id) DO UPDATE SET data=excluded.data
+	`
+	getOutboxEventsQuery = `
+		SELECT chat_jid, message_id, sender_jid, data, attempts, created_at FROM whatsmeow_event_outbox
+		WHERE our_jid=$1
+		ORDER BY created_at, message_id
+		LIMIT $2
+	`
+	incrementOutboxAttemptsQuery = `UPDATE whatsmeow_event_outbox SET attempts=attempts+1 WHERE our_jid=$1 AND chat_jid=$2 AND message_id=$3`
+	deleteOutboxEventQuery       = `DELETE FROM whatsmeow_event_outbox WHERE our_jid=$1 AND chat_jid=$2 AND message_id=$3`
+)
+
+func (s *SQLStore) PutOutboxEvent(evt store.OutboxEvent) error {
+	if evt.CreatedAt.IsZero() {
+		evt.CreatedAt = time.Now()
+	}
+	_, err := s.db.Exec(putOutboxEventQuery, s.JID, evt.Chat.ToNonAD(), evt.ID, evt.Sender, evt.Data, evt.Attempts, evt.CreatedAt.UnixMilli())
+	return err
+}
+
+func (s *SQLStore) GetOutboxEvents(limit int) ([]*store.OutboxEvent, error) {
+	rows, err := s.db.Query(getOutboxEventsQuery, s.JID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var output []*store.OutboxEvent
+	for rows.Next() {
+		var evt store.OutboxEvent
+		var createdAt int64
+		err = rows.Scan(&evt.Chat, &evt.ID, &evt.Sender, &evt.Data, &evt.Attempts, &createdAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		evt.CreatedAt = time.UnixMilli(createdAt)
+		output = append(output, &evt)
+	}
+	return output, rows.Err()
+}
+
+func (s *SQLStore) IncrementOutboxAttempts(chat types.JID, id types.MessageID) error {
+	_, err := s.db.Exec(incrementOutboxAttemptsQuery, s.JID, chat.ToNonAD(), id)
+	return err
+}
+
+func (s *SQLStore) DeleteOutboxEvent(chat types.JID, id types.MessageID) error {
+	_, err := s.db.Exec(deleteOutboxEventQuery, s.JID, chat.ToNonAD(), id)
+	return err
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+// checkSchemaVersion checks that the container's database was upgraded to the latest version.
+func checkSchemaVersion(t *testing.T, c *Container) {
+	t.Helper()
+	version, err := c.getVersion()
+	if err != nil {
+		t.Fatalf("failed to get schema version: %v", err)
+	} else if version != len(Upgrades) {
+		t.Fatalf("schema version is v%d, expected v%d", version, len(Upgrades))
+	}
+}
+
+// testStoreRoundTrip writes data into every table of the schema and reads it back. Most values are written
+// twice to exercise the upsert queries, which are rewritten to ON DUPLICATE KEY UPDATE in MySQL.
+func testStoreRoundTrip(t *testing.T, c *Container) {
+	device := newTestDevice(t, c, "1234")
+	s := device.Sessions.(*SQLStore)
+	ts := time.Unix(1700000000, 0)
+	chat := types.NewJID("5678", types.DefaultUserServer)
+	sender := types.NewJID("5678", types.DefaultUserServer)
+
+	t.Run("device", func(t *testing.T) {
+		device.PushName = "Updated"
+		if err := device.Save(); err != nil {
+			t.Fatalf("failed to save device again: %v", err)
+		}
+		loaded, err := c.GetDevice(*device.ID)
+		if err != nil || loaded == nil {
+			t.Fatalf("failed to get device: %v", err)
+		} else if loaded.PushName != "Updated" || *loaded.IdentityKey.Priv != *device.IdentityKey.Priv {
+			t.Errorf("loaded device doesn't match saved device")
+		}
+	})
+
+	t.Run("signal", func(t *testing.T) {
+		for _, value := range []byte{1, 2} {
+			if err := s.PutIdentity(testSessionAddress, [32]byte{value}); err != nil {
+				t.Fatalf("failed to put identity: %v", err)
+			} else if err = s.PutSession(testSessionAddress, []byte{value}); err != nil {
+				t.Fatalf("failed to put session: %v", err)
+			} else if err = s.PutSenderKey(testSenderKeyGroup, testSessionAddress, []byte{value}); err != nil {
+				t.Fatalf("failed to put sender key: %v", err)
+			}
+		}
+		if trusted, err := s.IsTrustedIdentity(testSessionAddress, [32]byte{2}); err != nil || !trusted {
+			t.Errorf("identity wasn't updated: %t, %v", trusted, err)
+		}
+		if session, err := s.GetSession(testSessionAddress); err != nil || !bytes.Equal(session, []byte{2}) {
+			t.Errorf("session is %v, %v", session, err)
+		}
+		if senderKey, err := s.GetSenderKey(testSenderKeyGroup, testSessionAddress); err != nil || !bytes.Equal(senderKey, []byte{2}) {
+			t.Errorf("sender key is %v, %v", senderKey, err)
+		}
+		preKeys, err := s.GetOrGenPreKeys(3)
+		if err != nil || len(preKeys) != 3 {
+			t.Fatalf("failed to generate prekeys: %d, %v", len(preKeys), err)
+		}
+		if err = s.MarkPreKeysAsUploaded(preKeys[2].KeyID); err != nil {
+			t.Fatalf("failed to mark prekeys as uploaded: %v", err)
+		} else if count, err := s.UploadedPreKeyCount(); err != nil || count != 3 {
+			t.Errorf("uploaded prekey count is %d, %v", count, err)
+		}
+		if err = s.RemovePreKey(preKeys[0].KeyID); err != nil {
+			t.Fatalf("failed to remove prekey: %v", err)
+		} else if key, err := s.GetPreKey(preKeys[0].KeyID); err != nil || key != nil {
+			t.Errorf("removed prekey is %v, %v", key, err)
+		} else if key, err = s.GetPreKey(preKeys[1].KeyID); err != nil || key == nil || *key.Priv != *preKeys[1].Priv {
+			t.Errorf("prekey is %v, %v", key, err)
+		}
+	})
+
+	t.Run("app state", func(t *testing.T) {
+		for _, timestamp := range []int64{1, 2} {
+			err := s.PutAppStateSyncKey(testSyncKeyID, store.AppStateSyncKey{Data: []byte("data"), Fingerprint: []byte("fp"), Timestamp: timestamp})
+			if err != nil {
+				t.Fatalf("failed to put app state sync key: %v", err)
+			}
+		}
+		if key, err := s.GetAppStateSyncKey(testSyncKeyID); err != nil || key == nil || key.Timestamp != 2 {
+			t.Errorf("app state sync key is %+v, %v", key, err)
+		}
+		for _, version := range []uint64{1, 2} {
+			if err := s.PutAppStateVersion("regular", version, [128]byte{byte(version)}); err != nil {
+				t.Fatalf("failed to put app state version: %v", err)
+			}
+		}
+		if version, hash, err := s.GetAppStateVersion("regular"); err != nil || version != 2 || hash[0] != 2 {
+			t.Errorf("app state version is %d (%d), %v", version, hash[0], err)
+		}
+		indexMAC := bytes.Repeat([]byte{1}, 32)
+		err := s.PutAppStateMutationMACs("regular", 2, []store.AppStateMutationMAC{{IndexMAC: indexMAC, ValueMAC: bytes.Repeat([]byte{2}, 32)}})
+		if err != nil {
+			t.Fatalf("failed to put mutation MACs: %v", err)
+		} else if valueMAC, err := s.GetAppStateMutationMAC("regular", indexMAC); err != nil || len(valueMAC) != 32 {
+			t.Errorf("value MAC is %v, %v", valueMAC, err)
+		}
+	})
+
+	t.Run("contacts", func(t *testing.T) {
+		if changed, _, err := s.PutPushName(sender, "Push"); err != nil || !changed {
+			t.Fatalf("failed to put push name: %t, %v", changed, err)
+		} else if err = s.PutContactName(sender, "First", "Full"); err != nil {
+			t.Fatalf("failed to put contact name: %v", err)
+		} else if err = s.PutAllContactNames([]store.ContactEntry{{JID: sender, FirstName: "First2", FullName: "Full2"}}); err != nil {
+			t.Fatalf("failed to put all contact names: %v", err)
+		}
+		if contact, err := s.GetContact(sender); err != nil || contact.PushName != "Push" || contact.FullName != "Full2" {
+			t.Errorf("contact is %+v, %v", contact, err)
+		}
+	})
+
+	t.Run("chat settings and metadata", func(t *testing.T) {
+		if err := s.PutPinned(chat, true); err != nil {
+			t.Fatalf("failed to put pinned: %v", err)
+		} else if err = s.PutArchived(chat, true); err != nil {
+			t.Fatalf("failed to put archived: %v", err)
+		} else if settings, err := s.GetChatSettings(chat); err != nil || !settings.Pinned || !settings.Archived {
+			t.Errorf("chat settings are %+v, %v", settings, err)
+		}
+		if err := s.PutMarkedAsUnread(chat, true); err != nil {
+			t.Fatalf("failed to put marked as unread: %v", err)
+		} else if err = s.PutChatCleared(chat, ts); err != nil {
+			t.Fatalf("failed to put chat cleared: %v", err)
+		} else if meta, err := s.GetChatMetadata(chat); err != nil || !meta.MarkedAsUnread || !meta.ClearedAt.Equal(ts) {
+			t.Errorf("chat metadata is %+v, %v", meta, err)
+		}
+		if err := s.PutMessageStarred(chat, sender, "msg1", false, true, ts); err != nil {
+			t.Fatalf("failed to put starred: %v", err)
+		} else if err = s.PutMessageDeletedForMe(chat, sender, "msg1", false, ts.Add(time.Second)); err != nil {
+			t.Fatalf("failed to put deleted for me: %v", err)
+		} else if meta, err := s.GetMessageMetadata(chat, sender, "msg1"); err != nil || meta == nil || !meta.Starred || !meta.DeletedForMe {
+			t.Errorf("message metadata is %+v, %v", meta, err)
+		}
+		for _, name := range []string{"Label", "Renamed"} {
+			if err := s.PutLabel(store.Label{ID: "1", Name: name, Color: 2}); err != nil {
+				t.Fatalf("failed to put label: %v", err)
+			}
+		}
+		if labels, err := s.GetLabels(); err != nil || len(labels) != 1 || labels[0].Name != "Renamed" {
+			t.Errorf("labels are %+v, %v", labels, err)
+		}
+		if err := s.PutChatLabel(chat, "1", true); err != nil {
+			t.Fatalf("failed to put chat label: %v", err)
+		} else if err = s.PutChatLabel(chat, "1", true); err != nil {
+			t.Fatalf("failed to put chat label again: %v", err)
+		} else if chats, err := s.GetChatsByLabel("1"); err != nil || len(chats) != 1 || chats[0] != chat {
+			t.Errorf("labeled chats are %v, %v", chats, err)
+		}
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		for _, secret := range []byte{1, 2} {
+			if err := s.PutMessageSecret(chat, sender, "msg1", []byte{secret}); err != nil {
+				t.Fatalf("failed to put message secret: %v", err)
+			}
+		}
+		// Message secrets are never overwritten
+		if secret, err := s.GetMessageSecret(chat, sender, "msg1"); err != nil || !bytes.Equal(secret, []byte{1}) {
+			t.Errorf("message secret is %v, %v", secret, err)
+		}
+		for _, token := range []string{"token1", "token2"} {
+			if err := s.PutPrivacyTokens(store.PrivacyToken{User: sender, Token: []byte(token), Timestamp: ts}); err != nil {
+				t.Fatalf("failed to put privacy token: %v", err)
+			}
+		}
+		if token, err := s.GetPrivacyToken(sender); err != nil || token == nil || string(token.Token) != "token2" {
+			t.Errorf("privacy token is %+v, %v", token, err)
+		}
+		entry := store.MessageEntry{Chat: chat, Sender: sender, ID: "msg1", Timestamp: ts}
+		if err := s.PutMessages([]store.MessageEntry{entry, entry}); err != nil {
+			t.Fatalf("failed to put messages: %v", err)
+		} else if msg, err := s.GetMessage(chat, "msg1"); err != nil || msg == nil || msg.Sender != sender {
+			t.Errorf("message is %+v, %v", msg, err)
+		}
+	})
+
+	t.Run("lids, groups and devices", func(t *testing.T) {
+		lid := types.NewJID("100", types.HiddenUserServer)
+		if err := s.PutManyLIDMappings([]store.LIDMapping{{LID: lid, PN: sender}, {LID: lid, PN: sender}}); err != nil {
+			t.Fatalf("failed to put LID mappings: %v", err)
+		} else if pn, err := s.GetPNForLID(lid); err != nil || pn != sender {
+			t.Errorf("PN for LID is %v, %v", pn, err)
+		}
+		group := types.NewJID("123456789", types.GroupServer)
+		for _, name := range []string{"Group", "Renamed"} {
+			info := &types.GroupInfo{JID: group, GroupName: types.GroupName{Name: name}, Participants: []types.GroupParticipant{{JID: sender}}}
+			if err := s.PutGroup(info); err != nil {
+				t.Fatalf("failed to put group: %v", err)
+			}
+		}
+		if info, err := s.GetGroup(group); err != nil || info == nil || info.Name != "Renamed" || len(info.Participants) != 1 {
+			t.Errorf("group is %+v, %v", info, err)
+		}
+		for _, dhash := range []string{"hash1", "hash2"} {
+			err := s.PutDeviceList(store.CachedDeviceList{User: sender, Devices: []types.JID{sender}, DHash: dhash, UpdatedAt: ts})
+			if err != nil {
+				t.Fatalf("failed to put device list: %v", err)
+			}
+		}
+		if lists, err := s.GetDeviceLists([]types.JID{sender}); err != nil || lists[sender] == nil || lists[sender].DHash != "hash2" {
+			t.Errorf("device lists are %+v, %v", lists, err)
+		}
+	})
+
+	t.Run("outbox", func(t *testing.T) {
+		evt := store.OutboxEvent{Chat: chat, Sender: sender, ID: "msg1", Data: []byte("event"), CreatedAt: ts}
+		if err := s.PutOutboxEvent(evt); err != nil {
+			t.Fatalf("failed to put outbox event: %v", err)
+		} else if err = s.IncrementOutboxAttempts(chat, "msg1"); err != nil {
+			t.Fatalf("failed to increment attempts: %v", err)
+		}
+		events, err := s.GetOutboxEvents(10)
+		if err != nil || len(events) != 1 || events[0].Attempts != 1 || !bytes.Equal(events[0].Data, evt.Data) {
+			t.Fatalf("outbox events are %+v, %v", events, err)
+		}
+		if err = s.DeleteOutboxEvent(chat, "msg1"); err != nil {
+			t.Fatalf("failed to delete outbox event: %v", err)
+		} else if events, err = s.GetOutboxEvents(10); err != nil || len(events) != 0 {
+			t.Errorf("outbox events after delete are %+v, %v", events, err)
+		}
+	})
+
+	t.Run("delete device", func(t *testing.T) {
+		jid := *device.ID
+		if err := device.Delete(); err != nil {
+			t.Fatalf("failed to delete device: %v", err)
+		} else if loaded, err := c.GetDevice(jid); err != nil || loaded != nil {
+			t.Errorf("deleted device is %v, %v", loaded, err)
+		}
+	})
+}
+
+func TestStoreRoundTrip_SQLite(t *testing.T) {
+	container := newTestContainer(t)
+	checkSchemaVersion(t, container)
+	testStoreRoundTrip(t, container)
+}
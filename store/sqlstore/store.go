@@ -8,10 +8,12 @@
 package sqlstore
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,7 +24,7 @@ import (
 )
 
 // ErrInvalidLength is returned by some database getters if the database returned a byte array with an unexpected length.
-// This should be impossible, as the database schema contains CHECK()s for all the relevant columns.
+// This should be impossible, as the database schema contains CHECK()s for all the relevant unencrypted columns.
 var ErrInvalidLength = errors.New("database returned byte array with illegal length")
 
 // PostgresArrayWrapper is a function to wrap array values before passing them to the sql package.
@@ -64,6 +66,10 @@ var _ store.SenderKeyStore = (*SQLStore)(nil)
 var _ store.AppStateSyncKeyStore = (*SQLStore)(nil)
 var _ store.AppStateStore = (*SQLStore)(nil)
 var _ store.ContactStore = (*SQLStore)(nil)
+var _ store.ContextIdentityStore = (*SQLStore)(nil)
+var _ store.ContextSessionStore = (*SQLStore)(nil)
+var _ store.ContextPreKeyStore = (*SQLStore)(nil)
+var _ store.ContextSenderKeyStore = (*SQLStore)(nil)
 
 const (
 	putIdentityQuery = `
@@ -75,29 +81,57 @@ const (
 	getIdentityQuery         = `SELECT identity FROM whatsmeow_identity_keys WHERE our_jid=$1 AND their_id=$2`
 )
 
+func (s *SQLStore) identityAD(address string) []byte {
+	return encryptionAD("whatsmeow_identity_keys", s.JID, address)
+}
+
 func (s *SQLStore) PutIdentity(address string, key [32]byte) error {
-	_, err := s.db.Exec(putIdentityQuery, s.JID, address, key[:])
+	return s.PutIdentityContext(context.Background(), address, key)
+}
+
+func (s *SQLStore) PutIdentityContext(ctx context.Context, address string, key [32]byte) error {
+	encryptedKey, err := s.encryptValue(key[:], s.identityAD(address))
+	if err != nil {
+		return err
+	}
+	_, err = s.conn(ctx).ExecContext(ctx, putIdentityQuery, s.JID, address, encryptedKey)
 	return err
 }
 
 func (s *SQLStore) DeleteAllIdentities(phone string) error {
-	_, err := s.db.Exec(deleteAllIdentitiesQuery, s.JID, phone+":%")
+	return s.DeleteAllIdentitiesContext(context.Background(), phone)
+}
+
+func (s *SQLStore) DeleteAllIdentitiesContext(ctx context.Context, phone string) error {
+	_, err := s.conn(ctx).ExecContext(ctx, deleteAllIdentitiesQuery, s.JID, phone+":%")
 	return err
 }
 
 func (s *SQLStore) DeleteIdentity(address string) error {
-	_, err := s.db.Exec(deleteAllIdentitiesQuery, s.JID, address)
+	return s.DeleteIdentityContext(context.Background(), address)
+}
+
+func (s *SQLStore) DeleteIdentityContext(ctx context.Context, address string) error {
+	_, err := s.conn(ctx).ExecContext(ctx, deleteIdentityQuery, s.JID, address)
 	return err
 }
 
 func (s *SQLStore) IsTrustedIdentity(address string, key [32]byte) (bool, error) {
+	return s.IsTrustedIdentityContext(context.Background(), address, key)
+}
+
+func (s *SQLStore) IsTrustedIdentityContext(ctx context.Context, address string, key [32]byte) (bool, error) {
 	var existingIdentity []byte
-	err := s.db.QueryRow(getIdentityQuery, s.JID, address).Scan(&existingIdentity)
+	err := s.conn(ctx).QueryRowContext(ctx, getIdentityQuery, s.JID, address).Scan(&existingIdentity)
 	if errors.Is(err, sql.ErrNoRows) {
 		// Trust if not known, it'll be saved automatically later
 		return true, nil
 	} else if err != nil {
 		return false, err
+	}
+	existingIdentity, err = s.decryptValue(existingIdentity, s.identityAD(address))
+	if err != nil {
+		return false, err
 	} else if len(existingIdentity) != 32 {
 		return false, ErrInvalidLength
 	}
@@ -115,16 +149,30 @@ const (
 	deleteSessionQuery     = `DELETE FROM whatsmeow_sessions WHERE our_jid=$1 AND their_id=$2`
 )
 
-func (s *SQLStore) GetSession(address string) (session []byte, err error) {
-	err = s.db.QueryRow(getSessionQuery, s.JID, address).Scan(&session)
+func (s *SQLStore) sessionAD(address string) []byte {
+	return encryptionAD("whatsmeow_sessions", s.JID, address)
+}
+
+func (s *SQLStore) GetSession(address string) ([]byte, error) {
+	return s.GetSessionContext(context.Background(), address)
+}
+
+func (s *SQLStore) GetSessionContext(ctx context.Context, address string) (session []byte, err error) {
+	err = s.conn(ctx).QueryRowContext(ctx, getSessionQuery, s.JID, address).Scan(&session)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
+	} else if err == nil {
+		session, err = s.decryptValue(session, s.sessionAD(address))
 	}
 	return
 }
 
-func (s *SQLStore) HasSession(address string) (has bool, err error) {
-	err = s.db.QueryRow(hasSessionQuery, s.JID, address).Scan(&has)
+func (s *SQLStore) HasSession(address string) (bool, error) {
+	return s.HasSessionContext(context.Background(), address)
+}
+
+func (s *SQLStore) HasSessionContext(ctx context.Context, address string) (has bool, err error) {
+	err = s.conn(ctx).QueryRowContext(ctx, hasSessionQuery, s.JID, address).Scan(&has)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
 	}
@@ -132,17 +180,33 @@ func (s *SQLStore) HasSession(address string) (has bool, err error) {
 }
 
 func (s *SQLStore) PutSession(address string, session []byte) error {
-	_, err := s.db.Exec(putSessionQuery, s.JID, address, session)
+	return s.PutSessionContext(context.Background(), address, session)
+}
+
+func (s *SQLStore) PutSessionContext(ctx context.Context, address string, session []byte) error {
+	encryptedSession, err := s.encryptValue(session, s.sessionAD(address))
+	if err != nil {
+		return err
+	}
+	_, err = s.conn(ctx).ExecContext(ctx, putSessionQuery, s.JID, address, encryptedSession)
 	return err
 }
 
 func (s *SQLStore) DeleteAllSessions(phone string) error {
-	_, err := s.db.Exec(deleteAllSessionsQuery, s.JID, phone+":%")
+	return s.DeleteAllSessionsContext(context.Background(), phone)
+}
+
+func (s *SQLStore) DeleteAllSessionsContext(ctx context.Context, phone string) error {
+	_, err := s.conn(ctx).ExecContext(ctx, deleteAllSessionsQuery, s.JID, phone+":%")
 	return err
 }
 
 func (s *SQLStore) DeleteSession(address string) error {
-	_, err := s.db.Exec(deleteSessionQuery, s.JID, address)
+	return s.DeleteSessionContext(context.Background(), address)
+}
+
+func (s *SQLStore) DeleteSessionContext(ctx context.Context, address string) error {
+	_, err := s.conn(ctx).ExecContext(ctx, deleteSessionQuery, s.JID, address)
 	return err
 }
 
@@ -156,15 +220,23 @@ const (
 	getUploadedPreKeyCountQuery = `SELECT COUNT(*) FROM whatsmeow_pre_keys WHERE jid=$1 AND uploaded=true`
 )
 
-func (s *SQLStore) genOnePreKey(id uint32, markUploaded bool) (*keys.PreKey, error) {
+func (s *SQLStore) preKeyAD(id uint32) []byte {
+	return encryptionAD("whatsmeow_pre_keys", s.JID, strconv.FormatUint(uint64(id), 10))
+}
+
+func (s *SQLStore) genOnePreKey(ctx context.Context, id uint32, markUploaded bool) (*keys.PreKey, error) {
 	key := keys.NewPreKey(id)
-	_, err := s.db.Exec(insertPreKeyQuery, s.JID, key.KeyID, key.Priv[:], markUploaded)
+	encryptedKey, err := s.encryptValue(key.Priv[:], s.preKeyAD(key.KeyID))
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.conn(ctx).ExecContext(ctx, insertPreKeyQuery, s.JID, key.KeyID, encryptedKey, markUploaded)
 	return key, err
 }
 
-func (s *SQLStore) getNextPreKeyID() (uint32, error) {
+func (s *SQLStore) getNextPreKeyID(ctx context.Context) (uint32, error) {
 	var lastKeyID sql.NullInt32
-	err := s.db.QueryRow(getLastPreKeyIDQuery, s.JID).Scan(&lastKeyID)
+	err := s.conn(ctx).QueryRowContext(ctx, getLastPreKeyIDQuery, s.JID).Scan(&lastKeyID)
 	if err != nil {
 		return 0, fmt.Errorf("failed to query next prekey ID: %w", err)
 	}
@@ -172,55 +244,88 @@ func (s *SQLStore) getNextPreKeyID() (uint32, error) {
 }
 
 func (s *SQLStore) GenOnePreKey() (*keys.PreKey, error) {
-	s.preKeyLock.Lock()
-	defer s.preKeyLock.Unlock()
-	nextKeyID, err := s.getNextPreKeyID()
+	return s.GenOnePreKeyContext(context.Background())
+}
+
+// GenOnePreKeyContext generates a new prekey that is marked as uploaded.
+//
+// Like GetOrGenPreKeysContext, this runs in a transaction, so that the SQLite transaction lock is always taken
+// before the prekey lock. Otherwise, concurrent calls of the two methods could deadlock when there's only one
+// database connection.
+func (s *SQLStore) GenOnePreKeyContext(ctx context.Context) (key *keys.PreKey, err error) {
+	err = s.DoTxn(ctx, func(ctx context.Context) error {
+		s.preKeyLock.Lock()
+		defer s.preKeyLock.Unlock()
+		var nextKeyID uint32
+		nextKeyID, err = s.getNextPreKeyID(ctx)
+		if err != nil {
+			return err
+		}
+		key, err = s.genOnePreKey(ctx, nextKeyID, true)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	return s.genOnePreKey(nextKeyID, true)
+	return key, nil
 }
 
 func (s *SQLStore) GetOrGenPreKeys(count uint32) ([]*keys.PreKey, error) {
-	s.preKeyLock.Lock()
-	defer s.preKeyLock.Unlock()
+	return s.GetOrGenPreKeysContext(context.Background(), count)
+}
 
-	res, err := s.db.Query(getUnuploadedPreKeysQuery, s.JID, count)
+func (s *SQLStore) getUnuploadedPreKeys(ctx context.Context, count uint32) ([]*keys.PreKey, error) {
+	res, err := s.conn(ctx).QueryContext(ctx, getUnuploadedPreKeysQuery, s.JID, count)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query existing prekeys: %w", err)
 	}
-	newKeys := make([]*keys.PreKey, count)
-	var existingCount uint32
+	defer res.Close()
+	existingKeys := make([]*keys.PreKey, 0, count)
 	for res.Next() {
 		var key *keys.PreKey
-		key, err = scanPreKey(res)
+		key, err = s.scanPreKey(res)
 		if err != nil {
 			return nil, err
 		} else if key != nil {
-			newKeys[existingCount] = key
-			existingCount++
+			existingKeys = append(existingKeys, key)
 		}
 	}
+	return existingKeys, res.Err()
+}
 
-	if existingCount < uint32(len(newKeys)) {
+// GetOrGenPreKeysContext returns count prekeys that haven't been uploaded yet, generating new ones if necessary.
+// All new prekeys are inserted in a single transaction.
+func (s *SQLStore) GetOrGenPreKeysContext(ctx context.Context, count uint32) (newKeys []*keys.PreKey, err error) {
+	err = s.DoTxn(ctx, func(ctx context.Context) error {
+		s.preKeyLock.Lock()
+		defer s.preKeyLock.Unlock()
+		newKeys, err = s.getUnuploadedPreKeys(ctx, count)
+		if err != nil || uint32(len(newKeys)) >= count {
+			return err
+		}
 		var nextKeyID uint32
-		nextKeyID, err = s.getNextPreKeyID()
+		nextKeyID, err = s.getNextPreKeyID(ctx)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		for i := existingCount; i < count; i++ {
-			newKeys[i], err = s.genOnePreKey(nextKeyID, false)
+		for i := uint32(len(newKeys)); i < count; i++ {
+			var key *keys.PreKey
+			key, err = s.genOnePreKey(ctx, nextKeyID, false)
 			if err != nil {
-				return nil, fmt.Errorf("failed to generate prekey: %w", err)
+				return fmt.Errorf("failed to generate prekey: %w", err)
 			}
+			newKeys = append(newKeys, key)
 			nextKeyID++
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return newKeys, nil
 }
 
-func scanPreKey(row scannable) (*keys.PreKey, error) {
+func (s *SQLStore) scanPreKey(row scannable) (*keys.PreKey, error) {
 	var priv []byte
 	var id uint32
 	err := row.Scan(&id, &priv)
@@ -228,6 +333,10 @@ func scanPreKey(row scannable) (*keys.PreKey, error) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
+	}
+	priv, err = s.decryptValue(priv, s.preKeyAD(id))
+	if err != nil {
+		return nil, err
 	} else if len(priv) != 32 {
 		return nil, ErrInvalidLength
 	}
@@ -238,21 +347,37 @@ func scanPreKey(row scannable) (*keys.PreKey, error) {
 }
 
 func (s *SQLStore) GetPreKey(id uint32) (*keys.PreKey, error) {
-	return scanPreKey(s.db.QueryRow(getPreKeyQuery, s.JID, id))
+	return s.GetPreKeyContext(context.Background(), id)
+}
+
+func (s *SQLStore) GetPreKeyContext(ctx context.Context, id uint32) (*keys.PreKey, error) {
+	return s.scanPreKey(s.conn(ctx).QueryRowContext(ctx, getPreKeyQuery, s.JID, id))
 }
 
 func (s *SQLStore) RemovePreKey(id uint32) error {
-	_, err := s.db.Exec(deletePreKeyQuery, s.JID, id)
+	return s.RemovePreKeyContext(context.Background(), id)
+}
+
+func (s *SQLStore) RemovePreKeyContext(ctx context.Context, id uint32) error {
+	_, err := s.conn(ctx).ExecContext(ctx, deletePreKeyQuery, s.JID, id)
 	return err
 }
 
 func (s *SQLStore) MarkPreKeysAsUploaded(upToID uint32) error {
-	_, err := s.db.Exec(markPreKeysAsUploadedQuery, s.JID, upToID)
+	return s.MarkPreKeysAsUploadedContext(context.Background(), upToID)
+}
+
+func (s *SQLStore) MarkPreKeysAsUploadedContext(ctx context.Context, upToID uint32) error {
+	_, err := s.conn(ctx).ExecContext(ctx, markPreKeysAsUploadedQuery, s.JID, upToID)
 	return err
 }
 
-func (s *SQLStore) UploadedPreKeyCount() (count int, err error) {
-	err = s.db.QueryRow(getUploadedPreKeyCountQuery, s.JID).Scan(&count)
+func (s *SQLStore) UploadedPreKeyCount() (int, error) {
+	return s.UploadedPreKeyCountContext(context.Background())
+}
+
+func (s *SQLStore) UploadedPreKeyCountContext(ctx context.Context) (count int, err error) {
+	err = s.conn(ctx).QueryRowContext(ctx, getUploadedPreKeyCountQuery, s.JID).Scan(&count)
 	return
 }
 
@@ -264,15 +389,33 @@ const (
 	`
 )
 
+func (s *SQLStore) senderKeyAD(group, user string) []byte {
+	return encryptionAD("whatsmeow_sender_keys", s.JID, group, user)
+}
+
 func (s *SQLStore) PutSenderKey(group, user string, session []byte) error {
-	_, err := s.db.Exec(putSenderKeyQuery, s.JID, group, user, session)
+	return s.PutSenderKeyContext(context.Background(), group, user, session)
+}
+
+func (s *SQLStore) PutSenderKeyContext(ctx context.Context, group, user string, session []byte) error {
+	encryptedSession, err := s.encryptValue(session, s.senderKeyAD(group, user))
+	if err != nil {
+		return err
+	}
+	_, err = s.conn(ctx).ExecContext(ctx, putSenderKeyQuery, s.JID, group, user, encryptedSession)
 	return err
 }
 
-func (s *SQLStore) GetSenderKey(group, user string) (key []byte, err error) {
-	err = s.db.QueryRow(getSenderKeyQuery, s.JID, group, user).Scan(&key)
+func (s *SQLStore) GetSenderKey(group, user string) ([]byte, error) {
+	return s.GetSenderKeyContext(context.Background(), group, user)
+}
+
+func (s *SQLStore) GetSenderKeyContext(ctx context.Context, group, user string) (key []byte, err error) {
+	err = s.conn(ctx).QueryRowContext(ctx, getSenderKeyQuery, s.JID, group, user).Scan(&key)
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
+	} else if err == nil {
+		key, err = s.decryptValue(key, s.senderKeyAD(group, user))
 	}
 	return
 }
@@ -284,22 +427,52 @@ const (
 			SET key_data=excluded.key_data, timestamp=excluded.timestamp, fingerprint=excluded.fingerprint
 			WHERE excluded.timestamp > whatsmeow_app_state_sync_keys.timestamp
 	`
+	// MySQL doesn't support conditional upserts, so the condition is applied to each column separately.
+	// The timestamp must be updated last, as MySQL applies the assignments in order.
+	putAppStateSyncKeyQueryMySQL = `
+		INSERT INTO whatsmeow_app_state_sync_keys (jid, key_id, key_data, timestamp, fingerprint) VALUES ($1, $2, $3, $4, $5)
+		ON DUPLICATE KEY UPDATE
+			key_data=IF(VALUES(timestamp) > timestamp, VALUES(key_data), key_data),
+			fingerprint=IF(VALUES(timestamp) > timestamp, VALUES(fingerprint), fingerprint),
+			timestamp=GREATEST(VALUES(timestamp), timestamp)
+	`
 	getAppStateSyncKeyQuery         = `SELECT key_data, timestamp, fingerprint FROM whatsmeow_app_state_sync_keys WHERE jid=$1 AND key_id=$2`
 	getLatestAppStateSyncKeyIDQuery = `SELECT key_id FROM whatsmeow_app_state_sync_keys WHERE jid=$1 ORDER BY timestamp DESC LIMIT 1`
 )
 
+func (s *SQLStore) appStateSyncKeyAD(id []byte) []byte {
+	return encryptionAD("whatsmeow_app_state_sync_keys", s.JID, string(id))
+}
+
 func (s *SQLStore) PutAppStateSyncKey(id []byte, key store.AppStateSyncKey) error {
-	_, err := s.db.Exec(putAppStateSyncKeyQuery, s.JID, id, key.Data, key.Timestamp, key.Fingerprint)
+	encryptedData, err := s.encryptValue(key.Data, s.appStateSyncKeyAD(id))
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.putAppStateSyncKeyQuery(), s.JID, id, encryptedData, key.Timestamp, key.Fingerprint)
 	return err
 }
 
+func (s *SQLStore) putAppStateSyncKeyQuery() string {
+	if s.dialect == "mysql" {
+		return putAppStateSyncKeyQueryMySQL
+	}
+	return putAppStateSyncKeyQuery
+}
+
 func (s *SQLStore) GetAppStateSyncKey(id []byte) (*store.AppStateSyncKey, error) {
 	var key store.AppStateSyncKey
 	err := s.db.QueryRow(getAppStateSyncKeyQuery, s.JID, id).Scan(&key.Data, &key.Timestamp, &key.Fingerprint)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key.Data, err = s.decryptValue(key.Data, s.appStateSyncKeyAD(id))
+	if err != nil {
+		return nil, err
 	}
-	return &key, err
+	return &key, nil
 }
 
 func (s *SQLStore) GetLatestAppStateSyncKeyID() ([]byte, error) {
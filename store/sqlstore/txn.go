@@ -0,0 +1,131 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+
+	"github.com/Romerito007/whatsmeow/store"
+)
+
+var _ store.TransactionalContainer = (*Container)(nil)
+
+// ErrNestedTransaction is returned by DoTxn when using SQLite if the same goroutine already has a transaction open,
+// but the context passed to DoTxn doesn't contain it. Waiting for the outer transaction to finish would deadlock,
+// so the context passed to the outer transaction function must be used for all store calls inside it.
+var ErrNestedTransaction = errors.New("DoTxn called inside another transaction without the transaction's context")
+
+type contextKey int
+
+const contextKeyTxn contextKey = iota
+
+type txnValue struct {
+	container *Container
+	tx        *sqlTx
+}
+
+// dbConn is the subset of methods shared by sqlDB and sqlTx that the context-accepting store methods use.
+type dbConn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (c *Container) txnFromContext(ctx context.Context) *sqlTx {
+	val, ok := ctx.Value(contextKeyTxn).(*txnValue)
+	if !ok || val.container != c {
+		return nil
+	}
+	return val.tx
+}
+
+// conn returns the transaction in the context if there is one, and the database otherwise.
+func (c *Container) conn(ctx context.Context) dbConn {
+	if tx := c.txnFromContext(ctx); tx != nil {
+		return tx
+	}
+	return c.db
+}
+
+// DoTxn runs the given function inside a database transaction. All context-accepting store methods that are
+// called with the context passed to the function will use the transaction. The transaction is committed if
+// the function returns nil, and rolled back if it returns an error or panics.
+//
+// When using SQLite, transactions are serialized, as SQLite only allows one writer at a time anyway,
+// and concurrent deferred transactions would otherwise fail with SQLITE_BUSY when upgrading to a write lock.
+// Starting a new transaction from inside the function (i.e. calling DoTxn with a context that doesn't come from
+// the outer transaction) returns ErrNestedTransaction instead of deadlocking. Nested transactions started from
+// other goroutines can't be detected and will deadlock if the outer function waits for them.
+func (c *Container) DoTxn(ctx context.Context, fn func(ctx context.Context) error) error {
+	return c.doTxn(ctx, nil, fn)
+}
+
+// snapshotTxnOptions returns the transaction options needed for all queries in a transaction to see
+// the same snapshot of the database. SQLite and MySQL (InnoDB) already do that by default.
+func (c *Container) snapshotTxnOptions() *sql.TxOptions {
+	if c.dialect == "postgres" || c.dialect == "pgx" {
+		return &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}
+	}
+	return nil
+}
+
+func (c *Container) doTxn(ctx context.Context, opts *sql.TxOptions, fn func(ctx context.Context) error) (err error) {
+	if c.txnFromContext(ctx) != nil {
+		return fn(ctx)
+	}
+	if c.dialect == "sqlite3" {
+		goroutine := goroutineID()
+		if goroutine != 0 && c.sqliteTxnOwner.Load() == goroutine {
+			return ErrNestedTransaction
+		}
+		c.sqliteTxnLock.Lock()
+		c.sqliteTxnOwner.Store(goroutine)
+		defer func() {
+			c.sqliteTxnOwner.Store(0)
+			c.sqliteTxnLock.Unlock()
+		}()
+	}
+	tx, err := c.db.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+	}()
+	err = fn(context.WithValue(ctx, contextKeyTxn, &txnValue{container: c, tx: tx}))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// goroutineID returns the ID of the current goroutine, which is only used to detect nested SQLite transactions.
+// Go doesn't expose it directly, but the first line of the stack trace is always "goroutine <id> [<status>]:".
+func goroutineID() uint64 {
+	var buf [64]byte
+	stack := buf[:runtime.Stack(buf[:], false)]
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if end := bytes.IndexByte(stack, ' '); end > 0 {
+		stack = stack[:end]
+	}
+	id, _ := strconv.ParseUint(string(stack), 10, 64)
+	return id
+}
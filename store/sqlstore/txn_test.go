@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sqlstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDoTxn_Nested(t *testing.T) {
+	container := newTestContainer(t)
+	s := newTestDevice(t, container, "1234").Sessions.(*SQLStore)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- container.DoTxn(context.Background(), func(ctx context.Context) error {
+			// Passing the transaction's context reuses the transaction
+			err := container.DoTxn(ctx, func(ctx context.Context) error {
+				return s.PutSessionContext(ctx, "1111.0:1", []byte("session"))
+			})
+			if err != nil {
+				return err
+			}
+			// Starting a new transaction from the same goroutine would deadlock
+			err = container.DoTxn(context.Background(), func(ctx context.Context) error {
+				return nil
+			})
+			if !errors.Is(err, ErrNestedTransaction) {
+				t.Errorf("expected ErrNestedTransaction, got %v", err)
+			}
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("transaction failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("nested transaction deadlocked")
+	}
+	if session, err := s.GetSession("1111.0:1"); err != nil || string(session) != "session" {
+		t.Errorf("session from reused transaction wasn't committed: %q, %v", session, err)
+	}
+
+	// Transactions from other goroutines still wait for each other instead of failing
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- container.DoTxn(context.Background(), func(ctx context.Context) error {
+				time.Sleep(10 * time.Millisecond)
+				return s.PutSessionContext(ctx, "2222.0:1", []byte("concurrent"))
+			})
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("concurrent transaction failed: %v", err)
+		}
+	}
+}
+
+func TestDoTxn_RollbackOnError(t *testing.T) {
+	container := newTestContainer(t)
+	s := newTestDevice(t, container, "1234").Sessions.(*SQLStore)
+	preKey, err := s.GenOnePreKey()
+	if err != nil {
+		t.Fatalf("failed to generate prekey: %v", err)
+	}
+
+	stepErr := errors.New("step failed")
+	err = container.DoTxn(context.Background(), func(ctx context.Context) error {
+		if err := s.PutSessionContext(ctx, "1111.0:1", []byte("session")); err != nil {
+			return err
+		} else if err = s.PutIdentityContext(ctx, "1111.0:1", [32]byte{1}); err != nil {
+			return err
+		} else if err = s.RemovePreKeyContext(ctx, preKey.KeyID); err != nil {
+			return err
+		}
+		return stepErr
+	})
+	if !errors.Is(err, stepErr) {
+		t.Fatalf("expected step error, got %v", err)
+	}
+	if has, err := s.HasSession("1111.0:1"); err != nil || has {
+		t.Errorf("session wasn't rolled back: %t, %v", has, err)
+	}
+	if trusted, err := s.IsTrustedIdentity("1111.0:1", [32]byte{2}); err != nil || !trusted {
+		t.Errorf("identity wasn't rolled back: %t, %v", trusted, err)
+	}
+	if key, err := s.GetPreKey(preKey.KeyID); err != nil || key == nil {
+		t.Errorf("prekey removal wasn't rolled back: %v, %v", key, err)
+	}
+}
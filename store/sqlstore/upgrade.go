@@ -7,17 +7,17 @@
 package sqlstore
 
 import (
-	"database/sql"
 	"fmt"
+	"strings"
 )
 
-type upgradeFunc func(*sql.Tx, *Container) error
+type upgradeFunc func(*sqlTx, *Container) error
 
 // Upgrades is a list of functions that will upgrade a database to the latest version.
 //
 // This may be of use if you want to manage the database fully manually, but in most cases you
 // should just call Container.Upgrade to let the library handle everything.
-var Upgrades = [...]upgradeFunc{upgradeV1, upgradeV2, upgradeV3, upgradeV4, upgradeV5, upgradeV6}
+var Upgrades = [...]upgradeFunc{upgradeV1, upgradeV2, upgradeV3, upgradeV4, upgradeV5, upgradeV6, upgradeV7, upgradeV8, upgradeV9, upgradeV10, upgradeV11, upgradeV12, upgradeV13, upgradeV14}
 
 func (c *Container) getVersion() (int, error) {
 	_, err := c.db.Exec("CREATE TABLE IF NOT EXISTS whatsmeow_version (version INTEGER)")
@@ -33,7 +33,7 @@ func (c *Container) getVersion() (int, error) {
 	return version, nil
 }
 
-func (c *Container) setVersion(tx *sql.Tx, version int) error {
+func (c *Container) setVersion(tx *sqlTx, version int) error {
 	_, err := tx.Exec("DELETE FROM whatsmeow_version")
 	if err != nil {
 		return err
@@ -59,8 +59,19 @@ func (c *Container) Upgrade() error {
 		return err
 	}
 
+	if c.dialect == "mysql" && version == 0 {
+		c.log.Infof("Creating MySQL database schema at v%d", mysqlBaseVersion)
+		err = c.upgradeMySQLBase()
+		if err != nil {
+			return err
+		}
+		version = mysqlBaseVersion
+	} else if c.dialect == "mysql" && version < mysqlBaseVersion {
+		return fmt.Errorf("unsupported MySQL database version v%d", version)
+	}
+
 	for ; version < len(Upgrades); version++ {
-		var tx *sql.Tx
+		var tx *sqlTx
 		tx, err = c.db.Begin()
 		if err != nil {
 			return err
@@ -86,7 +97,7 @@ func (c *Container) Upgrade() error {
 	return nil
 }
 
-func upgradeV1(tx *sql.Tx, _ *Container) error {
+func upgradeV1(tx *sqlTx, _ *Container) error {
 	_, err := tx.Exec(`CREATE TABLE whatsmeow_device (
 		jid TEXT PRIMARY KEY,
 
@@ -245,7 +256,7 @@ UPDATE whatsmeow_device SET adv_account_sig_key=(
 )
 `
 
-func upgradeV2(tx *sql.Tx, container *Container) error {
+func upgradeV2(tx *sqlTx, container *Container) error {
 	_, err := tx.Exec("ALTER TABLE whatsmeow_device ADD COLUMN adv_account_sig_key bytea CHECK ( length(adv_account_sig_key) = 32 )")
 	if err != nil {
 		return err
@@ -258,7 +269,7 @@ func upgradeV2(tx *sql.Tx, container *Container) error {
 	return err
 }
 
-func upgradeV3(tx *sql.Tx, container *Container) error {
+func upgradeV3(tx *sqlTx, container *Container) error {
 	_, err := tx.Exec(`CREATE TABLE whatsmeow_message_secrets (
 		our_jid    TEXT,
 		chat_jid   TEXT,
@@ -272,7 +283,7 @@ func upgradeV3(tx *sql.Tx, container *Container) error {
 	return err
 }
 
-func upgradeV4(tx *sql.Tx, container *Container) error {
+func upgradeV4(tx *sqlTx, container *Container) error {
 	_, err := tx.Exec(`CREATE TABLE whatsmeow_privacy_tokens (
 		our_jid   TEXT,
 		their_jid TEXT,
@@ -283,12 +294,453 @@ func upgradeV4(tx *sql.Tx, container *Container) error {
 	return err
 }
 
-func upgradeV5(tx *sql.Tx, container *Container) error {
+func upgradeV5(tx *sqlTx, container *Container) error {
 	_, err := tx.Exec("UPDATE whatsmeow_device SET jid=REPLACE(jid, '.0', '')")
 	return err
 }
 
-func upgradeV6(tx *sql.Tx, container *Container) error {
+func upgradeV6(tx *sqlTx, container *Container) error {
 	_, err := tx.Exec("ALTER TABLE whatsmeow_device ADD COLUMN facebook_uuid uuid")
 	return err
 }
+
+func upgradeV7(tx *sqlTx, container *Container) error {
+	_, err := tx.Exec(`CREATE TABLE whatsmeow_messages (
+		our_jid        TEXT,
+		chat_jid       TEXT,
+		message_id     TEXT,
+		sender_jid     TEXT    NOT NULL,
+		timestamp      BIGINT  NOT NULL,
+		from_me        BOOLEAN NOT NULL,
+		message        bytea,
+		edit_timestamp BIGINT  NOT NULL DEFAULT 0,
+		revoked        BOOLEAN NOT NULL DEFAULT false,
+		deleted_for_me BOOLEAN NOT NULL DEFAULT false,
+
+		PRIMARY KEY (our_jid, chat_jid, message_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX whatsmeow_messages_chat_timestamp_idx ON whatsmeow_messages (our_jid, chat_jid, timestamp, message_id)`)
+	return err
+}
+
+func upgradeV8(tx *sqlTx, container *Container) error {
+	_, err := tx.Exec(`CREATE TABLE whatsmeow_lid_map (
+		lid TEXT PRIMARY KEY,
+		pn  TEXT UNIQUE NOT NULL
+	)`)
+	return err
+}
+
+func upgradeV9(tx *sqlTx, container *Container) error {
+	_, err := tx.Exec(`CREATE TABLE whatsmeow_groups (
+		our_jid                TEXT,
+		group_jid              TEXT,
+		participant_version_id TEXT   NOT NULL,
+		info                   bytea  NOT NULL,
+		updated_at             BIGINT NOT NULL,
+
+		PRIMARY KEY (our_jid, group_jid),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	return err
+}
+
+func upgradeV10(tx *sqlTx, container *Container) error {
+	_, err := tx.Exec(`CREATE TABLE whatsmeow_device_lists (
+		our_jid    TEXT,
+		user_jid   TEXT,
+		devices    TEXT   NOT NULL,
+		dhash      TEXT   NOT NULL,
+		updated_at BIGINT NOT NULL,
+
+		PRIMARY KEY (our_jid, user_jid),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`)
+	return err
+}
+
+const relaxKeyLengthChecksPostgres = `
+ALTER TABLE whatsmeow_identity_keys DROP CONSTRAINT IF EXISTS whatsmeow_identity_keys_identity_check;
+ALTER TABLE whatsmeow_pre_keys DROP CONSTRAINT IF EXISTS whatsmeow_pre_keys_key_check;
+`
+
+// SQLite doesn't support dropping constraints, so the tables have to be recreated.
+const relaxKeyLengthChecksSQLite = `
+CREATE TABLE whatsmeow_identity_keys_new (
+	our_jid  TEXT,
+	their_id TEXT,
+	identity bytea NOT NULL,
+
+	PRIMARY KEY (our_jid, their_id),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+INSERT INTO whatsmeow_identity_keys_new (our_jid, their_id, identity)
+	SELECT our_jid, their_id, identity FROM whatsmeow_identity_keys;
+DROP TABLE whatsmeow_identity_keys;
+ALTER TABLE whatsmeow_identity_keys_new RENAME TO whatsmeow_identity_keys;
+
+CREATE TABLE whatsmeow_pre_keys_new (
+	jid      TEXT,
+	key_id   INTEGER          CHECK ( key_id >= 0 AND key_id < 16777216 ),
+	key      bytea   NOT NULL,
+	uploaded BOOLEAN NOT NULL,
+
+	PRIMARY KEY (jid, key_id),
+	FOREIGN KEY (jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+INSERT INTO whatsmeow_pre_keys_new (jid, key_id, key, uploaded)
+	SELECT jid, key_id, key, uploaded FROM whatsmeow_pre_keys;
+DROP TABLE whatsmeow_pre_keys;
+ALTER TABLE whatsmeow_pre_keys_new RENAME TO whatsmeow_pre_keys;
+`
+
+// upgradeV11 removes the length checks from the identity and prekey columns,
+// as encrypted values (see EncryptionKeyProvider) are longer than the raw keys.
+func upgradeV11(tx *sqlTx, container *Container) error {
+	var err error
+	if container.dialect == "postgres" || container.dialect == "pgx" {
+		_, err = tx.Exec(relaxKeyLengthChecksPostgres)
+	} else {
+		_, err = tx.Exec(relaxKeyLengthChecksSQLite)
+	}
+	return err
+}
+
+const chatMetadataTables = `
+CREATE TABLE whatsmeow_chat_metadata (
+	our_jid          %[1]s,
+	chat_jid         %[1]s,
+	marked_as_unread BOOLEAN NOT NULL DEFAULT false,
+	cleared_at       BIGINT  NOT NULL DEFAULT 0,
+	deleted_at       BIGINT  NOT NULL DEFAULT 0,
+
+	PRIMARY KEY (our_jid, chat_jid),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE TABLE whatsmeow_message_metadata (
+	our_jid        %[1]s,
+	chat_jid       %[1]s,
+	message_id     %[1]s,
+	sender_jid     %[1]s NOT NULL,
+	from_me        BOOLEAN NOT NULL,
+	starred        BOOLEAN NOT NULL DEFAULT false,
+	deleted_for_me BOOLEAN NOT NULL DEFAULT false,
+	updated_at     BIGINT  NOT NULL,
+
+	PRIMARY KEY (our_jid, chat_jid, message_id),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE TABLE whatsmeow_labels (
+	our_jid       %[1]s,
+	label_id      %[1]s,
+	name          TEXT    NOT NULL,
+	color         INTEGER NOT NULL,
+	predefined_id INTEGER NOT NULL,
+	deleted       BOOLEAN NOT NULL,
+
+	PRIMARY KEY (our_jid, label_id),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+)%[2]s;
+CREATE TABLE whatsmeow_label_chats (
+	our_jid  %[1]s,
+	label_id %[1]s,
+	chat_jid %[1]s,
+
+	PRIMARY KEY (our_jid, label_id, chat_jid),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE TABLE whatsmeow_label_messages (
+	our_jid    %[1]s,
+	label_id   %[1]s,
+	chat_jid   %[1]s,
+	message_id %[1]s,
+
+	PRIMARY KEY (our_jid, label_id, chat_jid, message_id),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+`
+
+func upgradeV12(tx *sqlTx, container *Container) error {
+	if container.dialect != "mysql" {
+		_, err := tx.Exec(fmt.Sprintf(chatMetadataTables, "TEXT", ""))
+		return err
+	}
+	// MySQL doesn't support multiple statements in one query by default
+	queries := strings.Split(fmt.Sprintf(chatMetadataTables, mysqlIDColumnType, " DEFAULT CHARSET=utf8mb4"), ";")
+	for _, query := range queries {
+		if strings.TrimSpace(query) == "" {
+			continue
+		}
+		_, err := tx.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upgradeV13(tx *sqlTx, container *Container) error {
+	idType, blobType := "TEXT", "bytea"
+	if container.dialect == "mysql" {
+		idType, blobType = mysqlIDColumnType, "LONGBLOB"
+	}
+	_, err := tx.Exec(fmt.Sprintf(`CREATE TABLE whatsmeow_event_outbox (
+		our_jid    %[1]s,
+		chat_jid   %[1]s,
+		message_id %[1]s,
+		sender_jid %[1]s NOT NULL,
+		data       %[2]s NOT NULL,
+		attempts   INTEGER NOT NULL DEFAULT 0,
+		created_at BIGINT  NOT NULL,
+
+		PRIMARY KEY (our_jid, chat_jid, message_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`, idType, blobType))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX whatsmeow_event_outbox_created_at_idx ON whatsmeow_event_outbox (our_jid, created_at)`)
+	return err
+}
+
+// SQLite doesn't support changing the primary key, so the table has to be recreated.
+const messageMetadataSenderKeySQLite = `
+CREATE TABLE whatsmeow_message_metadata_new (
+	our_jid        TEXT,
+	chat_jid       TEXT,
+	message_id     TEXT,
+	sender_jid     TEXT    NOT NULL,
+	from_me        BOOLEAN NOT NULL,
+	starred        BOOLEAN NOT NULL DEFAULT false,
+	deleted_for_me BOOLEAN NOT NULL DEFAULT false,
+	updated_at     BIGINT  NOT NULL,
+
+	PRIMARY KEY (our_jid, chat_jid, sender_jid, message_id),
+	FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+);
+INSERT INTO whatsmeow_message_metadata_new (our_jid, chat_jid, message_id, sender_jid, from_me, starred, deleted_for_me, updated_at)
+	SELECT our_jid, chat_jid, message_id, sender_jid, from_me, starred, deleted_for_me, updated_at FROM whatsmeow_message_metadata;
+DROP TABLE whatsmeow_message_metadata;
+ALTER TABLE whatsmeow_message_metadata_new RENAME TO whatsmeow_message_metadata;
+`
+
+// upgradeV14 adds the sender to the primary key of the message metadata table,
+// as message IDs are only unique per sender.
+func upgradeV14(tx *sqlTx, container *Container) error {
+	var err error
+	if container.dialect == "postgres" || container.dialect == "pgx" {
+		_, err = tx.Exec(`ALTER TABLE whatsmeow_message_metadata DROP CONSTRAINT whatsmeow_message_metadata_pkey,
+			ADD PRIMARY KEY (our_jid, chat_jid, sender_jid, message_id)`)
+	} else if container.dialect == "mysql" {
+		_, err = tx.Exec(`ALTER TABLE whatsmeow_message_metadata DROP PRIMARY KEY,
+			ADD PRIMARY KEY (our_jid, chat_jid, sender_jid, message_id)`)
+	} else {
+		_, err = tx.Exec(messageMetadataSenderKeySQLite)
+	}
+	return err
+}
+
+// mysqlIDColumnType is the column type used for JIDs and other identifiers in MySQL, see mysqlSchema.
+const mysqlIDColumnType = "VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin"
+
+// mysqlBaseVersion is the schema version that upgradeMySQLBase creates. MySQL support was added after the
+// upgrades up to this version were written, so new MySQL databases are created directly with the combined
+// schema instead of running the individual upgrades. Any later upgrades must handle the MySQL dialect.
+const mysqlBaseVersion = 11
+
+// mysqlSchema is the MySQL/MariaDB equivalent of the schema created by upgrades v1-v11.
+//
+// Columns that are part of primary keys must have a fixed maximum length in MySQL, so JIDs and other
+// identifiers are stored as binary-collated ASCII strings, which also matches the comparison semantics
+// of the other dialects. The queries are executed through sqlDB, which quotes the key column name.
+var mysqlSchema = []string{
+	`CREATE TABLE IF NOT EXISTS whatsmeow_device (
+		jid VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin PRIMARY KEY,
+
+		registration_id BIGINT NOT NULL CHECK ( registration_id >= 0 AND registration_id < 4294967296 ),
+
+		noise_key    VARBINARY(32) NOT NULL CHECK ( length(noise_key) = 32 ),
+		identity_key VARBINARY(32) NOT NULL CHECK ( length(identity_key) = 32 ),
+
+		signed_pre_key     VARBINARY(32) NOT NULL CHECK ( length(signed_pre_key) = 32 ),
+		signed_pre_key_id  INTEGER       NOT NULL CHECK ( signed_pre_key_id >= 0 AND signed_pre_key_id < 16777216 ),
+		signed_pre_key_sig VARBINARY(64) NOT NULL CHECK ( length(signed_pre_key_sig) = 64 ),
+
+		adv_key             BLOB          NOT NULL,
+		adv_details         BLOB          NOT NULL,
+		adv_account_sig     VARBINARY(64) NOT NULL CHECK ( length(adv_account_sig) = 64 ),
+		adv_account_sig_key VARBINARY(32) NOT NULL CHECK ( length(adv_account_sig_key) = 32 ),
+		adv_device_sig      VARBINARY(64) NOT NULL CHECK ( length(adv_device_sig) = 64 ),
+
+		platform      VARCHAR(255) NOT NULL DEFAULT '',
+		business_name VARCHAR(255) NOT NULL DEFAULT '',
+		push_name     VARCHAR(255) NOT NULL DEFAULT '',
+		facebook_uuid CHAR(36)
+	) DEFAULT CHARSET=utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_identity_keys (
+		our_jid  VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		their_id VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		identity BLOB NOT NULL,
+
+		PRIMARY KEY (our_jid, their_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_pre_keys (
+		jid      VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		key_id   INTEGER          CHECK ( key_id >= 0 AND key_id < 16777216 ),
+		key      BLOB    NOT NULL,
+		uploaded BOOLEAN NOT NULL,
+
+		PRIMARY KEY (jid, key_id),
+		FOREIGN KEY (jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_sessions (
+		our_jid  VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		their_id VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		session  LONGBLOB,
+
+		PRIMARY KEY (our_jid, their_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_sender_keys (
+		our_jid    VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		chat_id    VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		sender_id  VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		sender_key LONGBLOB NOT NULL,
+
+		PRIMARY KEY (our_jid, chat_id, sender_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_app_state_sync_keys (
+		jid         VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		key_id      VARBINARY(255),
+		key_data    BLOB   NOT NULL,
+		timestamp   BIGINT NOT NULL,
+		fingerprint BLOB   NOT NULL,
+
+		PRIMARY KEY (jid, key_id),
+		FOREIGN KEY (jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_app_state_version (
+		jid     VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		name    VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		version BIGINT         NOT NULL,
+		hash    VARBINARY(128) NOT NULL CHECK ( length(hash) = 128 ),
+
+		PRIMARY KEY (jid, name),
+		FOREIGN KEY (jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_app_state_mutation_macs (
+		jid       VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		name      VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		version   BIGINT,
+		index_mac VARBINARY(32)          CHECK ( length(index_mac) = 32 ),
+		value_mac VARBINARY(32) NOT NULL CHECK ( length(value_mac) = 32 ),
+
+		PRIMARY KEY (jid, name, version, index_mac),
+		FOREIGN KEY (jid, name) REFERENCES whatsmeow_app_state_version(jid, name) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_contacts (
+		our_jid       VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		their_jid     VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		first_name    TEXT,
+		full_name     TEXT,
+		push_name     TEXT,
+		business_name TEXT,
+
+		PRIMARY KEY (our_jid, their_jid),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	) DEFAULT CHARSET=utf8mb4`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_chat_settings (
+		our_jid     VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		chat_jid    VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		muted_until BIGINT  NOT NULL DEFAULT 0,
+		pinned      BOOLEAN NOT NULL DEFAULT false,
+		archived    BOOLEAN NOT NULL DEFAULT false,
+
+		PRIMARY KEY (our_jid, chat_jid),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_message_secrets (
+		our_jid    VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		chat_jid   VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		sender_jid VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		message_id VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		key        BLOB NOT NULL,
+
+		PRIMARY KEY (our_jid, chat_jid, sender_jid, message_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_privacy_tokens (
+		our_jid   VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		their_jid VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		token     BLOB   NOT NULL,
+		timestamp BIGINT NOT NULL,
+		PRIMARY KEY (our_jid, their_jid)
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_messages (
+		our_jid        VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		chat_jid       VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		message_id     VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		sender_jid     VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+		timestamp      BIGINT  NOT NULL,
+		from_me        BOOLEAN NOT NULL,
+		message        LONGBLOB,
+		edit_timestamp BIGINT  NOT NULL DEFAULT 0,
+		revoked        BOOLEAN NOT NULL DEFAULT false,
+		deleted_for_me BOOLEAN NOT NULL DEFAULT false,
+
+		PRIMARY KEY (our_jid, chat_jid, message_id),
+		INDEX whatsmeow_messages_chat_timestamp_idx (our_jid, chat_jid, timestamp, message_id),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_lid_map (
+		lid VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin PRIMARY KEY,
+		pn  VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin UNIQUE NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_groups (
+		our_jid                VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		group_jid              VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		participant_version_id TEXT     NOT NULL,
+		info                   LONGBLOB NOT NULL,
+		updated_at             BIGINT   NOT NULL,
+
+		PRIMARY KEY (our_jid, group_jid),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+	`CREATE TABLE IF NOT EXISTS whatsmeow_device_lists (
+		our_jid    VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		user_jid   VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin,
+		devices    TEXT   NOT NULL,
+		dhash      TEXT   NOT NULL,
+		updated_at BIGINT NOT NULL,
+
+		PRIMARY KEY (our_jid, user_jid),
+		FOREIGN KEY (our_jid) REFERENCES whatsmeow_device(jid) ON DELETE CASCADE ON UPDATE CASCADE
+	)`,
+}
+
+// upgradeMySQLBase creates the MySQL schema. MySQL implicitly commits DDL statements, so this can't be
+// done atomically. Instead, all the tables are created with IF NOT EXISTS, so a partially failed upgrade
+// can just be retried.
+func (c *Container) upgradeMySQLBase() error {
+	for _, query := range mysqlSchema {
+		_, err := c.db.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = c.setVersion(tx, mysqlBaseVersion); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -10,6 +10,7 @@ package store
 import (
 	"fmt"
 	"github.com/Romerito007/whatsmeow/proto/waAdv"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
 	"time"
 
 	"github.com/google/uuid"
@@ -126,6 +127,257 @@ type PrivacyTokenStore interface {
 	GetPrivacyToken(user types.JID) (*PrivacyToken, error)
 }
 
+// LIDMapping is a mapping between a hidden user (LID) JID and a phone number JID.
+type LIDMapping struct {
+	LID types.JID
+	PN  types.JID
+}
+
+// LIDStore stores mappings between LIDs and phone numbers.
+//
+// The mappings are stored without device IDs, so all parameters should be non-AD JIDs.
+type LIDStore interface {
+	PutLIDMapping(lid, pn types.JID) error
+	PutManyLIDMappings(mappings []LIDMapping) error
+	GetPNForLID(lid types.JID) (types.JID, error)
+	GetLIDForPN(pn types.JID) (types.JID, error)
+	GetManyPNsForLIDs(lids []types.JID) (map[types.JID]types.JID, error)
+	GetManyLIDsForPNs(pns []types.JID) (map[types.JID]types.JID, error)
+}
+
+// GroupStore caches group metadata, so that sending messages to groups doesn't require
+// fetching the participant list from the server after every restart.
+type GroupStore interface {
+	PutGroup(info *types.GroupInfo) error
+	PutGroups(infos []*types.GroupInfo) error
+	GetGroup(jid types.JID) (*types.GroupInfo, error)
+	DeleteGroup(jid types.JID) error
+}
+
+// CachedDeviceList is a user's device list stored in a DeviceListStore.
+type CachedDeviceList struct {
+	User      types.JID
+	Devices   []types.JID
+	DHash     string
+	UpdatedAt time.Time
+}
+
+// DeviceListStore caches the device lists of other users, so that sending messages doesn't require
+// fetching the device list of every recipient from the server after every restart.
+type DeviceListStore interface {
+	PutDeviceList(list CachedDeviceList) error
+	GetDeviceList(user types.JID) (*CachedDeviceList, error)
+	// GetDeviceLists returns the stored device lists of the given users. Users whose device list isn't stored
+	// are not included in the map.
+	GetDeviceLists(users []types.JID) (map[types.JID]*CachedDeviceList, error)
+	DeleteDeviceList(user types.JID) error
+}
+
+// ChatMetadata contains the local state of a chat from app state that isn't covered by ChatSettingsStore.
+type ChatMetadata struct {
+	Found bool
+
+	// Whether the chat has been manually marked as unread.
+	MarkedAsUnread bool
+	// The time when the chat was last cleared or deleted, or zero if it hasn't been.
+	ClearedAt time.Time
+	DeletedAt time.Time
+}
+
+// MessageMetadata is the local state of a single message from app state (starring and deleting for me).
+type MessageMetadata struct {
+	Chat     types.JID
+	Sender   types.JID
+	ID       types.MessageID
+	IsFromMe bool
+
+	Starred      bool
+	DeletedForMe bool
+	// The timestamp of the latest app state mutation affecting this message.
+	UpdatedAt time.Time
+}
+
+// Label is a chat label from app state. Labels are only available on WhatsApp Business.
+type Label struct {
+	ID           string
+	Name         string
+	Color        int32
+	PredefinedID int32
+	Deleted      bool
+}
+
+// LabeledMessage is a message that has a label.
+type LabeledMessage struct {
+	Chat types.JID
+	ID   types.MessageID
+}
+
+// ChatMetadataStore stores the chat and message state from app state mutations (read markers, cleared and
+// deleted chats, starred and deleted messages, labels), so that it can be queried without keeping track of events.
+type ChatMetadataStore interface {
+	PutMarkedAsUnread(chat types.JID, unread bool) error
+	PutChatCleared(chat types.JID, ts time.Time) error
+	PutChatDeleted(chat types.JID, ts time.Time) error
+	GetChatMetadata(chat types.JID) (ChatMetadata, error)
+	// GetArchivedChats returns all chats that are archived according to the ChatSettingsStore of the same device.
+	GetArchivedChats() ([]types.JID, error)
+
+	PutMessageStarred(chat, sender types.JID, id types.MessageID, fromMe, starred bool, ts time.Time) error
+	PutMessageDeletedForMe(chat, sender types.JID, id types.MessageID, fromMe bool, ts time.Time) error
+	// GetMessageMetadata returns the metadata of a single message.
+	// Like in the app state mutations, the sender is empty for messages in private chats.
+	GetMessageMetadata(chat, sender types.JID, id types.MessageID) (*MessageMetadata, error)
+	// GetStarredMessages returns the starred messages in the given chat, or in all chats if the JID is empty.
+	GetStarredMessages(chat types.JID) ([]*MessageMetadata, error)
+
+	PutLabel(label Label) error
+	// GetLabels returns all labels that haven't been deleted.
+	GetLabels() ([]Label, error)
+	PutChatLabel(chat types.JID, labelID string, labeled bool) error
+	PutMessageLabel(chat types.JID, id types.MessageID, labelID string, labeled bool) error
+	GetChatsByLabel(labelID string) ([]types.JID, error)
+	GetLabelsForChat(chat types.JID) ([]string, error)
+	GetMessagesByLabel(labelID string) ([]LabeledMessage, error)
+}
+
+// ExportedPreKey is a single prekey in DeviceData.
+type ExportedPreKey struct {
+	KeyID    uint32
+	Key      []byte
+	Uploaded bool
+}
+
+// ExportedSenderKey is a single sender key in DeviceData.
+type ExportedSenderKey struct {
+	Group string
+	User  string
+	Key   []byte
+}
+
+// ExportedAppStateSyncKey is a single app state sync key in DeviceData.
+type ExportedAppStateSyncKey struct {
+	ID []byte
+	AppStateSyncKey
+}
+
+// ExportedAppStateMutationMAC is a single app state mutation MAC in DeviceData.
+type ExportedAppStateMutationMAC struct {
+	Version uint64
+	AppStateMutationMAC
+}
+
+// ExportedAppStateVersion is the state of a single app state collection in DeviceData.
+type ExportedAppStateVersion struct {
+	Name         string
+	Version      uint64
+	Hash         []byte
+	MutationMACs []ExportedAppStateMutationMAC
+}
+
+// ExportedContact is a single contact in DeviceData.
+type ExportedContact struct {
+	JID          types.JID
+	FirstName    string
+	FullName     string
+	PushName     string
+	BusinessName string
+}
+
+// DeviceData contains the state of a device that is needed to move it to another container without re-pairing.
+//
+// Caches that can be refetched from the server (like groups and device lists) and archived messages are not included.
+type DeviceData struct {
+	Identities       map[string][]byte
+	Sessions         map[string][]byte
+	PreKeys          []ExportedPreKey
+	SenderKeys       []ExportedSenderKey
+	AppStateSyncKeys []ExportedAppStateSyncKey
+	AppStateVersions []ExportedAppStateVersion
+	Contacts         []ExportedContact
+	PrivacyTokens    []PrivacyToken
+}
+
+// DeviceDataStore is used to export and import all the data of a device at once. See the store/bundle package.
+type DeviceDataStore interface {
+	ExportDeviceData() (*DeviceData, error)
+	// ImportDeviceData inserts the given data into the store. Existing rows with the same keys are overwritten.
+	ImportDeviceData(data *DeviceData) error
+}
+
+// MessageEntry is a single message stored in a MessageStore.
+type MessageEntry struct {
+	Chat      types.JID
+	Sender    types.JID
+	ID        types.MessageID
+	Timestamp time.Time
+	IsFromMe  bool
+	// The message content. This is the unwrapped message (i.e. events.Message.Message rather than RawMessage).
+	// For edited messages, this is the latest content.
+	Message *waE2E.Message
+
+	// The time of the most recent edit, or zero if the message hasn't been edited.
+	EditTimestamp time.Time
+	// Whether the message has been revoked (deleted for everyone). The original content is kept in Message.
+	Revoked bool
+	// Whether the message has been deleted for the current user from another device.
+	DeletedForMe bool
+}
+
+// MessageCursor is a position in a chat's message list used for paginating MessageStore.GetChatMessages.
+type MessageCursor struct {
+	Timestamp time.Time
+	ID        types.MessageID
+}
+
+// Cursor returns a cursor pointing at this message, which can be used to fetch messages older than this one.
+func (entry *MessageEntry) Cursor() *MessageCursor {
+	return &MessageCursor{Timestamp: entry.Timestamp, ID: entry.ID}
+}
+
+// MessageStore is an archive of incoming and outgoing messages. When it's set in Device.Messages, the client
+// stores messages automatically as they're received, sent or synced from history, and applies edits and
+// revocations to the stored messages.
+//
+// Messages are identified by the chat and message ID. Storing a message that already exists is a no-op.
+type MessageStore interface {
+	PutMessage(entry MessageEntry) error
+	PutMessages(entries []MessageEntry) error
+	// GetMessage returns the given message, or nil if it hasn't been stored.
+	GetMessage(chat types.JID, id types.MessageID) (*MessageEntry, error)
+	// GetChatMessages returns up to limit messages in the given chat, newest first.
+	// If before is non-nil, only messages older than the cursor are returned.
+	GetChatMessages(chat types.JID, before *MessageCursor, limit int) ([]*MessageEntry, error)
+	// UpdateMessageContent replaces the content of the given message if it was sent by the given sender
+	// and the edit is newer than the previous one.
+	UpdateMessageContent(chat, sender types.JID, id types.MessageID, message *waE2E.Message, editTimestamp time.Time) error
+	// MarkMessageRevoked marks the given message as revoked if it was sent by the given sender.
+	// Callers must check that the user who revoked the message is allowed to do so (i.e. is the sender or a group admin).
+	MarkMessageRevoked(chat, sender types.JID, id types.MessageID) error
+	MarkMessageDeletedForMe(chat types.JID, id types.MessageID) error
+}
+
+// OutboxEvent is an incoming event that has been persisted before being passed to event handlers.
+type OutboxEvent struct {
+	Chat   types.JID
+	Sender types.JID
+	ID     types.MessageID
+	// The data needed to reconstruct the event. The format is only known to the client.
+	Data []byte
+	// The number of times event handlers have failed to handle the event.
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// OutboxStore is a durable queue of incoming events that event handlers haven't handled successfully yet.
+// It's used by the client when Client.AckAfterHandle is enabled.
+type OutboxStore interface {
+	PutOutboxEvent(evt OutboxEvent) error
+	// GetOutboxEvents returns up to limit events, oldest first.
+	GetOutboxEvents(limit int) ([]*OutboxEvent, error)
+	IncrementOutboxAttempts(chat types.JID, id types.MessageID) error
+	DeleteOutboxEvent(chat types.JID, id types.MessageID) error
+}
+
 type Device struct {
 	Log waLog.Logger
 
@@ -152,8 +404,15 @@ type Device struct {
 	AppState      AppStateStore
 	Contacts      ContactStore
 	ChatSettings  ChatSettingsStore
+	ChatMetadata  ChatMetadataStore
 	MsgSecrets    MsgSecretStore
 	PrivacyTokens PrivacyTokenStore
+	Messages      MessageStore
+	Outbox        OutboxStore
+	LIDs          LIDStore
+	Groups        GroupStore
+	DeviceLists   DeviceListStore
+	DeviceData    DeviceDataStore
 	Container     DeviceContainer
 
 	DatabaseErrorHandler func(device *Device, action string, attemptIndex int, err error) (retry bool)
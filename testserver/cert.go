@@ -0,0 +1,65 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver
+
+import (
+	"time"
+
+	"go.mau.fi/libsignal/ecc"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow"
+	"github.com/Romerito007/whatsmeow/proto/waCert"
+	"github.com/Romerito007/whatsmeow/util/keys"
+)
+
+const (
+	intermediateCertSerial = 1
+	leafCertSerial         = 2
+)
+
+// makeCertChain creates a noise certificate chain for the given static key, signed by an intermediate key
+// which is in turn signed by the root key, like the chain that WhatsApp's servers send during the handshake.
+func makeCertChain(rootKey, staticKey *keys.KeyPair) []byte {
+	intermediateKey := keys.NewKeyPair()
+	notBefore := uint64(time.Now().Add(-24 * time.Hour).Unix())
+	notAfter := uint64(time.Now().Add(365 * 24 * time.Hour).Unix())
+	intermediate := signCert(rootKey, &waCert.CertChain_NoiseCertificate_Details{
+		Serial:       proto.Uint32(intermediateCertSerial),
+		IssuerSerial: proto.Uint32(whatsmeow.WACertIssuerSerial),
+		Key:          intermediateKey.Pub[:],
+		NotBefore:    proto.Uint64(notBefore),
+		NotAfter:     proto.Uint64(notAfter),
+	})
+	leaf := signCert(intermediateKey, &waCert.CertChain_NoiseCertificate_Details{
+		Serial:       proto.Uint32(leafCertSerial),
+		IssuerSerial: proto.Uint32(intermediateCertSerial),
+		Key:          staticKey.Pub[:],
+		NotBefore:    proto.Uint64(notBefore),
+		NotAfter:     proto.Uint64(notAfter),
+	})
+	chain, err := proto.Marshal(&waCert.CertChain{
+		Leaf:         leaf,
+		Intermediate: intermediate,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return chain
+}
+
+func signCert(issuerKey *keys.KeyPair, details *waCert.CertChain_NoiseCertificate_Details) *waCert.CertChain_NoiseCertificate {
+	detailsBytes, err := proto.Marshal(details)
+	if err != nil {
+		panic(err)
+	}
+	signature := ecc.CalculateSignature(ecc.NewDjbECPrivateKey(*issuerKey.Priv), detailsBytes)
+	return &waCert.CertChain_NoiseCertificate{
+		Details:   detailsBytes,
+		Signature: signature[:],
+	}
+}
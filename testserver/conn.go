@@ -0,0 +1,342 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/proto"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/proto/waWa6"
+	"github.com/Romerito007/whatsmeow/socket"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+	"github.com/Romerito007/whatsmeow/util/keys"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// conn is a single websocket connection from a client.
+type conn struct {
+	srv *Server
+	ws  *websocket.Conn
+	log waLog.Logger
+
+	writeLock    sync.Mutex
+	writeKey     cipher.AEAD
+	writeCounter uint32
+	readKey      cipher.AEAD
+	readCounter  uint32
+	closed       atomic.Bool
+
+	headerReceived bool
+	pendingFrames  [][]byte
+
+	// The device that the connection is logged in as, set after a successful handshake.
+	device *device
+}
+
+func (srv *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := srv.wsUp.Upgrade(w, r, nil)
+	if err != nil {
+		srv.log.Warnf("Failed to upgrade websocket connection: %v", err)
+		return
+	}
+	c := &conn{
+		srv: srv,
+		ws:  ws,
+		log: srv.log.Sub(r.RemoteAddr),
+	}
+	srv.lock.Lock()
+	if srv.closed.Load() {
+		srv.lock.Unlock()
+		_ = ws.Close()
+		return
+	}
+	srv.conns[c] = struct{}{}
+	srv.lock.Unlock()
+	go c.serve()
+}
+
+func (c *conn) serve() {
+	defer c.close()
+	if err := c.handshake(); err != nil {
+		c.log.Warnf("Handshake failed: %v", err)
+		return
+	}
+	for {
+		frame, err := c.readFrame()
+		if err != nil {
+			if !c.closed.Load() {
+				c.log.Debugf("Failed to read frame: %v", err)
+			}
+			return
+		}
+		plaintext, err := c.readKey.Open(nil, generateIV(c.readCounter), frame, nil)
+		c.readCounter++
+		if err != nil {
+			c.log.Warnf("Failed to decrypt frame: %v", err)
+			return
+		}
+		decompressed, err := waBinary.Unpack(plaintext)
+		if err != nil {
+			c.log.Warnf("Failed to decompress frame: %v", err)
+			continue
+		}
+		node, err := waBinary.Unmarshal(decompressed)
+		if err != nil {
+			c.log.Warnf("Failed to decode node: %v", err)
+			continue
+		}
+		c.log.Debugf("Received %s", node.XMLString())
+		c.srv.handleNode(c, node)
+	}
+}
+
+func (c *conn) close() {
+	if !c.closed.CompareAndSwap(false, true) {
+		return
+	}
+	_ = c.ws.Close()
+	c.srv.lock.Lock()
+	delete(c.srv.conns, c)
+	if c.device != nil && c.device.conn == c {
+		c.device.conn = nil
+	}
+	c.srv.lock.Unlock()
+}
+
+func generateIV(count uint32) []byte {
+	iv := make([]byte, 12)
+	binary.BigEndian.PutUint32(iv[8:], count)
+	return iv
+}
+
+// readFrame returns the next length-prefixed frame sent by the client.
+func (c *conn) readFrame() ([]byte, error) {
+	for len(c.pendingFrames) == 0 {
+		msgType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return nil, err
+		} else if msgType != websocket.BinaryMessage {
+			continue
+		}
+		if !c.headerReceived {
+			if !bytes.HasPrefix(data, socket.WAConnHeader) {
+				return nil, fmt.Errorf("unexpected connection header %X", data[:min(len(data), len(socket.WAConnHeader))])
+			}
+			data = data[len(socket.WAConnHeader):]
+			c.headerReceived = true
+		}
+		for len(data) > 0 {
+			if len(data) < socket.FrameLengthSize {
+				return nil, errors.New("incomplete frame length")
+			}
+			length := int(data[0])<<16 | int(data[1])<<8 | int(data[2])
+			data = data[socket.FrameLengthSize:]
+			if len(data) < length {
+				return nil, fmt.Errorf("incomplete frame (expected %d bytes, got %d)", length, len(data))
+			}
+			c.pendingFrames = append(c.pendingFrames, data[:length])
+			data = data[length:]
+		}
+	}
+	frame := c.pendingFrames[0]
+	c.pendingFrames = c.pendingFrames[1:]
+	return frame, nil
+}
+
+// writeFrame sends a length-prefixed frame to the client. The write lock must be held.
+func (c *conn) writeFrame(data []byte) error {
+	if len(data) >= socket.FrameMaxSize {
+		return socket.ErrFrameTooLarge
+	}
+	wholeFrame := make([]byte, socket.FrameLengthSize+len(data))
+	wholeFrame[0] = byte(len(data) >> 16)
+	wholeFrame[1] = byte(len(data) >> 8)
+	wholeFrame[2] = byte(len(data))
+	copy(wholeFrame[socket.FrameLengthSize:], data)
+	_ = c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.ws.WriteMessage(websocket.BinaryMessage, wholeFrame)
+}
+
+func (c *conn) sendNode(node waBinary.Node) error {
+	payload, err := waBinary.Marshal(node)
+	if err != nil {
+		return fmt.Errorf("failed to marshal node: %w", err)
+	}
+	c.log.Debugf("Sending %s", node.XMLString())
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	ciphertext := c.writeKey.Seal(nil, generateIV(c.writeCounter), payload, nil)
+	c.writeCounter++
+	return c.writeFrame(ciphertext)
+}
+
+func (c *conn) sendStreamError(code, conflictType string) {
+	node := waBinary.Node{Tag: "stream:error", Attrs: waBinary.Attrs{}}
+	if code != "" {
+		node.Attrs["code"] = code
+	}
+	if conflictType != "" {
+		node.Content = []waBinary.Node{{Tag: "conflict", Attrs: waBinary.Attrs{"type": conflictType}}}
+	}
+	if err := c.sendNode(node); err != nil {
+		c.log.Debugf("Failed to send stream error: %v", err)
+	}
+}
+
+// handshake implements the server side of the Noise_XX_25519_AESGCM_SHA256 handshake
+// and logs in the device that the client authenticates as.
+func (c *conn) handshake() error {
+	_ = c.ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer func() {
+		_ = c.ws.SetReadDeadline(time.Time{})
+	}()
+	frame, err := c.readFrame()
+	if err != nil {
+		return fmt.Errorf("failed to read client hello: %w", err)
+	}
+	var hello waWa6.HandshakeMessage
+	if err = proto.Unmarshal(frame, &hello); err != nil {
+		return fmt.Errorf("failed to unmarshal client hello: %w", err)
+	}
+	clientEphemeral := hello.GetClientHello().GetEphemeral()
+	if len(clientEphemeral) != 32 {
+		return fmt.Errorf("unexpected length of client ephemeral key %d", len(clientEphemeral))
+	}
+	ephemeralKP := keys.NewKeyPair()
+
+	nh := socket.NewNoiseHandshake()
+	nh.Start(socket.NoiseStartPattern, socket.WAConnHeader)
+	nh.Authenticate(clientEphemeral)
+	nh.Authenticate(ephemeralKP.Pub[:])
+	if err = nh.MixSharedSecretIntoKey(*ephemeralKP.Priv, [32]byte(clientEphemeral)); err != nil {
+		return fmt.Errorf("failed to mix ephemeral keys in: %w", err)
+	}
+	encryptedStatic := nh.Encrypt(c.srv.staticKey.Pub[:])
+	if err = nh.MixSharedSecretIntoKey(*c.srv.staticKey.Priv, [32]byte(clientEphemeral)); err != nil {
+		return fmt.Errorf("failed to mix static key in: %w", err)
+	}
+	encryptedCert := nh.Encrypt(c.srv.certChain)
+	data, err := proto.Marshal(&waWa6.HandshakeMessage{
+		ServerHello: &waWa6.HandshakeMessage_ServerHello{
+			Ephemeral: ephemeralKP.Pub[:],
+			Static:    encryptedStatic,
+			Payload:   encryptedCert,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal server hello: %w", err)
+	}
+	c.writeLock.Lock()
+	err = c.writeFrame(data)
+	c.writeLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send server hello: %w", err)
+	}
+
+	frame, err = c.readFrame()
+	if err != nil {
+		return fmt.Errorf("failed to read client finish: %w", err)
+	}
+	var finish waWa6.HandshakeMessage
+	if err = proto.Unmarshal(frame, &finish); err != nil {
+		return fmt.Errorf("failed to unmarshal client finish: %w", err)
+	}
+	clientStatic, err := nh.Decrypt(finish.GetClientFinish().GetStatic())
+	if err != nil {
+		return fmt.Errorf("failed to decrypt client static key: %w", err)
+	} else if len(clientStatic) != 32 {
+		return fmt.Errorf("unexpected length of client static key %d", len(clientStatic))
+	} else if err = nh.MixSharedSecretIntoKey(*ephemeralKP.Priv, [32]byte(clientStatic)); err != nil {
+		return fmt.Errorf("failed to mix client static key in: %w", err)
+	}
+	payloadBytes, err := nh.Decrypt(finish.GetClientFinish().GetPayload())
+	if err != nil {
+		return fmt.Errorf("failed to decrypt client payload: %w", err)
+	}
+	var payload waWa6.ClientPayload
+	if err = proto.Unmarshal(payloadBytes, &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal client payload: %w", err)
+	}
+	c.readKey, c.writeKey, err = nh.FinalKeys()
+	if err != nil {
+		return err
+	}
+	return c.login(&payload, [32]byte(clientStatic))
+}
+
+func (c *conn) login(payload *waWa6.ClientPayload, noiseKey [32]byte) error {
+	if payload.Username == nil {
+		_ = c.sendNode(waBinary.Node{Tag: "failure", Attrs: waBinary.Attrs{"reason": int(events.ConnectFailureGeneric)}})
+		return errors.New("pairing new devices is not supported")
+	}
+	jid := types.NewADJID(strconv.FormatUint(payload.GetUsername(), 10), 0, byte(payload.GetDevice()))
+	c.srv.lock.Lock()
+	dev := c.srv.getDevice(jid)
+	if dev == nil || dev.noiseKey != noiseKey {
+		c.srv.lock.Unlock()
+		_ = c.sendNode(waBinary.Node{Tag: "failure", Attrs: waBinary.Attrs{"reason": int(events.ConnectFailureLoggedOut)}})
+		return fmt.Errorf("unknown device %s", jid)
+	}
+	oldConn := dev.conn
+	dev.conn = c
+	c.device = dev
+	c.log = c.srv.log.Sub(jid.String())
+	// Keep the lock while sending the queue, so that new messages aren't delivered in between.
+	err := c.sendOfflineQueue(dev)
+	c.srv.lock.Unlock()
+	if oldConn != nil {
+		oldConn.sendStreamError("", "replaced")
+		oldConn.close()
+	}
+	return err
+}
+
+// sendOfflineQueue sends the success node and all nodes that were queued while the device was offline.
+// The server lock must be held.
+func (c *conn) sendOfflineQueue(dev *device) error {
+	err := c.sendNode(waBinary.Node{
+		Tag: "success",
+		Attrs: waBinary.Attrs{
+			"t":        time.Now().Unix(),
+			"props":    "1",
+			"location": "test",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send success: %w", err)
+	}
+	count := len(dev.queue)
+	for len(dev.queue) > 0 {
+		if err = c.sendNode(*dev.queue[0]); err != nil {
+			return fmt.Errorf("failed to send queued node: %w", err)
+		}
+		dev.queue = dev.queue[1:]
+	}
+	dev.queue = nil
+	return c.sendNode(waBinary.Node{
+		Tag: "ib",
+		Content: []waBinary.Node{{
+			Tag:   "offline",
+			Attrs: waBinary.Attrs{"count": count},
+		}},
+	})
+}
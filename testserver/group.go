@@ -0,0 +1,107 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver
+
+import (
+	"slices"
+	"time"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+func (srv *Server) handleGroupIQ(dev *device, iqType string, node *waBinary.Node) ([]waBinary.Node, *iqError) {
+	to, _ := node.Attrs["to"].(types.JID)
+	children := node.GetChildren()
+	if len(children) != 1 {
+		return nil, errIQBadRequest
+	}
+	child := children[0]
+	sender := dev.jid.ToNonAD()
+	switch {
+	case child.Tag == "query" && iqType == "get":
+		grp, ok := srv.groups[to]
+		if !ok {
+			return nil, errIQNotFound
+		} else if !grp.hasParticipant(sender) {
+			return nil, errIQForbidden
+		}
+		return []waBinary.Node{grp.toNode()}, nil
+	case child.Tag == "participating" && iqType == "get" && to == types.GroupServerJID:
+		var groups []waBinary.Node
+		for _, grp := range srv.groups {
+			if grp.hasParticipant(sender) {
+				groups = append(groups, grp.toNode())
+			}
+		}
+		return []waBinary.Node{{Tag: "groups", Content: groups}}, nil
+	case child.Tag == "create" && iqType == "set" && to == types.GroupServerJID:
+		name, _ := child.Attrs["subject"].(string)
+		var participants []types.JID
+		for _, pcp := range child.GetChildrenByTag("participant") {
+			if jid, ok := pcp.Attrs["jid"].(types.JID); ok {
+				participants = append(participants, jid)
+			}
+		}
+		grp := srv.createGroup(name, sender, participants)
+		createNode := waBinary.Node{
+			Tag:     "create",
+			Attrs:   waBinary.Attrs{"reason": "create"},
+			Content: []waBinary.Node{grp.toNode()},
+		}
+		if key, ok := child.Attrs["key"]; ok {
+			createNode.Attrs["key"] = key
+		}
+		for _, participant := range grp.participants {
+			for _, target := range srv.getUserDevices(participant) {
+				if target == dev {
+					continue
+				}
+				srv.deliver(target, &waBinary.Node{
+					Tag: "notification",
+					Attrs: waBinary.Attrs{
+						"from":        grp.jid,
+						"id":          srv.generateID(),
+						"type":        "w:gp2",
+						"t":           time.Now().Unix(),
+						"participant": sender,
+					},
+					Content: []waBinary.Node{createNode},
+				})
+			}
+		}
+		return []waBinary.Node{grp.toNode()}, nil
+	default:
+		return nil, errIQNotImplemented
+	}
+}
+
+func (grp *group) hasParticipant(jid types.JID) bool {
+	return slices.Contains(grp.participants, jid.ToNonAD())
+}
+
+func (grp *group) toNode() waBinary.Node {
+	participants := make([]waBinary.Node, len(grp.participants))
+	for i, participant := range grp.participants {
+		participants[i] = waBinary.Node{Tag: "participant", Attrs: waBinary.Attrs{"jid": participant}}
+		if participant == grp.creator {
+			participants[i].Attrs["type"] = "superadmin"
+		}
+	}
+	return waBinary.Node{
+		Tag: "group",
+		Attrs: waBinary.Attrs{
+			"id":       grp.jid.User,
+			"subject":  grp.name,
+			"s_t":      grp.created.Unix(),
+			"s_o":      grp.creator,
+			"creation": grp.created.Unix(),
+			"creator":  grp.creator,
+		},
+		Content: participants,
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+
+	"go.mau.fi/libsignal/ecc"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/util/keys"
+)
+
+type iqError struct {
+	Code int
+	Text string
+}
+
+var (
+	errIQBadRequest     = &iqError{Code: 400, Text: "bad-request"}
+	errIQForbidden      = &iqError{Code: 403, Text: "forbidden"}
+	errIQNotFound       = &iqError{Code: 404, Text: "item-not-found"}
+	errIQNotImplemented = &iqError{Code: 501, Text: "feature-not-implemented"}
+)
+
+func (srv *Server) handleNode(c *conn, node *waBinary.Node) {
+	if srv.OnClientNode != nil {
+		srv.OnClientNode(c.device.jid, node)
+	}
+	switch node.Tag {
+	case "iq":
+		srv.handleIQ(c, node)
+	case "message":
+		srv.handleMessage(c, node)
+	case "receipt":
+		srv.handleReceipt(c, node)
+	case "ack", "presence", "chatstate":
+		// These aren't needed for anything
+	default:
+		c.log.Debugf("Ignoring unsupported %s node", node.Tag)
+	}
+}
+
+func (srv *Server) handleIQ(c *conn, node *waBinary.Node) {
+	ag := node.AttrGetter()
+	id := ag.String("id")
+	xmlns := ag.OptionalString("xmlns")
+	iqType := ag.OptionalString("type")
+	if iqType == "result" || iqType == "error" {
+		return
+	}
+	var content []waBinary.Node
+	var err *iqError
+	srv.lock.Lock()
+	switch xmlns {
+	case "w:p", "passive":
+		// Pings and passive mode changes don't need any response content
+	case "encrypt":
+		content, err = srv.handleEncryptIQ(c.device, iqType, node)
+	case "usync":
+		content, err = srv.handleUsyncIQ(node)
+	case "w:m":
+		content, err = srv.handleMediaConnIQ(node)
+	case "w:g2":
+		content, err = srv.handleGroupIQ(c.device, iqType, node)
+	default:
+		err = errIQNotImplemented
+	}
+	srv.lock.Unlock()
+	resp := waBinary.Node{
+		Tag: "iq",
+		Attrs: waBinary.Attrs{
+			"id":   id,
+			"type": "result",
+			"from": types.ServerJID,
+		},
+	}
+	if from, ok := node.Attrs["to"].(types.JID); ok {
+		resp.Attrs["from"] = from
+	}
+	if err != nil {
+		c.log.Debugf("Returning error %d to %s IQ %s", err.Code, xmlns, id)
+		resp.Attrs["type"] = "error"
+		content = []waBinary.Node{{Tag: "error", Attrs: waBinary.Attrs{"code": err.Code, "text": err.Text}}}
+	}
+	if len(content) > 0 {
+		resp.Content = content
+	}
+	if sendErr := c.sendNode(resp); sendErr != nil {
+		c.log.Warnf("Failed to send response to IQ %s: %v", id, sendErr)
+	}
+}
+
+func (srv *Server) handleEncryptIQ(dev *device, iqType string, node *waBinary.Node) ([]waBinary.Node, *iqError) {
+	if _, ok := node.GetOptionalChildByTag("count"); ok {
+		return []waBinary.Node{{Tag: "count", Attrs: waBinary.Attrs{"value": len(dev.preKeys)}}}, nil
+	} else if keyReq, ok := node.GetOptionalChildByTag("key"); ok {
+		return srv.fetchPreKeys(keyReq.GetChildren()), nil
+	} else if iqType != "set" {
+		return nil, errIQBadRequest
+	}
+	registration, _ := node.GetChildByTag("registration").Content.([]byte)
+	identity, _ := node.GetChildByTag("identity").Content.([]byte)
+	signedPreKey, ok := parsePreKey(node.GetChildByTag("skey"))
+	if len(registration) != 4 || len(identity) != 32 || !ok {
+		return nil, errIQBadRequest
+	}
+	var preKeys []*keys.PreKey
+	list := node.GetChildByTag("list")
+	for _, child := range list.GetChildren() {
+		preKey, ok := parsePreKey(child)
+		if !ok {
+			return nil, errIQBadRequest
+		}
+		preKeys = append(preKeys, preKey)
+	}
+	dev.registrationID = binary.BigEndian.Uint32(registration)
+	dev.identityKey = [32]byte(identity)
+	dev.signedPreKey = signedPreKey
+	for _, preKey := range preKeys {
+		if !slices.ContainsFunc(dev.preKeys, func(existing *keys.PreKey) bool { return existing.KeyID == preKey.KeyID }) {
+			dev.preKeys = append(dev.preKeys, preKey)
+		}
+	}
+	return nil, nil
+}
+
+// fetchPreKeys returns the prekey bundles of the requested devices. Each one-time prekey is only returned once.
+func (srv *Server) fetchPreKeys(requests []waBinary.Node) []waBinary.Node {
+	users := make([]waBinary.Node, 0, len(requests))
+	for _, req := range requests {
+		jid, ok := req.Attrs["jid"].(types.JID)
+		if req.Tag != "user" || !ok {
+			continue
+		}
+		dev := srv.getDevice(jid)
+		if dev == nil {
+			users = append(users, waBinary.Node{
+				Tag:     "user",
+				Attrs:   waBinary.Attrs{"jid": jid},
+				Content: []waBinary.Node{{Tag: "error", Attrs: waBinary.Attrs{"code": errIQNotFound.Code, "text": errIQNotFound.Text}}},
+			})
+			continue
+		}
+		var registrationID [4]byte
+		binary.BigEndian.PutUint32(registrationID[:], dev.registrationID)
+		bundle := []waBinary.Node{
+			{Tag: "registration", Content: registrationID[:]},
+			{Tag: "type", Content: []byte{ecc.DjbType}},
+			{Tag: "identity", Content: dev.identityKey[:]},
+			preKeyToNode(dev.signedPreKey),
+		}
+		if len(dev.preKeys) > 0 {
+			bundle = append(bundle, preKeyToNode(dev.preKeys[0]))
+			dev.preKeys = dev.preKeys[1:]
+		}
+		users = append(users, waBinary.Node{Tag: "user", Attrs: waBinary.Attrs{"jid": jid}, Content: bundle})
+	}
+	return []waBinary.Node{{Tag: "list", Content: users}}
+}
+
+func preKeyToNode(key *keys.PreKey) waBinary.Node {
+	var keyID [4]byte
+	binary.BigEndian.PutUint32(keyID[:], key.KeyID)
+	node := waBinary.Node{
+		Tag: "key",
+		Content: []waBinary.Node{
+			{Tag: "id", Content: keyID[1:]},
+			{Tag: "value", Content: key.Pub[:]},
+		},
+	}
+	if key.Signature != nil {
+		node.Tag = "skey"
+		node.Content = append(node.GetChildren(), waBinary.Node{Tag: "signature", Content: key.Signature[:]})
+	}
+	return node
+}
+
+func parsePreKey(node waBinary.Node) (*keys.PreKey, bool) {
+	id, _ := node.GetChildByTag("id").Content.([]byte)
+	value, _ := node.GetChildByTag("value").Content.([]byte)
+	if len(id) != 3 || len(value) != 32 {
+		return nil, false
+	}
+	key := &keys.PreKey{
+		KeyPair: keys.KeyPair{Pub: (*[32]byte)(value)},
+		KeyID:   binary.BigEndian.Uint32(append([]byte{0}, id...)),
+	}
+	if node.Tag == "skey" {
+		signature, _ := node.GetChildByTag("signature").Content.([]byte)
+		if len(signature) != 64 {
+			return nil, false
+		}
+		key.Signature = (*[64]byte)(signature)
+	}
+	return key, true
+}
+
+func (srv *Server) handleUsyncIQ(node *waBinary.Node) ([]waBinary.Node, *iqError) {
+	usync, ok := node.GetOptionalChildByTag("usync")
+	if !ok {
+		return nil, errIQBadRequest
+	}
+	queryNode, listNode := usync.GetChildByTag("query"), usync.GetChildByTag("list")
+	queries, requests := queryNode.GetChildren(), listNode.GetChildren()
+	users := make([]waBinary.Node, 0, len(requests))
+	for _, req := range requests {
+		var phone string
+		var contactQuery []byte
+		if jid, ok := req.Attrs["jid"].(types.JID); ok {
+			phone = jid.User
+		} else if contact, ok := req.GetOptionalChildByTag("contact"); ok {
+			contactQuery, _ = contact.Content.([]byte)
+			phone = strings.TrimPrefix(strings.TrimSuffix(string(contactQuery), "@"+types.LegacyUserServer), "+")
+		} else {
+			continue
+		}
+		jid := types.NewJID(phone, types.DefaultUserServer)
+		devices := srv.getUserDevices(jid)
+		results := make([]waBinary.Node, 0, len(queries))
+		for _, query := range queries {
+			switch query.Tag {
+			case "devices":
+				deviceNodes := make([]waBinary.Node, len(devices))
+				for i, dev := range devices {
+					deviceNodes[i] = waBinary.Node{Tag: "device", Attrs: waBinary.Attrs{"id": int(dev.jid.Device)}}
+				}
+				results = append(results, waBinary.Node{
+					Tag:     "devices",
+					Content: []waBinary.Node{{Tag: "device-list", Content: deviceNodes}},
+				})
+			case "contact":
+				contactType := "out"
+				if len(devices) > 0 {
+					contactType = "in"
+				}
+				contactNode := waBinary.Node{Tag: "contact", Attrs: waBinary.Attrs{"type": contactType}}
+				if contactQuery != nil {
+					contactNode.Content = contactQuery
+				}
+				results = append(results, contactNode)
+			}
+		}
+		users = append(users, waBinary.Node{Tag: "user", Attrs: waBinary.Attrs{"jid": jid}, Content: results})
+	}
+	return []waBinary.Node{{
+		Tag:   "usync",
+		Attrs: usync.Attrs,
+		Content: []waBinary.Node{
+			{Tag: "result"},
+			{Tag: "list", Content: users},
+		},
+	}}, nil
+}
+
+func (srv *Server) handleMediaConnIQ(node *waBinary.Node) ([]waBinary.Node, *iqError) {
+	if _, ok := node.GetOptionalChildByTag("media_conn"); !ok {
+		return nil, errIQNotImplemented
+	}
+	return []waBinary.Node{{
+		Tag: "media_conn",
+		Attrs: waBinary.Attrs{
+			"auth":        "test-media-auth",
+			"ttl":         3600,
+			"auth_ttl":    3600,
+			"max_buckets": 12,
+		},
+		Content: []waBinary.Node{{Tag: "host", Attrs: waBinary.Attrs{"hostname": srv.Host()}}},
+	}}, nil
+}
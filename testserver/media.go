@@ -0,0 +1,52 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Romerito007/whatsmeow"
+)
+
+// maxMediaSize is the maximum size of a single media upload.
+const maxMediaSize = 64 * 1024 * 1024
+
+func (srv *Server) handleMediaUpload(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxMediaSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if len(data) > maxMediaSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	id := srv.generateID()
+	srv.lock.Lock()
+	srv.media[id] = data
+	srv.lock.Unlock()
+	directPath := fmt.Sprintf("/media/%s?type=%s", id, r.PathValue("type"))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&whatsmeow.UploadResponse{
+		URL:        fmt.Sprintf("https://%s%s", srv.Host(), directPath),
+		DirectPath: directPath,
+	})
+}
+
+func (srv *Server) handleMediaDownload(w http.ResponseWriter, r *http.Request) {
+	srv.lock.Lock()
+	data, ok := srv.media[r.PathValue("id")]
+	srv.lock.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(data)
+}
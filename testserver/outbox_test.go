@@ -0,0 +1,290 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store/memstore"
+	"github.com/Romerito007/whatsmeow/testserver"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// clientNodeLog records the message acks and receipts that clients send to the server.
+type clientNodeLog struct {
+	lock    sync.Mutex
+	nodes   map[types.JID][]string
+	changed chan struct{}
+}
+
+func logClientNodes(srv *testserver.Server) *clientNodeLog {
+	log := &clientNodeLog{nodes: make(map[types.JID][]string), changed: make(chan struct{}, 1)}
+	srv.OnClientNode = func(from types.JID, node *waBinary.Node) {
+		if node.Tag != "receipt" && (node.Tag != "ack" || node.AttrGetter().OptionalString("class") != "message") {
+			return
+		}
+		log.lock.Lock()
+		log.nodes[from.ToNonAD()] = append(log.nodes[from.ToNonAD()], node.Tag+":"+node.AttrGetter().String("id"))
+		log.lock.Unlock()
+		select {
+		case log.changed <- struct{}{}:
+		default:
+		}
+	}
+	return log
+}
+
+func (log *clientNodeLog) has(from types.JID, tag string, id types.MessageID) bool {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return slices.Contains(log.nodes[from], tag+":"+id)
+}
+
+func (log *clientNodeLog) wait(t *testing.T, from types.JID, tag string, id types.MessageID) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for !log.has(from, tag, id) {
+		select {
+		case <-log.changed:
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s of %s from %s", tag, id, from)
+		}
+	}
+}
+
+// handledMessages records the messages passed to a client's error-returning event handler.
+// Unlike the events channel of testClient, it keeps events that arrive while connect is waiting.
+type handledMessages struct {
+	lock        sync.Mutex
+	messages    []*events.Message
+	deadLetters []*events.OutboxDeadLetter
+}
+
+func (hm *handledMessages) add(evt *events.Message) {
+	hm.lock.Lock()
+	hm.messages = append(hm.messages, evt)
+	hm.lock.Unlock()
+}
+
+func (hm *handledMessages) addDeadLetter(evt *events.OutboxDeadLetter) {
+	hm.lock.Lock()
+	hm.deadLetters = append(hm.deadLetters, evt)
+	hm.lock.Unlock()
+}
+
+func (hm *handledMessages) get() []*events.Message {
+	hm.lock.Lock()
+	defer hm.lock.Unlock()
+	return slices.Clone(hm.messages)
+}
+
+// wait waits until the handler has got at least count messages and returns them.
+func (hm *handledMessages) wait(t *testing.T, count int) []*events.Message {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		messages := hm.get()
+		if len(messages) >= count {
+			return messages
+		} else if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d handled messages, got %d", count, len(messages))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func sendText(t *testing.T, from *testClient, to types.JID, text string) types.MessageID {
+	t.Helper()
+	resp, err := from.SendMessage(context.Background(), to, &waE2E.Message{Conversation: proto.String(text)})
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	return resp.ID
+}
+
+// reconnect drops the client's connection on the server side and connects again.
+func (tc *testClient) reconnect(t *testing.T, srv *testserver.Server, whileOffline func()) {
+	t.Helper()
+	srv.Disconnect(*tc.Store.ID)
+	tc.Disconnect()
+	if whileOffline != nil {
+		whileOffline()
+	}
+	tc.connect(t)
+}
+
+func outboxLength(t *testing.T, tc *testClient) int {
+	t.Helper()
+	stored, err := tc.Store.Outbox.GetOutboxEvents(100)
+	if err != nil {
+		t.Fatalf("failed to get outbox: %v", err)
+	}
+	return len(stored)
+}
+
+var errHandlerFailed = errors.New("handler failed")
+
+func TestAckAfterHandle_NoAckOnError(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	nodes := logClientNodes(srv)
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := newClient(t, srv, container, "2222")
+	bobJID := bob.Store.ID.ToNonAD()
+	bob.AckAfterHandle = true
+	// Without an outbox, messages whose handlers fail must be left to the server to redeliver
+	bob.Store.Outbox = nil
+	var handled handledMessages
+	bob.AddEventHandlerWithError(func(evt any) error {
+		if msg, ok := evt.(*events.Message); ok {
+			handled.add(msg)
+			if msg.Message.GetConversation() == "fail" {
+				return errHandlerFailed
+			}
+		}
+		return nil
+	})
+	bob.connect(t)
+
+	failedID := sendText(t, alice, bobJID, "fail")
+	okID := sendText(t, alice, bobJID, "ok")
+	handled.wait(t, 2)
+	// Messages are handled in order, so once the second message has been acked and receipted,
+	// the first one would have been too if the client was going to do it.
+	nodes.wait(t, bobJID, "ack", okID)
+	nodes.wait(t, bobJID, "receipt", okID)
+	alice.waitReceipt(t, okID, types.ReceiptTypeDelivered, types.ReceiptTypeInactive)
+	if nodes.has(bobJID, "ack", failedID) {
+		t.Errorf("message whose handler failed was acknowledged")
+	}
+	if nodes.has(bobJID, "receipt", failedID) {
+		t.Errorf("delivery receipt was sent for message whose handler failed")
+	}
+}
+
+func TestAckAfterHandle_ReplayFromOutbox(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	nodes := logClientNodes(srv)
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := newClient(t, srv, container, "2222")
+	bobJID := bob.Store.ID.ToNonAD()
+	bob.AckAfterHandle = true
+	bob.EnableAutoReconnect = false
+	var failing atomic.Bool
+	failing.Store(true)
+	var handled handledMessages
+	bob.AddEventHandlerWithError(func(evt any) error {
+		if msg, ok := evt.(*events.Message); ok {
+			handled.add(msg)
+			if failing.Load() {
+				return errHandlerFailed
+			}
+		}
+		return nil
+	})
+	bob.connect(t)
+
+	firstID := sendText(t, alice, bobJID, "first")
+	handled.wait(t, 1)
+	// The message is acknowledged even though the handler failed, because it's safe in the outbox
+	nodes.wait(t, bobJID, "ack", firstID)
+	if length := outboxLength(t, bob); length != 1 {
+		t.Fatalf("outbox has %d events after handler failed, expected 1", length)
+	}
+
+	failing.Store(false)
+	var secondID types.MessageID
+	bob.reconnect(t, srv, func() {
+		// The server delivers this right after the client logs in, which must not overtake the replay
+		secondID = sendText(t, alice, bobJID, "second")
+	})
+
+	messages := handled.wait(t, 3)
+	if len(messages) != 3 {
+		t.Fatalf("handler got %d messages, expected 3", len(messages))
+	}
+	if messages[0].Info.ID != firstID || messages[0].IsReplay {
+		t.Errorf("first handled message is %s (replay: %t), expected live %s", messages[0].Info.ID, messages[0].IsReplay, firstID)
+	}
+	if messages[1].Info.ID != firstID || !messages[1].IsReplay {
+		t.Errorf("second handled message is %s (replay: %t), expected replayed %s", messages[1].Info.ID, messages[1].IsReplay, firstID)
+	}
+	if messages[2].Info.ID != secondID || messages[2].IsReplay {
+		t.Errorf("third handled message is %s (replay: %t), expected live %s", messages[2].Info.ID, messages[2].IsReplay, secondID)
+	}
+	if length := outboxLength(t, bob); length != 0 {
+		t.Errorf("outbox has %d events after replay, expected 0", length)
+	}
+}
+
+func TestAckAfterHandle_DeadLetter(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := newClient(t, srv, container, "2222")
+	bobJID := bob.Store.ID.ToNonAD()
+	bob.AckAfterHandle = true
+	bob.EnableAutoReconnect = false
+	bob.OutboxMaxAttempts = 2
+	var handled handledMessages
+	bob.AddEventHandlerWithError(func(evt any) error {
+		switch typedEvt := evt.(type) {
+		case *events.Message:
+			handled.add(typedEvt)
+			return errHandlerFailed
+		case *events.OutboxDeadLetter:
+			handled.addDeadLetter(typedEvt)
+		}
+		return nil
+	})
+	bob.connect(t)
+
+	id := sendText(t, alice, bobJID, "poison")
+	handled.wait(t, 1)
+	// The first replay fails too, which uses up the last attempt
+	bob.reconnect(t, srv, nil)
+	if length := outboxLength(t, bob); length != 1 {
+		t.Fatalf("outbox has %d events after second attempt, expected 1", length)
+	}
+	// The replay is done before the client dispatches the connected event,
+	// so the dead letter must have been handled once reconnecting returns.
+	bob.reconnect(t, srv, nil)
+	handled.lock.Lock()
+	deadLetters := handled.deadLetters
+	handled.lock.Unlock()
+	if len(deadLetters) != 1 {
+		t.Fatalf("got %d dead letters, expected 1", len(deadLetters))
+	}
+	deadLetter := deadLetters[0]
+	if deadLetter.ID != id || deadLetter.Chat.ToNonAD() != alice.Store.ID.ToNonAD() || deadLetter.Attempts != 2 {
+		t.Errorf("unexpected dead letter %s in %s after %d attempts", deadLetter.ID, deadLetter.Chat, deadLetter.Attempts)
+	}
+	if deadLetter.Message == nil || deadLetter.Message.Message.GetConversation() != "poison" {
+		t.Errorf("dead letter doesn't contain the message: %+v", deadLetter.Message)
+	}
+	if count := len(handled.get()); count != 2 {
+		t.Errorf("handler got the message %d times, expected 2", count)
+	}
+	if length := outboxLength(t, bob); length != 0 {
+		t.Errorf("outbox has %d events after dead letter, expected 0", length)
+	}
+}
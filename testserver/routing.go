@@ -0,0 +1,219 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver
+
+import (
+	"slices"
+	"time"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+// deliver sends a node to a device, or queues it until the device connects if it's offline.
+//
+// The server lock must be held. Nodes are sent while holding the lock, so that a device
+// always receives nodes in the same order as they were routed.
+func (srv *Server) deliver(dev *device, node *waBinary.Node) {
+	if srv.BeforeDeliver != nil {
+		node = srv.BeforeDeliver(dev.jid, node)
+		if node == nil {
+			return
+		}
+	}
+	if dev.conn != nil {
+		err := dev.conn.sendNode(*node)
+		if err == nil {
+			return
+		}
+		dev.conn.log.Debugf("Failed to deliver %s, queuing it: %v", node.Tag, err)
+	}
+	dev.queue = append(dev.queue, node)
+}
+
+// copyAttrs returns a copy of the attributes of a node without the ones the client sets for the server.
+func copyAttrs(attrs waBinary.Attrs) waBinary.Attrs {
+	newAttrs := make(waBinary.Attrs, len(attrs))
+	for key, value := range attrs {
+		switch key {
+		case "to", "participant", "recipient", "phash", "device_fanout":
+		default:
+			newAttrs[key] = value
+		}
+	}
+	return newAttrs
+}
+
+func (srv *Server) handleMessage(c *conn, node *waBinary.Node) {
+	ag := node.AttrGetter()
+	id := ag.String("id")
+	to := ag.JID("to")
+	ack := waBinary.Node{
+		Tag: "ack",
+		Attrs: waBinary.Attrs{
+			"class": "message",
+			"id":    id,
+			"from":  to,
+			"t":     time.Now().Unix(),
+		},
+	}
+	if !ag.OK() {
+		ack.Attrs["error"] = errIQBadRequest.Code
+	} else {
+		srv.lock.Lock()
+		if err := srv.routeMessage(c.device, to, node); err != nil {
+			ack.Attrs["error"] = err.Code
+		}
+		srv.lock.Unlock()
+	}
+	if err := c.sendNode(ack); err != nil {
+		c.log.Warnf("Failed to send ack for message %s: %v", id, err)
+	}
+}
+
+// routeMessage delivers a message to all the devices it was encrypted for. The server lock must be held.
+func (srv *Server) routeMessage(sender *device, to types.JID, node *waBinary.Node) *iqError {
+	attrs := copyAttrs(node.Attrs)
+	if _, ok := attrs["t"]; !ok {
+		attrs["t"] = time.Now().Unix()
+	}
+	// Encrypted payloads for specific devices are in the participants element,
+	// while everything else (e.g. the sender key message in groups) is sent to all devices.
+	perDevice := make(map[types.JID][]waBinary.Node)
+	var shared []waBinary.Node
+	var targets []*device
+	for _, child := range node.GetChildren() {
+		if child.Tag != "participants" {
+			shared = append(shared, child)
+			continue
+		}
+		for _, toNode := range child.GetChildren() {
+			jid, ok := toNode.Attrs["jid"].(types.JID)
+			if toNode.Tag != "to" || !ok {
+				continue
+			}
+			perDevice[jid] = toNode.GetChildren()
+			if to.Server != types.GroupServer {
+				if dev := srv.getDevice(jid); dev != nil && dev != sender {
+					targets = append(targets, dev)
+				}
+			}
+		}
+	}
+	participant, hasParticipant := node.Attrs["participant"].(types.JID)
+	if to.Server == types.GroupServer {
+		grp, ok := srv.groups[to]
+		if !ok {
+			return errIQNotFound
+		} else if !grp.hasParticipant(sender.jid) {
+			return errIQForbidden
+		}
+		attrs["from"] = to
+		attrs["participant"] = sender.jid
+		if hasParticipant {
+			// Retries are sent to a single participant device
+			if dev := srv.getDevice(participant); dev != nil {
+				targets = append(targets, dev)
+			}
+		} else {
+			for _, pcp := range grp.participants {
+				for _, dev := range srv.getUserDevices(pcp) {
+					if dev != sender {
+						targets = append(targets, dev)
+					}
+				}
+			}
+		}
+	} else {
+		attrs["from"] = sender.jid
+		if len(perDevice) == 0 {
+			// Retries are sent directly to the device without a participants element
+			if dev := srv.getDevice(to); dev != nil && dev != sender {
+				targets = append(targets, dev)
+			}
+		}
+	}
+	recipient, hasRecipient := node.Attrs["recipient"].(types.JID)
+	if !hasRecipient && to.Server != types.GroupServer {
+		recipient = to.ToNonAD()
+	}
+	for _, dev := range targets {
+		content := slices.Concat(perDevice[dev.jid], shared)
+		if len(content) == 0 {
+			continue
+		}
+		devAttrs := make(waBinary.Attrs, len(attrs)+1)
+		for key, value := range attrs {
+			devAttrs[key] = value
+		}
+		// Messages sent to the sender's other devices need to say which chat they were sent to
+		if to.Server != types.GroupServer && dev.jid.User == sender.jid.User && recipient.User != sender.jid.User {
+			devAttrs["recipient"] = recipient
+		}
+		srv.deliver(dev, &waBinary.Node{Tag: "message", Attrs: devAttrs, Content: content})
+	}
+	return nil
+}
+
+func (srv *Server) handleReceipt(c *conn, node *waBinary.Node) {
+	ag := node.AttrGetter()
+	id := ag.String("id")
+	to := ag.JID("to")
+	receiptType := ag.OptionalString("type")
+	participant := ag.OptionalJIDOrEmpty("participant")
+	recipient := ag.OptionalJIDOrEmpty("recipient")
+	if !ag.OK() {
+		c.log.Warnf("Ignoring receipt with invalid attributes: %v", ag.Error())
+		return
+	}
+	attrs := copyAttrs(node.Attrs)
+	if _, ok := attrs["t"]; !ok {
+		attrs["t"] = time.Now().Unix()
+	}
+	target := to
+	if to.Server == types.GroupServer {
+		attrs["from"] = to
+		attrs["participant"] = c.device.jid
+		target = participant
+	} else {
+		attrs["from"] = c.device.jid
+		if !recipient.IsEmpty() {
+			attrs["recipient"] = recipient
+		}
+	}
+	srv.lock.Lock()
+	var targets []*device
+	if receiptType == "retry" {
+		// Retry receipts only go to the device that sent the message, as only it can resend the message
+		if dev := srv.getDevice(target); dev != nil {
+			targets = append(targets, dev)
+		}
+	} else {
+		targets = srv.getUserDevices(target)
+	}
+	for _, dev := range targets {
+		if dev != c.device {
+			srv.deliver(dev, &waBinary.Node{Tag: "receipt", Attrs: attrs, Content: node.Content})
+		}
+	}
+	srv.lock.Unlock()
+
+	ack := waBinary.Node{
+		Tag: "ack",
+		Attrs: waBinary.Attrs{
+			"class": "receipt",
+			"id":    id,
+			"from":  to,
+		},
+	}
+	if receiptType != "" {
+		ack.Attrs["type"] = receiptType
+	}
+	if err := c.sendNode(ack); err != nil {
+		c.log.Warnf("Failed to send ack for receipt %s: %v", id, err)
+	}
+}
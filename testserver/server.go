@@ -0,0 +1,283 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package testserver implements a fake WhatsApp server for testing clients without connecting to WhatsApp.
+//
+// The server speaks the same websocket framing, noise handshake and binary XML protocol as the real one, and
+// implements enough of the protocol for end-to-end encrypted messaging between clients connected to it:
+// prekey uploads and fetches, device list queries, media uploads and downloads, basic group queries and
+// routing messages and receipts between devices. Pairing new devices is not supported, clients must use
+// devices registered with Server.AddDevice instead.
+//
+//	srv := testserver.New(nil)
+//	defer srv.Close()
+//	container := memstore.New(nil)
+//	aliceDevice := container.NewDevice()
+//	err := srv.AddDevice(aliceDevice, "1111")
+//	// handle error
+//	alice := srv.NewClient(aliceDevice, nil)
+//	err = alice.Connect()
+package testserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/Romerito007/whatsmeow"
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/store"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/util/keys"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
+)
+
+// ErrDeviceAlreadyRegistered is returned by AddDevice if the device store already has an ID.
+var ErrDeviceAlreadyRegistered = errors.New("device is already registered")
+
+// Server is a fake WhatsApp server. It must be created with New.
+type Server struct {
+	// BeforeDeliver is called before a message or receipt is sent to a device. It can return a modified node,
+	// or nil to drop the node entirely, e.g. to simulate lost or corrupted messages.
+	BeforeDeliver func(to types.JID, node *waBinary.Node) *waBinary.Node
+	// OnClientNode is called for every node received from a logged-in device before the server handles it,
+	// e.g. to check which messages the client acknowledged. It's called on the connection's read goroutine.
+	OnClientNode func(from types.JID, node *waBinary.Node)
+
+	log    waLog.Logger
+	http   *httptest.Server
+	wsUp   websocket.Upgrader
+	closed atomic.Bool
+
+	certKey   *keys.KeyPair
+	staticKey *keys.KeyPair
+	certChain []byte
+
+	lock   sync.Mutex
+	users  map[string]*user
+	groups map[types.JID]*group
+	media  map[string][]byte
+	conns  map[*conn]struct{}
+
+	idCounter atomic.Uint64
+}
+
+type user struct {
+	devices      map[uint16]*device
+	nextDeviceID uint16
+}
+
+type device struct {
+	jid            types.JID
+	noiseKey       [32]byte
+	registrationID uint32
+	identityKey    [32]byte
+	signedPreKey   *keys.PreKey
+	preKeys        []*keys.PreKey
+
+	conn  *conn
+	queue []*waBinary.Node
+}
+
+type group struct {
+	jid          types.JID
+	name         string
+	creator      types.JID
+	created      time.Time
+	participants []types.JID
+}
+
+// New starts a new fake server listening on a random local port.
+//
+// The logger can be nil, it will default to a no-op logger.
+func New(log waLog.Logger) *Server {
+	if log == nil {
+		log = waLog.Noop
+	}
+	srv := &Server{
+		log:       log,
+		certKey:   keys.NewKeyPair(),
+		staticKey: keys.NewKeyPair(),
+
+		users:  make(map[string]*user),
+		groups: make(map[types.JID]*group),
+		media:  make(map[string][]byte),
+		conns:  make(map[*conn]struct{}),
+	}
+	srv.certChain = makeCertChain(srv.certKey, srv.staticKey)
+	// Clients send the WhatsApp web origin, which obviously doesn't match the test server.
+	srv.wsUp.CheckOrigin = func(r *http.Request) bool { return true }
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ws/chat", srv.handleWebsocket)
+	mux.HandleFunc("POST /mms/{type}/{token}", srv.handleMediaUpload)
+	mux.HandleFunc("GET /media/{id}", srv.handleMediaDownload)
+	srv.http = httptest.NewTLSServer(mux)
+	return srv
+}
+
+// Close disconnects all clients and stops the server.
+func (srv *Server) Close() {
+	if !srv.closed.CompareAndSwap(false, true) {
+		return
+	}
+	srv.lock.Lock()
+	conns := make([]*conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.lock.Unlock()
+	for _, c := range conns {
+		c.close()
+	}
+	srv.http.Close()
+}
+
+// Host returns the host and port that the server is listening on.
+func (srv *Server) Host() string {
+	return srv.http.Listener.Addr().String()
+}
+
+// ServerConfig returns the config that makes a client connect to this server.
+func (srv *Server) ServerConfig() *whatsmeow.ServerConfig {
+	return &whatsmeow.ServerConfig{
+		WebsocketURL: fmt.Sprintf("wss://%s/ws/chat", srv.Host()),
+		CertPubKey:   *srv.certKey.Pub,
+		TLSConfig:    srv.http.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+}
+
+// NewClient creates a new client for the given device that connects to this server.
+// The device must have been registered with AddDevice.
+func (srv *Server) NewClient(device *store.Device, log waLog.Logger) *whatsmeow.Client {
+	cli := whatsmeow.NewClient(device, log)
+	cli.SetServerConfig(srv.ServerConfig())
+	return cli
+}
+
+// AddDevice registers a new logged-in device for the given user (phone number) on the server.
+// The device ID is assigned by the server and saved in the device store.
+func (srv *Server) AddDevice(deviceStore *store.Device, phone string) error {
+	if deviceStore.ID != nil {
+		return ErrDeviceAlreadyRegistered
+	}
+	srv.lock.Lock()
+	u := srv.getOrCreateUser(phone)
+	u.nextDeviceID++
+	dev := &device{
+		jid:            types.NewADJID(phone, 0, byte(u.nextDeviceID)),
+		noiseKey:       *deviceStore.NoiseKey.Pub,
+		registrationID: deviceStore.RegistrationID,
+		identityKey:    *deviceStore.IdentityKey.Pub,
+		signedPreKey:   deviceStore.SignedPreKey,
+	}
+	u.devices[u.nextDeviceID] = dev
+	srv.lock.Unlock()
+	jid := dev.jid
+	deviceStore.ID = &jid
+	return deviceStore.Save()
+}
+
+// RemoveDevice unregisters a device and disconnects it if it's connected. The next time the device connects,
+// the server will tell it that it has been logged out.
+func (srv *Server) RemoveDevice(jid types.JID) {
+	srv.lock.Lock()
+	var c *conn
+	if dev := srv.getDevice(jid); dev != nil {
+		c = dev.conn
+		delete(srv.users[jid.User].devices, jid.Device)
+	}
+	srv.lock.Unlock()
+	if c != nil {
+		c.sendStreamError("401", "device_removed")
+		c.close()
+	}
+}
+
+// Disconnect closes the connection of the given device without any error, like a network failure would.
+func (srv *Server) Disconnect(jid types.JID) {
+	srv.lock.Lock()
+	dev := srv.getDevice(jid)
+	var c *conn
+	if dev != nil {
+		c = dev.conn
+	}
+	srv.lock.Unlock()
+	if c != nil {
+		c.close()
+	}
+}
+
+// CreateGroup creates a group with the given participants. The creator is also added as a participant.
+func (srv *Server) CreateGroup(name string, creator types.JID, participants ...types.JID) types.JID {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.createGroup(name, creator, participants).jid
+}
+
+func (srv *Server) createGroup(name string, creator types.JID, participants []types.JID) *group {
+	grp := &group{
+		jid:     types.NewJID(fmt.Sprintf("1%d", time.Now().UnixNano()), types.GroupServer),
+		name:    name,
+		creator: creator.ToNonAD(),
+		created: time.Now(),
+	}
+	grp.participants = append(grp.participants, grp.creator)
+	for _, participant := range participants {
+		participant = participant.ToNonAD()
+		if participant != grp.creator {
+			grp.participants = append(grp.participants, participant)
+		}
+	}
+	for srv.groups[grp.jid] != nil {
+		grp.jid.User += "0"
+	}
+	srv.groups[grp.jid] = grp
+	return grp
+}
+
+// getOrCreateUser must be called with the lock held.
+func (srv *Server) getOrCreateUser(phone string) *user {
+	u, ok := srv.users[phone]
+	if !ok {
+		u = &user{devices: make(map[uint16]*device)}
+		srv.users[phone] = u
+	}
+	return u
+}
+
+// getDevice must be called with the lock held.
+func (srv *Server) getDevice(jid types.JID) *device {
+	u, ok := srv.users[jid.User]
+	if !ok || jid.Server != types.DefaultUserServer {
+		return nil
+	}
+	return u.devices[jid.Device]
+}
+
+// getUserDevices must be called with the lock held.
+func (srv *Server) getUserDevices(jid types.JID) []*device {
+	u, ok := srv.users[jid.User]
+	if !ok || jid.Server != types.DefaultUserServer {
+		return nil
+	}
+	devices := make([]*device, 0, len(u.devices))
+	for id := uint16(0); id <= u.nextDeviceID; id++ {
+		if dev, ok := u.devices[id]; ok {
+			devices = append(devices, dev)
+		}
+	}
+	return devices
+}
+
+func (srv *Server) generateID() string {
+	return fmt.Sprintf("TEST%016X", srv.idCounter.Add(1))
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver_test
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow"
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store/memstore"
+	"github.com/Romerito007/whatsmeow/testserver"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+type testClient struct {
+	*whatsmeow.Client
+	events chan any
+}
+
+// newClient creates a device and a client for it without connecting, so that the client can be configured first.
+func newClient(t *testing.T, srv *testserver.Server, container *memstore.Container, phone string) *testClient {
+	t.Helper()
+	device := container.NewDevice()
+	err := srv.AddDevice(device, phone)
+	if err != nil {
+		t.Fatalf("failed to add device %s: %v", phone, err)
+	}
+	tc := &testClient{Client: srv.NewClient(device, nil), events: make(chan any, 64)}
+	tc.AddEventHandler(func(evt any) {
+		switch evt.(type) {
+		case *events.Connected, *events.Message, *events.Receipt:
+			tc.events <- evt
+		}
+	})
+	t.Cleanup(tc.Disconnect)
+	return tc
+}
+
+func connectClient(t *testing.T, srv *testserver.Server, container *memstore.Container, phone string) *testClient {
+	t.Helper()
+	tc := newClient(t, srv, container, phone)
+	tc.connect(t)
+	return tc
+}
+
+// connect connects the client and waits until it's logged in.
+func (tc *testClient) connect(t *testing.T) {
+	t.Helper()
+	if err := tc.Connect(); err != nil {
+		t.Fatalf("failed to connect %s: %v", tc.Store.ID, err)
+	}
+	tc.waitEvent(t, "connected", func(evt any) bool {
+		_, ok := evt.(*events.Connected)
+		return ok
+	})
+}
+
+// waitEvent returns the first event that matches the filter, skipping other events.
+func (tc *testClient) waitEvent(t *testing.T, what string, filter func(evt any) bool) any {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case evt := <-tc.events:
+			if filter(evt) {
+				return evt
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event", what)
+			return nil
+		}
+	}
+}
+
+func (tc *testClient) waitReceipt(t *testing.T, id types.MessageID, receiptTypes ...types.ReceiptType) *events.Receipt {
+	t.Helper()
+	return tc.waitEvent(t, "receipt", func(evt any) bool {
+		receipt, ok := evt.(*events.Receipt)
+		if !ok || len(receipt.MessageIDs) == 0 || receipt.MessageIDs[0] != id {
+			return false
+		}
+		for _, receiptType := range receiptTypes {
+			if receipt.Type == receiptType {
+				return true
+			}
+		}
+		return false
+	}).(*events.Receipt)
+}
+
+func TestMessageAndReceipt(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := connectClient(t, srv, container, "2222")
+	aliceJID := alice.Store.ID.ToNonAD()
+	bobJID := bob.Store.ID.ToNonAD()
+
+	resp, err := alice.SendMessage(context.Background(), bobJID, &waE2E.Message{
+		Conversation: proto.String("Hello, Bob!"),
+	})
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	msg := bob.waitEvent(t, "message", func(evt any) bool {
+		_, ok := evt.(*events.Message)
+		return ok
+	}).(*events.Message)
+	if msg.Info.ID != resp.ID {
+		t.Errorf("received message ID %s, expected %s", msg.Info.ID, resp.ID)
+	}
+	if msg.Info.Sender.ToNonAD() != aliceJID || msg.Info.Chat != aliceJID || msg.Info.IsFromMe {
+		t.Errorf("unexpected message source %s", msg.Info.SourceString())
+	}
+	if text := msg.Message.GetConversation(); text != "Hello, Bob!" {
+		t.Errorf("unexpected message text %q", text)
+	}
+
+	// Bob's client sends a delivery receipt automatically. Clients that aren't marked as active send inactive receipts.
+	receipt := alice.waitReceipt(t, resp.ID, types.ReceiptTypeDelivered, types.ReceiptTypeInactive)
+	if receipt.Chat != bobJID || receipt.Sender.ToNonAD() != bobJID {
+		t.Errorf("unexpected delivery receipt source %s", receipt.SourceString())
+	}
+
+	err = bob.MarkRead([]types.MessageID{msg.Info.ID}, time.Now(), msg.Info.Chat, msg.Info.Sender)
+	if err != nil {
+		t.Fatalf("failed to mark message as read: %v", err)
+	}
+	receipt = alice.waitReceipt(t, resp.ID, types.ReceiptTypeRead)
+	if receipt.Chat != bobJID || receipt.Sender.ToNonAD() != bobJID {
+		t.Errorf("unexpected read receipt source %s", receipt.SourceString())
+	}
+}
+
+func TestGroupMembersFetchedFromServer(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := connectClient(t, srv, container, "2222")
+	aliceJID := alice.Store.ID.ToNonAD()
+	bobJID := bob.Store.ID.ToNonAD()
+	groupJID := srv.CreateGroup("Test", aliceJID, bobJID)
+
+	if info, err := alice.Store.Groups.GetGroup(groupJID); err != nil || info != nil {
+		t.Fatalf("expected group to not be stored yet, got %+v, %v", info, err)
+	}
+	// The group isn't in the store, so sending has to fetch the members from the server
+	resp, err := alice.SendMessage(context.Background(), groupJID, &waE2E.Message{
+		Conversation: proto.String("Hello, group!"),
+	})
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	// The sender key distribution message is dispatched separately before the actual message
+	msg := bob.waitEvent(t, "message", func(evt any) bool {
+		msg, ok := evt.(*events.Message)
+		return ok && msg.Info.ID == resp.ID && msg.Message.GetSenderKeyDistributionMessage() == nil
+	}).(*events.Message)
+	if msg.Info.Chat != groupJID || msg.Message.GetConversation() != "Hello, group!" {
+		t.Errorf("unexpected group message %s: %q", msg.Info.SourceString(), msg.Message.GetConversation())
+	}
+
+	info, err := alice.Store.Groups.GetGroup(groupJID)
+	if err != nil || info == nil {
+		t.Fatalf("group info fetched from server wasn't stored: %v", err)
+	}
+	if len(info.Participants) != 2 || info.Participants[0].JID != aliceJID || !info.Participants[0].IsSuperAdmin || info.Participants[1].JID != bobJID {
+		t.Errorf("unexpected stored participants %+v", info.Participants)
+	}
+}
+
+func TestRetryReceipt(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	var corrupted atomic.Bool
+	srv.BeforeDeliver = func(to types.JID, node *waBinary.Node) *waBinary.Node {
+		if node.Tag != "message" || corrupted.Load() || to.User != "2222" {
+			return node
+		}
+		corrupted.Store(true)
+		// Flip bytes in the ciphertext of the first message to Bob, so that decrypting it fails
+		children := slices.Clone(node.GetChildren())
+		for i, child := range children {
+			if ciphertext, ok := child.Content.([]byte); ok && child.Tag == "enc" {
+				ciphertext = slices.Clone(ciphertext)
+				for j := len(ciphertext) / 2; j < len(ciphertext); j++ {
+					ciphertext[j] ^= 0xff
+				}
+				children[i].Content = ciphertext
+			}
+		}
+		return &waBinary.Node{Tag: node.Tag, Attrs: node.Attrs, Content: children}
+	}
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := connectClient(t, srv, container, "2222")
+	undecryptable := make(chan *events.UndecryptableMessage, 1)
+	bob.AddEventHandler(func(evt any) {
+		if undecryptableEvt, ok := evt.(*events.UndecryptableMessage); ok {
+			undecryptable <- undecryptableEvt
+		}
+	})
+	bobJID := bob.Store.ID.ToNonAD()
+
+	resp, err := alice.SendMessage(context.Background(), bobJID, &waE2E.Message{
+		Conversation: proto.String("Hello, Bob!"),
+	})
+	if err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+	select {
+	case evt := <-undecryptable:
+		if evt.Info.ID != resp.ID {
+			t.Errorf("got undecryptable message %s, expected %s", evt.Info.ID, resp.ID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("corrupted message wasn't reported as undecryptable")
+	}
+	// Bob asks Alice to resend the message, and the resent copy decrypts normally
+	alice.waitReceipt(t, resp.ID, types.ReceiptTypeRetry)
+	msg := bob.waitEvent(t, "message", func(evt any) bool {
+		msg, ok := evt.(*events.Message)
+		return ok && msg.Info.ID == resp.ID
+	}).(*events.Message)
+	if text := msg.Message.GetConversation(); text != "Hello, Bob!" {
+		t.Errorf("unexpected resent message text %q", text)
+	}
+	if msg.RetryCount != 1 {
+		t.Errorf("resent message has retry count %d, expected 1", msg.RetryCount)
+	}
+	alice.waitReceipt(t, resp.ID, types.ReceiptTypeDelivered, types.ReceiptTypeInactive)
+}
+
+func TestGroupSend(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := connectClient(t, srv, container, "2222")
+	carol := connectClient(t, srv, container, "3333")
+	aliceJID := alice.Store.ID.ToNonAD()
+	bobJID := bob.Store.ID.ToNonAD()
+	carolJID := carol.Store.ID.ToNonAD()
+	groupJID := srv.CreateGroup("Test", aliceJID, bobJID, carolJID)
+
+	waitGroupMessage := func(tc *testClient, id types.MessageID, sender types.JID, text string) {
+		t.Helper()
+		msg := tc.waitEvent(t, "group message", func(evt any) bool {
+			msg, ok := evt.(*events.Message)
+			return ok && msg.Info.ID == id && msg.Message.GetSenderKeyDistributionMessage() == nil
+		}).(*events.Message)
+		if msg.Info.Chat != groupJID || msg.Info.Sender.ToNonAD() != sender || !msg.Info.IsGroup {
+			t.Errorf("unexpected group message source %s", msg.Info.SourceString())
+		} else if msg.Message.GetConversation() != text {
+			t.Errorf("unexpected group message text %q", msg.Message.GetConversation())
+		}
+	}
+	// waitEvent skips other events, so the receipts from all members have to be waited for at once
+	waitGroupReceipts := func(id types.MessageID, from ...types.JID) {
+		t.Helper()
+		remaining := slices.Clone(from)
+		for len(remaining) > 0 {
+			receipt := alice.waitEvent(t, "group receipt", func(evt any) bool {
+				receipt, ok := evt.(*events.Receipt)
+				return ok && len(receipt.MessageIDs) > 0 && receipt.MessageIDs[0] == id &&
+					(receipt.Type == types.ReceiptTypeDelivered || receipt.Type == types.ReceiptTypeInactive) &&
+					slices.Contains(remaining, receipt.Sender.ToNonAD())
+			}).(*events.Receipt)
+			if receipt.Chat != groupJID {
+				t.Errorf("group receipt from %s is in chat %s", receipt.Sender, receipt.Chat)
+			}
+			remaining = slices.DeleteFunc(remaining, func(jid types.JID) bool {
+				return jid == receipt.Sender.ToNonAD()
+			})
+		}
+	}
+
+	// The first message includes the sender key distribution message, the second one reuses the sender key
+	for _, text := range []string{"Hello, group!", "Second message"} {
+		resp, err := alice.SendMessage(context.Background(), groupJID, &waE2E.Message{Conversation: proto.String(text)})
+		if err != nil {
+			t.Fatalf("failed to send group message: %v", err)
+		}
+		waitGroupMessage(bob, resp.ID, aliceJID, text)
+		waitGroupMessage(carol, resp.ID, aliceJID, text)
+		waitGroupReceipts(resp.ID, bobJID, carolJID)
+	}
+
+	// Other members can reply with their own sender keys
+	resp, err := bob.SendMessage(context.Background(), groupJID, &waE2E.Message{Conversation: proto.String("Hi from Bob")})
+	if err != nil {
+		t.Fatalf("failed to send group message: %v", err)
+	}
+	waitGroupMessage(alice, resp.ID, bobJID, "Hi from Bob")
+	waitGroupMessage(carol, resp.ID, bobJID, "Hi from Bob")
+}
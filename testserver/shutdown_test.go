@@ -0,0 +1,140 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package testserver_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/Romerito007/whatsmeow"
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	"github.com/Romerito007/whatsmeow/proto/waE2E"
+	"github.com/Romerito007/whatsmeow/store/memstore"
+	"github.com/Romerito007/whatsmeow/testserver"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+func TestShutdownDrainsWork(t *testing.T) {
+	srv := testserver.New(nil)
+	defer srv.Close()
+	nodes := logClientNodes(srv)
+	// Holding a message from Bob to Alice on the server keeps Bob's send in progress, as the server
+	// only acknowledges the message after routing it.
+	const heldID types.MessageID = "3EB0C0FFEE0000000000"
+	sendRouted := make(chan struct{})
+	releaseSend := make(chan struct{})
+	deliveredToBob := make(chan struct{}, 10)
+	srv.BeforeDeliver = func(to types.JID, node *waBinary.Node) *waBinary.Node {
+		if node.Tag == "message" && to.User == "2222" {
+			deliveredToBob <- struct{}{}
+		} else if node.Tag == "message" && node.AttrGetter().OptionalString("id") == heldID {
+			close(sendRouted)
+			select {
+			case <-releaseSend:
+			case <-time.After(10 * time.Second):
+			}
+		}
+		return node
+	}
+	container := memstore.New(nil)
+	alice := connectClient(t, srv, container, "1111")
+	bob := connectClient(t, srv, container, "2222")
+	aliceJID := alice.Store.ID.ToNonAD()
+	bobJID := bob.Store.ID.ToNonAD()
+
+	// Bob's handler blocks on the first message, so the others stay in the handler queue
+	handlerBlocked := make(chan struct{})
+	releaseHandler := make(chan struct{})
+	var handled handledMessages
+	bob.AddEventHandler(func(evt any) {
+		msg, ok := evt.(*events.Message)
+		if !ok {
+			return
+		}
+		if len(handled.get()) == 0 {
+			close(handlerBlocked)
+			<-releaseHandler
+		}
+		handled.add(msg)
+	})
+	ids := []types.MessageID{sendText(t, alice, bobJID, "first"), sendText(t, alice, bobJID, "second"), sendText(t, alice, bobJID, "third")}
+	<-handlerBlocked
+	for range ids {
+		<-deliveredToBob
+	}
+	// Give Bob's client a moment to read the other messages from the socket into the handler queue
+	time.Sleep(100 * time.Millisecond)
+	for _, id := range ids[1:] {
+		if nodes.has(bobJID, "ack", id) {
+			t.Fatalf("message %s was handled while the handler was blocked", id)
+		}
+	}
+
+	sendResult := make(chan error, 1)
+	go func() {
+		_, err := bob.SendMessage(context.Background(), aliceJID, &waE2E.Message{Conversation: proto.String("Bye")}, whatsmeow.SendRequestExtra{ID: heldID})
+		sendResult <- err
+	}()
+	select {
+	case <-sendRouted:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Bob's message didn't reach the server")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	shutdownResult := make(chan error, 1)
+	go func() {
+		shutdownResult <- bob.Shutdown(shutdownCtx)
+	}()
+	select {
+	case err := <-shutdownResult:
+		t.Fatalf("shutdown returned while work was in progress: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(releaseSend)
+	close(releaseHandler)
+
+	if err := <-shutdownResult; err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if bob.IsConnected() {
+		t.Errorf("client is still connected after shutdown")
+	}
+	// Everything must have finished before Shutdown returned
+	select {
+	case err := <-sendResult:
+		if err != nil {
+			t.Errorf("in-progress send failed: %v", err)
+		}
+	default:
+		t.Errorf("in-progress send didn't finish before shutdown returned")
+	}
+	messages := handled.get()
+	if len(messages) != len(ids) {
+		t.Fatalf("%d messages were handled before shutdown returned, expected %d", len(messages), len(ids))
+	}
+	for i, msg := range messages {
+		if msg.Info.ID != ids[i] {
+			t.Errorf("message #%d is %s, expected %s", i+1, msg.Info.ID, ids[i])
+		}
+	}
+	// The delivery receipts are sent after handling, so they only reach the server if the socket was still open
+	for _, id := range ids {
+		if !nodes.has(bobJID, "receipt", id) {
+			t.Errorf("delivery receipt for %s wasn't sent before the connection was closed", id)
+		}
+	}
+	alice.waitEvent(t, "message from Bob", func(evt any) bool {
+		msg, ok := evt.(*events.Message)
+		return ok && msg.Info.ID == heldID
+	})
+}
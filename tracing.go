@@ -0,0 +1,73 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"context"
+)
+
+// Tracer creates spans for operations done by a client. See Client.Tracer.
+//
+// The interface has the same shape as the OpenTelemetry tracing API, so an adapter only needs to convert the
+// attributes and wrap the returned span:
+//
+//	type otelTracer struct{ trace.Tracer }
+//
+//	func (t otelTracer) StartSpan(ctx context.Context, name string, attrs ...whatsmeow.TraceAttribute) (context.Context, whatsmeow.Span) {
+//		ctx, span := t.Start(ctx, name, trace.WithAttributes(convertAttrs(attrs)...))
+//		return ctx, otelSpan{span}
+//	}
+//
+// The client creates spans named whatsmeow.send_message, whatsmeow.iq, whatsmeow.get_group_info,
+// whatsmeow.get_user_devices, whatsmeow.fetch_prekeys, whatsmeow.encrypt_message, whatsmeow.upload,
+// whatsmeow.download and whatsmeow.decrypt_message. The context returned by StartSpan is passed to the
+// operations done inside the span, so e.g. the info queries made while sending a message are children of
+// the send_message span, which is in turn a child of any span in the context passed to SendMessage.
+type Tracer interface {
+	// StartSpan starts a new span as a child of the span in the given context (if any)
+	// and returns a context containing the new span.
+	StartSpan(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, Span)
+}
+
+// Span is a single operation started with Tracer.StartSpan.
+type Span interface {
+	// SetAttributes adds attributes to the span.
+	SetAttributes(attrs ...TraceAttribute)
+	// RecordError marks the span as failed with the given error.
+	RecordError(err error)
+	// End finishes the span. No other methods are called after End.
+	End()
+}
+
+// TraceAttribute is a key-value pair attached to a span. The value is always a string, int, int64 or bool.
+type TraceAttribute struct {
+	Key   string
+	Value any
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...TraceAttribute) {}
+func (noopSpan) RecordError(error)               {}
+func (noopSpan) End()                            {}
+
+func (cli *Client) startSpan(ctx context.Context, name string, attrs ...TraceAttribute) (context.Context, Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if cli.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return cli.Tracer.StartSpan(ctx, name, attrs...)
+}
+
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+// EventSource specifies whether an event comes from live updates or from history/full syncs.
+type EventSource int
+
+const (
+	EventSourceAny     EventSource = iota // Match all events.
+	EventSourceLive                       // Match events that aren't from history sync or app state full syncs.
+	EventSourceHistory                    // Match history syncs, messages parsed from history syncs and app state full syncs.
+)
+
+// HandlerOptions contains filters and other options for AddTypedHandler.
+//
+// Filters on the chat, sender or from-me status only match events that contain that information
+// (e.g. messages, receipts and most app state events). Other events are never passed to handlers with such filters.
+type HandlerOptions struct {
+	// Handlers with a higher priority are called first. See Client.AddEventHandlerWithPriority.
+	Priority int
+
+	// Only match events in this chat.
+	Chat types.JID
+	// Only match events where the sender is this user. The device part of the JID is ignored.
+	Sender types.JID
+	// If set, only match events where the IsFromMe flag is equal to this.
+	IsFromMe *bool
+	// Only match events from the given source.
+	Source EventSource
+
+	// An additional custom filter. If set, events are only passed to the handler if this returns true.
+	Filter func(evt any) bool
+}
+
+// EventHandle is a handle to an event handler registered with AddTypedHandler.
+type EventHandle struct {
+	cli *Client
+	id  uint32
+}
+
+// ID returns the handler ID, which can also be passed to Client.RemoveEventHandler.
+func (eh EventHandle) ID() uint32 {
+	return eh.id
+}
+
+// Remove removes the event handler. This returns false if the handler was already removed.
+//
+// Like Client.RemoveEventHandler, this must not be called directly from an event handler.
+func (eh EventHandle) Remove() bool {
+	return eh.cli.RemoveEventHandler(eh.id)
+}
+
+// AddTypedHandler registers a function that only receives events of the type T and that match the filters
+// in the given options. T should be the pointer type that is dispatched, e.g. *events.Message:
+//
+//	whatsmeow.AddTypedHandler(cli, func(evt *events.Message) {
+//		fmt.Println("Received a message in", evt.Info.Chat)
+//	}, whatsmeow.HandlerOptions{Chat: groupJID, Source: whatsmeow.EventSourceLive})
+//
+// The handler is added to the same list as handlers registered with Client.AddEventHandler.
+func AddTypedHandler[T any](cli *Client, handler func(evt T), opts ...HandlerOptions) EventHandle {
+	var opt HandlerOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	id := cli.AddEventHandlerWithPriority(func(rawEvt any) {
+		evt, ok := rawEvt.(T)
+		if ok && opt.matches(rawEvt) {
+			handler(evt)
+		}
+	}, opt.Priority)
+	return EventHandle{cli: cli, id: id}
+}
+
+func (opt *HandlerOptions) matches(evt any) bool {
+	if !opt.Chat.IsEmpty() || !opt.Sender.IsEmpty() || opt.IsFromMe != nil {
+		source, ok := getEventMessageSource(evt)
+		if !ok ||
+			(!opt.Chat.IsEmpty() && source.Chat != opt.Chat) ||
+			(!opt.Sender.IsEmpty() && source.Sender.ToNonAD() != opt.Sender.ToNonAD()) ||
+			(opt.IsFromMe != nil && source.IsFromMe != *opt.IsFromMe) {
+			return false
+		}
+	}
+	if opt.Source != EventSourceAny && isHistoryEvent(evt) != (opt.Source == EventSourceHistory) {
+		return false
+	}
+	return opt.Filter == nil || opt.Filter(evt)
+}
+
+// getEventMessageSource extracts the chat, sender and from-me status from events that have them.
+// For app state events that only specify a chat, the sender is left empty.
+func getEventMessageSource(rawEvt any) (types.MessageSource, bool) {
+	switch evt := rawEvt.(type) {
+	case *events.Message:
+		return evt.Info.MessageSource, true
+	case *events.UndecryptableMessage:
+		return evt.Info.MessageSource, true
+	case *events.FBMessage:
+		return evt.Info.MessageSource, true
+	case *events.Receipt:
+		return evt.MessageSource, true
+	case *events.ChatPresence:
+		return evt.MessageSource, true
+	case *events.Star:
+		return types.MessageSource{Chat: evt.ChatJID, Sender: evt.SenderJID, IsFromMe: evt.IsFromMe}, true
+	case *events.DeleteForMe:
+		return types.MessageSource{Chat: evt.ChatJID, Sender: evt.SenderJID, IsFromMe: evt.IsFromMe}, true
+	case *events.Pin:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.Mute:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.Archive:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.MarkChatAsRead:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.ClearChat:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.DeleteChat:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.LabelAssociationChat:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.LabelAssociationMessage:
+		return types.MessageSource{Chat: evt.JID}, true
+	case *events.GroupInfo:
+		source := types.MessageSource{Chat: evt.JID, IsGroup: true}
+		if evt.Sender != nil {
+			source.Sender = *evt.Sender
+		}
+		return source, true
+	default:
+		return types.MessageSource{}, false
+	}
+}
+
+// isHistoryEvent returns true if the event comes from a history sync or an app state full sync.
+func isHistoryEvent(rawEvt any) bool {
+	switch evt := rawEvt.(type) {
+	case *events.HistorySync:
+		return true
+	case *events.Message:
+		// Messages parsed with ParseWebMessage have the source data, but unavailable message responses are live
+		return evt.SourceWebMsg != nil && evt.UnavailableRequestID == ""
+	case *events.Contact:
+		return evt.FromFullSync
+	case *events.Pin:
+		return evt.FromFullSync
+	case *events.Star:
+		return evt.FromFullSync
+	case *events.DeleteForMe:
+		return evt.FromFullSync
+	case *events.Mute:
+		return evt.FromFullSync
+	case *events.Archive:
+		return evt.FromFullSync
+	case *events.MarkChatAsRead:
+		return evt.FromFullSync
+	case *events.ClearChat:
+		return evt.FromFullSync
+	case *events.DeleteChat:
+		return evt.FromFullSync
+	case *events.PushNameSetting:
+		return evt.FromFullSync
+	case *events.UnarchiveChatsSetting:
+		return evt.FromFullSync
+	case *events.UserStatusMute:
+		return evt.FromFullSync
+	case *events.LabelEdit:
+		return evt.FromFullSync
+	case *events.LabelAssociationChat:
+		return evt.FromFullSync
+	case *events.LabelAssociationMessage:
+		return evt.FromFullSync
+	default:
+		return false
+	}
+}
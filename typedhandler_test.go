@@ -0,0 +1,142 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package whatsmeow
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Romerito007/whatsmeow/proto/waWeb"
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+func makeTestMessage(chat, sender types.JID, fromMe bool) *events.Message {
+	return &events.Message{Info: types.MessageInfo{
+		MessageSource: types.MessageSource{Chat: chat, Sender: sender, IsFromMe: fromMe, IsGroup: chat.Server == types.GroupServer},
+		ID:            "MSG",
+	}}
+}
+
+func TestTypedHandlerFilters(t *testing.T) {
+	fromMe, notFromMe := true, false
+	senderDevice := testPN1
+	senderDevice.Device = 5
+	tests := []struct {
+		name     string
+		opts     HandlerOptions
+		evt      any
+		expected bool
+	}{
+		{"no filters", HandlerOptions{}, makeTestMessage(testGroupJID, testPN1, false), true},
+		{"chat matches", HandlerOptions{Chat: testGroupJID}, makeTestMessage(testGroupJID, testPN1, false), true},
+		{"chat doesn't match", HandlerOptions{Chat: testPN2}, makeTestMessage(testGroupJID, testPN1, false), false},
+		{"sender matches", HandlerOptions{Sender: testPN1}, makeTestMessage(testGroupJID, testPN1, false), true},
+		{"sender device is ignored", HandlerOptions{Sender: testPN1}, makeTestMessage(testGroupJID, senderDevice, false), true},
+		{"sender doesn't match", HandlerOptions{Sender: testPN2}, makeTestMessage(testGroupJID, testPN1, false), false},
+		{"from me matches", HandlerOptions{IsFromMe: &fromMe}, makeTestMessage(testGroupJID, testPN1, true), true},
+		{"from me doesn't match", HandlerOptions{IsFromMe: &notFromMe}, makeTestMessage(testGroupJID, testPN1, true), false},
+		{"receipt chat", HandlerOptions{Chat: testGroupJID}, &events.Receipt{MessageSource: types.MessageSource{Chat: testGroupJID}}, true},
+		{"app state chat", HandlerOptions{Chat: testPN1}, &events.Pin{JID: testPN1}, true},
+		{"app state sender", HandlerOptions{Sender: testPN1}, &events.Star{ChatJID: testGroupJID, SenderJID: testPN1}, true},
+		{"group info sender", HandlerOptions{Sender: testPN1}, &events.GroupInfo{JID: testGroupJID, Sender: &testPN1}, true},
+		{"chat filter on event without chat", HandlerOptions{Chat: testPN1}, &events.Connected{}, false},
+		{"live message", HandlerOptions{Source: EventSourceLive}, makeTestMessage(testPN1, testPN1, false), true},
+		{"live filter on history message", HandlerOptions{Source: EventSourceLive}, &events.Message{SourceWebMsg: &waWeb.WebMessageInfo{}}, false},
+		{"history message", HandlerOptions{Source: EventSourceHistory}, &events.Message{SourceWebMsg: &waWeb.WebMessageInfo{}}, true},
+		{"history filter on unavailable message response", HandlerOptions{Source: EventSourceHistory}, &events.Message{SourceWebMsg: &waWeb.WebMessageInfo{}, UnavailableRequestID: "req"}, false},
+		{"history filter on live message", HandlerOptions{Source: EventSourceHistory}, makeTestMessage(testPN1, testPN1, false), false},
+		{"full sync app state", HandlerOptions{Source: EventSourceHistory}, &events.Pin{JID: testPN1, FromFullSync: true}, true},
+		{"custom filter", HandlerOptions{Filter: func(evt any) bool { return false }}, makeTestMessage(testPN1, testPN1, false), false},
+		{"all filters", HandlerOptions{Chat: testGroupJID, Sender: testPN1, IsFromMe: &notFromMe, Source: EventSourceLive, Filter: func(evt any) bool {
+			return evt.(*events.Message).Info.ID == "MSG"
+		}}, makeTestMessage(testGroupJID, testPN1, false), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli := newTestClient(t)
+			var called bool
+			AddTypedHandler(cli, func(evt any) {
+				called = true
+			}, test.opts)
+			cli.dispatchEvent(test.evt)
+			if called != test.expected {
+				t.Errorf("handler called: %t, expected %t", called, test.expected)
+			}
+		})
+	}
+}
+
+func TestTypedHandlerType(t *testing.T) {
+	cli := newTestClient(t)
+	var messages, receipts int
+	AddTypedHandler(cli, func(evt *events.Message) {
+		messages++
+	})
+	AddTypedHandler(cli, func(evt *events.Receipt) {
+		receipts++
+	})
+	cli.dispatchEvent(makeTestMessage(testPN1, testPN1, false))
+	cli.dispatchEvent(&events.Receipt{})
+	cli.dispatchEvent(&events.Receipt{})
+	cli.dispatchEvent(&events.Connected{})
+	if messages != 1 || receipts != 2 {
+		t.Errorf("got %d messages and %d receipts, expected 1 and 2", messages, receipts)
+	}
+}
+
+func TestAddEventHandlerWithPriority(t *testing.T) {
+	cli := newTestClient(t)
+	var order []string
+	add := func(name string, priority int) {
+		cli.AddEventHandlerWithPriority(func(evt any) {
+			order = append(order, name)
+		}, priority)
+	}
+	add("default 1", 0)
+	add("low", -10)
+	add("high 1", 10)
+	add("default 2", 0)
+	add("high 2", 10)
+	AddTypedHandler(cli, func(evt *events.Connected) {
+		order = append(order, "typed highest")
+	}, HandlerOptions{Priority: 20})
+	cli.AddEventHandler(func(evt any) {
+		order = append(order, "default 3")
+	})
+
+	cli.dispatchEvent(&events.Connected{})
+	expected := []string{"typed highest", "high 1", "high 2", "default 1", "default 2", "default 3", "low"}
+	if !slices.Equal(order, expected) {
+		t.Errorf("handlers were called in order %v, expected %v", order, expected)
+	}
+}
+
+func TestEventHandleRemove(t *testing.T) {
+	cli := newTestClient(t)
+	var first, second int
+	handle := AddTypedHandler(cli, func(evt *events.Connected) {
+		first++
+	})
+	AddTypedHandler(cli, func(evt *events.Connected) {
+		second++
+	})
+	cli.dispatchEvent(&events.Connected{})
+	if !handle.Remove() {
+		t.Errorf("removing handler returned false")
+	}
+	cli.dispatchEvent(&events.Connected{})
+	if first != 1 || second != 2 {
+		t.Errorf("handlers were called %d and %d times, expected 1 and 2", first, second)
+	}
+	if handle.Remove() {
+		t.Errorf("removing handler again returned true")
+	}
+	if cli.RemoveEventHandler(handle.ID()) {
+		t.Errorf("removing handler by ID after Remove returned true")
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package events
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+)
+
+// eventTypes contains all the event types that can be encoded with MarshalEvent.
+var eventTypes = []any{
+	// appstate.go
+	Contact{}, PushName{}, BusinessName{}, Pin{}, Star{}, DeleteForMe{}, Mute{}, Archive{}, MarkChatAsRead{},
+	ClearChat{}, DeleteChat{}, PushNameSetting{}, UnarchiveChatsSetting{}, UserStatusMute{}, LabelEdit{},
+	LabelAssociationChat{}, LabelAssociationMessage{}, AppState{}, AppStateSyncComplete{},
+	// call.go
+	CallOffer{}, CallAccept{}, CallPreAccept{}, CallTransport{}, CallOfferNotice{}, CallRelayLatency{},
+	CallTerminate{}, CallReject{}, UnknownCallEvent{},
+	// events.go
+	QR{}, PairSuccess{}, PairError{}, QRScannedWithoutMultidevice{}, Connected{}, KeepAliveTimeout{},
+	KeepAliveRestored{}, LoggedOut{}, StreamReplaced{}, ManualLoginReconnect{}, TemporaryBan{}, ConnectFailure{},
+	ClientOutdated{}, CATRefreshError{}, StreamError{}, Disconnected{}, ReconnectScheduled{}, HistorySync{}, UndecryptableMessage{},
+	Message{}, OutboxDeadLetter{}, FBMessage{}, Receipt{}, ChatPresence{}, Presence{}, JoinedGroup{}, GroupInfo{}, Picture{},
+	UserAbout{}, IdentityChange{}, PrivacySettings{}, OfflineSyncPreview{}, OfflineSyncCompleted{}, MediaRetry{},
+	Blocklist{}, NewsletterJoin{}, NewsletterLeave{}, NewsletterMuteChange{}, NewsletterLiveUpdate{},
+}
+
+var eventTypesByName = make(map[string]reflect.Type, len(eventTypes))
+
+func init() {
+	for _, evt := range eventTypes {
+		evtType := reflect.TypeOf(evt)
+		eventTypesByName[evtType.Name()] = evtType
+	}
+}
+
+var (
+	ErrUnknownEventType   = errors.New("unknown event type")
+	ErrUnsupportedField   = errors.New("unsupported field type")
+	ErrInvalidEventFormat = errors.New("invalid event format")
+)
+
+// EncodedEvent is the JSON structure produced by MarshalEvent.
+type EncodedEvent struct {
+	// The name of the event struct, e.g. "Message".
+	Type string `json:"type"`
+	// The event struct itself.
+	Data json.RawMessage `json:"data"`
+}
+
+// EventType returns the type name that MarshalEvent uses for the given event, e.g. "Message" for *events.Message.
+// If the event isn't supported by MarshalEvent, this returns an empty string.
+func EventType(evt any) string {
+	typ := reflect.TypeOf(evt)
+	if typ == nil {
+		return ""
+	} else if typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	if registered, ok := eventTypesByName[typ.Name()]; ok && registered == typ {
+		return typ.Name()
+	}
+	return ""
+}
+
+// MarshalEvent encodes the given event into JSON that can be decoded back into the same event with UnmarshalEvent.
+// The event can be a pointer (like the events dispatched by whatsmeow.Client) or a struct value.
+//
+// Unlike calling json.Marshal on events directly, this handles all the field types in events:
+// protobuf messages are encoded with protojson, *waBinary.Node fields keep their attribute types,
+// interface fields containing protobuf messages include the message type, and errors are encoded as strings.
+// The fields of the event structs are encoded using their Go names.
+func MarshalEvent(evt any) ([]byte, error) {
+	val := reflect.ValueOf(evt)
+	if val.Kind() == reflect.Pointer {
+		if val.IsNil() {
+			return nil, fmt.Errorf("%w: nil %T", ErrUnknownEventType, evt)
+		}
+		val = val.Elem()
+	}
+	if registered, ok := eventTypesByName[val.Type().Name()]; !ok || registered != val.Type() {
+		return nil, fmt.Errorf("%w: %T", ErrUnknownEventType, evt)
+	}
+	data, err := encodeValue(val)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", val.Type().Name(), err)
+	}
+	return json.Marshal(&EncodedEvent{Type: val.Type().Name(), Data: data})
+}
+
+// UnmarshalEvent decodes an event encoded with MarshalEvent. The returned value is a pointer to the event struct,
+// e.g. *events.Message, which is the same type that whatsmeow.Client dispatches to event handlers.
+func UnmarshalEvent(data []byte) (any, error) {
+	var encoded EncodedEvent
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEventFormat, err)
+	}
+	evtType, ok := eventTypesByName[encoded.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownEventType, encoded.Type)
+	}
+	evt := reflect.New(evtType)
+	err = decodeValue(encoded.Data, evt.Elem())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", encoded.Type, err)
+	}
+	return evt.Interface(), nil
+}
+
+var (
+	protoMessageType    = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	errorType           = reflect.TypeOf((*error)(nil)).Elem()
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	nodeType            = reflect.TypeOf(waBinary.Node{})
+)
+
+var jsonNull = json.RawMessage("null")
+
+// encodedProtoInterface is used for interface fields that contain protobuf messages.
+type encodedProtoInterface struct {
+	Type  protoreflect.FullName `json:"type"`
+	Value json.RawMessage       `json:"value"`
+}
+
+func encodeValue(val reflect.Value) (json.RawMessage, error) {
+	typ := val.Type()
+	switch {
+	case typ.Kind() == reflect.Pointer && typ.Implements(protoMessageType):
+		if val.IsNil() {
+			return jsonNull, nil
+		}
+		return protojson.Marshal(val.Interface().(proto.Message))
+	case typ == nodeType:
+		node := val.Interface().(waBinary.Node)
+		return json.Marshal(waBinary.ToJSONNode(&node))
+	case typ.Kind() == reflect.Interface:
+		return encodeInterface(val)
+	case typ.Implements(jsonMarshalerType), typ.Implements(textMarshalerType),
+		reflect.PointerTo(typ).Implements(jsonMarshalerType), reflect.PointerTo(typ).Implements(textMarshalerType):
+		if !val.CanAddr() {
+			ptr := reflect.New(typ)
+			ptr.Elem().Set(val)
+			val = ptr.Elem()
+		}
+		return json.Marshal(val.Addr().Interface())
+	}
+	switch typ.Kind() {
+	case reflect.Pointer:
+		if val.IsNil() {
+			return jsonNull, nil
+		}
+		return encodeValue(val.Elem())
+	case reflect.Struct:
+		fields := make(map[string]json.RawMessage, typ.NumField())
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			data, err := encodeValue(val.Field(i))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", field.Name, err)
+			}
+			fields[field.Name] = data
+		}
+		return json.Marshal(fields)
+	case reflect.Slice:
+		if val.IsNil() {
+			return jsonNull, nil
+		} else if typ.Elem().Kind() == reflect.Uint8 {
+			return json.Marshal(val.Bytes())
+		}
+		fallthrough
+	case reflect.Array:
+		items := make([]json.RawMessage, val.Len())
+		for i := range items {
+			var err error
+			items[i], err = encodeValue(val.Index(i))
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return json.Marshal(items)
+	case reflect.Map:
+		if val.IsNil() {
+			return jsonNull, nil
+		}
+		items := make(map[string]json.RawMessage, val.Len())
+		iter := val.MapRange()
+		for iter.Next() {
+			key, err := encodeMapKey(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			items[key], err = encodeValue(iter.Value())
+			if err != nil {
+				return nil, fmt.Errorf("[%s]: %w", key, err)
+			}
+		}
+		return json.Marshal(items)
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return json.Marshal(val.Interface())
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedField, typ)
+	}
+}
+
+func encodeInterface(val reflect.Value) (json.RawMessage, error) {
+	if val.IsNil() {
+		return jsonNull, nil
+	} else if val.Type() == errorType {
+		return json.Marshal(val.Interface().(error).Error())
+	}
+	msg, ok := val.Interface().(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w %T in %s", ErrUnsupportedField, val.Interface(), val.Type())
+	}
+	data, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&encodedProtoInterface{Type: msg.ProtoReflect().Descriptor().FullName(), Value: data})
+}
+
+func encodeMapKey(key reflect.Value) (string, error) {
+	if key.Type().Implements(textMarshalerType) {
+		data, err := key.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(data), err
+	}
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	default:
+		return "", fmt.Errorf("%w: map key %s", ErrUnsupportedField, key.Type())
+	}
+}
+
+func isNull(data json.RawMessage) bool {
+	return len(data) == 0 || string(data) == "null"
+}
+
+func decodeValue(data json.RawMessage, val reflect.Value) error {
+	typ := val.Type()
+	switch {
+	case typ.Kind() == reflect.Pointer && typ.Implements(protoMessageType):
+		if isNull(data) {
+			val.SetZero()
+			return nil
+		}
+		msg := reflect.New(typ.Elem())
+		err := protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, msg.Interface().(proto.Message))
+		if err != nil {
+			return err
+		}
+		val.Set(msg)
+		return nil
+	case typ == nodeType:
+		var jsonNode waBinary.JSONNode
+		err := json.Unmarshal(data, &jsonNode)
+		if err != nil {
+			return err
+		}
+		node, err := jsonNode.ToNode()
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(node))
+		return nil
+	case typ.Kind() == reflect.Interface:
+		return decodeInterface(data, val)
+	case reflect.PointerTo(typ).Implements(jsonUnmarshalerType), reflect.PointerTo(typ).Implements(textUnmarshalerType):
+		return json.Unmarshal(data, val.Addr().Interface())
+	}
+	switch typ.Kind() {
+	case reflect.Pointer:
+		if isNull(data) {
+			val.SetZero()
+			return nil
+		}
+		ptr := reflect.New(typ.Elem())
+		err := decodeValue(data, ptr.Elem())
+		if err != nil {
+			return err
+		}
+		val.Set(ptr)
+		return nil
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(data, &fields)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			fieldData, ok := fields[field.Name]
+			if !field.IsExported() || !ok {
+				continue
+			}
+			err = decodeValue(fieldData, val.Field(i))
+			if err != nil {
+				return fmt.Errorf("%s: %w", field.Name, err)
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if isNull(data) {
+			val.SetZero()
+			return nil
+		} else if typ.Elem().Kind() == reflect.Uint8 {
+			var bytes []byte
+			err := json.Unmarshal(data, &bytes)
+			if err != nil {
+				return err
+			}
+			val.SetBytes(bytes)
+			return nil
+		}
+		fallthrough
+	case reflect.Array:
+		var items []json.RawMessage
+		err := json.Unmarshal(data, &items)
+		if err != nil {
+			return err
+		}
+		if typ.Kind() == reflect.Slice {
+			val.Set(reflect.MakeSlice(typ, len(items), len(items)))
+		} else if len(items) != typ.Len() {
+			return fmt.Errorf("%w: expected %d items in array, got %d", ErrInvalidEventFormat, typ.Len(), len(items))
+		}
+		for i, item := range items {
+			err = decodeValue(item, val.Index(i))
+			if err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return nil
+	case reflect.Map:
+		if isNull(data) {
+			val.SetZero()
+			return nil
+		}
+		var items map[string]json.RawMessage
+		err := json.Unmarshal(data, &items)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.MakeMapWithSize(typ, len(items)))
+		for rawKey, item := range items {
+			key := reflect.New(typ.Key()).Elem()
+			err = decodeMapKey(rawKey, key)
+			if err != nil {
+				return err
+			}
+			elem := reflect.New(typ.Elem()).Elem()
+			err = decodeValue(item, elem)
+			if err != nil {
+				return fmt.Errorf("[%s]: %w", rawKey, err)
+			}
+			val.SetMapIndex(key, elem)
+		}
+		return nil
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return json.Unmarshal(data, val.Addr().Interface())
+	default:
+		return fmt.Errorf("%w %s", ErrUnsupportedField, typ)
+	}
+}
+
+func decodeInterface(data json.RawMessage, val reflect.Value) error {
+	if isNull(data) {
+		val.SetZero()
+		return nil
+	} else if val.Type() == errorType {
+		var msg string
+		err := json.Unmarshal(data, &msg)
+		if err != nil {
+			return err
+		}
+		val.Set(reflect.ValueOf(errors.New(msg)))
+		return nil
+	}
+	var encoded encodedProtoInterface
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return err
+	}
+	msgType, err := protoregistry.GlobalTypes.FindMessageByName(encoded.Type)
+	if err != nil {
+		return fmt.Errorf("failed to find message type %s: %w", encoded.Type, err)
+	}
+	msg := msgType.New().Interface()
+	err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(encoded.Value, msg)
+	if err != nil {
+		return err
+	}
+	msgVal := reflect.ValueOf(msg)
+	if !msgVal.Type().AssignableTo(val.Type()) {
+		return fmt.Errorf("%w: %s doesn't implement %s", ErrInvalidEventFormat, msgVal.Type(), val.Type())
+	}
+	val.Set(msgVal)
+	return nil
+}
+
+func decodeMapKey(rawKey string, key reflect.Value) error {
+	if reflect.PointerTo(key.Type()).Implements(textUnmarshalerType) {
+		return key.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(rawKey))
+	}
+	switch key.Kind() {
+	case reflect.String:
+		key.SetString(rawKey)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(rawKey, 10, 64)
+		if err != nil {
+			return err
+		}
+		key.SetInt(parsed)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		parsed, err := strconv.ParseUint(rawKey, 10, 64)
+		if err != nil {
+			return err
+		}
+		key.SetUint(parsed)
+	default:
+		return fmt.Errorf("%w: map key %s", ErrUnsupportedField, key.Type())
+	}
+	return nil
+}
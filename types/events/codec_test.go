@@ -0,0 +1,250 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package events
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	waBinary "github.com/Romerito007/whatsmeow/binary"
+	armadillo "github.com/Romerito007/whatsmeow/proto"
+	"github.com/Romerito007/whatsmeow/proto/waConsumerApplication"
+	"github.com/Romerito007/whatsmeow/types"
+)
+
+var (
+	testJID    = types.NewJID("1234", types.DefaultUserServer)
+	testTime   = time.Unix(1700000000, 0).UTC()
+	jidType    = reflect.TypeOf(types.JID{})
+	timeType   = reflect.TypeOf(time.Time{})
+	appSubType = reflect.TypeOf((*armadillo.MessageApplicationSub)(nil)).Elem()
+	testNode   = waBinary.Node{Tag: "test", Attrs: waBinary.Attrs{"jid": testJID, "text": "value"}, Content: []waBinary.Node{{Tag: "child", Content: []byte{1, 2, 3}}}}
+)
+
+// fillMaxDepth limits how deep fillValue goes into nested structs, pointers and collections.
+const fillMaxDepth = 4
+
+// fillProto sets all scalar fields of a protobuf message to non-default values.
+// Message fields are only filled if they're required.
+func fillProto(msg protoreflect.Message) {
+	fields := msg.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		field := fields.Get(i)
+		if field.IsList() || field.IsMap() {
+			continue
+		}
+		var val protoreflect.Value
+		switch field.Kind() {
+		case protoreflect.MessageKind:
+			if field.Cardinality() != protoreflect.Required {
+				continue
+			}
+			val = msg.NewField(field)
+			fillProto(val.Message())
+		case protoreflect.StringKind:
+			val = protoreflect.ValueOfString("test")
+		case protoreflect.BytesKind:
+			val = protoreflect.ValueOfBytes([]byte{1, 2, 3})
+		case protoreflect.BoolKind:
+			val = protoreflect.ValueOfBool(true)
+		case protoreflect.EnumKind:
+			val = protoreflect.ValueOfEnum(1)
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+			val = protoreflect.ValueOfInt32(5)
+		case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			val = protoreflect.ValueOfInt64(5)
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+			val = protoreflect.ValueOfUint32(5)
+		case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+			val = protoreflect.ValueOfUint64(5)
+		case protoreflect.FloatKind:
+			val = protoreflect.ValueOfFloat32(1.5)
+		case protoreflect.DoubleKind:
+			val = protoreflect.ValueOfFloat64(1.5)
+		default:
+			continue
+		}
+		msg.Set(field, val)
+	}
+}
+
+// fillValue sets all fields reachable from the given value to non-zero values.
+func fillValue(t *testing.T, val reflect.Value, depth int) {
+	t.Helper()
+	typ := val.Type()
+	switch {
+	case typ.Kind() == reflect.Pointer && typ.Implements(protoMessageType):
+		msg := reflect.New(typ.Elem())
+		fillProto(msg.Interface().(proto.Message).ProtoReflect())
+		val.Set(msg)
+		return
+	case typ == jidType:
+		val.Set(reflect.ValueOf(testJID))
+		return
+	case typ == timeType:
+		val.Set(reflect.ValueOf(testTime))
+		return
+	case typ == nodeType:
+		val.Set(reflect.ValueOf(testNode))
+		return
+	case typ == errorType:
+		val.Set(reflect.ValueOf(errors.New("test error")))
+		return
+	case typ == appSubType:
+		msg := &waConsumerApplication.ConsumerApplication{}
+		fillProto(msg.ProtoReflect())
+		val.Set(reflect.ValueOf(msg))
+		return
+	}
+	if depth > fillMaxDepth {
+		return
+	}
+	switch typ.Kind() {
+	case reflect.Pointer:
+		ptr := reflect.New(typ.Elem())
+		fillValue(t, ptr.Elem(), depth+1)
+		val.Set(ptr)
+	case reflect.Struct:
+		for i := 0; i < typ.NumField(); i++ {
+			if typ.Field(i).IsExported() {
+				fillValue(t, val.Field(i), depth+1)
+			}
+		}
+	case reflect.Slice:
+		val.Set(reflect.MakeSlice(typ, 1, 1))
+		fillValue(t, val.Index(0), depth+1)
+	case reflect.Array:
+		for i := 0; i < val.Len(); i++ {
+			fillValue(t, val.Index(i), depth+1)
+		}
+	case reflect.Map:
+		key := reflect.New(typ.Key()).Elem()
+		fillValue(t, key, depth+1)
+		elem := reflect.New(typ.Elem()).Elem()
+		fillValue(t, elem, depth+1)
+		val.Set(reflect.MakeMap(typ))
+		val.SetMapIndex(key, elem)
+	case reflect.String:
+		val.SetString("test")
+	case reflect.Bool:
+		val.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val.SetInt(5)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val.SetUint(5)
+	case reflect.Float32, reflect.Float64:
+		val.SetFloat(1.5)
+	case reflect.Interface:
+		t.Fatalf("don't know how to fill interface field of type %s", typ)
+	default:
+		t.Fatalf("don't know how to fill field of type %s", typ)
+	}
+}
+
+func TestMarshalEventRoundTrip(t *testing.T) {
+	for _, evt := range eventTypes {
+		typ := reflect.TypeOf(evt)
+		t.Run(typ.Name(), func(t *testing.T) {
+			val := reflect.New(typ)
+			fillValue(t, val.Elem(), 0)
+			data, err := MarshalEvent(val.Interface())
+			if err != nil {
+				t.Fatalf("failed to marshal: %v", err)
+			}
+			decoded, err := UnmarshalEvent(data)
+			if err != nil {
+				t.Fatalf("failed to unmarshal: %v", err)
+			}
+			if reflect.TypeOf(decoded) != val.Type() {
+				t.Fatalf("decoded event is %T, expected %s", decoded, val.Type())
+			} else if typ.NumField() > 0 && reflect.ValueOf(decoded).Elem().IsZero() {
+				t.Fatalf("decoded event is empty")
+			}
+			reencoded, err := MarshalEvent(decoded)
+			if err != nil {
+				t.Fatalf("failed to marshal decoded event: %v", err)
+			}
+			if !bytes.Equal(data, reencoded) {
+				t.Errorf("re-encoding changed data:\n%s\n%s", data, reencoded)
+			}
+			// Struct values are encoded the same way as pointers
+			if fromValue, err := MarshalEvent(val.Elem().Interface()); err != nil {
+				t.Errorf("failed to marshal struct value: %v", err)
+			} else if !bytes.Equal(data, fromValue) {
+				t.Errorf("struct value was encoded differently from pointer")
+			}
+		})
+	}
+}
+
+func TestMarshalEventFieldTypes(t *testing.T) {
+	evt := &FBMessage{}
+	fillValue(t, reflect.ValueOf(evt).Elem(), 0)
+	data, err := MarshalEvent(evt)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	decoded, err := UnmarshalEvent(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	fbMsg := decoded.(*FBMessage)
+	if app, ok := fbMsg.Message.(*waConsumerApplication.ConsumerApplication); !ok || !proto.Equal(app, evt.Message.(proto.Message)) {
+		t.Errorf("interface field decoded to %T %v", fbMsg.Message, fbMsg.Message)
+	}
+	if !proto.Equal(fbMsg.Transport, evt.Transport) {
+		t.Errorf("protobuf field changed: %v", fbMsg.Transport)
+	}
+	if fbMsg.Info.Sender != testJID || !fbMsg.Info.Timestamp.Equal(testTime) {
+		t.Errorf("message info changed: %+v", fbMsg.Info)
+	}
+
+	stream := &StreamError{}
+	fillValue(t, reflect.ValueOf(stream).Elem(), 0)
+	data, err = MarshalEvent(stream)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	decoded, err = UnmarshalEvent(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if raw := decoded.(*StreamError).Raw; raw == nil || !reflect.DeepEqual(*raw, testNode) {
+		t.Errorf("node field changed: %v", raw)
+	}
+
+	failure := &PairError{Error: errors.New("test error")}
+	data, err = MarshalEvent(failure)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	decoded, err = UnmarshalEvent(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	} else if decodedErr := decoded.(*PairError).Error; decodedErr == nil || decodedErr.Error() != "test error" {
+		t.Errorf("error field decoded to %v", decodedErr)
+	}
+}
+
+func TestMarshalEventUnknownType(t *testing.T) {
+	type NotAnEvent struct{}
+	if _, err := MarshalEvent(&NotAnEvent{}); !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("marshaling unknown type returned %v", err)
+	}
+	if _, err := UnmarshalEvent([]byte(`{"type":"NotAnEvent","data":{}}`)); !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("unmarshaling unknown type returned %v", err)
+	}
+	if _, err := UnmarshalEvent([]byte(`not json`)); !errors.Is(err, ErrInvalidEventFormat) {
+		t.Errorf("unmarshaling invalid JSON returned %v", err)
+	}
+}
@@ -234,6 +234,17 @@ type StreamError struct {
 // Disconnected is emitted when the websocket is closed by the server.
 type Disconnected struct{}
 
+// ReconnectScheduled is emitted when the client is about to wait before trying to reconnect automatically.
+// The delay is decided by the client's ReconnectPolicy.
+type ReconnectScheduled struct {
+	// The number of the attempt, starting from 1. It's only reset after successfully logging in.
+	Attempt int
+	// How long the client will wait before reconnecting.
+	Delay time.Duration
+	// The error from the previous attempt, or nil if this is the first attempt after disconnecting.
+	LastError error
+}
+
 // HistorySync is emitted when the phone has sent a blob of historical messages.
 type HistorySync struct {
 	Data *waHistorySync.HistorySync
@@ -289,6 +300,9 @@ type Message struct {
 	UnavailableRequestID types.MessageID
 	// If the message was re-requested from the sender, this is the number of retries it took.
 	RetryCount int
+	// True if the event is being replayed from the outbox after event handlers previously failed to handle it.
+	// See whatsmeow.Client.AckAfterHandle for more info.
+	IsReplay bool
 
 	NewsletterMeta *NewsletterMessageMeta
 
@@ -297,6 +311,23 @@ type Message struct {
 	RawMessage *waE2E.Message
 }
 
+// OutboxDeadLetter is emitted instead of replaying a message from the outbox when event handlers have
+// already failed to handle it whatsmeow.Client.OutboxMaxAttempts times (see whatsmeow.Client.AckAfterHandle).
+//
+// The message is removed from the outbox once all event handlers have handled this event successfully,
+// so handlers should store it elsewhere if it needs to be processed later.
+type OutboxDeadLetter struct {
+	Chat   types.JID
+	Sender types.JID
+	ID     types.MessageID
+	// The number of times event handlers failed to handle the message.
+	Attempts int
+	// The message event that couldn't be handled. This is nil if the stored data couldn't be decoded,
+	// in which case Data contains the raw data from the outbox.
+	Message *Message
+	Data    []byte
+}
+
 type FBMessage struct {
 	Info    types.MessageInfo               // Information about the message like the chat and sender IDs
 	Message armadillo.MessageApplicationSub // The actual message struct
@@ -412,6 +443,9 @@ type ChatPresence struct {
 type Presence struct {
 	// The user whose presence event this is
 	From types.JID
+	// The alternative address of the user, i.e. the phone number JID if From is a hidden user (LID) JID and vice versa.
+	// This is empty if the mapping isn't known.
+	FromAlt types.JID
 	// True if the user is now offline
 	Unavailable bool
 	// The time when the user was last online. This may be the zero value if the user has hid their last seen time.
@@ -456,9 +490,16 @@ type GroupInfo struct {
 	Join  []types.JID // Users who joined or were added the group
 	Leave []types.JID // Users who left or were removed from the group
 
+	// The full participant info of the users in Join, including admin status and any addresses the server sent.
+	JoinParticipants []types.GroupParticipant
+
 	Promote []types.JID // Users who were promoted to admins
 	Demote  []types.JID // Users who were demoted to normal users
 
+	// The alternative addresses of the users in Sender, Join, Leave, Promote and Demote, i.e. the phone number JID
+	// for hidden user (LID) JIDs and vice versa. Only the addresses that are known are included.
+	AltJIDs map[types.JID]types.JID
+
 	UnknownChanges []*waBinary.Node
 }
 
@@ -92,8 +92,11 @@ type GroupIncognito struct {
 
 // GroupParticipant contains info about a participant of a WhatsApp group chat.
 type GroupParticipant struct {
-	JID          JID
-	LID          JID
+	JID JID
+	LID JID
+	// The phone number JID of the participant. In groups that don't use LID addressing, this is the same as JID.
+	// Like LID, this is empty if the server didn't include it and the mapping isn't known.
+	PhoneNumber  JID
 	IsAdmin      bool
 	IsSuperAdmin bool
 
@@ -18,6 +18,10 @@ type MessageSource struct {
 	IsFromMe bool // Whether the message was sent by the current user instead of someone else.
 	IsGroup  bool // Whether the chat is a group chat or broadcast list.
 
+	// The alternative address of the sender, i.e. the phone number JID if Sender is a hidden user (LID) JID and vice versa.
+	// This is empty if the mapping isn't known.
+	SenderAlt JID
+
 	// When sending a read receipt to a broadcast list message, the Chat is the broadcast list
 	// and Sender is you, so this field contains the recipient of the read receipt.
 	BroadcastListOwner JID
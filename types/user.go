@@ -23,6 +23,7 @@ type UserInfo struct {
 	Status       string
 	PictureID    string
 	Devices      []JID
+	LID          JID
 }
 
 type BotListInfo struct {
@@ -83,6 +84,8 @@ type IsOnWhatsAppResponse struct {
 	IsIn  bool   // Whether the phone is registered or not.
 
 	VerifiedName *VerifiedName // If the phone is a business, the verified business details.
+
+	LID JID // The hidden user ID (LID) of the user, if the server returned it.
 }
 
 // BusinessMessageLinkTarget contains the info that is found using a business message link (see Client.ResolveBusinessMessageLink)
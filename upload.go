@@ -188,7 +188,12 @@ func (cli *Client) UploadNewsletterReader(ctx context.Context, data io.ReadSeeke
 	return
 }
 
-func (cli *Client) rawUpload(ctx context.Context, dataToUpload io.Reader, uploadSize uint64, fileHash []byte, appInfo MediaType, newsletter bool, resp *UploadResponse) error {
+func (cli *Client) rawUpload(ctx context.Context, dataToUpload io.Reader, uploadSize uint64, fileHash []byte, appInfo MediaType, newsletter bool, resp *UploadResponse) (err error) {
+	ctx, span := cli.startSpan(ctx, "whatsmeow.upload",
+		TraceAttribute{Key: "media_type", Value: string(appInfo)}, TraceAttribute{Key: "size", Value: int64(uploadSize)})
+	defer func() {
+		endSpan(span, err)
+	}()
 	mediaConn, err := cli.refreshMediaConn(false)
 	if err != nil {
 		return fmt.Errorf("failed to refresh media connections: %w", err)
@@ -243,6 +248,8 @@ func (cli *Client) rawUpload(ctx context.Context, dataToUpload io.Reader, upload
 		err = fmt.Errorf("upload failed with status code %d", httpResp.StatusCode)
 	} else if err = json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
 		err = fmt.Errorf("failed to parse upload response: %w", err)
+	} else {
+		cli.addCounter(MetricMediaBytes, float64(uploadSize), "upload")
 	}
 	if httpResp != nil {
 		_ = httpResp.Body.Close()
@@ -168,6 +168,7 @@ func (cli *Client) IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse,
 	list, err := cli.usync(context.TODO(), jids, "query", "interactive", []waBinary.Node{
 		{Tag: "business", Content: []waBinary.Node{{Tag: "verified_name"}}},
 		{Tag: "contact"},
+		{Tag: "lid"},
 	})
 	if err != nil {
 		return nil, err
@@ -185,6 +186,7 @@ func (cli *Client) IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse,
 		if err != nil {
 			cli.Log.Warnf("Failed to parse %s's verified name details: %v", jid, err)
 		}
+		info.LID = cli.storeUsyncLIDMapping(jid, &child)
 		contactNode := child.GetChildByTag("contact")
 		info.IsIn = contactNode.AttrGetter().String("type") == "in"
 		contactQuery, _ := contactNode.Content.([]byte)
@@ -201,6 +203,7 @@ func (cli *Client) GetUserInfo(jids []types.JID) (map[types.JID]types.UserInfo,
 		{Tag: "status"},
 		{Tag: "picture"},
 		{Tag: "devices", Attrs: waBinary.Attrs{"version": "2"}},
+		{Tag: "lid"},
 	})
 	if err != nil {
 		return nil, err
@@ -220,6 +223,7 @@ func (cli *Client) GetUserInfo(jids []types.JID) (map[types.JID]types.UserInfo,
 		info.Status = string(status)
 		info.PictureID, _ = child.GetChildByTag("picture").Attrs["id"].(string)
 		info.Devices = parseDeviceList(jid.User, child.GetChildByTag("devices"))
+		info.LID = cli.storeUsyncLIDMapping(jid, &child)
 		if verifiedName != nil {
 			cli.updateBusinessName(jid, nil, verifiedName.Details.GetVerifiedName())
 		}
@@ -421,13 +425,18 @@ func (cli *Client) GetUserDevices(jids []types.JID) ([]types.JID, error) {
 	return cli.GetUserDevicesContext(context.Background(), jids)
 }
 
-func (cli *Client) GetUserDevicesContext(ctx context.Context, jids []types.JID) ([]types.JID, error) {
+func (cli *Client) GetUserDevicesContext(ctx context.Context, jids []types.JID) (devices []types.JID, err error) {
+	ctx, span := cli.startSpan(ctx, "whatsmeow.get_user_devices", TraceAttribute{Key: "jid_count", Value: len(jids)})
+	defer func() {
+		endSpan(span, err)
+	}()
 	cli.userDevicesCacheLock.Lock()
 	defer cli.userDevicesCacheLock.Unlock()
 
-	var devices, jidsToSync, fbJIDsToSync []types.JID
+	var jidsToSync, fbJIDsToSync []types.JID
+	cachedDevices := cli.getManyCachedUserDevices(jids)
 	for _, jid := range jids {
-		cached, ok := cli.userDevicesCache[jid]
+		cached, ok := cachedDevices[jid]
 		if ok && len(cached.devices) > 0 {
 			devices = append(devices, cached.devices...)
 		} else if jid.Server == types.MessengerServer {
@@ -439,9 +448,11 @@ func (cli *Client) GetUserDevicesContext(ctx context.Context, jids []types.JID)
 			jidsToSync = append(jidsToSync, jid)
 		}
 	}
+	span.SetAttributes(TraceAttribute{Key: "uncached_count", Value: len(jidsToSync) + len(fbJIDsToSync)})
 	if len(jidsToSync) > 0 {
 		list, err := cli.usync(ctx, jidsToSync, "query", "message", []waBinary.Node{
 			{Tag: "devices", Attrs: waBinary.Attrs{"version": "2"}},
+			{Tag: "lid"},
 		})
 		if err != nil {
 			return nil, err
@@ -453,7 +464,8 @@ func (cli *Client) GetUserDevicesContext(ctx context.Context, jids []types.JID)
 				continue
 			}
 			userDevices := parseDeviceList(jid.User, user.GetChildByTag("devices"))
-			cli.userDevicesCache[jid] = deviceCache{devices: userDevices, dhash: participantListHashV2(userDevices)}
+			cli.storeUsyncLIDMapping(jid, &user)
+			cli.putCachedUserDevices(jid, deviceCache{devices: userDevices, dhash: participantListHashV2(userDevices)})
 			devices = append(devices, userDevices...)
 		}
 	}
@@ -469,7 +481,7 @@ func (cli *Client) GetUserDevicesContext(ctx context.Context, jids []types.JID)
 				continue
 			}
 			userDevices := parseFBDeviceList(jid, user.GetChildByTag("devices"))
-			cli.userDevicesCache[jid] = userDevices
+			cli.putCachedUserDevices(jid, userDevices)
 			devices = append(devices, userDevices.devices...)
 		}
 	}
@@ -22,6 +22,68 @@ type Logger interface {
 	Sub(module string) Logger
 }
 
+// StructuredLogger is a Logger that can attach key-value fields to all log lines.
+// All the loggers in this package implement it.
+type StructuredLogger interface {
+	Logger
+	// With returns a logger that includes the given fields in all log lines.
+	// The arguments are alternating keys and values, like in log/slog, and keys must be strings.
+	With(keyValues ...any) Logger
+}
+
+// With returns a logger that includes the given fields in all log lines.
+// The arguments are alternating keys and values, like in log/slog, and keys must be strings.
+//
+// If the logger doesn't implement StructuredLogger, the fields are appended to the log messages instead.
+func With(log Logger, keyValues ...any) Logger {
+	if len(keyValues) == 0 {
+		return log
+	} else if structured, ok := log.(StructuredLogger); ok {
+		return structured.With(keyValues...)
+	}
+	return &fieldLogger{Logger: log, fields: formatFields(keyValues)}
+}
+
+func formatFields(keyValues []any) string {
+	var buf strings.Builder
+	for i := 0; i < len(keyValues); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		if i+1 < len(keyValues) {
+			_, _ = fmt.Fprintf(&buf, "%v=%v", keyValues[i], keyValues[i+1])
+		} else {
+			_, _ = fmt.Fprintf(&buf, "!BADKEY=%v", keyValues[i])
+		}
+	}
+	return buf.String()
+}
+
+// fieldLogger adds fields to the messages of loggers that don't support structured fields.
+type fieldLogger struct {
+	Logger
+	fields string
+}
+
+func (f *fieldLogger) Errorf(msg string, args ...interface{}) {
+	f.Logger.Errorf("%s [%s]", fmt.Sprintf(msg, args...), f.fields)
+}
+func (f *fieldLogger) Warnf(msg string, args ...interface{}) {
+	f.Logger.Warnf("%s [%s]", fmt.Sprintf(msg, args...), f.fields)
+}
+func (f *fieldLogger) Infof(msg string, args ...interface{}) {
+	f.Logger.Infof("%s [%s]", fmt.Sprintf(msg, args...), f.fields)
+}
+func (f *fieldLogger) Debugf(msg string, args ...interface{}) {
+	f.Logger.Debugf("%s [%s]", fmt.Sprintf(msg, args...), f.fields)
+}
+func (f *fieldLogger) Sub(module string) Logger {
+	return &fieldLogger{Logger: f.Logger.Sub(module), fields: f.fields}
+}
+func (f *fieldLogger) With(keyValues ...any) Logger {
+	return &fieldLogger{Logger: f.Logger, fields: f.fields + " " + formatFields(keyValues)}
+}
+
 type noopLogger struct{}
 
 func (n *noopLogger) Errorf(_ string, _ ...interface{}) {}
@@ -29,14 +91,16 @@ func (n *noopLogger) Warnf(_ string, _ ...interface{})  {}
 func (n *noopLogger) Infof(_ string, _ ...interface{})  {}
 func (n *noopLogger) Debugf(_ string, _ ...interface{}) {}
 func (n *noopLogger) Sub(_ string) Logger               { return n }
+func (n *noopLogger) With(_ ...any) Logger              { return n }
 
 // Noop is a no-op Logger implementation that silently drops everything.
 var Noop Logger = &noopLogger{}
 
 type stdoutLogger struct {
-	mod   string
-	color bool
-	min   int
+	mod    string
+	color  bool
+	min    int
+	fields string
 }
 
 var colors = map[string]string{
@@ -62,7 +126,11 @@ func (s *stdoutLogger) outputf(level, msg string, args ...interface{}) {
 		colorStart = colors[level]
 		colorReset = "\033[0m"
 	}
-	fmt.Printf("%s%s [%s %s] %s%s\n", time.Now().Format("15:04:05.000"), colorStart, s.mod, level, fmt.Sprintf(msg, args...), colorReset)
+	var fields string
+	if s.fields != "" {
+		fields = " [" + s.fields + "]"
+	}
+	fmt.Printf("%s%s [%s %s] %s%s%s\n", time.Now().Format("15:04:05.000"), colorStart, s.mod, level, fmt.Sprintf(msg, args...), fields, colorReset)
 }
 
 func (s *stdoutLogger) Errorf(msg string, args ...interface{}) { s.outputf("ERROR", msg, args...) }
@@ -70,7 +138,14 @@ func (s *stdoutLogger) Warnf(msg string, args ...interface{})  { s.outputf("WARN
 func (s *stdoutLogger) Infof(msg string, args ...interface{})  { s.outputf("INFO", msg, args...) }
 func (s *stdoutLogger) Debugf(msg string, args ...interface{}) { s.outputf("DEBUG", msg, args...) }
 func (s *stdoutLogger) Sub(mod string) Logger {
-	return &stdoutLogger{mod: fmt.Sprintf("%s/%s", s.mod, mod), color: s.color, min: s.min}
+	return &stdoutLogger{mod: fmt.Sprintf("%s/%s", s.mod, mod), color: s.color, min: s.min, fields: s.fields}
+}
+func (s *stdoutLogger) With(keyValues ...any) Logger {
+	fields := formatFields(keyValues)
+	if s.fields != "" {
+		fields = s.fields + " " + fields
+	}
+	return &stdoutLogger{mod: s.mod, color: s.color, min: s.min, fields: fields}
 }
 
 // Stdout is a simple Logger implementation that outputs to stdout. The module name given is included in log lines.
@@ -81,3 +156,9 @@ func (s *stdoutLogger) Sub(mod string) Logger {
 func Stdout(module string, minLevel string, color bool) Logger {
 	return &stdoutLogger{mod: module, color: color, min: levelToInt[strings.ToUpper(minLevel)]}
 }
+
+var (
+	_ StructuredLogger = &noopLogger{}
+	_ StructuredLogger = &stdoutLogger{}
+	_ StructuredLogger = &fieldLogger{}
+)
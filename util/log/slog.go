@@ -0,0 +1,55 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package waLog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+type slogLogger struct {
+	mod string
+	log *slog.Logger
+}
+
+// Slog wraps a [slog.Logger] to implement the [Logger] interface.
+//
+// Like with [Zerolog], subloggers will be created by setting the `sublogger` attribute.
+func Slog(log *slog.Logger) Logger {
+	return &slogLogger{log: log}
+}
+
+func (s *slogLogger) output(level slog.Level, msg string, args []any) {
+	ctx := context.Background()
+	if !s.log.Enabled(ctx, level) {
+		return
+	}
+	// Skip output, the Xf method and runtime.Callers itself, so that the source of the record is the caller of Xf.
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+	record := slog.NewRecord(time.Now(), level, fmt.Sprintf(msg, args...), pcs[0])
+	_ = s.log.Handler().Handle(ctx, record)
+}
+
+func (s *slogLogger) Warnf(msg string, args ...any)  { s.output(slog.LevelWarn, msg, args) }
+func (s *slogLogger) Errorf(msg string, args ...any) { s.output(slog.LevelError, msg, args) }
+func (s *slogLogger) Infof(msg string, args ...any)  { s.output(slog.LevelInfo, msg, args) }
+func (s *slogLogger) Debugf(msg string, args ...any) { s.output(slog.LevelDebug, msg, args) }
+func (s *slogLogger) Sub(module string) Logger {
+	if s.mod != "" {
+		module = fmt.Sprintf("%s/%s", s.mod, module)
+	}
+	return &slogLogger{mod: module, log: s.log.With("sublogger", module)}
+}
+func (s *slogLogger) With(keyValues ...any) Logger {
+	return &slogLogger{mod: s.mod, log: s.log.With(keyValues...)}
+}
+
+var _ StructuredLogger = &slogLogger{}
@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const signaturePrefix = "sha256="
+
+var (
+	ErrMissingSignature = errors.New("missing signature or timestamp header")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrTimestampTooOld  = errors.New("timestamp is outside the allowed tolerance")
+)
+
+func computeMAC(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp))
+	h.Write([]byte{'.'})
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// ComputeSignature returns the value of the X-Whatsmeow-Signature header for the given request.
+//
+// The signature is the hex-encoded HMAC-SHA256 of the timestamp header, a dot and the request body,
+// prefixed with "sha256=".
+func ComputeSignature(secret []byte, timestamp string, body []byte) string {
+	return signaturePrefix + hex.EncodeToString(computeMAC(secret, timestamp, body))
+}
+
+// VerifySignature checks that the signature matches the timestamp and body in constant time.
+func VerifySignature(secret []byte, timestamp string, body []byte, signature string) bool {
+	hexMAC, ok := strings.CutPrefix(signature, signaturePrefix)
+	if !ok {
+		return false
+	}
+	mac, err := hex.DecodeString(hexMAC)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, computeMAC(secret, timestamp, body))
+}
+
+// VerifyRequest reads the body of a webhook request and checks its signature. The timestamp of the request
+// must be within the given tolerance of the current time to prevent replaying old requests. If tolerance is zero,
+// the timestamp isn't checked.
+//
+// The returned body is only valid if the error is nil.
+func VerifyRequest(secret []byte, r *http.Request, tolerance time.Duration) ([]byte, error) {
+	timestamp := r.Header.Get(HeaderTimestamp)
+	signature := r.Header.Get(HeaderSignature)
+	if timestamp == "" || signature == "" {
+		return nil, ErrMissingSignature
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !VerifySignature(secret, timestamp, body, signature) {
+		return nil, ErrInvalidSignature
+	}
+	if tolerance > 0 {
+		unixTS, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidSignature
+		}
+		diff := time.Since(time.Unix(unixTS, 0))
+		if diff > tolerance || diff < -tolerance {
+			return nil, ErrTimestampTooOld
+		}
+	}
+	return body, nil
+}
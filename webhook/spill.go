@@ -0,0 +1,100 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package webhook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spillQueue is a directory of deliveries for a single endpoint, stored as one JSON file per delivery.
+// File names start with the time they were spilled, so sorting the names gives the delivery order.
+type spillQueue struct {
+	dir  string
+	lock sync.Mutex
+}
+
+func newSpillQueue(baseDir, url string) (*spillQueue, error) {
+	urlHash := sha256.Sum256([]byte(url))
+	dir := filepath.Join(baseDir, hex.EncodeToString(urlHash[:8]))
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+	return &spillQueue{dir: dir}, nil
+}
+
+// Push writes the delivery to disk.
+func (sq *spillQueue) Push(d *delivery) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	name := fmt.Sprintf("%020d-%s.json", time.Now().UnixNano(), d.ID)
+	// Write to a temporary file first, so that a crash doesn't leave a partial file in the queue
+	tmpPath := filepath.Join(sq.dir, name+".tmp")
+	err = os.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(sq.dir, name))
+}
+
+// Peek returns the oldest delivery on disk without removing it, or nil if there are none.
+func (sq *spillQueue) Peek() (*delivery, error) {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	entries, err := os.ReadDir(sq.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	slices.Sort(names)
+	data, err := os.ReadFile(filepath.Join(sq.dir, names[0]))
+	if err != nil {
+		return nil, err
+	}
+	var d delivery
+	err = json.Unmarshal(data, &d)
+	if err != nil {
+		// Move broken files out of the way so they don't block the queue
+		_ = os.Rename(filepath.Join(sq.dir, names[0]), filepath.Join(sq.dir, names[0]+".broken"))
+		return nil, fmt.Errorf("failed to parse %s: %w", names[0], err)
+	}
+	d.spillFile = names[0]
+	return &d, nil
+}
+
+// Remove deletes a delivery returned by Peek from disk.
+func (sq *spillQueue) Remove(d *delivery) error {
+	sq.lock.Lock()
+	defer sq.lock.Unlock()
+	err := os.Remove(filepath.Join(sq.dir, d.spillFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
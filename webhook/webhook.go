@@ -0,0 +1,436 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package webhook implements forwarding whatsmeow events to HTTP endpoints.
+//
+// Events are serialized with events.MarshalEvent and POSTed to each configured endpoint that accepts the event type.
+// Requests are signed with HMAC-SHA256 (see VerifySignature), failed deliveries are retried with exponential backoff,
+// and deliveries that can't be made (e.g. because the endpoint is down for a long time) can be spilled to disk
+// and retried later.
+//
+//	forwarder, err := webhook.New(webhook.Config{
+//		Endpoints: []webhook.Endpoint{{
+//			URL:        "https://example.com/whatsapp",
+//			Secret:     []byte("hunter2"),
+//			EventTypes: []string{"Message", "Receipt"},
+//		}},
+//		SpillDir: "/var/lib/mybot/webhook-spill",
+//	})
+//	if err != nil {
+//		panic(err)
+//	}
+//	forwarder.Start()
+//	cli.AddEventHandler(forwarder.HandleEvent)
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mau.fi/util/random"
+	"go.mau.fi/util/retryafter"
+
+	"github.com/Romerito007/whatsmeow/types/events"
+	waLog "github.com/Romerito007/whatsmeow/util/log"
+)
+
+// Headers that are included in all webhook requests.
+const (
+	HeaderEventType  = "X-Whatsmeow-Event"
+	HeaderDeliveryID = "X-Whatsmeow-Delivery"
+	HeaderTimestamp  = "X-Whatsmeow-Timestamp"
+	HeaderSignature  = "X-Whatsmeow-Signature"
+)
+
+// Default values for Config.
+const (
+	DefaultQueueSize          = 1024
+	DefaultMaxAttempts        = 5
+	DefaultInitialBackoff     = 1 * time.Second
+	DefaultMaxBackoff         = 1 * time.Minute
+	DefaultRequestTimeout     = 30 * time.Second
+	DefaultSpillRetryInterval = 1 * time.Minute
+)
+
+var (
+	ErrNoEndpoints       = errors.New("no webhook endpoints configured")
+	ErrAlreadyStarted    = errors.New("forwarder already started")
+	ErrPermanentFailure  = errors.New("endpoint rejected the request")
+	ErrForwarderStopping = errors.New("forwarder is stopping")
+)
+
+// Endpoint is a single HTTP endpoint that events are sent to.
+type Endpoint struct {
+	// The URL to POST events to.
+	URL string
+	// The secret used to sign requests. If empty, requests aren't signed.
+	Secret []byte
+	// The event types to send to this endpoint, e.g. "Message" for *events.Message. If empty, all events are sent.
+	EventTypes []string
+}
+
+// Config contains the settings for a Forwarder.
+type Config struct {
+	Endpoints []Endpoint
+
+	// The HTTP client used to send requests. Defaults to a client with RequestTimeout as the timeout.
+	HTTPClient *http.Client
+	// The timeout for a single request when using the default HTTP client.
+	RequestTimeout time.Duration
+
+	// The number of deliveries that can be waiting for each endpoint before they're spilled to disk (or dropped).
+	QueueSize int
+	// The maximum number of attempts to deliver an event before it's spilled to disk (or dropped).
+	MaxAttempts int
+	// The delay before the first retry. The delay is doubled after every failed attempt up to MaxBackoff.
+	// If the endpoint returns a Retry-After header, that's used instead, but it's still capped to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// The directory where deliveries are stored when the queue is full, all attempts have failed, or the forwarder
+	// is stopped with deliveries still queued. Spilled deliveries are retried every SpillRetryInterval and when
+	// the forwarder is started. If empty, such deliveries are dropped.
+	SpillDir           string
+	SpillRetryInterval time.Duration
+
+	Log waLog.Logger
+}
+
+// Forwarder forwards events to HTTP endpoints. HandleEvent should be registered as an event handler in the client.
+type Forwarder struct {
+	endpoints []*endpointWorker
+	client    *http.Client
+	log       waLog.Logger
+	config    Config
+
+	startLock sync.Mutex
+	started   bool
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// delivery is a single event that should be sent to a single endpoint.
+type delivery struct {
+	ID        string          `json:"id"`
+	EventType string          `json:"event_type"`
+	Body      json.RawMessage `json:"body"`
+	// The name of the spill file this delivery was read from, if any.
+	spillFile string
+}
+
+// New creates a new forwarder with the given config. Start must be called before events are delivered.
+func New(config Config) (*Forwarder, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = DefaultRequestTimeout
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultMaxAttempts
+	}
+	if config.InitialBackoff <= 0 {
+		config.InitialBackoff = DefaultInitialBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = DefaultMaxBackoff
+	}
+	if config.SpillRetryInterval <= 0 {
+		config.SpillRetryInterval = DefaultSpillRetryInterval
+	}
+	if config.Log == nil {
+		config.Log = waLog.Noop
+	}
+	f := &Forwarder{
+		client: config.HTTPClient,
+		log:    config.Log,
+		config: config,
+	}
+	if f.client == nil {
+		f.client = &http.Client{Timeout: config.RequestTimeout}
+	}
+	for i, endpoint := range config.Endpoints {
+		worker := &endpointWorker{
+			Endpoint:  endpoint,
+			forwarder: f,
+			queue:     make(chan *delivery, config.QueueSize),
+			log:       config.Log.Sub(fmt.Sprintf("Endpoint%d", i)),
+		}
+		if len(endpoint.EventTypes) > 0 {
+			worker.eventTypes = make(map[string]struct{}, len(endpoint.EventTypes))
+			for _, evtType := range endpoint.EventTypes {
+				worker.eventTypes[evtType] = struct{}{}
+			}
+		}
+		if config.SpillDir != "" {
+			var err error
+			worker.spill, err = newSpillQueue(config.SpillDir, endpoint.URL)
+			if err != nil {
+				return nil, err
+			}
+		}
+		f.endpoints = append(f.endpoints, worker)
+	}
+	return f, nil
+}
+
+// Start starts the goroutines that deliver events to the endpoints.
+func (f *Forwarder) Start() error {
+	f.startLock.Lock()
+	defer f.startLock.Unlock()
+	if f.started {
+		return ErrAlreadyStarted
+	}
+	f.started = true
+	f.stop = make(chan struct{})
+	for _, worker := range f.endpoints {
+		f.wg.Add(1)
+		go worker.loop(f.stop)
+	}
+	return nil
+}
+
+// Stop stops delivering events and waits for in-progress deliveries to finish. Deliveries that are still queued
+// are spilled to disk if SpillDir is set, and dropped otherwise.
+//
+// If the context is canceled before in-progress deliveries finish, Stop returns the context error,
+// but the deliveries will still be finished in the background.
+func (f *Forwarder) Stop(ctx context.Context) error {
+	f.startLock.Lock()
+	if !f.started {
+		f.startLock.Unlock()
+		return nil
+	}
+	f.started = false
+	close(f.stop)
+	f.startLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// HandleEvent queues the given event for delivery to all endpoints that accept it.
+// It has the signature of whatsmeow.EventHandler, so it can be passed directly to Client.AddEventHandler.
+//
+// Events are delivered asynchronously, so this never blocks on HTTP requests.
+func (f *Forwarder) HandleEvent(evt any) {
+	evtType := events.EventType(evt)
+	if evtType == "" {
+		f.log.Debugf("Not forwarding unsupported event %T", evt)
+		return
+	}
+	var body []byte
+	for _, worker := range f.endpoints {
+		if !worker.accepts(evtType) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = events.MarshalEvent(evt)
+			if err != nil {
+				f.log.Errorf("Failed to encode %T for webhook: %v", evt, err)
+				return
+			}
+		}
+		worker.enqueue(&delivery{
+			ID:        random.String(16),
+			EventType: evtType,
+			Body:      body,
+		})
+	}
+}
+
+type endpointWorker struct {
+	Endpoint
+	forwarder  *Forwarder
+	eventTypes map[string]struct{}
+	queue      chan *delivery
+	spill      *spillQueue
+	log        waLog.Logger
+}
+
+func (ew *endpointWorker) accepts(evtType string) bool {
+	if ew.eventTypes == nil {
+		return true
+	}
+	_, ok := ew.eventTypes[evtType]
+	return ok
+}
+
+func (ew *endpointWorker) enqueue(d *delivery) {
+	select {
+	case ew.queue <- d:
+	default:
+		ew.log.Warnf("Delivery queue is full")
+		ew.spillDelivery(d)
+	}
+}
+
+func (ew *endpointWorker) spillDelivery(d *delivery) {
+	if ew.spill == nil {
+		ew.log.Warnf("Dropping %s delivery %s", d.EventType, d.ID)
+		return
+	} else if d.spillFile != "" {
+		// Already on disk
+		return
+	}
+	err := ew.spill.Push(d)
+	if err != nil {
+		ew.log.Errorf("Failed to spill %s delivery %s to disk, dropping it: %v", d.EventType, d.ID, err)
+	} else {
+		ew.log.Debugf("Spilled %s delivery %s to disk", d.EventType, d.ID)
+	}
+}
+
+func (ew *endpointWorker) loop(stop <-chan struct{}) {
+	defer ew.forwarder.wg.Done()
+	var spillTicker <-chan time.Time
+	if ew.spill != nil {
+		ticker := time.NewTicker(ew.forwarder.config.SpillRetryInterval)
+		defer ticker.Stop()
+		spillTicker = ticker.C
+		ew.retrySpilled(stop)
+	}
+	for {
+		select {
+		case d := <-ew.queue:
+			select {
+			case <-stop:
+				// Both channels may be ready at once, so check if the forwarder was stopped before delivering
+				ew.spillDelivery(d)
+				ew.drainQueue()
+				return
+			default:
+			}
+			ew.deliverOrSpill(d, stop)
+		case <-spillTicker:
+			ew.retrySpilled(stop)
+		case <-stop:
+			ew.drainQueue()
+			return
+		}
+	}
+}
+
+// drainQueue spills all the deliveries remaining in the queue after the forwarder is stopped.
+func (ew *endpointWorker) drainQueue() {
+	for {
+		select {
+		case d := <-ew.queue:
+			ew.spillDelivery(d)
+		default:
+			return
+		}
+	}
+}
+
+// retrySpilled tries to deliver spilled deliveries in the order they were spilled.
+// It stops at the first delivery that fails, so that the endpoint isn't flooded while it's down.
+func (ew *endpointWorker) retrySpilled(stop <-chan struct{}) {
+	for {
+		d, err := ew.spill.Peek()
+		if err != nil {
+			ew.log.Errorf("Failed to read spilled delivery: %v", err)
+			return
+		} else if d == nil {
+			return
+		}
+		err = ew.deliver(d, stop)
+		if err != nil && !errors.Is(err, ErrPermanentFailure) {
+			ew.log.Debugf("Failed to deliver spilled %s delivery %s: %v", d.EventType, d.ID, err)
+			return
+		} else if err != nil {
+			ew.log.Errorf("Dropping spilled %s delivery %s: %v", d.EventType, d.ID, err)
+		}
+		err = ew.spill.Remove(d)
+		if err != nil {
+			ew.log.Errorf("Failed to remove delivered spill file: %v", err)
+			return
+		}
+	}
+}
+
+func (ew *endpointWorker) deliverOrSpill(d *delivery, stop <-chan struct{}) {
+	err := ew.deliver(d, stop)
+	if errors.Is(err, ErrPermanentFailure) {
+		ew.log.Errorf("Dropping %s delivery %s: %v", d.EventType, d.ID, err)
+	} else if err != nil {
+		ew.log.Warnf("Failed to deliver %s delivery %s: %v", d.EventType, d.ID, err)
+		ew.spillDelivery(d)
+	}
+}
+
+// deliver sends the delivery to the endpoint, retrying with backoff if it fails.
+func (ew *endpointWorker) deliver(d *delivery, stop <-chan struct{}) error {
+	config := &ew.forwarder.config
+	backoff := config.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		retryAfter, err := ew.send(d)
+		if err == nil || errors.Is(err, ErrPermanentFailure) {
+			return err
+		} else if attempt >= config.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		delay := min(retryafter.Parse(retryAfter, backoff), config.MaxBackoff)
+		ew.log.Debugf("Attempt #%d to deliver %s failed, retrying in %s: %v", attempt, d.ID, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return ErrForwarderStopping
+		}
+		backoff = min(backoff*2, config.MaxBackoff)
+	}
+}
+
+// send makes a single request to the endpoint. If the request fails temporarily, the value of the
+// Retry-After header is returned along with the error.
+func (ew *endpointWorker) send(d *delivery) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, ew.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to prepare request: %w", ErrPermanentFailure, err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEventType, d.EventType)
+	req.Header.Set(HeaderDeliveryID, d.ID)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if len(ew.Secret) > 0 {
+		req.Header.Set(HeaderSignature, ComputeSignature(ew.Secret, timestamp, d.Body))
+	}
+	resp, err := ew.forwarder.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return "", nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return resp.Header.Get("Retry-After"), fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	default:
+		return "", fmt.Errorf("%w with status code %d", ErrPermanentFailure, resp.StatusCode)
+	}
+}
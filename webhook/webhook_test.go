@@ -0,0 +1,431 @@
+// Copyright (c) 2024 Tulir Asokan
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Romerito007/whatsmeow/types"
+	"github.com/Romerito007/whatsmeow/types/events"
+)
+
+var testSecret = []byte("hunter2")
+
+type receivedRequest struct {
+	eventType string
+	body      []byte
+	err       error
+}
+
+// testEndpoint is an httptest server that records the requests it receives and responds with
+// the status codes returned by the respond function.
+type testEndpoint struct {
+	*httptest.Server
+	received chan receivedRequest
+
+	lock     sync.Mutex
+	requests int
+	respond  func(w http.ResponseWriter, attempt int)
+}
+
+func newTestEndpoint(t *testing.T, respond func(w http.ResponseWriter, attempt int)) *testEndpoint {
+	te := &testEndpoint{received: make(chan receivedRequest, 64), respond: respond}
+	te.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		te.lock.Lock()
+		te.requests++
+		attempt := te.requests
+		respond := te.respond
+		te.lock.Unlock()
+		body, err := VerifyRequest(testSecret, r, time.Minute)
+		te.received <- receivedRequest{eventType: r.Header.Get(HeaderEventType), body: body, err: err}
+		respond(w, attempt)
+	}))
+	t.Cleanup(te.Close)
+	return te
+}
+
+func (te *testEndpoint) setRespond(respond func(w http.ResponseWriter, attempt int)) {
+	te.lock.Lock()
+	te.respond = respond
+	te.lock.Unlock()
+}
+
+func (te *testEndpoint) waitRequest(t *testing.T) receivedRequest {
+	t.Helper()
+	select {
+	case req := <-te.received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook request")
+		return receivedRequest{}
+	}
+}
+
+func (te *testEndpoint) expectNoRequest(t *testing.T, wait time.Duration) {
+	t.Helper()
+	select {
+	case req := <-te.received:
+		t.Fatalf("unexpected %s request", req.eventType)
+	case <-time.After(wait):
+	}
+}
+
+func respondStatus(status int) func(w http.ResponseWriter, attempt int) {
+	return func(w http.ResponseWriter, attempt int) {
+		w.WriteHeader(status)
+	}
+}
+
+func startForwarder(t *testing.T, config Config) *Forwarder {
+	t.Helper()
+	if config.InitialBackoff == 0 {
+		config.InitialBackoff = time.Millisecond
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 10 * time.Millisecond
+	}
+	f, err := New(config)
+	if err != nil {
+		t.Fatalf("failed to create forwarder: %v", err)
+	}
+	if err = f.Start(); err != nil {
+		t.Fatalf("failed to start forwarder: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = f.Stop(context.Background())
+	})
+	return f
+}
+
+func testMessage(id types.MessageID) *events.Message {
+	return &events.Message{Info: types.MessageInfo{ID: id, Timestamp: time.Unix(1700000000, 0)}}
+}
+
+func TestSignature(t *testing.T) {
+	body := []byte(`{"type":"Connected","data":{}}`)
+	sig := ComputeSignature(testSecret, "1700000000", body)
+	if !VerifySignature(testSecret, "1700000000", body, sig) {
+		t.Error("valid signature was rejected")
+	}
+	tests := map[string]struct {
+		secret    []byte
+		timestamp string
+		body      []byte
+		signature string
+	}{
+		"wrong secret":      {[]byte("hunter3"), "1700000000", body, sig},
+		"wrong timestamp":   {testSecret, "1700000001", body, sig},
+		"modified body":     {testSecret, "1700000000", []byte(`{"type":"Connected","data":null}`), sig},
+		"missing prefix":    {testSecret, "1700000000", body, sig[len(signaturePrefix):]},
+		"invalid hex":       {testSecret, "1700000000", body, signaturePrefix + "zz"},
+		"truncated":         {testSecret, "1700000000", body, sig[:len(sig)-2]},
+		"empty signature":   {testSecret, "1700000000", body, ""},
+		"other hash prefix": {testSecret, "1700000000", body, "sha1=" + sig[len(signaturePrefix):]},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if VerifySignature(test.secret, test.timestamp, test.body, test.signature) {
+				t.Error("invalid signature was accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"type":"Connected","data":{}}`)
+	makeRequest := func(timestamp time.Time, signature string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		req.Header.Set(HeaderTimestamp, ts)
+		if signature == "" {
+			signature = ComputeSignature(testSecret, ts, body)
+		}
+		req.Header.Set(HeaderSignature, signature)
+		return req
+	}
+	got, err := VerifyRequest(testSecret, makeRequest(time.Now(), ""), time.Minute)
+	if err != nil {
+		t.Fatalf("valid request was rejected: %v", err)
+	} else if !bytes.Equal(got, body) {
+		t.Errorf("wrong body: %s", got)
+	}
+	_, err = VerifyRequest(testSecret, makeRequest(time.Now(), signaturePrefix+"00"), time.Minute)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got %v", err)
+	}
+	_, err = VerifyRequest(testSecret, makeRequest(time.Now().Add(-time.Hour), ""), time.Minute)
+	if !errors.Is(err, ErrTimestampTooOld) {
+		t.Errorf("expected ErrTimestampTooOld, got %v", err)
+	}
+	_, err = VerifyRequest(testSecret, makeRequest(time.Now().Add(-time.Hour), ""), 0)
+	if err != nil {
+		t.Errorf("old request was rejected without tolerance: %v", err)
+	}
+	_, err = VerifyRequest(testSecret, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)), time.Minute)
+	if !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("expected ErrMissingSignature, got %v", err)
+	}
+}
+
+func TestDeliverSigned(t *testing.T) {
+	endpoint := newTestEndpoint(t, respondStatus(http.StatusNoContent))
+	f := startForwarder(t, Config{Endpoints: []Endpoint{{URL: endpoint.URL, Secret: testSecret}}})
+	f.HandleEvent(testMessage("ABCD"))
+	req := endpoint.waitRequest(t)
+	if req.err != nil {
+		t.Fatalf("signature verification failed: %v", req.err)
+	} else if req.eventType != "Message" {
+		t.Errorf("wrong event type header %q", req.eventType)
+	}
+	decoded, err := events.UnmarshalEvent(req.body)
+	if err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	} else if msg, ok := decoded.(*events.Message); !ok || msg.Info.ID != "ABCD" {
+		t.Errorf("unexpected event %#v", decoded)
+	}
+}
+
+func TestDeliverWrongSecret(t *testing.T) {
+	endpoint := newTestEndpoint(t, respondStatus(http.StatusOK))
+	f := startForwarder(t, Config{Endpoints: []Endpoint{{URL: endpoint.URL, Secret: []byte("wrong")}}})
+	f.HandleEvent(&events.Connected{})
+	if req := endpoint.waitRequest(t); !errors.Is(req.err, ErrInvalidSignature) {
+		t.Errorf("expected ErrInvalidSignature, got %v", req.err)
+	}
+}
+
+func TestEventTypeFilter(t *testing.T) {
+	messages := newTestEndpoint(t, respondStatus(http.StatusOK))
+	all := newTestEndpoint(t, respondStatus(http.StatusOK))
+	f := startForwarder(t, Config{Endpoints: []Endpoint{
+		{URL: messages.URL, Secret: testSecret, EventTypes: []string{"Message"}},
+		{URL: all.URL, Secret: testSecret},
+	}})
+	f.HandleEvent(&events.Connected{})
+	f.HandleEvent(testMessage("ABCD"))
+	// Unsupported event types aren't sent anywhere
+	f.HandleEvent(struct{}{})
+
+	if req := messages.waitRequest(t); req.eventType != "Message" {
+		t.Errorf("filtered endpoint received %s event", req.eventType)
+	}
+	if req := all.waitRequest(t); req.eventType != "Connected" {
+		t.Errorf("expected Connected event first, got %s", req.eventType)
+	}
+	if req := all.waitRequest(t); req.eventType != "Message" {
+		t.Errorf("expected Message event second, got %s", req.eventType)
+	}
+	messages.expectNoRequest(t, 50*time.Millisecond)
+	all.expectNoRequest(t, 0)
+}
+
+func TestRetryTemporaryFailures(t *testing.T) {
+	tests := map[string]func(w http.ResponseWriter){
+		"500": func(w http.ResponseWriter) { w.WriteHeader(http.StatusInternalServerError) },
+		"503": func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+		"429": func(w http.ResponseWriter) { w.WriteHeader(http.StatusTooManyRequests) },
+		// The delay from Retry-After is capped to MaxBackoff, otherwise this would take an hour
+		"429 with Retry-After": func(w http.ResponseWriter) {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+		},
+	}
+	for name, fail := range tests {
+		t.Run(name, func(t *testing.T) {
+			endpoint := newTestEndpoint(t, func(w http.ResponseWriter, attempt int) {
+				if attempt < 3 {
+					fail(w)
+				} else {
+					w.WriteHeader(http.StatusOK)
+				}
+			})
+			f := startForwarder(t, Config{Endpoints: []Endpoint{{URL: endpoint.URL, Secret: testSecret}}})
+			f.HandleEvent(&events.Connected{})
+			for i := 0; i < 3; i++ {
+				endpoint.waitRequest(t)
+			}
+			endpoint.expectNoRequest(t, 50*time.Millisecond)
+		})
+	}
+}
+
+func TestNoRetryPermanentFailures(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			spillDir := t.TempDir()
+			endpoint := newTestEndpoint(t, respondStatus(status))
+			f := startForwarder(t, Config{
+				Endpoints: []Endpoint{{URL: endpoint.URL, Secret: testSecret}},
+				SpillDir:  spillDir,
+			})
+			f.HandleEvent(&events.Connected{})
+			endpoint.waitRequest(t)
+			endpoint.expectNoRequest(t, 50*time.Millisecond)
+			// Permanently rejected deliveries are dropped rather than spilled
+			if files := spillFiles(t, spillDir); len(files) != 0 {
+				t.Errorf("rejected delivery was spilled: %v", files)
+			}
+		})
+	}
+}
+
+func TestGiveUpAfterMaxAttempts(t *testing.T) {
+	endpoint := newTestEndpoint(t, respondStatus(http.StatusBadGateway))
+	f := startForwarder(t, Config{
+		Endpoints:   []Endpoint{{URL: endpoint.URL, Secret: testSecret}},
+		MaxAttempts: 3,
+	})
+	f.HandleEvent(&events.Connected{})
+	for i := 0; i < 3; i++ {
+		endpoint.waitRequest(t)
+	}
+	endpoint.expectNoRequest(t, 50*time.Millisecond)
+}
+
+func spillFiles(t *testing.T, spillDir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(spillDir, "*", "*.json"))
+	if err != nil {
+		t.Fatalf("failed to list spill files: %v", err)
+	}
+	return files
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSpillAndRedeliver(t *testing.T) {
+	spillDir := t.TempDir()
+	endpoint := newTestEndpoint(t, respondStatus(http.StatusServiceUnavailable))
+	f := startForwarder(t, Config{
+		Endpoints:          []Endpoint{{URL: endpoint.URL, Secret: testSecret}},
+		MaxAttempts:        2,
+		SpillDir:           spillDir,
+		SpillRetryInterval: 20 * time.Millisecond,
+	})
+	f.HandleEvent(testMessage("first"))
+	f.HandleEvent(testMessage("second"))
+	waitFor(t, "deliveries to be spilled", func() bool {
+		return len(spillFiles(t, spillDir)) == 2
+	})
+
+	endpoint.setRespond(respondStatus(http.StatusOK))
+	waitFor(t, "spilled deliveries to be removed", func() bool {
+		return len(spillFiles(t, spillDir)) == 0
+	})
+	// Spilled deliveries are delivered in the order they were spilled
+	var delivered []types.MessageID
+	for len(endpoint.received) > 0 {
+		req := <-endpoint.received
+		if req.err != nil {
+			t.Fatalf("signature verification failed: %v", req.err)
+		}
+		decoded, err := events.UnmarshalEvent(req.body)
+		if err != nil {
+			t.Fatalf("failed to decode body: %v", err)
+		}
+		id := decoded.(*events.Message).Info.ID
+		if len(delivered) == 0 || delivered[len(delivered)-1] != id {
+			delivered = append(delivered, id)
+		}
+	}
+	if len(delivered) < 2 || delivered[len(delivered)-2] != "first" || delivered[len(delivered)-1] != "second" {
+		t.Errorf("unexpected delivery order %v", delivered)
+	}
+}
+
+func TestSpillOnStopAndRedeliverOnStart(t *testing.T) {
+	spillDir := t.TempDir()
+	block := make(chan struct{})
+	endpoint := newTestEndpoint(t, func(w http.ResponseWriter, attempt int) {
+		<-block
+		w.WriteHeader(http.StatusOK)
+	})
+	config := Config{
+		Endpoints:          []Endpoint{{URL: endpoint.URL, Secret: testSecret}},
+		SpillDir:           spillDir,
+		SpillRetryInterval: time.Hour,
+	}
+	f := startForwarder(t, config)
+	// The first delivery blocks the worker, so the others stay in the queue until the forwarder is stopped
+	f.HandleEvent(testMessage("in-progress"))
+	endpoint.waitRequest(t)
+	f.HandleEvent(testMessage("queued1"))
+	f.HandleEvent(testMessage("queued2"))
+	// Stop can't finish while the request is blocked, but the forwarder is stopped by the time it returns
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := f.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Stop to time out, got %v", err)
+	}
+	close(block)
+	waitFor(t, "queued deliveries to be spilled", func() bool {
+		return len(spillFiles(t, spillDir)) == 2
+	})
+	endpoint.expectNoRequest(t, 20*time.Millisecond)
+
+	startForwarder(t, config)
+	for _, expected := range []types.MessageID{"queued1", "queued2"} {
+		req := endpoint.waitRequest(t)
+		decoded, err := events.UnmarshalEvent(req.body)
+		if err != nil {
+			t.Fatalf("failed to decode body: %v", err)
+		} else if id := decoded.(*events.Message).Info.ID; id != expected {
+			t.Errorf("expected %s to be redelivered, got %s", expected, id)
+		}
+	}
+	waitFor(t, "spilled deliveries to be removed", func() bool {
+		return len(spillFiles(t, spillDir)) == 0
+	})
+}
+
+func TestBrokenSpillFile(t *testing.T) {
+	spillDir := t.TempDir()
+	endpoint := newTestEndpoint(t, respondStatus(http.StatusOK))
+	queue, err := newSpillQueue(spillDir, endpoint.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(queue.dir, "00000000000000000001-broken.json"), []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = queue.Push(&delivery{ID: "valid", EventType: "Connected", Body: []byte(`{"type":"Connected","data":{}}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startForwarder(t, Config{
+		Endpoints:          []Endpoint{{URL: endpoint.URL, Secret: testSecret}},
+		SpillDir:           spillDir,
+		SpillRetryInterval: 10 * time.Millisecond,
+	})
+	// The broken file is moved out of the way, so it doesn't block the valid delivery
+	if req := endpoint.waitRequest(t); req.eventType != "Connected" {
+		t.Errorf("unexpected %s request", req.eventType)
+	}
+	if _, err = os.Stat(filepath.Join(queue.dir, "00000000000000000001-broken.json.broken")); err != nil {
+		t.Errorf("broken file wasn't renamed: %v", err)
+	}
+}